@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// defaultAckBatchInterval is how long an accepted message may wait for its
+// batch to fill when SubscriberOptions.AckBatchInterval is not set.
+const defaultAckBatchInterval = time.Second
+
+// pendingAck is an accepted message waiting to be settled.
+type pendingAck struct {
+	receiver *amqp.Receiver
+	msg      *amqp.Message
+}
+
+// ackBatcher buffers accepted messages and settles them together once size
+// of them are buffered or interval has passed since the first one. Handlers
+// then do not wait for each disposition. go-amqp still sends one disposition
+// per message.
+type ackBatcher struct {
+	size     int
+	interval time.Duration
+	// settled is called for every message of a flushed batch.
+	settled func(msg *amqp.Message, err error)
+
+	mu      sync.Mutex
+	pending []pendingAck
+	timer   *time.Timer
+}
+
+func newAckBatcher(size int, interval time.Duration, settled func(*amqp.Message, error)) *ackBatcher {
+	if interval <= 0 {
+		interval = defaultAckBatchInterval
+	}
+	return &ackBatcher{size: size, interval: interval, settled: settled}
+}
+
+// add buffers msg, received on receiver, for acceptance.
+func (b *ackBatcher) add(receiver *amqp.Receiver, msg *amqp.Message) {
+	b.mu.Lock()
+	b.pending = append(b.pending, pendingAck{receiver, msg})
+	if len(b.pending) < b.size {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.interval, b.flush)
+		}
+		b.mu.Unlock()
+		return
+	}
+	batch := b.take()
+	b.mu.Unlock()
+	b.settle(batch)
+}
+
+// flush settles the buffered messages. It is safe to call on a nil batcher.
+func (b *ackBatcher) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.settle(batch)
+}
+
+// take removes the buffered messages. Must be called with b.mu held.
+func (b *ackBatcher) take() []pendingAck {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// settle accepts batch. It does not use the handling context, so messages
+// buffered when handling is cancelled are still accepted.
+func (b *ackBatcher) settle(batch []pendingAck) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	accept := &SettlementDecision{Policy: PolicyAccept}
+	for _, ack := range batch {
+		b.settled(ack.msg, settle(ctx, ack.receiver, ack.msg, accept))
+	}
+}
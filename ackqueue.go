@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/go-amqp"
+)
+
+// queuedSettlement is a handled message waiting to be settled.
+type queuedSettlement struct {
+	receiver *amqp.Receiver
+	msg      *amqp.Message
+	decision *SettlementDecision
+}
+
+// ackQueue settles handled messages on a dedicated goroutine, in the order
+// they were handled, so workers move on to the next message without waiting
+// for the broker's disposition.
+type ackQueue struct {
+	queue chan queuedSettlement
+	done  chan struct{}
+	// settled is called for every message once it is settled.
+	settled func(msg *amqp.Message, decision *SettlementDecision, err error)
+}
+
+// newAckQueue starts the settling goroutine. add blocks while size messages
+// are already waiting.
+func newAckQueue(size int, settled func(*amqp.Message, *SettlementDecision, error)) *ackQueue {
+	q := &ackQueue{
+		queue:   make(chan queuedSettlement, size),
+		done:    make(chan struct{}),
+		settled: settled,
+	}
+	go q.run()
+	return q
+}
+
+// add queues msg, received on receiver, for settlement with decision.
+func (q *ackQueue) add(receiver *amqp.Receiver, msg *amqp.Message, decision *SettlementDecision) {
+	q.queue <- queuedSettlement{receiver, msg, decision}
+}
+
+// close settles the queued messages and stops the goroutine. add must not be
+// called afterwards.
+func (q *ackQueue) close() {
+	close(q.queue)
+	<-q.done
+}
+
+// run settles queued messages. Like ackBatcher it does not use the handling
+// context, so messages queued when handling is cancelled are still settled.
+func (q *ackQueue) run() {
+	defer close(q.done)
+	for s := range q.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		q.settled(s.msg, s.decision, settle(ctx, s.receiver, s.msg, s.decision))
+		cancel()
+	}
+}
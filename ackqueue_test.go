@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestAsyncAcks(t *testing.T) {
+	const messages = 50
+	tests := []struct {
+		name        string
+		concurrency int
+		// wantOrdered checks the settlements follow the send order.
+		wantOrdered bool
+	}{
+		{name: "single worker", concurrency: 1, wantOrdered: true},
+		{name: "worker pool", concurrency: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			config.Concurrency = tt.concurrency
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.AsyncAcks = true },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					n, _ := strconv.Atoi(string(msg.GetData()))
+					if n%10 == 0 && !redelivered(msg) {
+						return Abandon(errors.New("retry"))
+					}
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			for i := range messages {
+				b.send(config.SubscriptionPath(), amqp.NewMessage([]byte(strconv.Itoa(i))))
+			}
+			// Every tenth message is abandoned once and then accepted.
+			outcomes := b.waitSettlements(messages + messages/10)
+			accepted := make(map[string]bool)
+			var order []int
+			for _, outcome := range outcomes {
+				body := string(outcome.Message.GetData())
+				n, _ := strconv.Atoi(body)
+				want := "accepted"
+				if n%10 == 0 && !redelivered(outcome.Message) {
+					want = "modified"
+				}
+				if outcome.State.Outcome != want {
+					t.Errorf("message %s settled as %q, want %q", body, outcome.State.Outcome, want)
+				}
+				if outcome.State.Outcome == "accepted" {
+					accepted[body] = true
+					if n%10 != 0 {
+						order = append(order, n)
+					}
+				}
+			}
+			if len(accepted) != messages {
+				t.Errorf("%d messages accepted, want %d", len(accepted), messages)
+			}
+			if tt.wantOrdered {
+				for i := 1; i < len(order); i++ {
+					if order[i] < order[i-1] {
+						t.Errorf("settled out of order: %v", order)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAckQueueSettlesOnClose(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	block := make(chan struct{})
+	s := newBrokerSubscriber(t, config, func(o *SubscriberOptions) { o.AsyncAcks = true },
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			<-block
+			return nil
+		}))
+	listenInBackground(t, s)
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("last")))
+	b.waitFor("the message to be delivered", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.queues[config.SubscriptionPath()]) == 0
+	})
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.GracefulStop(context.Background()) }()
+	close(block)
+	if err := <-stopped; err != nil {
+		t.Fatalf("GracefulStop: %v", err)
+	}
+	if got := b.waitSettlements(1)[0].State.Outcome; got != "accepted" {
+		t.Errorf("outcome = %q, want accepted", got)
+	}
+}
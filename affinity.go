@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// sessionWorker is the worker a session is pinned to and the number of its
+// messages that worker has not handled yet.
+type sessionWorker struct {
+	worker  int
+	pending int
+}
+
+// sessionAffinity pins the messages of each session to one worker while any
+// of them is queued or being handled, so they are handled one at a time and
+// in order. Sessions are assigned to workers round-robin, as are messages
+// without a session ID.
+type sessionAffinity struct {
+	workers int
+
+	mu       sync.Mutex
+	next     int
+	sessions map[string]*sessionWorker
+}
+
+func newSessionAffinity(workers int) *sessionAffinity {
+	return &sessionAffinity{workers: workers, sessions: make(map[string]*sessionWorker)}
+}
+
+// assign returns the worker that handles msg. Every assigned message with a
+// session ID must be released once handled.
+func (a *sessionAffinity) assign(msg *amqp.Message) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := sessionIDOf(msg)
+	if id == "" {
+		return a.roundRobin()
+	}
+	session, ok := a.sessions[id]
+	if !ok {
+		session = &sessionWorker{worker: a.roundRobin()}
+		a.sessions[id] = session
+	}
+	session.pending++
+	return session.worker
+}
+
+// release unpins the session of msg once none of its messages is pending.
+func (a *sessionAffinity) release(msg *amqp.Message) {
+	id := sessionIDOf(msg)
+	if id == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if session, ok := a.sessions[id]; ok {
+		session.pending--
+		if session.pending == 0 {
+			delete(a.sessions, id)
+		}
+	}
+}
+
+// roundRobin must be called with a.mu held.
+func (a *sessionAffinity) roundRobin() int {
+	worker := a.next
+	a.next = (a.next + 1) % a.workers
+	return worker
+}
+
+// sessionIDOf returns the Service Bus session ID of msg, carried in the
+// group-id property.
+func sessionIDOf(msg *amqp.Message) string {
+	if msg.Properties == nil || msg.Properties.GroupID == nil {
+		return ""
+	}
+	return *msg.Properties.GroupID
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestSessionAffinityAssign(t *testing.T) {
+	message := func(group string) *amqp.Message {
+		msg := amqp.NewMessage(nil)
+		if group != "" {
+			msg.Properties = &amqp.MessageProperties{GroupID: &group}
+		}
+		return msg
+	}
+	// Each step assigns a message of a session, or releases one with a "-"
+	// prefix, and wants the worker it was assigned to.
+	tests := []struct {
+		name    string
+		workers int
+		steps   []string
+		want    []int
+	}{
+		{name: "sessions round-robin", workers: 3, steps: []string{"a", "b", "c", "d"}, want: []int{0, 1, 2, 0}},
+		{name: "session pinned", workers: 3, steps: []string{"a", "b", "a", "a"}, want: []int{0, 1, 0, 0}},
+		{name: "no session", workers: 2, steps: []string{"", "", ""}, want: []int{0, 1, 0}},
+		{name: "unpinned once released", workers: 2, steps: []string{"a", "-a", "b", "a"}, want: []int{0, -1, 1, 0}},
+		{name: "pinned while pending", workers: 2, steps: []string{"a", "a", "-a", "b", "a"}, want: []int{0, 0, -1, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSessionAffinity(tt.workers)
+			for i, step := range tt.steps {
+				if group, ok := strings.CutPrefix(step, "-"); ok {
+					a.release(message(group))
+					continue
+				}
+				if got := a.assign(message(step)); got != tt.want[i] {
+					t.Errorf("step %d: assigned %q to worker %d, want %d", i, step, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSessionAffinityOrder(t *testing.T) {
+	const sessions, perSession = 4, 25
+	b := newTestBroker(t)
+	config := b.config()
+	config.Concurrency = 4
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	active := make(map[string]bool)
+	s := newBrokerSubscriber(t, config,
+		func(o *SubscriberOptions) { o.SessionAffinity, o.DispatchBufferSize = true, 8 },
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			group := *msg.Properties.GroupID
+			mu.Lock()
+			if active[group] {
+				t.Errorf("session %s handled concurrently", group)
+			}
+			active[group] = true
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			n, _ := strconv.Atoi(string(msg.GetData()))
+			mu.Lock()
+			active[group] = false
+			handled[group] = append(handled[group], n)
+			mu.Unlock()
+			return nil
+		}))
+	listenInBackground(t, s)
+
+	for i := range sessions * perSession {
+		msg := amqp.NewMessage([]byte(strconv.Itoa(i / sessions)))
+		msg.Properties = &amqp.MessageProperties{GroupID: ptr(fmt.Sprint(i % sessions))}
+		b.send(config.SubscriptionPath(), msg)
+	}
+	b.waitSettlements(sessions * perSession)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for group, order := range handled {
+		for i, n := range order {
+			if n != i {
+				t.Errorf("session %s handled in order %v", group, order)
+				break
+			}
+		}
+	}
+}
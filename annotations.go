@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Message annotations Service Bus reads from sent messages.
+const (
+	// scheduledEnqueueTimeAnnotation holds a message until the given UTC time
+	// before making it visible.
+	scheduledEnqueueTimeAnnotation = "x-opt-scheduled-enqueue-time"
+	// partitionKeyAnnotation selects the partition of a partitioned entity.
+	partitionKeyAnnotation = "x-opt-partition-key"
+	// viaPartitionKeyAnnotation selects the partition of the transfer queue
+	// when a message is sent through it as part of a transaction.
+	viaPartitionKeyAnnotation = "x-opt-via-partition-key"
+)
+
+// AnnotateScheduleAt makes Service Bus hold msg until t before delivering it.
+func AnnotateScheduleAt(msg *amqp.Message, t time.Time) {
+	annotate(msg, scheduledEnqueueTimeAnnotation, t.UTC())
+}
+
+// AnnotatePartitionKey sends msg to the partition chosen by key.
+func AnnotatePartitionKey(msg *amqp.Message, key string) {
+	annotate(msg, partitionKeyAnnotation, key)
+}
+
+// AnnotateViaPartitionKey sets the partition key of the transfer queue msg is
+// sent through.
+func AnnotateViaPartitionKey(msg *amqp.Message, key string) {
+	annotate(msg, viaPartitionKeyAnnotation, key)
+}
+
+func annotate(msg *amqp.Message, key string, value any) {
+	if msg.Annotations == nil {
+		msg.Annotations = amqp.Annotations{}
+	}
+	msg.Annotations[key] = value
+}
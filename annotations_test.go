@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestAnnotate(t *testing.T) {
+	at := time.Date(2024, 5, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		name     string
+		annotate func(msg *amqp.Message)
+		key      string
+		want     any
+	}{
+		{name: "schedule at", annotate: func(msg *amqp.Message) { AnnotateScheduleAt(msg, at) },
+			key: "x-opt-scheduled-enqueue-time", want: at.UTC()},
+		{name: "partition key", annotate: func(msg *amqp.Message) { AnnotatePartitionKey(msg, "customer-1") },
+			key: "x-opt-partition-key", want: "customer-1"},
+		{name: "via partition key", annotate: func(msg *amqp.Message) { AnnotateViaPartitionKey(msg, "transfer-1") },
+			key: "x-opt-via-partition-key", want: "transfer-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := amqp.NewMessage([]byte("body"))
+			tt.annotate(msg)
+			if got := msg.Annotations[tt.key]; got != tt.want {
+				t.Errorf("%s = %v, want %v", tt.key, got, tt.want)
+			}
+			if len(msg.Annotations) != 1 {
+				t.Errorf("annotations = %v, want only %s", msg.Annotations, tt.key)
+			}
+
+			// Existing annotations are kept.
+			msg = amqp.NewMessage([]byte("body"))
+			msg.Annotations = amqp.Annotations{"x-opt-other": 1}
+			tt.annotate(msg)
+			if msg.Annotations["x-opt-other"] != 1 || msg.Annotations[tt.key] != tt.want {
+				t.Errorf("annotations = %v, want x-opt-other kept and %s set", msg.Annotations, tt.key)
+			}
+		})
+	}
+}
+
+func TestPublishPartitionKeys(t *testing.T) {
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config())
+	opts := &SendOptions{PartitionKey: "customer-1", ViaPartitionKey: "transfer-1"}
+	if err := p.Publish(context.Background(), "partitioned", opts); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := p.Publish(context.Background(), "unpartitioned", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	received := b.receivedAt("topic")
+	if len(received) != 2 {
+		t.Fatalf("broker received %d messages, want 2", len(received))
+	}
+	for key, want := range map[string]string{partitionKeyAnnotation: "customer-1", viaPartitionKeyAnnotation: "transfer-1"} {
+		if got := received[0].Annotations[key]; got != want {
+			t.Errorf("%s = %v, want %s", key, got, want)
+		}
+		if v, ok := received[1].Annotations[key]; ok {
+			t.Errorf("message without partition keys annotated with %s = %v", key, v)
+		}
+	}
+}
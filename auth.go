@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	cbsAddress         = "$cbs"
+	serviceBusScope    = "https://servicebus.azure.net//.default"
+	tokenRefreshMargin = 5 * time.Minute
+	tokenRetryInterval = 30 * time.Second
+)
+
+// dial opens an AMQP connection to the broker. In AAD mode the connection is
+// opened with SASL ANONYMOUS and authorized for entityPath through the CBS
+// link; the token is then refreshed in the background until the connection
+// is closed. The connection goes through config.ProxyURL when set.
+func dial(ctx context.Context, logger *slog.Logger, config AmqpConfig, entityPath string) (*amqp.Conn, error) {
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AuthMode != AuthModeAAD {
+		var opts *amqp.ConnOptions
+		if tlsConfig != nil {
+			opts = &amqp.ConnOptions{TLSConfig: tlsConfig}
+		}
+		return dialAMQP(ctx, logger, config, opts)
+	}
+
+	conn, err := dialAMQP(ctx, logger, config, &amqp.ConnOptions{
+		SASLType:  amqp.SASLTypeAnonymous(),
+		TLSConfig: tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, logger, conn, config, entityPath); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authorize grants conn access to entityPath in AAD mode and keeps the token
+// refreshed until the connection is closed. In SAS mode the connection is
+// already authorized for every entity and nothing is done.
+func authorize(ctx context.Context, logger *slog.Logger, conn *amqp.Conn, config AmqpConfig, entityPath string) error {
+	if config.AuthMode != AuthModeAAD {
+		return nil
+	}
+	auth := &cbsAuthenticator{
+		conn:       conn,
+		credential: config.Credential,
+		audience:   fmt.Sprintf("amqps://%s/%s", config.BrokerURL, entityPath),
+		logger:     logger,
+	}
+	expiresOn, err := auth.putToken(ctx)
+	if err != nil {
+		return err
+	}
+	go auth.refresh(expiresOn)
+	return nil
+}
+
+// cbsAuthenticator authorizes an AMQP connection for a single entity using the
+// claims-based security (CBS) put-token operation.
+type cbsAuthenticator struct {
+	conn       *amqp.Conn
+	credential azcore.TokenCredential
+	audience   string
+	logger     *slog.Logger
+}
+
+// refresh re-authorizes the connection shortly before each token expires. It
+// returns once the connection is closed.
+func (a *cbsAuthenticator) refresh(expiresOn time.Time) {
+	for {
+		timer := time.NewTimer(time.Until(expiresOn.Add(-tokenRefreshMargin)))
+		select {
+		case <-a.conn.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), tokenRetryInterval)
+		next, err := a.putToken(ctx)
+		cancel()
+		if err != nil {
+			a.logger.Error("failed to refresh Azure AD token", "audience", a.audience, "error", err)
+			expiresOn = time.Now().Add(tokenRefreshMargin + tokenRetryInterval)
+			continue
+		}
+		expiresOn = next
+	}
+}
+
+// putToken obtains a fresh token and sends it to the broker's $cbs node,
+// returning the token's expiry.
+func (a *cbsAuthenticator) putToken(ctx context.Context) (time.Time, error) {
+	token, err := a.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{serviceBusScope}})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get Azure AD token: %w", err)
+	}
+
+	session, err := a.conn.NewSession(ctx, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to create CBS session: %w", err)
+	}
+	defer session.Close(ctx)
+
+	response, err := managementRequest(ctx, session, cbsAddress, &amqp.Message{
+		Value: token.Token,
+		ApplicationProperties: map[string]any{
+			"operation":  "put-token",
+			"type":       "jwt",
+			"name":       a.audience,
+			"expiration": strconv.FormatInt(token.ExpiresOn.Unix(), 10),
+		},
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("CBS put-token for %s failed: %w", a.audience, err)
+	}
+
+	code, description := statusOf(response)
+	if code != 200 && code != 202 {
+		return time.Time{}, fmt.Errorf("CBS put-token for %s rejected with status %d: %s", a.audience, code, description)
+	}
+	return token.ExpiresOn, nil
+}
+
+// statusOf extracts the status code and description from a management or CBS
+// response message.
+func statusOf(msg *amqp.Message) (int, string) {
+	var code int
+	switch v := msg.ApplicationProperties["status-code"].(type) {
+	case int32:
+		code = int(v)
+	case int64:
+		code = int(v)
+	case int:
+		code = v
+	}
+	description, _ := msg.ApplicationProperties["status-description"].(string)
+	return code, description
+}
+
+// randomAddress returns a unique link address with the given prefix, used as
+// the reply-to address of request/response links.
+func randomAddress(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate link address: %w", err)
+	}
+	return prefix + "-" + hex.EncodeToString(b), nil
+}
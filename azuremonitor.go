@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	azureMonitorWorkspaceVariable = "AZURE_MONITOR_WORKSPACE_ID"
+	azureMonitorEndpointVariable  = "AZURE_MONITOR_DCE_ENDPOINT"
+
+	azureMonitorScope     = "https://monitoring.azure.com//.default"
+	azureMonitorNamespace = "asb_amqp_pubsub"
+)
+
+// AzureMonitorExporter is a prometheus.Registerer that forwards the metrics
+// of the collectors registered with it to the Azure Monitor custom metrics
+// API. Every observed sample is sent as its own POST on each Flush. Azure
+// Monitor aggregates the values posted in each interval, so counters,
+// histograms and summaries are sent as their change since the previous
+// Flush rather than as totals.
+type AzureMonitorExporter struct {
+	url        string
+	credential azcore.TokenCredential
+	client     *http.Client
+	registry   *prometheus.Registry
+	logger     *slog.Logger
+
+	// mu serializes flushes; previous holds the totals of each cumulative
+	// series at the last successful post, keyed by azureMonitorSeriesKey.
+	mu       sync.Mutex
+	previous map[string]azureMonitorTotals
+}
+
+// NewAzureMonitorExporter returns an exporter posting to
+// <endpoint>/<workspaceID>/metrics. credential may be nil, in which case no
+// Authorization header is sent.
+func NewAzureMonitorExporter(endpoint, workspaceID string, credential azcore.TokenCredential, logger *slog.Logger) *AzureMonitorExporter {
+	return &AzureMonitorExporter{
+		url:        strings.TrimRight(endpoint, "/") + "/" + strings.Trim(workspaceID, "/") + "/metrics",
+		credential: credential,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		registry:   prometheus.NewRegistry(),
+		logger:     logger,
+		previous:   make(map[string]azureMonitorTotals),
+	}
+}
+
+// newAzureMonitorExporterFromEnv builds an exporter from the
+// AZURE_MONITOR_* environment variables. It returns nil when they are unset.
+// A DefaultAzureCredential is created when credential is nil.
+func newAzureMonitorExporterFromEnv(credential azcore.TokenCredential, logger *slog.Logger) (*AzureMonitorExporter, error) {
+	workspaceID := os.Getenv(azureMonitorWorkspaceVariable)
+	endpoint := os.Getenv(azureMonitorEndpointVariable)
+	if workspaceID == "" && endpoint == "" {
+		return nil, nil
+	}
+	if workspaceID == "" || endpoint == "" {
+		return nil, fmt.Errorf("environment variables %s and %s must be set together",
+			azureMonitorWorkspaceVariable, azureMonitorEndpointVariable)
+	}
+	if credential == nil {
+		var err error
+		if credential, err = azidentity.NewDefaultAzureCredential(nil); err != nil {
+			return nil, fmt.Errorf("failed to create Azure Monitor credential: %w", err)
+		}
+	}
+	return NewAzureMonitorExporter(endpoint, workspaceID, credential, logger), nil
+}
+
+func (e *AzureMonitorExporter) Register(c prometheus.Collector) error {
+	return e.registry.Register(c)
+}
+
+func (e *AzureMonitorExporter) MustRegister(cs ...prometheus.Collector) {
+	e.registry.MustRegister(cs...)
+}
+
+func (e *AzureMonitorExporter) Unregister(c prometheus.Collector) bool {
+	return e.registry.Unregister(c)
+}
+
+// Run flushes the registered metrics every interval until ctx is done.
+func (e *AzureMonitorExporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Flush(ctx); err != nil {
+				e.logger.ErrorContext(ctx, "failed to export metrics to Azure Monitor", "error", err)
+			}
+		}
+	}
+}
+
+// Flush gathers the registered metrics and posts each sample to Azure Monitor.
+// Histograms and summaries without observations since the previous Flush are
+// skipped.
+func (e *AzureMonitorExporter) Flush(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	families, err := e.registry.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	now := time.Now().UTC()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := azureMonitorSeriesKey(family.GetName(), metric)
+			totals, cumulative := cumulativeTotals(metric)
+			var previous *azureMonitorTotals
+			if p, ok := e.previous[key]; ok {
+				previous = &p
+			}
+			payload, ok := newAzureMonitorMetric(now, family.GetName(), metric, previous)
+			if ok {
+				if err := e.post(ctx, payload); err != nil {
+					return err
+				}
+			}
+			if cumulative {
+				e.previous[key] = totals
+			}
+		}
+	}
+	return nil
+}
+
+func (e *AzureMonitorExporter) post(ctx context.Context, payload azureMonitorMetric) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode metric %s: %w", payload.Data.BaseData.Metric, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Azure Monitor request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.credential != nil {
+		token, err := e.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureMonitorScope}})
+		if err != nil {
+			return fmt.Errorf("failed to get Azure Monitor token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post metric %s: %w", payload.Data.BaseData.Metric, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Azure Monitor rejected metric %s with status %d", payload.Data.BaseData.Metric, resp.StatusCode)
+	}
+	return nil
+}
+
+// azureMonitorMetric is the Azure Monitor custom metrics request body.
+type azureMonitorMetric struct {
+	Time time.Time `json:"time"`
+	Data struct {
+		BaseData struct {
+			Metric    string               `json:"metric"`
+			Namespace string               `json:"namespace"`
+			DimNames  []string             `json:"dimNames,omitempty"`
+			Series    []azureMonitorSeries `json:"series"`
+		} `json:"baseData"`
+	} `json:"data"`
+}
+
+type azureMonitorSeries struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     uint64   `json:"count"`
+}
+
+// azureMonitorTotals are the cumulative sum and count of a counter,
+// histogram or summary series.
+type azureMonitorTotals struct {
+	sum   float64
+	count uint64
+}
+
+// cumulativeTotals returns the totals of metric, reporting false when it is
+// not cumulative.
+func cumulativeTotals(metric *dto.Metric) (azureMonitorTotals, bool) {
+	switch {
+	case metric.Counter != nil:
+		return azureMonitorTotals{sum: metric.GetCounter().GetValue()}, true
+	case metric.Histogram != nil:
+		return azureMonitorTotals{sum: metric.GetHistogram().GetSampleSum(), count: metric.GetHistogram().GetSampleCount()}, true
+	case metric.Summary != nil:
+		return azureMonitorTotals{sum: metric.GetSummary().GetSampleSum(), count: metric.GetSummary().GetSampleCount()}, true
+	}
+	return azureMonitorTotals{}, false
+}
+
+// azureMonitorSeriesKey identifies the series of metric within the family
+// name.
+func azureMonitorSeriesKey(name string, metric *dto.Metric) string {
+	var key strings.Builder
+	key.WriteString(name)
+	for _, label := range metric.GetLabel() {
+		key.WriteByte(0)
+		key.WriteString(label.GetName())
+		key.WriteByte('=')
+		key.WriteString(label.GetValue())
+	}
+	return key.String()
+}
+
+// newAzureMonitorMetric converts a Prometheus sample into a single-series
+// custom metric. Histograms and summaries only expose a sum and count, so
+// their min and max are reported as the mean. The cumulative values of
+// counters, histograms and summaries are reported as their change since
+// previous, the totals of their last post, unless they were reset since.
+// It reports false for a histogram or summary without new observations.
+func newAzureMonitorMetric(at time.Time, name string, metric *dto.Metric, previous *azureMonitorTotals) (azureMonitorMetric, bool) {
+	var payload azureMonitorMetric
+	payload.Time = at
+	payload.Data.BaseData.Metric = name
+	payload.Data.BaseData.Namespace = azureMonitorNamespace
+
+	var series azureMonitorSeries
+	for _, label := range metric.GetLabel() {
+		payload.Data.BaseData.DimNames = append(payload.Data.BaseData.DimNames, label.GetName())
+		series.DimValues = append(series.DimValues, label.GetValue())
+	}
+
+	var sum float64
+	var count uint64 = 1
+	switch {
+	case metric.Counter != nil:
+		sum = metric.GetCounter().GetValue()
+	case metric.Gauge != nil:
+		sum = metric.GetGauge().GetValue()
+	case metric.Histogram != nil:
+		sum, count = metric.GetHistogram().GetSampleSum(), metric.GetHistogram().GetSampleCount()
+	case metric.Summary != nil:
+		sum, count = metric.GetSummary().GetSampleSum(), metric.GetSummary().GetSampleCount()
+	case metric.Untyped != nil:
+		sum = metric.GetUntyped().GetValue()
+	}
+	if previous != nil {
+		switch {
+		case metric.Counter != nil:
+			// A counter below its previous total was reset, so all of it
+			// was counted since.
+			if sum >= previous.sum {
+				sum -= previous.sum
+			}
+		case metric.Histogram != nil, metric.Summary != nil:
+			if count >= previous.count {
+				sum, count = sum-previous.sum, count-previous.count
+			}
+		}
+	}
+	if count == 0 {
+		return payload, false
+	}
+	mean := sum
+	if count > 1 {
+		mean = sum / float64(count)
+	}
+	series.Min, series.Max, series.Sum, series.Count = mean, mean, sum, count
+
+	payload.Data.BaseData.Series = []azureMonitorSeries{series}
+	return payload, true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAzureMonitorExporterPostsDeltas(t *testing.T) {
+	var mu sync.Mutex
+	posted := make(map[string]azureMonitorSeries)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/workspace/metrics" {
+			t.Errorf("posted to %s, want /workspace/metrics", r.URL.Path)
+		}
+		var payload azureMonitorMetric
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode metric: %v", err)
+		}
+		mu.Lock()
+		posted[payload.Data.BaseData.Metric] = payload.Data.BaseData.Series[0]
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	e := NewAzureMonitorExporter(server.URL, "workspace", nil, discardLogger())
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "published_total"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency_seconds"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "in_flight"})
+	e.MustRegister(counter, histogram, gauge)
+
+	intervals := []struct {
+		counter    float64
+		histogram  []float64
+		gauge      float64
+		want       map[string]azureMonitorSeries
+		wantAbsent []string
+	}{
+		{
+			counter:   3,
+			histogram: []float64{1, 2},
+			gauge:     5,
+			want: map[string]azureMonitorSeries{
+				"published_total": {Min: 3, Max: 3, Sum: 3, Count: 1},
+				"latency_seconds": {Min: 1.5, Max: 1.5, Sum: 3, Count: 2},
+				"in_flight":       {Min: 5, Max: 5, Sum: 5, Count: 1},
+			},
+		},
+		{
+			counter:   2,
+			histogram: []float64{4},
+			gauge:     -1,
+			want: map[string]azureMonitorSeries{
+				"published_total": {Min: 2, Max: 2, Sum: 2, Count: 1},
+				"latency_seconds": {Min: 4, Max: 4, Sum: 4, Count: 1},
+				"in_flight":       {Min: 4, Max: 4, Sum: 4, Count: 1},
+			},
+		},
+		{
+			want: map[string]azureMonitorSeries{
+				"published_total": {Min: 0, Max: 0, Sum: 0, Count: 1},
+				"in_flight":       {Min: 4, Max: 4, Sum: 4, Count: 1},
+			},
+			wantAbsent: []string{"latency_seconds"},
+		},
+	}
+	for i, interval := range intervals {
+		counter.Add(interval.counter)
+		for _, v := range interval.histogram {
+			histogram.Observe(v)
+		}
+		gauge.Add(interval.gauge)
+		mu.Lock()
+		clear(posted)
+		mu.Unlock()
+
+		if err := e.Flush(context.Background()); err != nil {
+			t.Fatalf("flush %d: %v", i+1, err)
+		}
+		mu.Lock()
+		for name, want := range interval.want {
+			if got := posted[name]; !reflect.DeepEqual(got, want) {
+				t.Errorf("flush %d: %s posted %+v, want %+v", i+1, name, got, want)
+			}
+		}
+		for _, name := range interval.wantAbsent {
+			if got, ok := posted[name]; ok {
+				t.Errorf("flush %d: %s posted %+v, want nothing", i+1, name, got)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestNewAzureMonitorMetric(t *testing.T) {
+	counter := func(v float64) *dto.Metric {
+		return &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(v)}}
+	}
+	histogram := func(sum float64, count uint64) *dto.Metric {
+		return &dto.Metric{Histogram: &dto.Histogram{SampleSum: proto.Float64(sum), SampleCount: proto.Uint64(count)}}
+	}
+	tests := []struct {
+		name     string
+		metric   *dto.Metric
+		previous *azureMonitorTotals
+		want     azureMonitorSeries
+		wantOK   bool
+	}{
+		{"first counter", counter(5), nil, azureMonitorSeries{Min: 5, Max: 5, Sum: 5, Count: 1}, true},
+		{"counter delta", counter(8), &azureMonitorTotals{sum: 5}, azureMonitorSeries{Min: 3, Max: 3, Sum: 3, Count: 1}, true},
+		{"counter reset", counter(2), &azureMonitorTotals{sum: 5}, azureMonitorSeries{Min: 2, Max: 2, Sum: 2, Count: 1}, true},
+		{"histogram delta", histogram(10, 4), &azureMonitorTotals{sum: 4, count: 1}, azureMonitorSeries{Min: 2, Max: 2, Sum: 6, Count: 3}, true},
+		{"histogram reset", histogram(3, 1), &azureMonitorTotals{sum: 10, count: 4}, azureMonitorSeries{Min: 3, Max: 3, Sum: 3, Count: 1}, true},
+		{"histogram unchanged", histogram(10, 4), &azureMonitorTotals{sum: 10, count: 4}, azureMonitorSeries{}, false},
+		{"gauge", &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(7)}}, &azureMonitorTotals{sum: 5}, azureMonitorSeries{Min: 7, Max: 7, Sum: 7, Count: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, ok := newAzureMonitorMetric(time.Now(), "metric", tt.metric, tt.previous)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := payload.Data.BaseData.Series[0]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("series = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// BaggageExtractionMiddleware extracts the OpenTelemetry baggage propagated
+// in the message's application properties into the handler's context, where
+// baggage.FromContext returns it. Only the baggage is taken from what
+// propagator extracts, so a composite propagator does not also replace the
+// span context; use TraceExtractionMiddleware for that. A nil propagator
+// defaults to propagation.Baggage, which reads the "baggage" property.
+func BaggageExtractionMiddleware(propagator propagation.TextMapPropagator) SubscriberMiddleware {
+	if propagator == nil {
+		propagator = propagation.Baggage{}
+	}
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			extracted := propagator.Extract(context.Background(), applicationPropertiesCarrier(msg.ApplicationProperties))
+			if bag := baggage.FromContext(extracted); bag.Len() > 0 {
+				ctx = baggage.ContextWithBaggage(ctx, bag)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// BaggageInjectionMiddleware is the publisher counterpart of
+// BaggageExtractionMiddleware: it injects the baggage of the publish context
+// into the application properties of each message, modifying it in place.
+// Messages are sent unchanged when the context has no baggage. A nil
+// propagator defaults to propagation.Baggage.
+func BaggageInjectionMiddleware(propagator propagation.TextMapPropagator) PublisherMiddleware {
+	if propagator == nil {
+		propagator = propagation.Baggage{}
+	}
+	return func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			if bag := baggage.FromContext(ctx); bag.Len() > 0 {
+				if msg.ApplicationProperties == nil {
+					msg.ApplicationProperties = make(map[string]any)
+				}
+				propagator.Inject(baggage.ContextWithBaggage(context.Background(), bag), applicationPropertiesCarrier(msg.ApplicationProperties))
+			}
+			return next(ctx, msg)
+		}
+	}
+}
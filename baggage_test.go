@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+func TestBaggageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		members map[string]string
+	}{
+		{name: "baggage", members: map[string]string{"tenant": "acme", "region": "us-east"}},
+		{name: "no baggage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			p := newBrokerPublisher(t, config, WithPublisherMiddleware(BaggageInjectionMiddleware(nil)))
+
+			ctx := context.Background()
+			var members []baggage.Member
+			for key, value := range tt.members {
+				m, err := baggage.NewMember(key, value)
+				if err != nil {
+					t.Fatalf("NewMember(%s) = %v", key, err)
+				}
+				members = append(members, m)
+			}
+			if len(members) > 0 {
+				bag, err := baggage.New(members...)
+				if err != nil {
+					t.Fatalf("baggage.New() = %v", err)
+				}
+				ctx = baggage.ContextWithBaggage(ctx, bag)
+			}
+			if err := p.Publish(ctx, "hello", nil); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			sent := b.receivedAt("topic")
+			if len(sent) != 1 {
+				t.Fatalf("broker received %d messages, want 1", len(sent))
+			}
+			if _, ok := sent[0].ApplicationProperties["baggage"]; ok != (len(tt.members) > 0) {
+				t.Errorf("baggage property sent = %v, want %v", ok, len(tt.members) > 0)
+			}
+
+			bags := make(chan baggage.Baggage, 1)
+			s := newBrokerSubscriber(t, config,
+				WithMiddleware(BaggageExtractionMiddleware(nil)),
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					bags <- baggage.FromContext(ctx)
+					return nil
+				}),
+			)
+			listenInBackground(t, s)
+			b.send(config.SubscriptionPath(), sent[0])
+
+			var got baggage.Baggage
+			select {
+			case got = <-bags:
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler was not called")
+			}
+			if got.Len() != len(tt.members) {
+				t.Errorf("handler baggage = %s, want %d members", got, len(tt.members))
+			}
+			for key, value := range tt.members {
+				if v := got.Member(key).Value(); v != value {
+					t.Errorf("handler baggage %s = %q, want %q", key, v, value)
+				}
+			}
+		})
+	}
+}
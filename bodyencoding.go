@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+)
+
+// BodyEncoding selects how a Publisher writes message bodies into the Data
+// section.
+type BodyEncoding int
+
+const (
+	// BodyEncodingRaw sends bodies as they are. It is the default.
+	BodyEncodingRaw BodyEncoding = iota
+	// BodyEncodingBase64 sends the standard base64 encoding of bodies, for
+	// consumers that expect text payloads. Base64DecodingMiddleware reverses
+	// it.
+	BodyEncodingBase64
+)
+
+func (e BodyEncoding) String() string {
+	switch e {
+	case BodyEncodingRaw:
+		return "raw"
+	case BodyEncodingBase64:
+		return "base64"
+	default:
+		return fmt.Sprintf("BodyEncoding(%d)", int(e))
+	}
+}
+
+// encode returns body in encoding e.
+func (e BodyEncoding) encode(body []byte) []byte {
+	if e != BodyEncodingBase64 {
+		return body
+	}
+	return []byte(base64.StdEncoding.EncodeToString(body))
+}
+
+// Base64DecodingMiddleware passes next a copy of each message with its body
+// decoded from standard base64, as sent with BodyEncodingBase64. Messages
+// whose body is not valid base64 are dead-lettered with reason
+// "DeserializationFailed". When used with AssemblyHandler it must wrap it,
+// as each chunk is encoded separately.
+func Base64DecodingMiddleware(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *amqp.Message) error {
+		body, err := base64.StdEncoding.DecodeString(string(msg.GetData()))
+		if err != nil {
+			return DeadLetter(decodeFailedReason, fmt.Sprintf("failed to decode base64 body: %v", err))
+		}
+		decoded := *msg
+		decoded.Data = [][]byte{body}
+		return next(ctx, &decoded)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestBodyEncodingRoundTrip(t *testing.T) {
+	const body = "binary \x00\xff payload"
+	tests := []struct {
+		name     string
+		encoding BodyEncoding
+		wantSent string
+	}{
+		{name: "raw", encoding: BodyEncodingRaw, wantSent: body},
+		{name: "base64", encoding: BodyEncodingBase64, wantSent: "YmluYXJ5IAD/IHBheWxvYWQ="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			p := newBrokerPublisher(t, config, func(o *PublisherOptions) { o.BodyEncoding = tt.encoding })
+			if err := p.Publish(context.Background(), body, nil); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+			sent := b.receivedAt("topic")
+			if len(sent) != 1 || string(sent[0].GetData()) != tt.wantSent {
+				t.Fatalf("broker received %v, want one message with body %q", sent, tt.wantSent)
+			}
+			if tt.encoding != BodyEncodingBase64 {
+				return
+			}
+
+			received := make(chan string, 1)
+			s := newBrokerSubscriber(t, config,
+				WithMiddleware(Base64DecodingMiddleware),
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					received <- string(msg.GetData())
+					return nil
+				}),
+			)
+			listenInBackground(t, s)
+			b.send(config.SubscriptionPath(), sent[0])
+			select {
+			case got := <-received:
+				if got != body {
+					t.Errorf("handler body = %q, want %q", got, body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler was not called")
+			}
+		})
+	}
+}
+
+func TestBase64DecodingMiddlewareInvalidBody(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	s := newBrokerSubscriber(t, config,
+		WithMiddleware(Base64DecodingMiddleware),
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			t.Errorf("handler called with %q", msg.GetData())
+			return nil
+		}),
+	)
+	listenInBackground(t, s)
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("not base64!")))
+
+	got := b.waitSettlements(1)[0].State
+	if got.Outcome != "rejected" || got.Info["DeadLetterReason"] != decodeFailedReason {
+		t.Errorf("settlement = %q %v, want rejected with reason %s", got.Outcome, got.Info["DeadLetterReason"], decodeFailedReason)
+	}
+}
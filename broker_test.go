@@ -0,0 +1,1355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// testBroker is a minimal in-process AMQP 1.0 broker for tests. It accepts
+// connections without SASL, keeps a queue per address and delivers the
+// messages of a queue to the receivers attached to it. Messages sent to a
+// topic are also queued for each of its subscriptions that a receiver has
+// attached to. Requests to management nodes ($cbs and addresses ending in
+// $management) are answered on the requester's reply receiver.
+type testBroker struct {
+	t        testing.TB
+	listener net.Listener
+
+	mu     sync.Mutex
+	queues map[string][]*amqp.Message
+	// received logs every message clients sent, by address.
+	received map[string][]*amqp.Message
+	outcomes []brokerOutcome
+	conns    map[*brokerConn]struct{}
+	accepted int
+	// begun counts the sessions begun so far.
+	begun int
+	// filters holds the source filters of the last receiver attached to
+	// each address, keyed by filter name.
+	filters  map[string]map[string]any
+	sequence int64
+	changed  chan struct{}
+	// management answers requests to management nodes; a nil response is
+	// never answered. It defaults to status 200.
+	management func(address string, req *amqp.Message) *amqp.Message
+	// sendOutcome settles the messages clients send. It defaults to
+	// accepting them.
+	sendOutcome func(address string, msg *amqp.Message) brokerState
+	// ignoreAttach, when it returns true for the address of a sender link,
+	// leaves the attach unanswered, as a broker that hangs. It is called with
+	// mu held.
+	ignoreAttach func(address string) bool
+
+	wg sync.WaitGroup
+}
+
+// brokerState is an AMQP delivery state as settled by the broker or a
+// client.
+type brokerState struct {
+	// Outcome is "accepted", "rejected", "released" or "modified".
+	Outcome string
+	// Condition and Description are the error of a rejection.
+	Condition   string
+	Description string
+	// Info holds the error info of a rejection, and Annotations the message
+	// annotations of a modification.
+	Info        map[string]any
+	Annotations map[string]any
+	// DeliveryFailed and UndeliverableHere are the flags of a modification.
+	DeliveryFailed    bool
+	UndeliverableHere bool
+}
+
+// brokerOutcome is a client's settlement of a message delivered from
+// Address.
+type brokerOutcome struct {
+	Address string
+	Message *amqp.Message
+	State   brokerState
+}
+
+// newTestBroker starts a broker listening on a local port, stopped when the
+// test ends.
+func newTestBroker(t testing.TB) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return startTestBroker(t, ln)
+}
+
+// startTestBroker serves connections accepted by ln, which may be a TLS
+// listener.
+func startTestBroker(t testing.TB, ln net.Listener) *testBroker {
+	b := &testBroker{
+		t:        t,
+		listener: ln,
+		queues:   make(map[string][]*amqp.Message),
+		received: make(map[string][]*amqp.Message),
+		filters:  make(map[string]map[string]any),
+		conns:    make(map[*brokerConn]struct{}),
+		changed:  make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+// config returns the configuration of a client of topic "topic" and
+// subscription "sub" on the broker.
+func (b *testBroker) config() AmqpConfig {
+	return AmqpConfig{
+		ConnectionString: "amqp://" + b.listener.Addr().String(),
+		Topic:            "topic",
+		Subscription:     "sub",
+	}
+}
+
+func (b *testBroker) serve() {
+	defer b.wg.Done()
+	for {
+		netConn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerConn{broker: b, conn: netConn, sessions: make(map[uint16]*brokerSession), maxFrameSize: 512}
+		b.mu.Lock()
+		b.conns[c] = struct{}{}
+		b.accepted++
+		b.notifyLocked()
+		b.mu.Unlock()
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			c.serve()
+		}()
+	}
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.dropConnections()
+	b.wg.Wait()
+}
+
+// dropConnections closes every client connection without closing frames.
+func (b *testBroker) dropConnections() {
+	b.mu.Lock()
+	conns := make([]*brokerConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+// connections returns the number of connections accepted so far.
+func (b *testBroker) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.accepted
+}
+
+// send queues msg at address for delivery, as if a client had sent it.
+func (b *testBroker) send(address string, msg *amqp.Message) {
+	b.mu.Lock()
+	b.enqueueLocked(address, msg)
+	b.mu.Unlock()
+	b.dispatch()
+}
+
+// enqueueLocked must be called with b.mu held.
+func (b *testBroker) enqueueLocked(address string, msg *amqp.Message) {
+	address = normalizeAddress(address)
+	b.sequence++
+	msg = copyMessage(msg)
+	if msg.Annotations == nil {
+		msg.Annotations = amqp.Annotations{}
+	}
+	if _, ok := msg.Annotations[sequenceNumberAnnotation]; !ok {
+		msg.Annotations[sequenceNumberAnnotation] = b.sequence
+	}
+	b.queues[address] = append(b.queues[address], msg)
+	// Fan out to the subscriptions of a topic.
+	for queue := range b.queues {
+		if strings.HasPrefix(queue, address+"/subscriptions/") {
+			b.queues[queue] = append(b.queues[queue], copyMessage(msg))
+		}
+	}
+	b.notifyLocked()
+}
+
+// receivedAt returns the messages clients sent to address.
+func (b *testBroker) receivedAt(address string) []*amqp.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*amqp.Message(nil), b.received[normalizeAddress(address)]...)
+}
+
+// sourceFilters returns the source filters of the last receiver attached to
+// address, by name.
+func (b *testBroker) sourceFilters(address string) map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.filters[normalizeAddress(address)]
+}
+
+// settlements returns the settlements of delivered messages so far.
+func (b *testBroker) settlements() []brokerOutcome {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]brokerOutcome(nil), b.outcomes...)
+}
+
+// waitFor polls cond until it holds, failing the test after 10s.
+func (b *testBroker) waitFor(what string, cond func() bool) {
+	b.t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		b.mu.Lock()
+		changed := b.changed
+		b.mu.Unlock()
+		if cond() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			b.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitSettlements waits until n messages are settled and returns the
+// settlements.
+func (b *testBroker) waitSettlements(n int) []brokerOutcome {
+	b.t.Helper()
+	b.waitFor(fmt.Sprintf("%d settlements", n), func() bool { return len(b.settlements()) >= n })
+	return b.settlements()
+}
+
+// notifyLocked wakes up waitFor. It must be called with b.mu held.
+func (b *testBroker) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// detachReceivers detaches every receiver link attached to address with
+// an error, leaving sessions and connections open.
+func (b *testBroker) detachReceivers(address string) {
+	address = normalizeAddress(address)
+	b.mu.Lock()
+	var links []*brokerLink
+	for c := range b.conns {
+		for _, s := range c.sessions {
+			for _, l := range s.links {
+				if l.outgoing && l.address == address && !l.detached {
+					l.detached = true
+					for id, d := range s.unsettled {
+						if d.link == l {
+							b.requeueLocked(d)
+							delete(s.unsettled, id)
+						}
+					}
+					links = append(links, l)
+				}
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, l := range links {
+		l.session.conn.write(l.session.channel, performative(0x16, l.handle, true,
+			wireError("amqp:link:detach-forced", "detached by test broker")))
+	}
+}
+
+// sessionsBegun returns the number of sessions begun so far.
+func (b *testBroker) sessionsBegun() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.begun
+}
+
+// endSessions ends every session with a link to or from address, as the
+// broker does when it closes a session.
+func (b *testBroker) endSessions(address string) {
+	address = normalizeAddress(address)
+	b.mu.Lock()
+	var ended []*brokerSession
+	for c := range b.conns {
+		for channel, s := range c.sessions {
+			for _, l := range s.links {
+				if l.address == address {
+					s.end()
+					delete(c.sessions, channel)
+					ended = append(ended, s)
+					break
+				}
+			}
+		}
+	}
+	b.notifyLocked()
+	b.mu.Unlock()
+	for _, s := range ended {
+		s.conn.write(s.channel, performative(0x17, wireError("amqp:internal-error", "ended by test broker")))
+	}
+	b.dispatch()
+}
+
+// dispatch delivers queued messages to receivers with credit.
+func (b *testBroker) dispatch() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		for _, s := range c.sessions {
+			for _, l := range s.links {
+				for l.outgoing && l.credit > 0 && !l.detached {
+					var msg *amqp.Message
+					if len(l.replies) > 0 {
+						msg, l.replies = l.replies[0], l.replies[1:]
+					} else if queue := b.queues[l.address]; len(queue) > 0 && !l.private {
+						msg, b.queues[l.address] = queue[0], queue[1:]
+					} else {
+						break
+					}
+					l.deliver(msg)
+				}
+			}
+		}
+	}
+}
+
+// requeueLocked returns an unsettled delivery to its queue, counting it as
+// a failed delivery. It must be called with b.mu held.
+func (b *testBroker) requeueLocked(d *brokerDelivery) {
+	if d.link.private {
+		return
+	}
+	msg := copyMessage(d.msg)
+	if msg.Header == nil {
+		msg.Header = &amqp.MessageHeader{}
+	}
+	msg.Header.DeliveryCount++
+	b.queues[d.link.address] = append([]*amqp.Message{msg}, b.queues[d.link.address]...)
+}
+
+// brokerConn is one client connection.
+type brokerConn struct {
+	broker       *testBroker
+	conn         net.Conn
+	writeMu      sync.Mutex
+	sessions     map[uint16]*brokerSession
+	maxFrameSize uint32
+}
+
+type brokerSession struct {
+	conn           *brokerConn
+	channel        uint16
+	nextIncomingID uint32
+	nextOutgoingID uint32
+	nextDeliveryID uint32
+	links          map[uint32]*brokerLink
+	unsettled      map[uint32]*brokerDelivery
+}
+
+// brokerLink is the broker's end of a link. outgoing links deliver to a
+// client receiver, the others take the messages of a client sender.
+type brokerLink struct {
+	session       *brokerSession
+	handle        uint32
+	outgoing      bool
+	address       string
+	targetAddress string
+	// private links only receive management replies.
+	private       bool
+	credit        int64
+	deliveryCount uint32
+	// replies are the management responses waiting for the link.
+	replies  []*amqp.Message
+	detached bool
+	// payload accumulates a transfer split over several frames.
+	payload    []byte
+	deliveryID uint32
+	settled    bool
+}
+
+type brokerDelivery struct {
+	link *brokerLink
+	msg  *amqp.Message
+}
+
+func (c *brokerConn) serve() {
+	defer c.cleanup()
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return
+	}
+	if !bytes.Equal(header, []byte("AMQP\x00\x01\x00\x00")) {
+		return
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return
+	}
+	for {
+		channel, body, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		if len(body) == 0 {
+			continue // heartbeat
+		}
+		if err := c.handle(channel, body); err != nil {
+			if !errors.Is(err, io.EOF) {
+				c.broker.t.Logf("test broker: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// cleanup returns the connection's unsettled deliveries to their queues.
+func (c *brokerConn) cleanup() {
+	c.conn.Close()
+	b := c.broker
+	b.mu.Lock()
+	delete(b.conns, c)
+	for _, s := range c.sessions {
+		s.end()
+	}
+	b.notifyLocked()
+	b.mu.Unlock()
+	b.dispatch()
+}
+
+// end releases the session's unsettled deliveries. It must be called with
+// b.mu held.
+func (s *brokerSession) end() {
+	for id, d := range s.unsettled {
+		s.conn.broker.requeueLocked(d)
+		delete(s.unsettled, id)
+	}
+	for _, l := range s.links {
+		l.detached = true
+	}
+}
+
+func (c *brokerConn) readFrame() (uint16, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	doff := int(header[4]) * 4
+	if size < 8 || doff < 8 || int(size) < doff {
+		return 0, nil, fmt.Errorf("invalid frame header %x", header)
+	}
+	frame := make([]byte, size-8)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint16(header[6:]), frame[doff-8:], nil
+}
+
+// write sends a frame of body, a performative, followed by payload.
+func (c *brokerConn) write(channel uint16, body wireDescribed, payload ...[]byte) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0, 2, 0, 0, 0})
+	binary.BigEndian.PutUint16(buf.Bytes()[6:], channel)
+	encodeWire(&buf, body)
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.Write(frame)
+}
+
+func (c *brokerConn) handle(channel uint16, body []byte) error {
+	v, n, err := decodeWire(body)
+	if err != nil {
+		return err
+	}
+	frame, ok := v.(wireDescribed)
+	if !ok {
+		return fmt.Errorf("frame body is %T, not a performative", v)
+	}
+	code, _ := frame.descriptor.(uint64)
+	fields, _ := frame.value.([]any)
+	payload := body[n:]
+
+	b := c.broker
+	if code >= 0x12 && code <= 0x16 {
+		b.mu.Lock()
+		_, begun := c.sessions[channel]
+		b.mu.Unlock()
+		if !begun {
+			// Sent before the client saw the end of endSessions.
+			return nil
+		}
+	}
+	switch code {
+	case 0x10: // open
+		if size, ok := fieldValue(fields, 2).(uint32); ok && size >= 512 {
+			c.maxFrameSize = min(size, 65536)
+		}
+		c.write(0, performative(0x10, "test-broker", nil, uint32(65536), uint16(math.MaxUint16)))
+	case 0x11: // begin
+		s := &brokerSession{
+			conn:      c,
+			channel:   channel,
+			links:     make(map[uint32]*brokerLink),
+			unsettled: make(map[uint32]*brokerDelivery),
+		}
+		s.nextIncomingID, _ = fieldValue(fields, 1).(uint32)
+		b.mu.Lock()
+		c.sessions[channel] = s
+		b.begun++
+		b.mu.Unlock()
+		c.write(channel, performative(0x11, channel, uint32(0), uint32(100000), uint32(100000), uint32(math.MaxUint32)))
+	case 0x12: // attach
+		c.attach(channel, fields)
+	case 0x13: // flow
+		c.flow(channel, fields)
+	case 0x14: // transfer
+		c.transfer(channel, fields, payload)
+	case 0x15: // disposition
+		c.disposition(channel, fields)
+	case 0x16: // detach
+		handle, _ := fieldValue(fields, 0).(uint32)
+		b.mu.Lock()
+		s := c.sessions[channel]
+		// Links whose attach was ignored are not answered either.
+		wasDetached := true
+		if s != nil {
+			if l := s.links[handle]; l != nil {
+				wasDetached = l.detached
+				l.detached = true
+				for id, d := range s.unsettled {
+					if d.link == l {
+						b.requeueLocked(d)
+						delete(s.unsettled, id)
+					}
+				}
+				delete(s.links, handle)
+			}
+		}
+		b.notifyLocked()
+		b.mu.Unlock()
+		if !wasDetached {
+			c.write(channel, performative(0x16, handle, true))
+		}
+		b.dispatch()
+	case 0x17: // end
+		b.mu.Lock()
+		s := c.sessions[channel]
+		if s != nil {
+			s.end()
+			delete(c.sessions, channel)
+		}
+		b.mu.Unlock()
+		// A session ended by endSessions is already gone.
+		if s != nil {
+			c.write(channel, performative(0x17))
+		}
+		b.dispatch()
+	case 0x18: // close
+		c.write(0, performative(0x18))
+		return io.EOF
+	default:
+		return fmt.Errorf("unexpected performative %#x", code)
+	}
+	return nil
+}
+
+func (c *brokerConn) attach(channel uint16, fields []any) {
+	b := c.broker
+	name, _ := fieldValue(fields, 0).(string)
+	handle, _ := fieldValue(fields, 1).(uint32)
+	clientReceives, _ := fieldValue(fields, 2).(bool)
+	source, _ := fieldValue(fields, 5).(wireDescribed)
+	target, _ := fieldValue(fields, 6).(wireDescribed)
+	sourceAddress, _ := fieldValue(listOf(source.value), 0).(string)
+	targetAddress, _ := fieldValue(listOf(target.value), 0).(string)
+
+	b.mu.Lock()
+	s := c.sessions[channel]
+	l := &brokerLink{session: s, handle: handle, outgoing: clientReceives}
+	if clientReceives {
+		l.address = normalizeAddress(sourceAddress)
+		l.targetAddress = targetAddress
+		l.private = isManagementNode(l.address)
+		b.filters[l.address] = mapOf(fieldValue(listOf(source.value), 7))
+		if _, ok := b.queues[l.address]; !ok && !l.private {
+			b.queues[l.address] = nil
+		}
+	} else {
+		l.address = normalizeAddress(targetAddress)
+		l.deliveryCount, _ = fieldValue(fields, 9).(uint32)
+		if b.ignoreAttach != nil && b.ignoreAttach(l.address) {
+			b.mu.Unlock()
+			return
+		}
+	}
+	s.links[handle] = l
+	b.notifyLocked()
+	b.mu.Unlock()
+
+	c.write(channel, performative(0x12, name, handle, !clientReceives,
+		fieldValue(fields, 3), fieldValue(fields, 4),
+		performative(0x28, sourceAddress), performative(0x29, targetAddress),
+		nil, nil, uint32(0)))
+	if !clientReceives {
+		b.mu.Lock()
+		l.credit = 10000
+		flow := l.flowLocked()
+		b.mu.Unlock()
+		c.write(channel, flow)
+	}
+}
+
+// flowLocked returns a flow frame of the link's state. It must be called
+// with b.mu held.
+func (l *brokerLink) flowLocked() wireDescribed {
+	s := l.session
+	return performative(0x13, s.nextIncomingID, uint32(100000), s.nextOutgoingID, uint32(100000),
+		l.handle, l.deliveryCount, uint32(max(l.credit, 0)))
+}
+
+func (c *brokerConn) flow(channel uint16, fields []any) {
+	b := c.broker
+	handle, isLink := fieldValue(fields, 4).(uint32)
+	echo, _ := fieldValue(fields, 9).(bool)
+	b.mu.Lock()
+	s := c.sessions[channel]
+	var reply *wireDescribed
+	if l := s.links[handle]; isLink && l != nil {
+		if l.outgoing {
+			deliveryCount, _ := fieldValue(fields, 5).(uint32)
+			credit, _ := fieldValue(fields, 6).(uint32)
+			l.credit = int64(deliveryCount) + int64(credit) - int64(l.deliveryCount)
+			if drain, _ := fieldValue(fields, 8).(bool); drain {
+				b.mu.Unlock()
+				b.dispatch()
+				b.mu.Lock()
+				l.deliveryCount += uint32(max(l.credit, 0))
+				l.credit = 0
+				flow := l.flowLocked()
+				flow.value = append(listOf(flow.value), nil, true)
+				reply = &flow
+			}
+		}
+		if echo && reply == nil {
+			flow := l.flowLocked()
+			reply = &flow
+		}
+	} else if echo {
+		flow := performative(0x13, s.nextIncomingID, uint32(100000), s.nextOutgoingID, uint32(100000))
+		reply = &flow
+	}
+	b.mu.Unlock()
+	if reply != nil {
+		c.write(channel, *reply)
+	}
+	b.dispatch()
+}
+
+func (c *brokerConn) transfer(channel uint16, fields []any, payload []byte) {
+	b := c.broker
+	handle, _ := fieldValue(fields, 0).(uint32)
+	more, _ := fieldValue(fields, 5).(bool)
+
+	b.mu.Lock()
+	s := c.sessions[channel]
+	s.nextIncomingID++
+	l := s.links[handle]
+	if l == nil {
+		b.mu.Unlock()
+		return
+	}
+	if id, ok := fieldValue(fields, 1).(uint32); ok {
+		l.deliveryID = id
+		l.settled, _ = fieldValue(fields, 4).(bool)
+		l.payload = nil
+	}
+	l.payload = append(l.payload, payload...)
+	if more {
+		b.mu.Unlock()
+		return
+	}
+	data, deliveryID, settled := l.payload, l.deliveryID, l.settled
+	l.payload = nil
+	l.deliveryCount++
+	l.credit--
+	var flow *wireDescribed
+	if l.credit < 5000 {
+		l.credit = 10000
+		f := l.flowLocked()
+		flow = &f
+	}
+	b.mu.Unlock()
+	if flow != nil {
+		c.write(channel, *flow)
+	}
+
+	msg := new(amqp.Message)
+	state := brokerState{Outcome: "accepted"}
+	if err := msg.UnmarshalBinary(data); err != nil {
+		state = brokerState{Outcome: "rejected", Condition: "amqp:decode-error", Description: err.Error()}
+	} else {
+		b.mu.Lock()
+		sendOutcome := b.sendOutcome
+		b.mu.Unlock()
+		if sendOutcome != nil {
+			state = sendOutcome(l.address, msg)
+		}
+	}
+	if !settled {
+		c.write(channel, performative(0x15, true, deliveryID, nil, true, state.wire()))
+	}
+	if state.Outcome != "accepted" {
+		return
+	}
+
+	if isManagementNode(l.address) {
+		c.answer(l.address, msg)
+		return
+	}
+	b.mu.Lock()
+	b.received[l.address] = append(b.received[l.address], msg)
+	b.enqueueLocked(l.address, msg)
+	b.mu.Unlock()
+	b.dispatch()
+}
+
+// answer routes the response to a management request to the reply
+// receiver of the request's connection.
+func (c *brokerConn) answer(address string, req *amqp.Message) {
+	b := c.broker
+	b.mu.Lock()
+	b.received[address] = append(b.received[address], req)
+	management := b.management
+	b.notifyLocked()
+	b.mu.Unlock()
+
+	var resp *amqp.Message
+	if management != nil {
+		resp = management(address, req)
+		if resp == nil {
+			return
+		}
+	} else {
+		resp = &amqp.Message{ApplicationProperties: map[string]any{"status-code": int32(200)}}
+	}
+	if req.Properties == nil || req.Properties.ReplyTo == nil {
+		return
+	}
+	resp = copyMessage(resp)
+	if resp.Properties == nil {
+		resp.Properties = &amqp.MessageProperties{}
+	}
+	resp.Properties.CorrelationID = req.Properties.MessageID
+
+	b.mu.Lock()
+	for _, s := range c.sessions {
+		for _, l := range s.links {
+			if l.outgoing && l.address == address && l.targetAddress == *req.Properties.ReplyTo {
+				l.replies = append(l.replies, resp)
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.dispatch()
+}
+
+func (c *brokerConn) disposition(channel uint16, fields []any) {
+	b := c.broker
+	first, _ := fieldValue(fields, 1).(uint32)
+	last, ok := fieldValue(fields, 2).(uint32)
+	if !ok {
+		last = first
+	}
+	settled, _ := fieldValue(fields, 3).(bool)
+	state := parseBrokerState(fieldValue(fields, 4))
+
+	b.mu.Lock()
+	s := c.sessions[channel]
+	for id := first; id <= last; id++ {
+		d, ok := s.unsettled[id]
+		if !ok {
+			continue
+		}
+		delete(s.unsettled, id)
+		if !d.link.private {
+			b.outcomes = append(b.outcomes, brokerOutcome{Address: d.link.address, Message: d.msg, State: state})
+		}
+		switch state.Outcome {
+		case "released", "modified":
+			b.requeueLocked(d)
+		case "rejected":
+			if !d.link.private {
+				b.queues[d.link.address+"/$deadletterqueue"] = append(b.queues[d.link.address+"/$deadletterqueue"], d.msg)
+			}
+		}
+	}
+	b.notifyLocked()
+	b.mu.Unlock()
+	if !settled {
+		c.write(channel, performative(0x15, false, first, last, true, state.wire()))
+	}
+	b.dispatch()
+}
+
+// deliver transfers msg on l. It must be called with b.mu held.
+func (l *brokerLink) deliver(msg *amqp.Message) {
+	s := l.session
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		s.conn.broker.t.Errorf("test broker: failed to encode message: %v", err)
+		return
+	}
+	id := s.nextDeliveryID
+	s.nextDeliveryID++
+	l.deliveryCount++
+	l.credit--
+	s.unsettled[id] = &brokerDelivery{link: l, msg: msg}
+	tag := make([]byte, 16)
+	binary.BigEndian.PutUint32(tag, id)
+	binary.BigEndian.PutUint16(tag[4:], s.channel)
+
+	// Leave room for the frame header and transfer performative.
+	chunk := int(s.conn.maxFrameSize) - 64
+	for first := true; first || len(data) > 0; first = false {
+		part := data[:min(chunk, len(data))]
+		data = data[len(part):]
+		more := len(data) > 0
+		if first {
+			s.conn.write(s.channel, performative(0x14, l.handle, id, tag, uint32(0), false, more), part)
+		} else {
+			s.conn.write(s.channel, performative(0x14, l.handle, nil, nil, nil, nil, more), part)
+		}
+		s.nextOutgoingID++
+	}
+}
+
+// wire returns the AMQP encoding of the state.
+func (st brokerState) wire() wireDescribed {
+	switch st.Outcome {
+	case "rejected":
+		return performative(0x25, wireError(st.Condition, st.Description))
+	case "released":
+		return performative(0x26)
+	case "modified":
+		return performative(0x27, st.DeliveryFailed, st.UndeliverableHere)
+	default:
+		return performative(0x24)
+	}
+}
+
+func parseBrokerState(v any) brokerState {
+	d, _ := v.(wireDescribed)
+	fields := listOf(d.value)
+	code, _ := d.descriptor.(uint64)
+	switch code {
+	case 0x25:
+		st := brokerState{Outcome: "rejected"}
+		e, _ := fieldValue(fields, 0).(wireDescribed)
+		errFields := listOf(e.value)
+		condition, _ := fieldValue(errFields, 0).(wireSymbol)
+		st.Condition = string(condition)
+		st.Description, _ = fieldValue(errFields, 1).(string)
+		st.Info = mapOf(fieldValue(errFields, 2))
+		return st
+	case 0x26:
+		return brokerState{Outcome: "released"}
+	case 0x27:
+		st := brokerState{Outcome: "modified"}
+		st.DeliveryFailed, _ = fieldValue(fields, 0).(bool)
+		st.UndeliverableHere, _ = fieldValue(fields, 1).(bool)
+		st.Annotations = mapOf(fieldValue(fields, 2))
+		return st
+	default:
+		return brokerState{Outcome: "accepted"}
+	}
+}
+
+func isManagementNode(address string) bool {
+	return address == cbsAddress || strings.HasSuffix(address, "$management")
+}
+
+// normalizeAddress makes the "subscriptions" segment of an entity path
+// lowercase, as Service Bus paths are case-insensitive.
+func normalizeAddress(address string) string {
+	return strings.Replace(address, "/Subscriptions/", "/subscriptions/", 1)
+}
+
+// copyMessage returns a copy of the sections of msg, without the state of
+// a received message.
+func copyMessage(msg *amqp.Message) *amqp.Message {
+	c := &amqp.Message{
+		Format:              msg.Format,
+		DeliveryAnnotations: msg.DeliveryAnnotations,
+		Data:                msg.Data,
+		Value:               msg.Value,
+		Sequence:            msg.Sequence,
+		Footer:              msg.Footer,
+	}
+	if msg.Header != nil {
+		header := *msg.Header
+		c.Header = &header
+	}
+	if msg.Properties != nil {
+		properties := *msg.Properties
+		c.Properties = &properties
+	}
+	if msg.Annotations != nil {
+		c.Annotations = amqp.Annotations{}
+		for k, v := range msg.Annotations {
+			c.Annotations[k] = v
+		}
+	}
+	if msg.ApplicationProperties != nil {
+		c.ApplicationProperties = map[string]any{}
+		for k, v := range msg.ApplicationProperties {
+			c.ApplicationProperties[k] = v
+		}
+	}
+	return c
+}
+
+// wireSymbol is an AMQP symbol.
+type wireSymbol string
+
+// wireDescribed is an AMQP described value, such as a performative.
+type wireDescribed struct {
+	descriptor any
+	value      any
+}
+
+// wireMap is an AMQP map as alternating keys and values.
+type wireMap []any
+
+// performative returns the composite type of code with fields, omitting
+// trailing nulls.
+func performative(code uint64, fields ...any) wireDescribed {
+	for len(fields) > 0 && fields[len(fields)-1] == nil {
+		fields = fields[:len(fields)-1]
+	}
+	return wireDescribed{descriptor: code, value: fields}
+}
+
+func wireError(condition, description string) wireDescribed {
+	return performative(0x1d, wireSymbol(condition), description)
+}
+
+func fieldValue(fields []any, i int) any {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return nil
+}
+
+func listOf(v any) []any {
+	list, _ := v.([]any)
+	return list
+}
+
+// mapOf converts a decoded map to a Go map keyed by the keys' string form.
+func mapOf(v any) map[string]any {
+	m, ok := v.(wireMap)
+	if !ok {
+		return nil
+	}
+	out := make(map[string]any, len(m)/2)
+	for i := 0; i+1 < len(m); i += 2 {
+		out[fmt.Sprint(m[i])] = m[i+1]
+	}
+	return out
+}
+
+func encodeWire(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0x40)
+	case bool:
+		if v {
+			buf.WriteByte(0x41)
+		} else {
+			buf.WriteByte(0x42)
+		}
+	case uint8:
+		buf.Write([]byte{0x50, v})
+	case uint16:
+		buf.WriteByte(0x60)
+		buf.Write(binary.BigEndian.AppendUint16(nil, v))
+	case uint32:
+		buf.WriteByte(0x70)
+		buf.Write(binary.BigEndian.AppendUint32(nil, v))
+	case uint64:
+		if v < 256 {
+			// go-amqp requires performative descriptors as smallulong.
+			buf.Write([]byte{0x53, byte(v)})
+			return
+		}
+		buf.WriteByte(0x80)
+		buf.Write(binary.BigEndian.AppendUint64(nil, v))
+	case int32:
+		buf.WriteByte(0x71)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	case int64:
+		buf.WriteByte(0x81)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v)))
+	case string:
+		buf.WriteByte(0xb1)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.WriteString(v)
+	case wireSymbol:
+		buf.WriteByte(0xb3)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.WriteString(string(v))
+	case []byte:
+		buf.WriteByte(0xb0)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(v))))
+		buf.Write(v)
+	case wireDescribed:
+		buf.WriteByte(0x00)
+		encodeWire(buf, v.descriptor)
+		encodeWire(buf, v.value)
+	case []any:
+		encodeCompound(buf, 0xd0, v)
+	case wireMap:
+		encodeCompound(buf, 0xd1, v)
+	default:
+		panic(fmt.Sprintf("test broker cannot encode %T", v))
+	}
+}
+
+func encodeCompound(buf *bytes.Buffer, code byte, items []any) {
+	var body bytes.Buffer
+	for _, item := range items {
+		encodeWire(&body, item)
+	}
+	buf.WriteByte(code)
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(body.Len()+4)))
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(items))))
+	buf.Write(body.Bytes())
+}
+
+// decodeWire decodes the AMQP value at the start of data and returns it with
+// its encoded length.
+func decodeWire(data []byte) (any, int, error) {
+	if len(data) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if data[0] == 0x00 {
+		descriptor, n, err := decodeWire(data[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		value, m, err := decodeWire(data[1+n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return wireDescribed{descriptor: descriptor, value: value}, 1 + n + m, nil
+	}
+	v, n, err := decodeWireBody(data[0], data[1:])
+	return v, n + 1, err
+}
+
+// decodeWireBody decodes a value of type code encoded in data.
+func decodeWireBody(code byte, data []byte) (any, int, error) {
+	need := func(n int) error {
+		if len(data) < n {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	fixed := map[byte]int{
+		0x50: 1, 0x51: 1, 0x52: 1, 0x53: 1, 0x54: 1, 0x55: 1, 0x56: 1,
+		0x60: 2, 0x61: 2,
+		0x70: 4, 0x71: 4, 0x72: 4, 0x73: 4, 0x74: 4,
+		0x80: 8, 0x81: 8, 0x82: 8, 0x83: 8, 0x84: 8,
+		0x94: 16, 0x98: 16,
+	}
+	if size, ok := fixed[code]; ok {
+		if err := need(size); err != nil {
+			return nil, 0, err
+		}
+		b := data[:size]
+		switch code {
+		case 0x50:
+			return b[0], 1, nil
+		case 0x51:
+			return int8(b[0]), 1, nil
+		case 0x52:
+			return uint32(b[0]), 1, nil
+		case 0x53:
+			return uint64(b[0]), 1, nil
+		case 0x54:
+			return int32(int8(b[0])), 1, nil
+		case 0x55:
+			return int64(int8(b[0])), 1, nil
+		case 0x56:
+			return b[0] != 0, 1, nil
+		case 0x60:
+			return binary.BigEndian.Uint16(b), 2, nil
+		case 0x61:
+			return int16(binary.BigEndian.Uint16(b)), 2, nil
+		case 0x70:
+			return binary.BigEndian.Uint32(b), 4, nil
+		case 0x71:
+			return int32(binary.BigEndian.Uint32(b)), 4, nil
+		case 0x72:
+			return math.Float32frombits(binary.BigEndian.Uint32(b)), 4, nil
+		case 0x73:
+			return rune(binary.BigEndian.Uint32(b)), 4, nil
+		case 0x80:
+			return binary.BigEndian.Uint64(b), 8, nil
+		case 0x81:
+			return int64(binary.BigEndian.Uint64(b)), 8, nil
+		case 0x82:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), 8, nil
+		case 0x83:
+			return time.UnixMilli(int64(binary.BigEndian.Uint64(b))).UTC(), 8, nil
+		default:
+			return append([]byte(nil), b...), size, nil
+		}
+	}
+
+	switch code {
+	case 0x40:
+		return nil, 0, nil
+	case 0x41:
+		return true, 0, nil
+	case 0x42:
+		return false, 0, nil
+	case 0x43:
+		return uint32(0), 0, nil
+	case 0x44:
+		return uint64(0), 0, nil
+	case 0x45:
+		return []any(nil), 0, nil
+	case 0xa0, 0xa1, 0xa3, 0xb0, 0xb1, 0xb3:
+		width := 1
+		if code >= 0xb0 {
+			width = 4
+		}
+		size, err := wireSize(data, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := need(width + size); err != nil {
+			return nil, 0, err
+		}
+		b := data[width : width+size]
+		switch code & 0x0f {
+		case 0x00:
+			return append([]byte(nil), b...), width + size, nil
+		case 0x01:
+			return string(b), width + size, nil
+		default:
+			return wireSymbol(b), width + size, nil
+		}
+	case 0xc0, 0xc1, 0xd0, 0xd1:
+		width := 1
+		if code >= 0xd0 {
+			width = 4
+		}
+		size, err := wireSize(data, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := need(width + size); err != nil {
+			return nil, 0, err
+		}
+		body := data[width : width+size]
+		count, err := wireSize(body, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		items := make([]any, 0, count)
+		pos := width
+		for range count {
+			item, n, err := decodeWire(body[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			pos += n
+		}
+		if code&0x0f == 0x01 {
+			return wireMap(items), width + size, nil
+		}
+		return items, width + size, nil
+	case 0xe0, 0xf0:
+		width := 1
+		if code == 0xf0 {
+			width = 4
+		}
+		size, err := wireSize(data, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := need(width + size); err != nil {
+			return nil, 0, err
+		}
+		body := data[width : width+size]
+		count, err := wireSize(body, width)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos := width
+		var descriptor any
+		if body[pos] == 0x00 {
+			d, n, err := decodeWire(body[pos+1:])
+			if err != nil {
+				return nil, 0, err
+			}
+			descriptor = d
+			pos += 1 + n
+		}
+		elementCode := body[pos]
+		pos++
+		items := make([]any, 0, count)
+		for range count {
+			item, n, err := decodeWireBody(elementCode, body[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			if descriptor != nil {
+				item = wireDescribed{descriptor: descriptor, value: item}
+			}
+			items = append(items, item)
+			pos += n
+		}
+		return items, width + size, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported AMQP type code %#x", code)
+	}
+}
+
+func wireSize(data []byte, width int) (int, error) {
+	if len(data) < width {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if width == 1 {
+		return int(data[0]), nil
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// discardLogger returns a logger for code under test whose output is not
+// checked.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// logRecorder is a slog.Handler keeping the records logged at every level.
+// Attributes added with With are dropped.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+// recordingLogger returns a logger and the recorder of its records.
+func recordingLogger() (*slog.Logger, *logRecorder) {
+	r := &logRecorder{}
+	return slog.New(r), r
+}
+
+func (r *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r *logRecorder) Handle(_ context.Context, record slog.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record.Clone())
+	return nil
+}
+
+func (r *logRecorder) WithAttrs([]slog.Attr) slog.Handler { return r }
+func (r *logRecorder) WithGroup(string) slog.Handler      { return r }
+
+// count returns the number of records logged at level with message msg.
+func (r *logRecorder) count(level slog.Level, msg string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, record := range r.records {
+		if record.Level == level && record.Message == msg {
+			n++
+		}
+	}
+	return n
+}
+
+// newBrokerSubscriber subscribes to config's subscription on a test broker,
+// closing the subscriber when the test ends.
+func newBrokerSubscriber(t testing.TB, config AmqpConfig, opts ...SubscriberOption) *Subscriber {
+	t.Helper()
+	s, cleanup, err := NewSubscriber(context.Background(), discardLogger(), config, opts...)
+	if err != nil {
+		t.Fatalf("NewSubscriber: %v", err)
+	}
+	t.Cleanup(cleanup)
+	return s
+}
+
+// listenInBackground runs s.StartListening until the test ends, returning
+// the channel its result is sent on.
+func listenInBackground(t testing.TB, s *Subscriber) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.StartListening(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-result
+	})
+	return result
+}
+
+// redelivered reports whether msg was delivered before.
+func redelivered(msg *amqp.Message) bool {
+	return msg.Header != nil && msg.Header.DeliveryCount > 0
+}
+
+// newBrokerPublisher publishes to config's topic on a test broker, closing
+// the publisher when the test ends.
+func newBrokerPublisher(t testing.TB, config AmqpConfig, opts ...PublisherOption) *Publisher {
+	t.Helper()
+	p, cleanup, err := NewPublisher(context.Background(), discardLogger(), config, opts...)
+	if err != nil {
+		t.Fatalf("NewPublisher: %v", err)
+	}
+	t.Cleanup(cleanup)
+	return p
+}
+
+// newTLSTestBroker starts a broker serving TLS with config.
+func newTLSTestBroker(t testing.TB, config *tls.Config) *testBroker {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return startTestBroker(t, ln)
+}
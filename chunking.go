@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+// Application properties of the chunks sent by PublishLarge.
+const (
+	chunkIDProperty    = "x-chunk-id"
+	chunkIndexProperty = "x-chunk-index"
+	chunkTotalProperty = "x-chunk-total"
+)
+
+const (
+	// chunkAssemblyTimeout is how long AssemblyHandler keeps the chunks of
+	// an incomplete payload after the last one arrived.
+	chunkAssemblyTimeout = 10 * time.Minute
+	// invalidChunkReason is the dead-letter reason of chunks with invalid
+	// chunk properties.
+	invalidChunkReason = "InvalidChunk"
+)
+
+// PublishLarge splits data into chunks of at most chunkSize bytes and
+// publishes each as its own message carrying the x-chunk-id, x-chunk-index
+// and x-chunk-total application properties, for reassembly by
+// AssemblyHandler. Chunk message IDs are derived from the chunk ID, so a
+// retried chunk is caught by duplicate detection.
+func (p *Publisher) PublishLarge(ctx context.Context, data []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		return errors.New("chunk size must be positive")
+	}
+	chunkID := uuid.NewString()
+	total := max((len(data)+chunkSize-1)/chunkSize, 1)
+	for index := range total {
+		chunk := data[index*chunkSize : min((index+1)*chunkSize, len(data))]
+		msg, err := p.newMessage(chunk, &SendOptions{
+			MessageID: fmt.Sprintf("%s-%d", chunkID, index),
+			ApplicationProperties: map[string]any{
+				chunkIDProperty:    chunkID,
+				chunkIndexProperty: int64(index),
+				chunkTotalProperty: int64(total),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if err := p.PublishMessage(ctx, msg); err != nil {
+			return fmt.Errorf("failed to publish chunk %d of %d: %w", index+1, total, err)
+		}
+	}
+	return nil
+}
+
+// chunkAssembly collects the chunks of one payload.
+type chunkAssembly struct {
+	chunks   [][]byte
+	received int
+	first    *amqp.Message
+	updated  time.Time
+}
+
+// AssemblyHandler wraps next so that the chunks published by PublishLarge
+// are buffered until all have arrived, then passed to next as one message
+// with the reassembled body and the first chunk's properties. Other messages
+// are passed through. The result of next settles the chunk that completed
+// the payload; if it fails, the payload is handled again when that chunk is
+// redelivered. Other chunks are accepted as they are buffered, so a payload
+// whose chunks are split across subscriber instances or restarts is lost;
+// use a session per payload where that matters. Incomplete payloads are
+// dropped 10 minutes after their last chunk arrived.
+func AssemblyHandler(next MessageHandler) MessageHandler {
+	var mu sync.Mutex
+	assemblies := make(map[string]*chunkAssembly)
+
+	return func(ctx context.Context, msg *amqp.Message) error {
+		chunkID, ok := msg.ApplicationProperties[chunkIDProperty].(string)
+		if !ok {
+			return next(ctx, msg)
+		}
+		index, indexOK := integerProperty(msg.ApplicationProperties[chunkIndexProperty], 32)
+		total, totalOK := integerProperty(msg.ApplicationProperties[chunkTotalProperty], 32)
+		if !indexOK || !totalOK || total < 1 || index < 0 || index >= total {
+			return DeadLetter(invalidChunkReason, "missing or invalid chunk index or total")
+		}
+
+		now := time.Now()
+		mu.Lock()
+		for id, assembly := range assemblies {
+			if now.Sub(assembly.updated) > chunkAssemblyTimeout {
+				delete(assemblies, id)
+			}
+		}
+		assembly, ok := assemblies[chunkID]
+		if !ok {
+			assembly = &chunkAssembly{chunks: make([][]byte, total)}
+			assemblies[chunkID] = assembly
+		}
+		if int64(len(assembly.chunks)) != total {
+			mu.Unlock()
+			return DeadLetter(invalidChunkReason, "chunk total differs from earlier chunks")
+		}
+		if assembly.chunks[index] == nil {
+			assembly.received++
+		}
+		assembly.chunks[index] = msg.GetData()
+		if assembly.chunks[index] == nil {
+			// Keep empty chunks distinguishable from missing ones.
+			assembly.chunks[index] = []byte{}
+		}
+		if index == 0 {
+			assembly.first = msg
+		}
+		assembly.updated = now
+		complete := assembly.received == len(assembly.chunks)
+		if complete {
+			delete(assemblies, chunkID)
+		}
+		mu.Unlock()
+
+		if !complete {
+			return nil
+		}
+		err := next(ctx, assembledMessage(chunkID, assembly))
+		if err != nil {
+			// The final chunk is settled with err; keep the others so
+			// that its redelivery completes the payload again.
+			mu.Lock()
+			assemblies[chunkID] = assembly
+			mu.Unlock()
+		}
+		return err
+	}
+}
+
+// assembledMessage returns the message of a complete assembly.
+func assembledMessage(chunkID string, assembly *chunkAssembly) *amqp.Message {
+	first := assembly.first
+	msg := amqp.NewMessage(bytes.Join(assembly.chunks, nil))
+	msg.Header = first.Header
+	msg.Annotations = first.Annotations
+	if first.Properties != nil {
+		properties := *first.Properties
+		properties.MessageID = chunkID
+		msg.Properties = &properties
+	}
+	msg.ApplicationProperties = maps.Clone(first.ApplicationProperties)
+	delete(msg.ApplicationProperties, chunkIDProperty)
+	delete(msg.ApplicationProperties, chunkIndexProperty)
+	delete(msg.ApplicationProperties, chunkTotalProperty)
+	return msg
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPublishLargeRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 25)
+	tests := []struct {
+		name       string
+		payload    []byte
+		chunkSize  int
+		wantChunks int
+	}{
+		{name: "larger than a chunk", payload: payload, chunkSize: 100, wantChunks: 3},
+		{name: "exact multiple", payload: payload, chunkSize: 50, wantChunks: 5},
+		{name: "one chunk", payload: payload, chunkSize: 1000, wantChunks: 1},
+		{name: "empty", payload: []byte{}, chunkSize: 100, wantChunks: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			assembled := make(chan *amqp.Message, 1)
+			s := newBrokerSubscriber(t, config, WithHandler(AssemblyHandler(func(ctx context.Context, msg *amqp.Message) error {
+				assembled <- msg
+				return nil
+			})))
+			listenInBackground(t, s)
+			p := newBrokerPublisher(t, config)
+
+			if err := p.PublishLarge(context.Background(), tt.payload, tt.chunkSize); err != nil {
+				t.Fatalf("PublishLarge: %v", err)
+			}
+			chunks := b.receivedAt("topic")
+			if len(chunks) != tt.wantChunks {
+				t.Fatalf("published %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+			for i, chunk := range chunks {
+				if len(chunk.GetData()) > tt.chunkSize || chunk.ApplicationProperties[chunkIndexProperty] != int64(i) ||
+					chunk.ApplicationProperties[chunkTotalProperty] != int64(tt.wantChunks) {
+					t.Errorf("chunk %d of %d bytes with properties %v", i, len(chunk.GetData()), chunk.ApplicationProperties)
+				}
+			}
+
+			b.waitSettlements(tt.wantChunks)
+			msg := <-assembled
+			if !bytes.Equal(msg.GetData(), tt.payload) {
+				t.Errorf("reassembled %d bytes, want the %d-byte payload", len(msg.GetData()), len(tt.payload))
+			}
+			if msg.Properties.MessageID != chunks[0].ApplicationProperties[chunkIDProperty] {
+				t.Errorf("reassembled message ID = %v, want the chunk ID", msg.Properties.MessageID)
+			}
+			if _, ok := msg.ApplicationProperties[chunkIndexProperty]; ok {
+				t.Error("reassembled message keeps the chunk properties")
+			}
+		})
+	}
+}
+
+func TestAssemblyHandler(t *testing.T) {
+	chunk := func(id string, index, total int64, body string) *amqp.Message {
+		msg := amqp.NewMessage([]byte(body))
+		msg.ApplicationProperties = map[string]any{chunkIDProperty: id, chunkIndexProperty: index, chunkTotalProperty: total}
+		return msg
+	}
+	tests := []struct {
+		name       string
+		msgs       []*amqp.Message
+		want       []string
+		wantReason string
+	}{
+		{name: "out of order", msgs: []*amqp.Message{chunk("c1", 2, 3, "c"), chunk("c1", 0, 3, "a"), chunk("c1", 1, 3, "b")}, want: []string{"abc"}},
+		{name: "interleaved payloads", msgs: []*amqp.Message{chunk("c1", 0, 2, "a"), chunk("c2", 0, 2, "x"), chunk("c2", 1, 2, "y"), chunk("c1", 1, 2, "b")}, want: []string{"xy", "ab"}},
+		{name: "duplicate chunk", msgs: []*amqp.Message{chunk("c1", 0, 2, "a"), chunk("c1", 0, 2, "a"), chunk("c1", 1, 2, "b")}, want: []string{"ab"}},
+		{name: "not a chunk", msgs: []*amqp.Message{amqp.NewMessage([]byte("plain"))}, want: []string{"plain"}},
+		{name: "index out of range", msgs: []*amqp.Message{chunk("c1", 3, 3, "a")}, wantReason: invalidChunkReason},
+		{name: "total changed", msgs: []*amqp.Message{chunk("c1", 0, 3, "a"), chunk("c1", 1, 2, "b")}, wantReason: invalidChunkReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			handler := AssemblyHandler(func(ctx context.Context, msg *amqp.Message) error {
+				got = append(got, string(msg.GetData()))
+				return nil
+			})
+			var err error
+			for _, msg := range tt.msgs {
+				if err = handler(context.Background(), msg); err != nil {
+					break
+				}
+			}
+			if tt.wantReason != "" {
+				var decision *SettlementDecision
+				if !errors.As(err, &decision) || decision.Reason != tt.wantReason {
+					t.Errorf("error = %v, want a dead-letter with reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handler: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("handled %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Publisher methods while the circuit breaker
+// rejects sends after repeated failures.
+var ErrCircuitOpen = errors.New("publisher circuit breaker is open")
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultProbeCount       = 1
+)
+
+// CircuitBreakerOptions configures the publisher's circuit breaker.
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive send failures that open
+	// the circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before letting probes
+	// through. Defaults to 30s.
+	OpenTimeout time.Duration
+	// ProbeCount is the number of sends allowed while half-open; after that
+	// many consecutive successes the circuit closes. Defaults to 1.
+	ProbeCount int
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops sends from reaching a broker that keeps failing. A
+// nil *circuitBreaker allows every send.
+type circuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	// probes and successes count the sends let through and completed while
+	// half-open.
+	probes    int
+	successes int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultOpenTimeout
+	}
+	if opts.ProbeCount <= 0 {
+		opts.ProbeCount = defaultProbeCount
+	}
+	return &circuitBreaker{opts: opts}
+}
+
+// allow returns ErrCircuitOpen if a send may not proceed now.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if time.Since(b.openedAt) < b.opts.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.state, b.probes, b.successes = circuitHalfOpen, 0, 0
+	}
+	if b.state == circuitHalfOpen {
+		if b.probes >= b.opts.ProbeCount {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// record updates the breaker with the result of an allowed send. A
+// cancelled send says nothing about the broker and only frees its probe.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) {
+		if b.state == circuitHalfOpen {
+			b.probes--
+		}
+		return
+	}
+
+	switch b.state {
+	case circuitClosed:
+		if err == nil {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.opts.FailureThreshold {
+			b.open()
+		}
+	case circuitHalfOpen:
+		if err != nil {
+			b.open()
+			return
+		}
+		if b.successes++; b.successes >= b.opts.ProbeCount {
+			b.state, b.failures = circuitClosed, 0
+		}
+	}
+}
+
+// open must be called with b.mu held.
+func (b *circuitBreaker) open() {
+	b.state = circuitOpen
+	b.openedAt = time.Now()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errSend := errors.New("send failed")
+	// Each step is "allow" or "deny", checking allow's result, "ok", "fail"
+	// or "cancel", recording a send's result, or "expire", ending the open
+	// timeout.
+	tests := []struct {
+		name  string
+		opts  CircuitBreakerOptions
+		steps []string
+		want  circuitState
+	}{
+		{
+			name:  "stays closed below the threshold",
+			opts:  CircuitBreakerOptions{FailureThreshold: 3},
+			steps: []string{"allow", "fail", "allow", "fail", "allow", "ok", "allow", "fail", "allow"},
+			want:  circuitClosed,
+		},
+		{
+			name:  "opens at the threshold",
+			opts:  CircuitBreakerOptions{FailureThreshold: 2},
+			steps: []string{"allow", "fail", "allow", "fail", "deny", "deny"},
+			want:  circuitOpen,
+		},
+		{
+			name:  "single probe closes",
+			opts:  CircuitBreakerOptions{FailureThreshold: 1},
+			steps: []string{"allow", "fail", "deny", "expire", "allow", "deny", "ok", "allow"},
+			want:  circuitClosed,
+		},
+		{
+			name:  "failed probe reopens",
+			opts:  CircuitBreakerOptions{FailureThreshold: 1, ProbeCount: 2},
+			steps: []string{"allow", "fail", "expire", "allow", "allow", "deny", "ok", "fail", "deny"},
+			want:  circuitOpen,
+		},
+		{
+			name:  "every probe must succeed",
+			opts:  CircuitBreakerOptions{FailureThreshold: 1, ProbeCount: 3},
+			steps: []string{"allow", "fail", "expire", "allow", "allow", "allow", "deny", "ok", "ok", "deny", "ok", "allow"},
+			want:  circuitClosed,
+		},
+		{
+			name:  "cancelled probe is freed",
+			opts:  CircuitBreakerOptions{FailureThreshold: 1},
+			steps: []string{"allow", "fail", "expire", "allow", "deny", "cancel", "allow", "ok"},
+			want:  circuitClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newCircuitBreaker(tt.opts)
+			for i, step := range tt.steps {
+				switch step {
+				case "allow", "deny":
+					err := b.allow()
+					if wantDenied := step == "deny"; errors.Is(err, ErrCircuitOpen) != wantDenied {
+						t.Fatalf("step %d: allow() = %v, want denied %v", i, err, wantDenied)
+					}
+				case "ok":
+					b.record(nil)
+				case "fail":
+					b.record(errSend)
+				case "cancel":
+					b.record(context.Canceled)
+				case "expire":
+					b.openedAt = b.openedAt.Add(-b.opts.OpenTimeout - time.Millisecond)
+				}
+			}
+			if b.state != tt.want {
+				t.Errorf("state = %d, want %d", b.state, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *circuitBreaker
+	b.record(errors.New("send failed"))
+	if err := b.allow(); err != nil {
+		t.Errorf("allow() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/Azure/go-amqp"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types set by the built-in encoders.
+const (
+	jsonContentType     = "application/json"
+	msgpackContentType  = "application/msgpack"
+	protobufContentType = "application/x-protobuf"
+)
+
+// decodeFailedReason is the dead-letter reason of messages TypedHandler
+// cannot decode.
+const decodeFailedReason = "DeserializationFailed"
+
+// Encoder serializes values published with PublishTyped, returning the body
+// and its content type.
+type Encoder interface {
+	Encode(v any) ([]byte, string, error)
+}
+
+// JSONEncoder encodes values with encoding/json. It is the default Encoder.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(v any) ([]byte, string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return data, jsonContentType, nil
+}
+
+// msgpackHandle configures MessagePack encoding and decoding.
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// MsgpackEncoder encodes values as MessagePack.
+type MsgpackEncoder struct{}
+
+func (MsgpackEncoder) Encode(v any) ([]byte, string, error) {
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, msgpackHandle).Encode(v); err != nil {
+		return nil, "", fmt.Errorf("failed to encode MessagePack: %w", err)
+	}
+	return data, msgpackContentType, nil
+}
+
+// ProtoEncoder encodes protocol buffer messages. Values must implement
+// proto.Message.
+type ProtoEncoder struct{}
+
+func (ProtoEncoder) Encode(v any) ([]byte, string, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, "", fmt.Errorf("failed to encode protobuf: %T is not a proto.Message", v)
+	}
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode protobuf: %w", err)
+	}
+	return data, protobufContentType, nil
+}
+
+// Decoder deserializes received message bodies for TypedHandler.
+type Decoder interface {
+	Decode(data []byte, contentType string, v any) error
+}
+
+// JSONDecoder decodes bodies with encoding/json.
+type JSONDecoder struct{}
+
+func (JSONDecoder) Decode(data []byte, _ string, v any) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	return nil
+}
+
+// MsgpackDecoder decodes MessagePack bodies.
+type MsgpackDecoder struct{}
+
+func (MsgpackDecoder) Decode(data []byte, _ string, v any) error {
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode MessagePack: %w", err)
+	}
+	return nil
+}
+
+// ProtoDecoder decodes protocol buffer bodies into a proto.Message.
+type ProtoDecoder struct{}
+
+func (ProtoDecoder) Decode(data []byte, _ string, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("failed to decode protobuf: %T is not a proto.Message", v)
+	}
+	if err := proto.Unmarshal(data, m); err != nil {
+		return fmt.Errorf("failed to decode protobuf: %w", err)
+	}
+	return nil
+}
+
+// ErrUnknownContentType is returned by decoders for content types they do
+// not handle, so that the next of the subscriber's fallback decoders is
+// tried.
+var ErrUnknownContentType = errors.New("unknown content type")
+
+// TextDecoder decodes bodies with a text/* content type, or none, into a
+// *string or *[]byte as they are.
+type TextDecoder struct{}
+
+func (TextDecoder) Decode(data []byte, contentType string, v any) error {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if mediaType = strings.TrimSpace(strings.ToLower(mediaType)); mediaType != "" && !strings.HasPrefix(mediaType, "text/") {
+		return fmt.Errorf("failed to decode text: %w %q", ErrUnknownContentType, contentType)
+	}
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+	case *[]byte:
+		*v = slices.Clone(data)
+	default:
+		return fmt.Errorf("failed to decode text: %T is not a *string or *[]byte", v)
+	}
+	return nil
+}
+
+// fallbackDecoder tries each of its decoders in order until one succeeds.
+type fallbackDecoder []Decoder
+
+func (d fallbackDecoder) Decode(data []byte, contentType string, v any) error {
+	errs := make([]error, 0, len(d))
+	for _, decoder := range d {
+		err := decoder.Decode(data, contentType, v)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ContentTypeDecoder picks the built-in decoder matching the content type
+// set by the built-in encoders, using JSON for any other content type. It is
+// the default Decoder.
+type ContentTypeDecoder struct{}
+
+func (ContentTypeDecoder) Decode(data []byte, contentType string, v any) error {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(strings.ToLower(mediaType)) {
+	case msgpackContentType, "application/x-msgpack":
+		return MsgpackDecoder{}.Decode(data, contentType, v)
+	case protobufContentType, "application/protobuf":
+		return ProtoDecoder{}.Decode(data, contentType, v)
+	default:
+		return JSONDecoder{}.Decode(data, contentType, v)
+	}
+}
+
+// DeserializationErrorPolicy selects how TypedHandler settles messages it
+// cannot decode.
+type DeserializationErrorPolicy int
+
+const (
+	// DeserializationDeadLetter dead-letters the message with reason
+	// "DeserializationFailed". It is the default.
+	DeserializationDeadLetter DeserializationErrorPolicy = iota
+	// DeserializationAbandon abandons the message for redelivery, e.g. when
+	// a newer decoder is being rolled out.
+	DeserializationAbandon
+	// DeserializationSkip accepts the message without calling the handler
+	// and logs a warning.
+	DeserializationSkip
+)
+
+func (p DeserializationErrorPolicy) String() string {
+	switch p {
+	case DeserializationDeadLetter:
+		return "dead-letter"
+	case DeserializationAbandon:
+		return "abandon"
+	case DeserializationSkip:
+		return "skip"
+	default:
+		return fmt.Sprintf("DeserializationErrorPolicy(%d)", int(p))
+	}
+}
+
+// decoding holds the settings the subscriber passes to TypedHandler in the
+// handler's context.
+type decoding struct {
+	decoder Decoder
+	policy  DeserializationErrorPolicy
+	logger  *slog.Logger
+}
+
+type decodingContextKey struct{}
+
+// decodingFrom returns the decoding settings the subscriber passed in ctx.
+func decodingFrom(ctx context.Context) decoding {
+	if d, ok := ctx.Value(decodingContextKey{}).(decoding); ok {
+		return d
+	}
+	return decoding{decoder: ContentTypeDecoder{}, logger: slog.Default()}
+}
+
+// TypedHandler returns a MessageHandler that decodes each message body into
+// a T with the subscriber's Decoder before calling fn. When T is a pointer
+// type, a new value is allocated for it. Messages that cannot be decoded are
+// settled according to the subscriber's DeserializationErrorPolicy.
+func TypedHandler[T any](fn func(ctx context.Context, v T) error) MessageHandler {
+	return func(ctx context.Context, msg *amqp.Message) error {
+		var v T
+		target := any(&v)
+		if t := reflect.TypeFor[T](); t.Kind() == reflect.Pointer {
+			v = reflect.New(t.Elem()).Interface().(T)
+			target = v
+		}
+
+		var contentType string
+		if msg.Properties != nil && msg.Properties.ContentType != nil {
+			contentType = *msg.Properties.ContentType
+		}
+		d := decodingFrom(ctx)
+		if err := d.decoder.Decode(msg.GetData(), contentType, target); err != nil {
+			switch d.policy {
+			case DeserializationAbandon:
+				return Abandon(err)
+			case DeserializationSkip:
+				d.logger.WarnContext(ctx, "skipping message that cannot be decoded", "message_id", messageIDOf(msg), "error", err)
+				return nil
+			default:
+				return DeadLetter(decodeFailedReason, err.Error())
+			}
+		}
+		return fn(ctx, v)
+	}
+}
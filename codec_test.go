@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestTextDecoder(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		wantErr     error
+	}{
+		{name: "no content type"},
+		{name: "plain text", contentType: "text/plain"},
+		{name: "with parameters", contentType: "Text/CSV; charset=utf-8"},
+		{name: "not text", contentType: "application/json", wantErr: ErrUnknownContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			err := TextDecoder{}.Decode([]byte("hello"), tt.contentType, &got)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Decode = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != "hello" {
+				t.Errorf("decoded %q, want hello", got)
+			}
+		})
+	}
+
+	var n int
+	if err := (TextDecoder{}).Decode([]byte("1"), "text/plain", &n); err == nil {
+		t.Error("decoded text into an int")
+	}
+}
+
+func TestDecoderFallbacks(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		fallbacks   []Decoder
+		want        string
+		wantOutcome string
+	}{
+		{name: "primary decodes", body: `"json"`, contentType: "application/json", fallbacks: []Decoder{TextDecoder{}}, want: "json", wantOutcome: "accepted"},
+		{name: "fallback decodes", body: "plain", contentType: "text/plain", fallbacks: []Decoder{TextDecoder{}}, want: "plain", wantOutcome: "accepted"},
+		{name: "no fallback", body: "plain", contentType: "text/plain", wantOutcome: "rejected"},
+		{name: "every decoder fails", body: "plain", contentType: "application/octet-stream", fallbacks: []Decoder{TextDecoder{}}, wantOutcome: "rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			decoded := make(chan string, 1)
+			s := newBrokerSubscriber(t, config, WithDecoderFallbacks(tt.fallbacks...),
+				WithHandler(TypedHandler(func(ctx context.Context, v string) error {
+					decoded <- v
+					return nil
+				})))
+			listenInBackground(t, s)
+
+			msg := amqp.NewMessage([]byte(tt.body))
+			msg.Properties = &amqp.MessageProperties{ContentType: &tt.contentType}
+			b.send(config.SubscriptionPath(), msg)
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.wantOutcome {
+				t.Fatalf("outcome = %q, want %q", got.Outcome, tt.wantOutcome)
+			}
+			if tt.want != "" {
+				if v := <-decoded; v != tt.want {
+					t.Errorf("decoded %q, want %q", v, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// codecOrder is the value the codec round-trip tests encode.
+type codecOrder struct {
+	ID    string
+	Items []string
+	Total float64
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name            string
+		encoder         Encoder
+		decoder         Decoder
+		value           any
+		target          func() any
+		wantContentType string
+	}{
+		{name: "JSON", encoder: JSONEncoder{}, decoder: JSONDecoder{}, wantContentType: jsonContentType,
+			value: &codecOrder{ID: "o1", Items: []string{"a", "b"}, Total: 9.5}, target: func() any { return &codecOrder{} }},
+		{name: "MessagePack", encoder: MsgpackEncoder{}, decoder: MsgpackDecoder{}, wantContentType: msgpackContentType,
+			value: &codecOrder{ID: "o1", Items: []string{"a", "b"}, Total: 9.5}, target: func() any { return &codecOrder{} }},
+		{name: "protobuf", encoder: ProtoEncoder{}, decoder: ProtoDecoder{}, wantContentType: protobufContentType,
+			value: wrapperspb.String("o1"), target: func() any { return &wrapperspb.StringValue{} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), WithEncoder(tt.encoder))
+			if err := p.PublishTyped(context.Background(), tt.value, nil); err != nil {
+				t.Fatalf("PublishTyped: %v", err)
+			}
+			sent := b.receivedAt("topic")
+			if len(sent) != 1 {
+				t.Fatalf("broker received %d messages, want 1", len(sent))
+			}
+			var contentType string
+			if props := sent[0].Properties; props != nil && props.ContentType != nil {
+				contentType = *props.ContentType
+			}
+			if contentType != tt.wantContentType {
+				t.Errorf("content type = %q, want %q", contentType, tt.wantContentType)
+			}
+
+			for _, decoder := range []Decoder{tt.decoder, ContentTypeDecoder{}} {
+				got := tt.target()
+				if err := decoder.Decode(sent[0].GetData(), contentType, got); err != nil {
+					t.Fatalf("%T.Decode: %v", decoder, err)
+				}
+				if m, ok := got.(proto.Message); ok {
+					if !proto.Equal(m, tt.value.(proto.Message)) {
+						t.Errorf("%T decoded %v, want %v", decoder, got, tt.value)
+					}
+				} else if !reflect.DeepEqual(got, tt.value) {
+					t.Errorf("%T decoded %+v, want %+v", decoder, got, tt.value)
+				}
+			}
+		})
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	type order struct {
+		ID string
+	}
+	tests := []struct {
+		name            string
+		encoder         Encoder
+		value           any
+		want            []byte
+		wantContentType string
+		wantErr         bool
+	}{
+		{name: "JSON", encoder: JSONEncoder{}, value: order{ID: "o1"}, want: []byte(`{"ID":"o1"}`), wantContentType: "application/json"},
+		{name: "JSON unsupported value", encoder: JSONEncoder{}, value: make(chan int), wantErr: true},
+		// A fixmap of one entry, "ID" to "o1", as fixstrs.
+		{name: "MessagePack", encoder: MsgpackEncoder{}, value: order{ID: "o1"}, want: []byte{0x81, 0xa2, 'I', 'D', 0xa2, 'o', '1'}, wantContentType: "application/msgpack"},
+		// Field 1, length-delimited, of 2 bytes.
+		{name: "protobuf", encoder: ProtoEncoder{}, value: wrapperspb.String("o1"), want: []byte{0x0a, 0x02, 'o', '1'}, wantContentType: "application/x-protobuf"},
+		{name: "protobuf of a non-message", encoder: ProtoEncoder{}, value: order{ID: "o1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, contentType, err := tt.encoder.Encode(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Encode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) || contentType != tt.wantContentType {
+				t.Errorf("Encode() = %x, %q, want %x, %q", got, contentType, tt.want, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestDeserializationErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      DeserializationErrorPolicy
+		wantOutcome string
+		wantReason  any
+	}{
+		{name: "dead-letter", policy: DeserializationDeadLetter, wantOutcome: "rejected", wantReason: decodeFailedReason},
+		{name: "abandon", policy: DeserializationAbandon, wantOutcome: "modified"},
+		{name: "skip", policy: DeserializationSkip, wantOutcome: "accepted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			var calls atomic.Int32
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.DeserializationErrorPolicy = tt.policy },
+				WithHandler(TypedHandler(func(ctx context.Context, v struct{ Name string }) error {
+					calls.Add(1)
+					return nil
+				})),
+			)
+			listenInBackground(t, s)
+
+			msg := amqp.NewMessage([]byte(`{"name":`))
+			msg.Properties = &amqp.MessageProperties{ContentType: ptr("application/json")}
+			b.send(config.SubscriptionPath(), msg)
+
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.wantOutcome {
+				t.Errorf("outcome = %q, want %q", got.Outcome, tt.wantOutcome)
+			}
+			if got.Info["DeadLetterReason"] != tt.wantReason {
+				t.Errorf("DeadLetterReason = %v, want %v", got.Info["DeadLetterReason"], tt.wantReason)
+			}
+			if n := calls.Load(); n != 0 {
+				t.Errorf("handler called %d times, want 0", n)
+			}
+		})
+	}
+}
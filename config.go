@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	brokerUrlVariable        = "ASB_BROKER_URL"
+	accessKeyNameVariable    = "ASB_ACCESS_KEY_NAME"
+	accessKeyVariable        = "ASB_ACCESS_KEY"
+	topicVariable            = "ASB_TOPIC"
+	subscriptionNameVariable = "ASB_SUBSCRIPTION"
+	connectionStringVariable = "ASB_CONNECTION_STRING"
+	authModeVariable         = "ASB_AUTH_MODE"
+	concurrencyVariable      = "ASB_CONCURRENCY"
+	prefetchCountVariable    = "ASB_PREFETCH_COUNT"
+	sessionEnabledVariable   = "ASB_SESSION_ENABLED"
+	warmStandbyVariable      = "ASB_WARM_STANDBY"
+	secondaryConnVariable    = "ASB_SECONDARY_CONNECTION_STRING"
+	sessionIDVariable        = "ASB_SESSION_ID"
+	tlsCACertVariable        = "ASB_TLS_CA_CERT"
+	tlsClientCertVariable    = "ASB_TLS_CLIENT_CERT"
+	tlsClientKeyVariable     = "ASB_TLS_CLIENT_KEY"
+	tlsClientCertPEMVariable = "ASB_TLS_CLIENT_CERT_PEM"
+	tlsClientKeyPEMVariable  = "ASB_TLS_CLIENT_KEY_PEM"
+	listenAddrVariable       = "ASB_LISTEN_ADDR"
+	shutdownTimeoutVariable  = "ASB_SHUTDOWN_TIMEOUT"
+	configFileVariable       = "ASB_CONFIG_FILE"
+	proxyURLVariable         = "ASB_PROXY_URL"
+	transportVariable        = "ASB_TRANSPORT"
+	amqpFrameLogVariable     = "AMQP_FRAME_LOG"
+
+	defaultListenAddr      = ":8080"
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// AuthMode selects how the application authenticates against Service Bus.
+type AuthMode string
+
+const (
+	// AuthModeSAS authenticates with a shared access policy name and key.
+	AuthModeSAS AuthMode = "sas"
+	// AuthModeAAD authenticates with an Azure AD token obtained from
+	// azidentity.DefaultAzureCredential and sent over the CBS link.
+	AuthModeAAD AuthMode = "aad"
+)
+
+type AmqpConfig struct {
+	// ConnectionString is the broker URL to dial. When empty it is assembled
+	// from BrokerURL and, in SAS mode, the access key.
+	ConnectionString string `yaml:"connectionString"`
+	// BrokerURL is the Service Bus FQDN. In AAD mode it is also used to build
+	// the token audience of each entity.
+	BrokerURL     string `yaml:"brokerUrl"`
+	AccessKeyName string `yaml:"accessKeyName"`
+	// AccessKey is the raw SAS key; it is URL-encoded when the connection
+	// string is assembled.
+	AccessKey    string `yaml:"accessKey"`
+	Topic        string `yaml:"topic"`
+	Subscription string `yaml:"subscription"`
+
+	AuthMode AuthMode `yaml:"authMode"`
+	// Credential provides the Azure AD tokens in AAD mode.
+	Credential azcore.TokenCredential `yaml:"-"`
+
+	// Concurrency is the number of messages the subscriber handles in
+	// parallel. Values above 1 give up FIFO processing order.
+	Concurrency int `yaml:"concurrency"`
+	// PrefetchCount is the link credit of the receiver: how many unsettled
+	// messages the broker may push ahead of processing. Defaults to 1; values
+	// of 50-200 are recommended for throughput in production. The credit is
+	// never lower than what the workers and dispatch buffer can hold.
+	PrefetchCount uint32 `yaml:"prefetchCount"`
+
+	// SessionEnabled receives from a session-enabled subscription, handling
+	// the messages of the locked session one at a time and in order.
+	SessionEnabled bool `yaml:"sessionEnabled"`
+	// SessionID is the session to lock. When empty, the broker assigns the
+	// next available session.
+	SessionID string `yaml:"sessionId"`
+
+	// WarmStandby keeps an idle connection open to the broker at
+	// SecondaryConnectionString, which the publisher switches to without
+	// dialing when its connection to the primary broker is lost.
+	WarmStandby               bool   `yaml:"warmStandby"`
+	SecondaryConnectionString string `yaml:"secondaryConnectionString"`
+
+	// TLSCACertFile is a PEM bundle of CAs trusted instead of the system roots.
+	TLSCACertFile string `yaml:"tlsCaCert"`
+	// TLSClientCertFile and TLSClientKeyFile are a PEM client key pair
+	// presented to brokers that require client certificates.
+	TLSClientCertFile string `yaml:"tlsClientCert"`
+	TLSClientKeyFile  string `yaml:"tlsClientKey"`
+	// TLSClientCert and TLSClientKey are the same key pair given as PEM
+	// text, for deployments that mount secrets as environment variables
+	// rather than files. They cannot be combined with the file fields.
+	TLSClientCert string `yaml:"tlsClientCertPem"`
+	TLSClientKey  string `yaml:"tlsClientKeyPem"`
+
+	// ProxyURL is an HTTP or HTTPS proxy the broker connections are tunneled
+	// through with CONNECT. Credentials in the URL are sent as Basic
+	// proxy authorization. In a config file it is given as a string.
+	ProxyURL *url.URL `yaml:"-"`
+	// Transport carries AMQP over TCP, the default, or over a WebSocket.
+	Transport Transport `yaml:"transport"`
+	// AMQPFrameLog logs the bytes of every AMQP frame sent to and received
+	// from the broker as hex dumps at LevelTrace, for debugging broker
+	// compatibility. Dumps include SASL credentials and message bodies.
+	AMQPFrameLog bool `yaml:"amqpFrameLog"`
+
+	// ListenAddr is the address of the HTTP server. Defaults to ":8080".
+	ListenAddr string `yaml:"listenAddr"`
+	// ShutdownTimeout bounds how long shutdown waits for in-flight messages
+	// and HTTP requests to complete. Defaults to 5s.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// SubscriptionPath returns the entity path of the subscription.
+func (c AmqpConfig) SubscriptionPath() string {
+	return fmt.Sprintf("%s/subscriptions/%s", c.Topic, c.Subscription)
+}
+
+// ConfigSource supplies configuration values. Apply only sets the fields the
+// source has a value for, leaving the others as they are.
+type ConfigSource interface {
+	Apply(config *AmqpConfig) error
+}
+
+// setting describes one configuration field and how it is named in each
+// source: key is the config file key and the flag name, variable the
+// environment variable. Boolean settings are set by a flag without a value.
+type setting struct {
+	key      string
+	flag     string
+	variable string
+	usage    string
+	set      func(config *AmqpConfig, value string) error
+	boolean  bool
+}
+
+func stringSetting(key, flagName, variable, usage string, field func(*AmqpConfig) *string) setting {
+	return setting{key: key, flag: flagName, variable: variable, usage: usage, set: func(config *AmqpConfig, value string) error {
+		*field(config) = value
+		return nil
+	}}
+}
+
+func boolSetting(key, flagName, variable, usage string, field func(*AmqpConfig) *bool) setting {
+	return setting{key: key, flag: flagName, variable: variable, usage: usage, boolean: true, set: func(config *AmqpConfig, value string) error {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be a boolean, got %q", value)
+		}
+		*field(config) = enabled
+		return nil
+	}}
+}
+
+var settings = []setting{
+	stringSetting("connectionString", "connection-string", connectionStringVariable, "full connection string",
+		func(c *AmqpConfig) *string { return &c.ConnectionString }),
+	stringSetting("brokerUrl", "broker-url", brokerUrlVariable, "Service Bus FQDN",
+		func(c *AmqpConfig) *string { return &c.BrokerURL }),
+	stringSetting("accessKeyName", "access-key-name", accessKeyNameVariable, "SAS policy name",
+		func(c *AmqpConfig) *string { return &c.AccessKeyName }),
+	stringSetting("accessKey", "access-key", accessKeyVariable, "SAS policy key",
+		func(c *AmqpConfig) *string { return &c.AccessKey }),
+	stringSetting("topic", "topic", topicVariable, "topic name",
+		func(c *AmqpConfig) *string { return &c.Topic }),
+	stringSetting("subscription", "subscription", subscriptionNameVariable, "subscription name under the topic",
+		func(c *AmqpConfig) *string { return &c.Subscription }),
+	{key: "authMode", flag: "auth-mode", variable: authModeVariable, usage: `"sas" or "aad"`, set: func(c *AmqpConfig, v string) error {
+		c.AuthMode = AuthMode(v)
+		return nil
+	}},
+	{key: "concurrency", flag: "concurrency", variable: concurrencyVariable, usage: "messages handled in parallel", set: func(c *AmqpConfig, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("must be a positive integer, got %q", v)
+		}
+		c.Concurrency = n
+		return nil
+	}},
+	{key: "prefetchCount", flag: "prefetch-count", variable: prefetchCountVariable, usage: "receiver link credit", set: func(c *AmqpConfig, v string) error {
+		n, err := strconv.ParseUint(v, 10, 31)
+		if err != nil || n < 1 {
+			return fmt.Errorf("must be a positive integer, got %q", v)
+		}
+		c.PrefetchCount = uint32(n)
+		return nil
+	}},
+	boolSetting("sessionEnabled", "session-enabled", sessionEnabledVariable, "receive from a session-enabled subscription",
+		func(c *AmqpConfig) *bool { return &c.SessionEnabled }),
+	stringSetting("sessionId", "session-id", sessionIDVariable, "session to lock",
+		func(c *AmqpConfig) *string { return &c.SessionID }),
+	boolSetting("warmStandby", "warm-standby", warmStandbyVariable, "keep an idle connection to the secondary broker",
+		func(c *AmqpConfig) *bool { return &c.WarmStandby }),
+	stringSetting("secondaryConnectionString", "secondary-connection-string", secondaryConnVariable, "connection string of the standby broker",
+		func(c *AmqpConfig) *string { return &c.SecondaryConnectionString }),
+	stringSetting("tlsCaCert", "tls-ca-cert", tlsCACertVariable, "PEM bundle of trusted CAs",
+		func(c *AmqpConfig) *string { return &c.TLSCACertFile }),
+	stringSetting("tlsClientCert", "tls-client-cert", tlsClientCertVariable, "PEM client certificate file",
+		func(c *AmqpConfig) *string { return &c.TLSClientCertFile }),
+	stringSetting("tlsClientKey", "tls-client-key", tlsClientKeyVariable, "PEM client key file",
+		func(c *AmqpConfig) *string { return &c.TLSClientKeyFile }),
+	stringSetting("tlsClientCertPem", "tls-client-cert-pem", tlsClientCertPEMVariable, "PEM client certificate text",
+		func(c *AmqpConfig) *string { return &c.TLSClientCert }),
+	stringSetting("tlsClientKeyPem", "tls-client-key-pem", tlsClientKeyPEMVariable, "PEM client key text",
+		func(c *AmqpConfig) *string { return &c.TLSClientKey }),
+	{key: "proxyUrl", flag: "proxy-url", variable: proxyURLVariable, usage: "HTTP proxy for broker connections", set: func(c *AmqpConfig, v string) error {
+		u, err := parseProxyURL(v)
+		if err != nil {
+			return err
+		}
+		c.ProxyURL = u
+		return nil
+	}},
+	{key: "transport", flag: "transport", variable: transportVariable, usage: `"tcp" or "websocket"`, set: func(c *AmqpConfig, v string) error {
+		c.Transport = Transport(v)
+		return nil
+	}},
+	boolSetting("amqpFrameLog", "amqp-frame-log", amqpFrameLogVariable, "log AMQP frames as hex dumps at trace level",
+		func(c *AmqpConfig) *bool { return &c.AMQPFrameLog }),
+	stringSetting("listenAddr", "listen-addr", listenAddrVariable, "HTTP listen address",
+		func(c *AmqpConfig) *string { return &c.ListenAddr }),
+	{key: "shutdownTimeout", flag: "shutdown-timeout", variable: shutdownTimeoutVariable, usage: "time to drain in-flight work on shutdown, e.g. 30s", set: func(c *AmqpConfig, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("must be a positive duration, got %q", v)
+		}
+		c.ShutdownTimeout = d
+		return nil
+	}},
+}
+
+// describeSetting names the field with key in all the ways it can be set.
+func describeSetting(key string) string {
+	for _, s := range settings {
+		if s.key == key {
+			return fmt.Sprintf("%s (--%s, %s)", s.key, s.flag, s.variable)
+		}
+	}
+	return key
+}
+
+// EnvConfigSource reads the ASB_* environment variables.
+type EnvConfigSource struct{}
+
+func (EnvConfigSource) Apply(config *AmqpConfig) error {
+	for _, s := range settings {
+		v := os.Getenv(s.variable)
+		if v == "" {
+			continue
+		}
+		if err := s.set(config, v); err != nil {
+			return fmt.Errorf("environment variable %s %w", s.variable, err)
+		}
+	}
+	return nil
+}
+
+// FlagConfigSource reads command-line flags named after the settings, e.g.
+// --broker-url. Only flags given on the command line are applied.
+type FlagConfigSource struct {
+	values map[string]string
+}
+
+// NewFlagConfigSource defines a flag for every setting on fs. Apply must be
+// called after fs is parsed.
+func NewFlagConfigSource(fs *flag.FlagSet) *FlagConfigSource {
+	s := &FlagConfigSource{values: make(map[string]string)}
+	for _, setting := range settings {
+		record := func(v string) error {
+			s.values[setting.flag] = v
+			return nil
+		}
+		if setting.boolean {
+			fs.BoolFunc(setting.flag, setting.usage, record)
+		} else {
+			fs.Func(setting.flag, setting.usage, record)
+		}
+	}
+	return s
+}
+
+func (s *FlagConfigSource) Apply(config *AmqpConfig) error {
+	for _, setting := range settings {
+		v, ok := s.values[setting.flag]
+		if !ok {
+			continue
+		}
+		if err := setting.set(config, v); err != nil {
+			return fmt.Errorf("flag --%s %w", setting.flag, err)
+		}
+	}
+	return nil
+}
+
+// FileConfigSource reads a YAML or JSON file whose keys match the yaml tags of
+// AmqpConfig. Unknown keys are rejected.
+type FileConfigSource struct {
+	Path string
+}
+
+func (s FileConfigSource) Apply(config *AmqpConfig) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	// ProxyURL is not a plain string, so it is decoded alongside the other
+	// fields and parsed separately.
+	file := struct {
+		AmqpConfig `yaml:",inline"`
+		ProxyURL   string `yaml:"proxyUrl"`
+	}{AmqpConfig: *config}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", s.Path, err)
+	}
+	if file.ProxyURL != "" {
+		u, err := parseProxyURL(file.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("config file %s: proxyUrl %w", s.Path, err)
+		}
+		file.AmqpConfig.ProxyURL = u
+	}
+	*config = file.AmqpConfig
+	return nil
+}
+
+// MountedConfigMapSource reads a Kubernetes ConfigMap mounted as a volume:
+// a directory holding one file per key, named after the environment
+// variable of the setting, such as ASB_TOPIC, with the value as content. A
+// trailing line break is trimmed. Files that name no setting, and the
+// hidden ".." entries Kubernetes uses for atomic updates, are ignored.
+type MountedConfigMapSource struct {
+	Dir string
+}
+
+func (s MountedConfigMapSource) Apply(config *AmqpConfig) error {
+	for _, setting := range settings {
+		path := filepath.Join(s.Dir, setting.variable)
+		content, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read config map key %s: %w", setting.variable, err)
+		}
+		if err := setting.set(config, strings.TrimRight(string(content), "\r\n")); err != nil {
+			return fmt.Errorf("config map key %s %w", setting.variable, err)
+		}
+	}
+	return nil
+}
+
+// LoadConfigFromMountedConfigMap loads the configuration from the
+// ConfigMap mounted at mountPath alone, as described for
+// MountedConfigMapSource.
+func LoadConfigFromMountedConfigMap(mountPath string) (AmqpConfig, error) {
+	info, err := os.Stat(mountPath)
+	if err != nil {
+		return AmqpConfig{}, fmt.Errorf("failed to read config map: %w", err)
+	}
+	if !info.IsDir() {
+		return AmqpConfig{}, fmt.Errorf("config map mount %s is not a directory", mountPath)
+	}
+	return LoadConfig(MountedConfigMapSource{Dir: mountPath})
+}
+
+// parseProxyURL parses an http:// or https:// proxy URL.
+func parseProxyURL(v string) (*url.URL, error) {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("must be an http or https URL, got %q", v)
+	}
+	return u, nil
+}
+
+// LoadConfig applies sources in order over the defaults, so later sources
+// override earlier ones, then validates the result. The connection string is
+// assembled here when not given.
+func LoadConfig(sources ...ConfigSource) (AmqpConfig, error) {
+	config := AmqpConfig{
+		AuthMode:        AuthModeSAS,
+		Transport:       TransportTCP,
+		Concurrency:     1,
+		PrefetchCount:   1,
+		ListenAddr:      defaultListenAddr,
+		ShutdownTimeout: defaultShutdownTimeout,
+	}
+	for _, source := range sources {
+		if err := source.Apply(&config); err != nil {
+			return AmqpConfig{}, err
+		}
+	}
+
+	config.AuthMode = AuthMode(strings.ToLower(string(config.AuthMode)))
+	config.Transport = Transport(strings.ToLower(string(config.Transport)))
+	if missing := missingSettings(config); len(missing) > 0 {
+		return AmqpConfig{}, fmt.Errorf("missing required configuration: %s", strings.Join(missing, ", "))
+	}
+	if config.Concurrency < 1 {
+		return AmqpConfig{}, fmt.Errorf("concurrency must be a positive integer, got %d", config.Concurrency)
+	}
+	if config.PrefetchCount < 1 {
+		return AmqpConfig{}, fmt.Errorf("prefetchCount must be a positive integer, got %d", config.PrefetchCount)
+	}
+	if config.ShutdownTimeout <= 0 {
+		return AmqpConfig{}, fmt.Errorf("shutdownTimeout must be a positive duration, got %s", config.ShutdownTimeout)
+	}
+	if config.SessionID != "" {
+		config.SessionEnabled = true
+	}
+
+	switch config.AuthMode {
+	case AuthModeSAS:
+	case AuthModeAAD:
+		credential, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return AmqpConfig{}, fmt.Errorf("failed to create Azure AD credential: %w", err)
+		}
+		config.Credential = credential
+	default:
+		return AmqpConfig{}, fmt.Errorf("authMode must be %q or %q, got %q", AuthModeSAS, AuthModeAAD, config.AuthMode)
+	}
+
+	if config.Transport != TransportTCP && config.Transport != TransportWebSocket {
+		return AmqpConfig{}, fmt.Errorf("transport must be %q or %q, got %q", TransportTCP, TransportWebSocket, config.Transport)
+	}
+
+	connectionString, err := buildConnectionString(config)
+	if err != nil {
+		return AmqpConfig{}, err
+	}
+	config.ConnectionString = connectionString
+	return config, nil
+}
+
+// missingSettings lists the required fields that are unset. The broker
+// settings needed depend on the auth mode and whether a connection string
+// was given.
+func missingSettings(config AmqpConfig) []string {
+	var missing []string
+	require := func(key, value string) {
+		if value == "" {
+			missing = append(missing, describeSetting(key))
+		}
+	}
+	require("topic", config.Topic)
+	require("subscription", config.Subscription)
+	if config.WarmStandby {
+		require("secondaryConnectionString", config.SecondaryConnectionString)
+	}
+
+	switch {
+	case config.AuthMode == AuthModeAAD:
+		require("brokerUrl", config.BrokerURL)
+	case config.ConnectionString == "":
+		require("brokerUrl", config.BrokerURL)
+		require("accessKeyName", config.AccessKeyName)
+		require("accessKey", config.AccessKey)
+	}
+	return missing
+}
+
+// secondary returns the configuration of the standby broker: config with
+// SecondaryConnectionString dialed instead, and in AAD mode its host as the
+// token audience.
+func (c AmqpConfig) secondary() (AmqpConfig, error) {
+	u, err := url.Parse(c.SecondaryConnectionString)
+	if err != nil || u.Host == "" {
+		return AmqpConfig{}, fmt.Errorf("invalid secondary connection string")
+	}
+	secondary := c
+	secondary.ConnectionString = c.SecondaryConnectionString
+	secondary.BrokerURL = u.Hostname()
+	return secondary, nil
+}
+
+// buildConnectionString returns the URL to dial. An explicit connection
+// string is used as is in SAS mode.
+func buildConnectionString(config AmqpConfig) (string, error) {
+	if config.AuthMode == AuthModeAAD {
+		return fmt.Sprintf("amqps://%s", config.BrokerURL), nil
+	}
+	if config.ConnectionString != "" {
+		return config.ConnectionString, nil
+	}
+	return BuildAMQPSConnectionString(config.BrokerURL, config.AccessKeyName, config.AccessKey)
+}
+
+// BuildAMQPSConnectionString returns the amqps:// URL authenticating to host
+// with a shared access policy. The raw access key name and key are
+// URL-encoded here.
+func BuildAMQPSConnectionString(host, accessKeyName, accessKey string) (string, error) {
+	if host == "" || accessKeyName == "" || accessKey == "" {
+		return "", errors.New("host, access key name and access key must not be empty")
+	}
+	u := url.URL{Scheme: "amqps", User: url.UserPassword(accessKeyName, accessKey), Host: host}
+	return u.String(), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// cloudEventsContentType marks a structured-mode CloudEvent, whose body
+	// is the JSON event including its attributes.
+	cloudEventsContentType = "application/cloudevents+json"
+	// invalidCloudEventReason is the dead-letter reason of messages that
+	// claim to be CloudEvents but cannot be decoded.
+	invalidCloudEventReason = "InvalidCloudEvent"
+)
+
+// CloudEventsEnvelope is a CloudEvents 1.0 event decoded from the JSON
+// format.
+type CloudEventsEnvelope struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            *time.Time      `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	// DataBase64 carries binary data in place of Data.
+	DataBase64 []byte `json:"data_base64,omitempty"`
+}
+
+// HTTPMessage presents a message the way an HTTP callback receives a
+// request: the content type, message ID, correlation ID and application
+// properties become headers.
+type HTTPMessage struct {
+	Method string
+	Header http.Header
+	Body   []byte
+}
+
+// ConversionMiddleware adapts next to a MessageHandler, setting either
+// Envelope.CloudEvent or Envelope.HTTP so next always receives a populated
+// Envelope. Messages with the CloudEvents content type that fail to decode
+// are dead-lettered without calling next.
+func ConversionMiddleware(next EnvelopeHandler) MessageHandler {
+	return func(ctx context.Context, msg *amqp.Message) error {
+		env := WrapEnvelope(msg)
+		if isCloudEvent(env.ContentType) {
+			event, err := decodeCloudEvent(env.Body)
+			if err != nil {
+				return DeadLetter(invalidCloudEventReason, err.Error())
+			}
+			env.CloudEvent = event
+		} else {
+			env.HTTP = httpMessage(env)
+		}
+		return next(ctx, env)
+	}
+}
+
+func isCloudEvent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == cloudEventsContentType
+}
+
+func decodeCloudEvent(body []byte) (*CloudEventsEnvelope, error) {
+	var event CloudEventsEnvelope
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("failed to decode CloudEvent: %w", err)
+	}
+	if event.SpecVersion == "" || event.ID == "" || event.Source == "" || event.Type == "" {
+		return nil, errors.New("CloudEvent is missing one of specversion, id, source or type")
+	}
+	return &event, nil
+}
+
+func httpMessage(env Envelope) *HTTPMessage {
+	header := make(http.Header)
+	if env.ContentType != "" {
+		header.Set("Content-Type", env.ContentType)
+	}
+	if env.MessageID != nil {
+		header.Set("Message-Id", fmt.Sprint(env.MessageID))
+	}
+	if env.CorrelationID != nil {
+		header.Set("Correlation-Id", fmt.Sprint(env.CorrelationID))
+	}
+	for name, value := range env.ApplicationProperties {
+		header.Set(name, fmt.Sprint(value))
+	}
+	return &HTTPMessage{Method: http.MethodPost, Header: header, Body: env.Body}
+}
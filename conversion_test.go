@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestConversionMiddleware(t *testing.T) {
+	const event = `{"specversion":"1.0","id":"e1","source":"/orders","type":"order.created","data":{"order":1}}`
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		wantCloudEvent bool
+		wantReason     string
+	}{
+		{name: "CloudEvent", contentType: cloudEventsContentType, body: event, wantCloudEvent: true},
+		{name: "CloudEvent with charset", contentType: cloudEventsContentType + "; charset=utf-8", body: event, wantCloudEvent: true},
+		{name: "JSON passes through", contentType: "application/json", body: `{"order":1}`},
+		{name: "no content type", body: "plain"},
+		{name: "invalid CloudEvent", contentType: cloudEventsContentType, body: `{"id":"e1"}`, wantReason: invalidCloudEventReason},
+		{name: "malformed CloudEvent", contentType: cloudEventsContentType, body: `{`, wantReason: invalidCloudEventReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := amqp.NewMessage([]byte(tt.body))
+			msg.Properties = &amqp.MessageProperties{MessageID: "m1"}
+			if tt.contentType != "" {
+				msg.Properties.ContentType = &tt.contentType
+			}
+			msg.ApplicationProperties = map[string]any{"tenant": "acme"}
+
+			var got *Envelope
+			err := ConversionMiddleware(func(ctx context.Context, env Envelope) error {
+				got = &env
+				return nil
+			})(context.Background(), msg)
+
+			if tt.wantReason != "" {
+				var decision *SettlementDecision
+				if !errors.As(err, &decision) || decision.Policy != PolicyDeadLetter || decision.Reason != tt.wantReason {
+					t.Fatalf("error = %v, want a dead-letter with reason %s", err, tt.wantReason)
+				}
+				if got != nil {
+					t.Error("handler called with an invalid CloudEvent")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if got == nil {
+				t.Fatal("handler not called")
+			}
+			if tt.wantCloudEvent {
+				if got.CloudEvent == nil || got.HTTP != nil {
+					t.Fatalf("CloudEvent = %v, HTTP = %v, want only a CloudEvent", got.CloudEvent, got.HTTP)
+				}
+				if got.CloudEvent.ID != "e1" || got.CloudEvent.Type != "order.created" || string(got.CloudEvent.Data) != `{"order":1}` {
+					t.Errorf("CloudEvent = %+v", got.CloudEvent)
+				}
+				return
+			}
+			if got.HTTP == nil || got.CloudEvent != nil {
+				t.Fatalf("CloudEvent = %v, HTTP = %v, want only an HTTP message", got.CloudEvent, got.HTTP)
+			}
+			if string(got.HTTP.Body) != tt.body || got.HTTP.Header.Get("Content-Type") != tt.contentType ||
+				got.HTTP.Header.Get("Message-Id") != "m1" || got.HTTP.Header.Get("Tenant") != "acme" {
+				t.Errorf("HTTP message = %+v", got.HTTP)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// defaultMaxTracked bounds the memory used to remember processed sequence
+// numbers above the low watermark.
+const defaultMaxTracked = 10000
+
+// SequenceDeduplicationStore detects redelivered messages by their Service
+// Bus sequence number, which unlike the message ID is unique per entity.
+//
+// It remembers a low watermark, the highest sequence number up to which
+// every number has been processed, and the set of processed numbers above
+// it. Sequence numbers start at 1, so the watermark only advances while
+// numbers are processed without gaps from the first one; as those of a
+// filtered subscription are not contiguous, the set usually holds the most
+// recent ones. Once it holds more than MaxTracked numbers, those marked
+// first are forgotten, so a message redelivered after that many others is
+// processed again. A number is never reported as seen unless it was marked.
+type SequenceDeduplicationStore struct {
+	// MaxTracked is the number of processed sequence numbers remembered
+	// above the low watermark. Defaults to 10000.
+	MaxTracked int
+
+	mu sync.Mutex
+	// watermark is the highest sequence number up to which all are
+	// processed.
+	watermark int64
+	processed map[int64]struct{}
+	// order lists the numbers in processed in the order they were marked,
+	// along with numbers since absorbed by the watermark.
+	order []int64
+}
+
+// NewSequenceDeduplicationStore returns an empty store.
+func NewSequenceDeduplicationStore() *SequenceDeduplicationStore {
+	return &SequenceDeduplicationStore{MaxTracked: defaultMaxTracked, processed: make(map[int64]struct{})}
+}
+
+// Seen reports whether seq has already been marked as processed.
+func (d *SequenceDeduplicationStore) Seen(seq int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seen(seq)
+}
+
+// seen must be called with d.mu held.
+func (d *SequenceDeduplicationStore) seen(seq int64) bool {
+	if seq <= d.watermark {
+		return true
+	}
+	_, ok := d.processed[seq]
+	return ok
+}
+
+// Mark records seq as processed.
+func (d *SequenceDeduplicationStore) Mark(seq int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen(seq) {
+		return
+	}
+	if d.processed == nil {
+		d.processed = make(map[int64]struct{})
+	}
+
+	if seq == d.watermark+1 {
+		d.watermark = seq
+		for {
+			if _, ok := d.processed[d.watermark+1]; !ok {
+				break
+			}
+			delete(d.processed, d.watermark+1)
+			d.watermark++
+		}
+	} else {
+		d.processed[seq] = struct{}{}
+		d.order = append(d.order, seq)
+	}
+
+	maxTracked := d.MaxTracked
+	if maxTracked <= 0 {
+		maxTracked = defaultMaxTracked
+	}
+	for len(d.processed) > maxTracked {
+		delete(d.processed, d.order[0])
+		d.order = d.order[1:]
+	}
+	if len(d.order) > 2*maxTracked {
+		// Drop the numbers absorbed by the watermark.
+		d.order = slices.DeleteFunc(d.order, func(seq int64) bool {
+			_, ok := d.processed[seq]
+			return !ok
+		})
+	}
+}
+
+// Handler wraps next so that messages whose sequence number was already
+// processed are accepted without calling it. A sequence number is only
+// marked once next succeeds, so failed messages are retried when redelivered.
+// Messages without a sequence number are always passed through.
+func (d *SequenceDeduplicationStore) Handler(next MessageHandler) MessageHandler {
+	return func(ctx context.Context, msg *amqp.Message) error {
+		seq, ok := msg.Annotations[sequenceNumberAnnotation].(int64)
+		if !ok {
+			return next(ctx, msg)
+		}
+		if d.Seen(seq) {
+			return nil
+		}
+		if err := next(ctx, msg); err != nil {
+			return err
+		}
+		d.Mark(seq)
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestSequenceDeduplicationStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxTracked int
+		mark       []int64
+		seen       []int64
+		unseen     []int64
+	}{
+		{
+			name:   "first mark leaves lower numbers unseen",
+			mark:   []int64{1000},
+			seen:   []int64{1000},
+			unseen: []int64{1, 999, 1001},
+		},
+		{
+			name:   "in order",
+			mark:   []int64{1, 2, 3},
+			seen:   []int64{1, 2, 3},
+			unseen: []int64{4},
+		},
+		{
+			name:   "out of order",
+			mark:   []int64{3, 1, 5},
+			seen:   []int64{1, 3, 5},
+			unseen: []int64{2, 4, 6},
+		},
+		{
+			name:   "gap filled",
+			mark:   []int64{2, 3, 1, 5, 4},
+			seen:   []int64{1, 2, 3, 4, 5},
+			unseen: []int64{6},
+		},
+		{
+			name:   "redelivery",
+			mark:   []int64{7, 7, 8, 7},
+			seen:   []int64{7, 8},
+			unseen: []int64{6, 9},
+		},
+		{
+			name:       "overflow forgets the oldest marks",
+			maxTracked: 2,
+			mark:       []int64{10, 20, 30, 40},
+			seen:       []int64{30, 40},
+			unseen:     []int64{10, 20, 11, 25},
+		},
+		{
+			name:       "overflow never marks gaps",
+			maxTracked: 2,
+			mark:       []int64{1, 2, 5, 7, 9, 3},
+			seen:       []int64{1, 2, 3, 7, 9},
+			unseen:     []int64{4, 5, 6, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewSequenceDeduplicationStore()
+			if tt.maxTracked != 0 {
+				d.MaxTracked = tt.maxTracked
+			}
+			for _, seq := range tt.mark {
+				d.Mark(seq)
+			}
+			for _, seq := range tt.seen {
+				if !d.Seen(seq) {
+					t.Errorf("Seen(%d) = false, want true", seq)
+				}
+			}
+			for _, seq := range tt.unseen {
+				if d.Seen(seq) {
+					t.Errorf("Seen(%d) = true, want false", seq)
+				}
+			}
+		})
+	}
+}
+
+func TestSequenceDeduplicationStoreBounded(t *testing.T) {
+	d := NewSequenceDeduplicationStore()
+	d.MaxTracked = 100
+	for seq := int64(2); seq < 100_000; seq += 2 {
+		d.Mark(seq)
+	}
+	if len(d.processed) > d.MaxTracked {
+		t.Errorf("tracked %d numbers, want at most %d", len(d.processed), d.MaxTracked)
+	}
+	if len(d.order) > 2*d.MaxTracked {
+		t.Errorf("order holds %d numbers, want at most %d", len(d.order), 2*d.MaxTracked)
+	}
+	for seq := int64(1); seq < 100_000; seq += 2 {
+		if d.Seen(seq) {
+			t.Fatalf("Seen(%d) = true for an unmarked number", seq)
+		}
+	}
+}
+
+func TestSequenceDeduplicationHandler(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	tests := []struct {
+		name      string
+		seqs      []any
+		fail      map[int]bool
+		wantCalls int
+	}{
+		{name: "redelivered after success", seqs: []any{int64(1), int64(1)}, wantCalls: 1},
+		{name: "redelivered after failure", seqs: []any{int64(1), int64(1)}, fail: map[int]bool{0: true}, wantCalls: 2},
+		{name: "out of order", seqs: []any{int64(2), int64(1), int64(2)}, wantCalls: 2},
+		{name: "no sequence number", seqs: []any{nil, nil}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			h := NewSequenceDeduplicationStore().Handler(func(ctx context.Context, msg *amqp.Message) error {
+				calls++
+				if tt.fail[calls-1] {
+					return errHandler
+				}
+				return nil
+			})
+			for _, seq := range tt.seqs {
+				msg := &amqp.Message{Annotations: amqp.Annotations{}}
+				if seq != nil {
+					msg.Annotations[sequenceNumberAnnotation] = seq
+				}
+				if err := h(context.Background(), msg); err != nil && !errors.Is(err, errHandler) {
+					t.Fatalf("handler: %v", err)
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("next called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
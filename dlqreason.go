@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+)
+
+// genericHandlerErrorReason is the dead-letter reason of handler
+// dead-letter decisions without a reason of their own.
+const genericHandlerErrorReason = "GenericHandlerError"
+
+// handlerDecision maps the result of the subscriber's handler to a
+// settlement decision, dead-lettering errors registered in DLQReasonMap.
+func (s *Subscriber) handlerDecision(err error) *SettlementDecision {
+	decision := decisionFor(err)
+	if decision.Policy == PolicyAbandon && decision.Err == err {
+		// A plain error rather than an explicit decision.
+		if reason, ok := dlqReason(s.dlqReasons, err); ok {
+			return &SettlementDecision{Policy: PolicyDeadLetter, Reason: reason, Description: err.Error(), Err: err}
+		}
+	}
+	if decision.Policy == PolicyDeadLetter && decision.Reason == "" {
+		withReason := *decision
+		withReason.Reason = genericHandlerErrorReason
+		return &withReason
+	}
+	return decision
+}
+
+// dlqReason returns the reason registered in reasons for the first error in
+// err's tree that matches a key. An error matches a key it is equal to or
+// whose Is method reports it, and a nil pointer key matches every error of
+// its type.
+func dlqReason(reasons map[error]string, err error) (string, bool) {
+	if len(reasons) == 0 || err == nil {
+		return "", false
+	}
+	for key, reason := range reasons {
+		if matchesKey(err, key) {
+			return reason, true
+		}
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return dlqReason(reasons, e.Unwrap())
+	case interface{ Unwrap() []error }:
+		for _, err := range e.Unwrap() {
+			if reason, ok := dlqReason(reasons, err); ok {
+				return reason, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchesKey reports whether err itself, not its wrapped errors, matches
+// key as described by dlqReason.
+func matchesKey(err, key error) bool {
+	keyType := reflect.TypeOf(key)
+	if keyType == reflect.TypeOf(err) {
+		if keyType.Kind() == reflect.Pointer && reflect.ValueOf(key).IsNil() {
+			return true
+		}
+		if keyType.Comparable() && err == key {
+			return true
+		}
+	}
+	if is, ok := err.(interface{ Is(error) bool }); ok {
+		return is.Is(key)
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+type quotaError struct{ tenant string }
+
+func (e *quotaError) Error() string { return "quota exceeded for " + e.tenant }
+
+var errMalformedOrder = errors.New("malformed order")
+
+func TestDLQReasonMap(t *testing.T) {
+	reasons := map[error]string{
+		(*quotaError)(nil): "QuotaExceeded",
+		errMalformedOrder:  "MalformedOrder",
+	}
+	tests := []struct {
+		name        string
+		err         error
+		wantOutcome string
+		wantReason  any
+		wantDesc    any
+	}{
+		{name: "typed error", err: &quotaError{tenant: "a"}, wantOutcome: "rejected", wantReason: "QuotaExceeded", wantDesc: "quota exceeded for a"},
+		{name: "wrapped typed error", err: fmt.Errorf("handling: %w", &quotaError{tenant: "b"}), wantOutcome: "rejected", wantReason: "QuotaExceeded", wantDesc: "handling: quota exceeded for b"},
+		{name: "joined sentinel", err: errors.Join(errors.New("other"), errMalformedOrder), wantOutcome: "rejected", wantReason: "MalformedOrder"},
+		{name: "unmapped error", err: errors.New("transient"), wantOutcome: "modified"},
+		{name: "dead-letter without reason", err: DeadLetter("", "bad"), wantOutcome: "rejected", wantReason: genericHandlerErrorReason},
+		{name: "explicit decision kept", err: DeadLetter("Custom", "bad"), wantOutcome: "rejected", wantReason: "Custom"},
+		{name: "explicit abandon not mapped", err: Abandon(&quotaError{tenant: "c"}), wantOutcome: "modified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.DLQReasonMap = reasons },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error { return tt.err }),
+			)
+			listenInBackground(t, s)
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("hello")))
+
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.wantOutcome {
+				t.Fatalf("outcome = %q, want %q", got.Outcome, tt.wantOutcome)
+			}
+			if got.Info["DeadLetterReason"] != tt.wantReason {
+				t.Errorf("DeadLetterReason = %v, want %v", got.Info["DeadLetterReason"], tt.wantReason)
+			}
+			if tt.wantDesc != nil && got.Info["DeadLetterErrorDescription"] != tt.wantDesc {
+				t.Errorf("DeadLetterErrorDescription = %v, want %v", got.Info["DeadLetterErrorDescription"], tt.wantDesc)
+			}
+		})
+	}
+}
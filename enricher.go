@@ -0,0 +1,43 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+
+	"github.com/Azure/go-amqp"
+)
+
+// MessageEnricher is called before a received message is settled and
+// returns it, or a copy, with application properties added or changed, e.g.
+// "x-processed-at" or "x-processor-id". The broker only records them on
+// messages that are abandoned, deferred or dead-lettered; accepted messages
+// are removed.
+type MessageEnricher func(msg *amqp.Message) *amqp.Message
+
+// enrich runs the subscriber's enricher on msg and returns decision with the
+// application properties the enricher added or changed merged into its
+// annotations. Annotations already set by the handler take precedence.
+func (s *Subscriber) enrich(msg *amqp.Message, decision *SettlementDecision) *SettlementDecision {
+	if s.enricher == nil {
+		return decision
+	}
+	before := maps.Clone(msg.ApplicationProperties)
+	enriched := s.enricher(msg)
+	if enriched == nil {
+		return decision
+	}
+
+	annotations := make(amqp.Annotations)
+	for name, value := range enriched.ApplicationProperties {
+		if old, ok := before[name]; !ok || !reflect.DeepEqual(old, value) {
+			annotations[name] = value
+		}
+	}
+	if len(annotations) == 0 {
+		return decision
+	}
+	maps.Copy(annotations, decision.Annotations)
+	enrichedDecision := *decision
+	enrichedDecision.Annotations = annotations
+	return &enrichedDecision
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestEnricher(t *testing.T) {
+	tag := func(msg *amqp.Message) *amqp.Message {
+		msg.ApplicationProperties["x-processor-id"] = "worker-1"
+		msg.ApplicationProperties["kind"] = "order"
+		return msg
+	}
+	tests := []struct {
+		name     string
+		enricher MessageEnricher
+		result   error
+		want     brokerState
+		// wantInfo holds the error info expected on a dead-lettered message.
+		wantInfo map[string]any
+	}{
+		{
+			name:     "accepted",
+			enricher: tag,
+			want:     brokerState{Outcome: "accepted"},
+		},
+		{
+			name:     "abandoned",
+			enricher: tag,
+			result:   Abandon(errors.New("retry later")),
+			want:     brokerState{Outcome: "modified", DeliveryFailed: true, Annotations: map[string]any{"x-processor-id": "worker-1"}},
+		},
+		{
+			name:     "deferred",
+			enricher: tag,
+			result:   Defer(),
+			want:     brokerState{Outcome: "modified", UndeliverableHere: true, Annotations: map[string]any{"x-processor-id": "worker-1"}},
+		},
+		{
+			name:     "dead-lettered",
+			enricher: tag,
+			result:   DeadLetter("Invalid", "bad order"),
+			want:     brokerState{Outcome: "rejected", Condition: string(deadLetterCondition)},
+			wantInfo: map[string]any{"x-processor-id": "worker-1", "DeadLetterReason": "Invalid"},
+		},
+		{
+			name:     "enricher returns nil",
+			enricher: func(msg *amqp.Message) *amqp.Message { return nil },
+			result:   Abandon(errors.New("retry later")),
+			want:     brokerState{Outcome: "modified", DeliveryFailed: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			s := newBrokerSubscriber(t, config, WithEnricher(tt.enricher),
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					if redelivered(msg) {
+						return nil
+					}
+					return tt.result
+				}))
+			listenInBackground(t, s)
+
+			msg := amqp.NewMessage([]byte("order"))
+			msg.ApplicationProperties = map[string]any{"kind": "order"}
+			b.send(config.SubscriptionPath(), msg)
+			got := b.waitSettlements(1)[0].State
+
+			if got.Outcome != tt.want.Outcome || got.Condition != tt.want.Condition ||
+				got.DeliveryFailed != tt.want.DeliveryFailed || got.UndeliverableHere != tt.want.UndeliverableHere {
+				t.Errorf("settlement = %+v, want %+v", got, tt.want)
+			}
+			if len(got.Annotations) != len(tt.want.Annotations) {
+				t.Errorf("annotations = %v, want %v", got.Annotations, tt.want.Annotations)
+			}
+			for k, v := range tt.want.Annotations {
+				if got.Annotations[k] != v {
+					t.Errorf("annotation %s = %v, want %v", k, got.Annotations[k], v)
+				}
+			}
+			for k, v := range tt.wantInfo {
+				if got.Info[k] != v {
+					t.Errorf("error info %s = %v, want %v", k, got.Info[k], v)
+				}
+			}
+			if _, ok := got.Info["kind"]; ok {
+				t.Error("unchanged property recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gin-gonic/gin"
+)
+
+// envelopeContextKey is the context key of the Envelope of the message being
+// handled. It is unexported so no other package can set or shadow the value;
+// ContextWithEnvelope and EnvelopeFromContext are the only supported way in
+// and out, in place of an exported well-known key.
+type envelopeContextKey struct{}
+
+// Envelope is a received message in a transport-neutral form, as passed to
+// an EnvelopeHandler.
+type Envelope struct {
+	MessageID     any
+	CorrelationID any
+	ContentType   string
+	Subject       string
+	Body          []byte
+	// ApplicationProperties are the message's custom properties.
+	ApplicationProperties map[string]any
+	// Annotations, DeliveryAnnotations and Footer are the message's
+	// annotation sections, such as the broker's x-opt-* annotations.
+	// Keys other than symbols, which the spec allows as ulongs, are in
+	// their fmt.Sprint form.
+	Annotations         map[string]any
+	DeliveryAnnotations map[string]any
+	Footer              map[string]any
+
+	// CloudEvent is set by ConversionMiddleware when the message is a
+	// structured-mode CloudEvent.
+	CloudEvent *CloudEventsEnvelope
+	// HTTP is set by ConversionMiddleware for any other message.
+	HTTP *HTTPMessage
+
+	// Message is the original AMQP message.
+	Message *amqp.Message
+}
+
+// EnvelopeHandler processes a received message as an Envelope. Its result
+// settles the message like that of a MessageHandler.
+type EnvelopeHandler func(ctx context.Context, env Envelope) error
+
+// WrapEnvelope returns the Envelope of msg.
+func WrapEnvelope(msg *amqp.Message) Envelope {
+	env := Envelope{
+		Body:                  msg.GetData(),
+		ApplicationProperties: msg.ApplicationProperties,
+		Annotations:           annotationsMap(msg.Annotations),
+		DeliveryAnnotations:   annotationsMap(msg.DeliveryAnnotations),
+		Footer:                annotationsMap(msg.Footer),
+		Message:               msg,
+	}
+	if props := msg.Properties; props != nil {
+		env.MessageID = props.MessageID
+		env.CorrelationID = props.CorrelationID
+		if props.ContentType != nil {
+			env.ContentType = *props.ContentType
+		}
+		if props.Subject != nil {
+			env.Subject = *props.Subject
+		}
+	}
+	return env
+}
+
+// annotationsMap returns a copy of annotations keyed by string, or nil when
+// the section is absent.
+func annotationsMap(annotations amqp.Annotations) map[string]any {
+	if annotations == nil {
+		return nil
+	}
+	m := make(map[string]any, len(annotations))
+	for key, value := range annotations {
+		m[fmt.Sprint(key)] = value
+	}
+	return m
+}
+
+// ContextWithEnvelope returns a copy of ctx carrying env. The subscriber sets
+// it on the context passed to handlers.
+func ContextWithEnvelope(ctx context.Context, env Envelope) context.Context {
+	return context.WithValue(ctx, envelopeContextKey{}, env)
+}
+
+// EnvelopeFromContext returns the Envelope carried by ctx. ctx may be the
+// gin.Context of a request built from a handler's context, for handlers that
+// pass the message to an internal HTTP workflow. It is the only supported
+// accessor: the context key is not exported.
+func EnvelopeFromContext(ctx context.Context) (Envelope, bool) {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	env, ok := ctx.Value(envelopeContextKey{}).(Envelope)
+	return env, ok
+}
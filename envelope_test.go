@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gin-gonic/gin"
+)
+
+func TestWrapEnvelope(t *testing.T) {
+	tests := []struct {
+		name                    string
+		msg                     *amqp.Message
+		wantAnnotations         map[string]any
+		wantDeliveryAnnotations map[string]any
+		wantFooter              map[string]any
+	}{
+		{
+			name: "all sections",
+			msg: &amqp.Message{
+				Data:                  [][]byte{[]byte("body")},
+				Properties:            &amqp.MessageProperties{MessageID: "id", Subject: ptr("subject"), ContentType: ptr("text/plain")},
+				ApplicationProperties: map[string]any{"tenant": "a"},
+				Annotations:           amqp.Annotations{"x-opt-enqueued-time": int64(1), uint64(7): "ulong"},
+				DeliveryAnnotations:   amqp.Annotations{"x-opt-lock-token": "token"},
+				Footer:                amqp.Annotations{"checksum": "abc"},
+			},
+			wantAnnotations:         map[string]any{"x-opt-enqueued-time": int64(1), "7": "ulong"},
+			wantDeliveryAnnotations: map[string]any{"x-opt-lock-token": "token"},
+			wantFooter:              map[string]any{"checksum": "abc"},
+		},
+		{
+			name: "no sections",
+			msg:  &amqp.Message{Data: [][]byte{[]byte("body")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := WrapEnvelope(tt.msg)
+			if string(env.Body) != "body" {
+				t.Errorf("Body = %q, want %q", env.Body, "body")
+			}
+			if !reflect.DeepEqual(env.Annotations, tt.wantAnnotations) {
+				t.Errorf("Annotations = %v, want %v", env.Annotations, tt.wantAnnotations)
+			}
+			if !reflect.DeepEqual(env.DeliveryAnnotations, tt.wantDeliveryAnnotations) {
+				t.Errorf("DeliveryAnnotations = %v, want %v", env.DeliveryAnnotations, tt.wantDeliveryAnnotations)
+			}
+			if !reflect.DeepEqual(env.Footer, tt.wantFooter) {
+				t.Errorf("Footer = %v, want %v", env.Footer, tt.wantFooter)
+			}
+			if props := tt.msg.Properties; props != nil {
+				if env.MessageID != props.MessageID || env.Subject != *props.Subject || env.ContentType != *props.ContentType {
+					t.Errorf("envelope properties = %v, %q, %q, want those of %+v", env.MessageID, env.Subject, env.ContentType, props)
+				}
+				if !reflect.DeepEqual(env.ApplicationProperties, tt.msg.ApplicationProperties) {
+					t.Errorf("ApplicationProperties = %v, want %v", env.ApplicationProperties, tt.msg.ApplicationProperties)
+				}
+			}
+		})
+	}
+}
+
+func TestEnvelopeFromContext(t *testing.T) {
+	env := WrapEnvelope(amqp.NewMessage([]byte("body")))
+	withEnvelope := ContextWithEnvelope(context.Background(), env)
+
+	// ginContext passes ctx as the request context to a gin handler and
+	// returns the handler's gin.Context.
+	gin.SetMode(gin.TestMode)
+	ginContext := func(ctx context.Context) context.Context {
+		engine := gin.New()
+		var got context.Context
+		engine.GET("/", func(c *gin.Context) { got = c })
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		engine.ServeHTTP(httptest.NewRecorder(), req)
+		return got
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		wantOK bool
+	}{
+		{name: "with envelope", ctx: withEnvelope, wantOK: true},
+		{name: "without envelope", ctx: context.Background()},
+		{name: "derived context", ctx: context.WithValue(withEnvelope, struct{ k string }{"other"}, 1), wantOK: true},
+		{name: "gin context", ctx: ginContext(withEnvelope), wantOK: true},
+		{name: "gin context without envelope", ctx: ginContext(context.Background())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := EnvelopeFromContext(tt.ctx)
+			if ok != tt.wantOK {
+				t.Fatalf("EnvelopeFromContext() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && string(got.Body) != "body" {
+				t.Errorf("EnvelopeFromContext() body = %q, want %q", got.Body, "body")
+			}
+		})
+	}
+}
+
+func TestHandlerContextEnvelope(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	got := make(chan Envelope, 1)
+	s := newBrokerSubscriber(t, config, WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+		env, ok := EnvelopeFromContext(ctx)
+		if !ok {
+			t.Error("handler context has no envelope")
+		}
+		got <- env
+		return nil
+	}))
+	listenInBackground(t, s)
+
+	msg := amqp.NewMessage([]byte("body"))
+	msg.Properties = &amqp.MessageProperties{MessageID: "m1"}
+	b.send(config.SubscriptionPath(), msg)
+	b.waitSettlements(1)
+	if env := <-got; env.MessageID != "m1" || string(env.Body) != "body" {
+		t.Errorf("envelope = %v, %q, want m1, %q", env.MessageID, env.Body, "body")
+	}
+}
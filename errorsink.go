@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+
+	"github.com/Azure/go-amqp"
+)
+
+// originalTopicProperty is the application property naming the topic a
+// message sent to the error sink was meant for.
+const originalTopicProperty = "x-original-topic"
+
+// sendToErrorSink publishes msg to the error-sink topic after sending it to
+// the publisher's topic failed with sendErr, so the message is not lost
+// along with an error the caller may ignore. The sender is attached on the
+// first failure and reused until its link fails. Failures are only logged.
+func (p *Publisher) sendToErrorSink(ctx context.Context, msg *amqp.Message, sendErr error) {
+	if p.errorSinkTopic == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+	defer cancel()
+
+	logger := p.logger.With("message_id", messageIDOf(msg), "error_sink_topic", p.errorSinkTopic)
+	sender, err := p.errorSinkSender(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to attach error sink sender", "error", err)
+		return
+	}
+	if err := sender.Send(ctx, errorSinkMessage(msg, p.topic), nil); err != nil {
+		logger.ErrorContext(ctx, "failed to send message to error sink", "error", err)
+		if linkFailure(err) {
+			p.dropErrorSink(ctx, sender)
+		}
+		return
+	}
+	logger.WarnContext(ctx, "sent unpublished message to error sink", "publish_error", sendErr)
+}
+
+// errorSinkSender returns the error-sink sender, attaching it on a new
+// session first if there is none.
+func (p *Publisher) errorSinkSender(ctx context.Context) (*amqp.Sender, error) {
+	p.sinkMu.Lock()
+	defer p.sinkMu.Unlock()
+	if p.sinkSender != nil {
+		return p.sinkSender, nil
+	}
+
+	session, err := p.Connection().NewSession(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AMQP session: %w", err)
+	}
+	sender, err := p.attachSender(ctx, session, p.errorSinkTopic)
+	if err != nil {
+		session.Close(ctx)
+		return nil, fmt.Errorf("failed to create AMQP sender: %w", err)
+	}
+	p.sinkSession = session
+	p.sinkSender = sender
+	return sender, nil
+}
+
+// dropErrorSink closes the error-sink sender after its link failed, so the
+// next failure attaches a new one. failed is the sender that observed the
+// error; if another caller already replaced it nothing is done.
+func (p *Publisher) dropErrorSink(ctx context.Context, failed *amqp.Sender) {
+	p.sinkMu.Lock()
+	defer p.sinkMu.Unlock()
+	if p.sinkSender == failed {
+		p.closeErrorSinkLocked(ctx)
+	}
+}
+
+// closeErrorSink closes the error-sink sender and session, if attached.
+func (p *Publisher) closeErrorSink(ctx context.Context) {
+	p.sinkMu.Lock()
+	defer p.sinkMu.Unlock()
+	p.closeErrorSinkLocked(ctx)
+}
+
+// closeErrorSinkLocked must be called with p.sinkMu held.
+func (p *Publisher) closeErrorSinkLocked(ctx context.Context) {
+	if p.sinkSender == nil {
+		return
+	}
+	p.sinkSender.Close(ctx)
+	p.sinkSession.Close(ctx)
+	p.sinkSender, p.sinkSession = nil, nil
+}
+
+// errorSinkMessage copies msg with the originalTopicProperty set to topic,
+// leaving msg unchanged.
+func errorSinkMessage(msg *amqp.Message, topic string) *amqp.Message {
+	properties := maps.Clone(msg.ApplicationProperties)
+	if properties == nil {
+		properties = make(map[string]any, 1)
+	}
+	properties[originalTopicProperty] = topic
+	return &amqp.Message{
+		Format:                msg.Format,
+		Header:                msg.Header,
+		DeliveryAnnotations:   msg.DeliveryAnnotations,
+		Annotations:           msg.Annotations,
+		Properties:            msg.Properties,
+		ApplicationProperties: properties,
+		Data:                  msg.Data,
+		Value:                 msg.Value,
+		Sequence:              msg.Sequence,
+		Footer:                msg.Footer,
+	}
+}
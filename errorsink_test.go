@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestErrorSink(t *testing.T) {
+	publishMessage := func(p *Publisher, msg *amqp.Message) error {
+		return p.PublishMessage(context.Background(), msg)
+	}
+	publishWithReceipt := func(p *Publisher, msg *amqp.Message) error {
+		_, err := p.PublishWithReceipt(context.Background(), msg)
+		return err
+	}
+	tests := []struct {
+		name    string
+		opts    []PublisherOption
+		publish func(p *Publisher, msg *amqp.Message) error
+		count   int
+		// wantErr is the error of the last publish.
+		wantErr  error
+		wantSunk int
+	}{
+		{name: "rejected", publish: publishMessage, count: 1, wantSunk: 1},
+		{name: "rejected with receipt", publish: publishWithReceipt, count: 1, wantSunk: 1},
+		{name: "sender reused", publish: publishMessage, count: 3, wantSunk: 3},
+		{
+			name:     "circuit open",
+			opts:     []PublisherOption{WithCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1})},
+			publish:  publishMessage,
+			count:    2,
+			wantErr:  ErrCircuitOpen,
+			wantSunk: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			b.sendOutcome = func(address string, msg *amqp.Message) brokerState {
+				if address == "topic" {
+					return brokerState{Outcome: "rejected", Condition: "amqp:internal-error"}
+				}
+				return brokerState{Outcome: "accepted"}
+			}
+			p := newBrokerPublisher(t, b.config(), append(tt.opts, func(o *PublisherOptions) { o.ErrorSinkTopic = "errors" })...)
+
+			var err error
+			var sinkSender *amqp.Sender
+			for range tt.count {
+				err = tt.publish(p, &amqp.Message{
+					Data:                  [][]byte{[]byte("payload")},
+					ApplicationProperties: map[string]any{"kind": "test"},
+				})
+				if sinkSender == nil {
+					sinkSender = p.sinkSender
+				} else if p.sinkSender != sinkSender {
+					t.Error("error sink sender attached again")
+				}
+			}
+			if err == nil {
+				t.Fatal("publish succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("publish error = %v, want %v", err, tt.wantErr)
+			}
+
+			sunk := b.receivedAt("errors")
+			if len(sunk) != tt.wantSunk {
+				t.Fatalf("error sink received %d messages, want %d", len(sunk), tt.wantSunk)
+			}
+			for _, msg := range sunk {
+				if got := msg.ApplicationProperties[originalTopicProperty]; got != "topic" {
+					t.Errorf("%s = %v, want topic", originalTopicProperty, got)
+				}
+				if got := msg.ApplicationProperties["kind"]; got != "test" {
+					t.Errorf("kind = %v, want test", got)
+				}
+				if got := string(msg.GetData()); got != "payload" {
+					t.Errorf("body = %q, want payload", got)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorSinkMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties map[string]any
+	}{
+		{"no properties", nil},
+		{"with properties", map[string]any{"kind": "test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &amqp.Message{ApplicationProperties: tt.properties}
+			got := errorSinkMessage(msg, "orders")
+			if got.ApplicationProperties[originalTopicProperty] != "orders" {
+				t.Errorf("%s = %v, want orders", originalTopicProperty, got.ApplicationProperties[originalTopicProperty])
+			}
+			if _, ok := msg.ApplicationProperties[originalTopicProperty]; ok {
+				t.Error("original message modified")
+			}
+			for k, v := range tt.properties {
+				if got.ApplicationProperties[k] != v {
+					t.Errorf("%s = %v, want %v", k, got.ApplicationProperties[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorHandlingStrategy selects what the subscriber does when handling a
+// message fails in a way the handler's result cannot settle, such as a
+// failed settlement. Receive failures always stop StartListening.
+type ErrorHandlingStrategy int
+
+const (
+	// ErrorHandlingStopAll returns the error from StartListening. It is the
+	// default.
+	ErrorHandlingStopAll ErrorHandlingStrategy = iota
+	// ErrorHandlingContinueOnError logs the error and keeps receiving.
+	ErrorHandlingContinueOnError
+	// ErrorHandlingExponentialPause logs the error and pauses receiving,
+	// for 1s after the first error, doubling with each consecutive error up
+	// to 1m. The pause is reset once a message is handled successfully.
+	ErrorHandlingExponentialPause
+)
+
+func (s ErrorHandlingStrategy) String() string {
+	switch s {
+	case ErrorHandlingStopAll:
+		return "stop-all"
+	case ErrorHandlingContinueOnError:
+		return "continue-on-error"
+	case ErrorHandlingExponentialPause:
+		return "exponential-pause"
+	default:
+		return fmt.Sprintf("ErrorHandlingStrategy(%d)", int(s))
+	}
+}
+
+const (
+	minErrorPause = time.Second
+	maxErrorPause = time.Minute
+)
+
+// errorPause tracks the pause of ErrorHandlingExponentialPause.
+type errorPause struct {
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+// failed extends the pause after another consecutive error and returns it.
+func (p *errorPause) failed() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pause := maxErrorPause
+	if p.failures < 6 {
+		pause = min(minErrorPause<<p.failures, maxErrorPause)
+	}
+	p.failures++
+	p.until = time.Now().Add(pause)
+	return pause
+}
+
+// succeeded resets the pause.
+func (p *errorPause) succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = 0
+	p.until = time.Time{}
+}
+
+// wait blocks while receiving is paused or until ctx is done.
+func (p *errorPause) wait(ctx context.Context) error {
+	p.mu.Lock()
+	delay := time.Until(p.until)
+	p.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handled applies the error handling strategy to the result of handling a
+// message, returning the error when receiving must stop.
+func (s *Subscriber) handled(ctx context.Context, err error) error {
+	if err == nil {
+		s.pause.succeeded()
+		return nil
+	}
+	switch s.errorStrategy {
+	case ErrorHandlingContinueOnError:
+		s.logger.ErrorContext(ctx, "failed to handle message, continuing", "error", err)
+		return nil
+	case ErrorHandlingExponentialPause:
+		pause := s.pause.failed()
+		s.logger.ErrorContext(ctx, "failed to handle message, pausing", "error", err, "pause_ms", pause.Milliseconds())
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorHandlingStrategy(t *testing.T) {
+	boom := errors.New("settlement failed")
+	// results are those of handling five messages, of which the second, third
+	// and fifth fail.
+	results := []error{nil, boom, boom, nil, boom}
+	tests := []struct {
+		strategy ErrorHandlingStrategy
+		// wantStop is the index of the result that stops receiving, or -1.
+		wantStop   int
+		wantPauses []time.Duration
+	}{
+		{strategy: ErrorHandlingStopAll, wantStop: 1},
+		{strategy: ErrorHandlingContinueOnError, wantStop: -1},
+		// The pause doubles with consecutive errors and resets after a
+		// success.
+		{strategy: ErrorHandlingExponentialPause, wantStop: -1, wantPauses: []time.Duration{0, time.Second, 2 * time.Second, 0, time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			s := &Subscriber{errorStrategy: tt.strategy, logger: discardLogger()}
+			stopped := -1
+			for i, result := range results {
+				start := time.Now()
+				err := s.handled(context.Background(), result)
+				if tt.wantPauses != nil {
+					s.pause.mu.Lock()
+					pause := s.pause.until.Sub(start)
+					s.pause.mu.Unlock()
+					if want := tt.wantPauses[i]; want == 0 && pause > 0 || want > 0 && (pause < want || pause > want+time.Second/2) {
+						t.Errorf("pause after result %d = %v, want %v", i, pause, want)
+					}
+				}
+				if err != nil {
+					if !errors.Is(err, boom) {
+						t.Errorf("handled() = %v, want %v", err, boom)
+					}
+					stopped = i
+					break
+				}
+			}
+			if stopped != tt.wantStop {
+				t.Errorf("stopped at result %d, want %d", stopped, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestErrorPause(t *testing.T) {
+	var p errorPause
+	var got []time.Duration
+	for range 8 {
+		got = append(got, p.failed())
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pause after %d consecutive errors = %v, want %v", i+1, got[i], want[i])
+		}
+	}
+
+	// wait returns once the context is done rather than after the pause.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() during a pause = %v, want %v", err, context.DeadlineExceeded)
+	}
+	p.succeeded()
+	if err := p.wait(context.Background()); err != nil {
+		t.Errorf("wait() after a success = %v, want nil", err)
+	}
+}
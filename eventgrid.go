@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+const (
+	// eventGridEventType is the CloudEvents type of messages forwarded to
+	// Event Grid.
+	eventGridEventType = "asb_amqp_pubsub.message.published"
+	// eventGridTimeout bounds each Event Grid request.
+	eventGridTimeout = 10 * time.Second
+)
+
+// RetryPolicy selects which failed HTTP requests are retried and how long to
+// wait in between.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt. Zero
+	// disables retrying.
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry, doubled for each
+	// following one up to MaxBackoff. They default to 1s and 30s. A
+	// Retry-After header in seconds replaces the wait, within MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryableStatusCodes lists the response statuses that are retried.
+	// Defaults to 429 and 503. Requests that fail without a response are
+	// not retried.
+	RetryableStatusCodes []int
+}
+
+// backoff returns the wait before retry number retry, counted from 0.
+func (p RetryPolicy) backoff(retry int, retryAfter time.Duration) time.Duration {
+	initial, limit := p.InitialBackoff, p.MaxBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if limit <= 0 {
+		limit = 30 * time.Second
+	}
+	if retryAfter > 0 {
+		return min(retryAfter, limit)
+	}
+	return min(initial<<min(retry, 30), limit)
+}
+
+// retryable reports whether a response with status code is retried.
+func (p RetryPolicy) retryable(code int) bool {
+	if p.RetryableStatusCodes == nil {
+		return code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+	}
+	return slices.Contains(p.RetryableStatusCodes, code)
+}
+
+// eventGridStatusError is returned when Event Grid responds with an error
+// status.
+type eventGridStatusError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *eventGridStatusError) Error() string {
+	return fmt.Sprintf("Event Grid rejected event with status %d", e.code)
+}
+
+// eventGridForwarder posts published messages to an Event Grid topic as
+// structured-mode CloudEvents.
+type eventGridForwarder struct {
+	endpoint string
+	key      string
+	client   *http.Client
+	retry    RetryPolicy
+	logger   *slog.Logger
+}
+
+// forward posts msg, published to topic, in the background. Failures are
+// logged and do not affect the AMQP send.
+func (f *eventGridForwarder) forward(ctx context.Context, topic string, msg *amqp.Message) {
+	if f == nil {
+		return
+	}
+	event, err := json.Marshal(cloudEventOf(topic, msg))
+	if err != nil {
+		f.logger.WarnContext(ctx, "failed to encode Event Grid event", "message_id", messageIDOf(msg), "error", err)
+		return
+	}
+	go func() {
+		ctx := context.WithoutCancel(ctx)
+		if err := f.postWithRetry(ctx, event); err != nil {
+			f.logger.WarnContext(ctx, "failed to forward message to Event Grid", "message_id", messageIDOf(msg), "error", err)
+		}
+	}()
+}
+
+// postWithRetry posts event, retrying according to f.retry.
+func (f *eventGridForwarder) postWithRetry(ctx context.Context, event []byte) error {
+	for retry := 0; ; retry++ {
+		err := f.post(ctx, event)
+		var statusErr *eventGridStatusError
+		if err == nil || retry >= f.retry.MaxRetries || !errors.As(err, &statusErr) || !f.retry.retryable(statusErr.code) {
+			return err
+		}
+		wait := f.retry.backoff(retry, statusErr.retryAfter)
+		f.logger.DebugContext(ctx, "retrying Event Grid request", "status", statusErr.code, "retry", retry+1, "wait_ms", wait.Milliseconds())
+		time.Sleep(wait)
+	}
+}
+
+// post makes one attempt to post event, bounded by eventGridTimeout.
+func (f *eventGridForwarder) post(ctx context.Context, event []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, eventGridTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.endpoint, bytes.NewReader(event))
+	if err != nil {
+		return fmt.Errorf("failed to create Event Grid request: %w", err)
+	}
+	req.Header.Set("Content-Type", cloudEventsContentType+"; charset=utf-8")
+	if f.key != "" {
+		req.Header.Set("aeg-sas-key", f.key)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		statusErr := &eventGridStatusError{code: resp.StatusCode}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			statusErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return statusErr
+	}
+	return nil
+}
+
+// cloudEventOf returns the CloudEvent of msg published to topic. A JSON body
+// is sent as the event data, any other body base64-encoded.
+func cloudEventOf(topic string, msg *amqp.Message) CloudEventsEnvelope {
+	now := time.Now().UTC()
+	event := CloudEventsEnvelope{
+		SpecVersion: "1.0",
+		ID:          fmt.Sprint(messageIDOf(msg)),
+		Source:      "/topics/" + topic,
+		Type:        eventGridEventType,
+		Time:        &now,
+	}
+	if msg.Properties != nil {
+		if msg.Properties.Subject != nil {
+			event.Subject = *msg.Properties.Subject
+		}
+		if msg.Properties.ContentType != nil {
+			event.DataContentType = *msg.Properties.ContentType
+		}
+	}
+	if messageIDOf(msg) == nil {
+		event.ID = uuid.NewString()
+	}
+
+	body := msg.GetData()
+	if json.Valid(body) {
+		event.Data = body
+		if event.DataContentType == "" {
+			event.DataContentType = jsonContentType
+		}
+	} else {
+		event.DataBase64 = body
+	}
+	return event
+}
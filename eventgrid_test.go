@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		retry      int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{name: "defaults", retry: 0, want: time.Second},
+		{name: "doubles", policy: RetryPolicy{InitialBackoff: 100 * time.Millisecond}, retry: 3, want: 800 * time.Millisecond},
+		{name: "capped", policy: RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}, retry: 10, want: 5 * time.Second},
+		{name: "retry after", policy: RetryPolicy{InitialBackoff: time.Second}, retry: 2, retryAfter: 3 * time.Second, want: 3 * time.Second},
+		{name: "retry after capped", policy: RetryPolicy{MaxBackoff: 2 * time.Second}, retryAfter: time.Minute, want: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.backoff(tt.retry, tt.retryAfter); got != tt.want {
+				t.Errorf("backoff(%d, %v) = %v, want %v", tt.retry, tt.retryAfter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventGridRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		statuses     []int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, wantAttempts: 1},
+		{name: "retries 429", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, wantAttempts: 2},
+		{name: "retries 503", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}, wantAttempts: 3},
+		{name: "retries exhausted", policy: RetryPolicy{MaxRetries: 1}, statuses: []int{http.StatusServiceUnavailable}, wantAttempts: 2, wantErr: true},
+		{name: "not retryable", statuses: []int{http.StatusBadRequest}, wantAttempts: 1, wantErr: true},
+		{name: "custom codes", policy: RetryPolicy{MaxRetries: 3, RetryableStatusCodes: []int{http.StatusInternalServerError}}, statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}, wantAttempts: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(attempts.Add(1)) - 1
+				if got := r.Header.Get("aeg-sas-key"); got != "key" {
+					t.Errorf("aeg-sas-key = %q, want %q", got, "key")
+				}
+				w.WriteHeader(tt.statuses[min(n, len(tt.statuses)-1)])
+			}))
+			defer server.Close()
+
+			policy := tt.policy
+			if policy.MaxRetries == 0 {
+				policy.MaxRetries = 3
+			}
+			policy.InitialBackoff = time.Millisecond
+			f := &eventGridForwarder{endpoint: server.URL, key: "key", client: server.Client(), retry: policy, logger: discardLogger()}
+			err := f.postWithRetry(context.Background(), []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("postWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestEventGridRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	f := &eventGridForwarder{endpoint: server.URL, client: server.Client(), retry: policy, logger: discardLogger()}
+	start := time.Now()
+	if err := f.postWithRetry(context.Background(), []byte(`{}`)); err != nil {
+		t.Fatalf("postWithRetry() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("retried after %v, want the Retry-After wait capped at 50ms", elapsed)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("attempts = %d, want 2", got)
+	}
+}
+
+func TestDualWriteEventGrid(t *testing.T) {
+	const warning = "failed to forward message to Event Grid"
+	tests := []struct {
+		name        string
+		status      int
+		wantWarning bool
+	}{
+		{name: "forwarded", status: http.StatusOK},
+		{name: "Event Grid fails", status: http.StatusInternalServerError, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The Event Grid handler holds each request until release is
+			// closed, so a publish returning first shows it does not wait.
+			release := make(chan struct{})
+			events := make(chan CloudEventsEnvelope, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var event CloudEventsEnvelope
+				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+					t.Errorf("decode event: %v", err)
+				}
+				if got := r.Header.Get("aeg-sas-key"); got != "key" {
+					t.Errorf("aeg-sas-key = %q, want %q", got, "key")
+				}
+				<-release
+				events <- event
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+			defer close(release)
+
+			logger, logs := recordingLogger()
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) {
+				o.DualWriteEventGrid = true
+				o.EventGridEndpoint = server.URL
+				o.EventGridKey = "key"
+				o.Logger = logger
+			})
+
+			msg := amqp.NewMessage([]byte(`{"order":1}`))
+			msg.Properties = &amqp.MessageProperties{MessageID: "m1"}
+			done := make(chan error, 1)
+			go func() { done <- p.PublishMessage(context.Background(), msg) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("publish waited for Event Grid")
+			}
+			if got := len(b.receivedAt("topic")); got != 1 {
+				t.Fatalf("Service Bus received %d messages, want 1", got)
+			}
+
+			release <- struct{}{}
+			event := <-events
+			if event.ID != "m1" || event.Source != "/topics/topic" || string(event.Data) != `{"order":1}` {
+				t.Errorf("event id %q, source %q, data %s, want m1, /topics/topic, the message body", event.ID, event.Source, event.Data)
+			}
+			if tt.wantWarning {
+				b.waitFor("Event Grid failure logged", func() bool { return logs.count(slog.LevelWarn, warning) == 1 })
+			} else if got := logs.count(slog.LevelWarn, warning); got != 0 {
+				t.Errorf("logged %d Event Grid warnings, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// enqueuedTimeAnnotation is the message annotation carrying the time
+	// Service Bus accepted a message.
+	enqueuedTimeAnnotation = "x-opt-enqueued-time"
+	// expiredDeadLetterReason matches the reason Service Bus records when it
+	// dead-letters an expired message itself.
+	expiredDeadLetterReason = "TTLExpiredException"
+)
+
+// expiresAt returns when msg expires: its absolute expiry time if set, and
+// otherwise its enqueued time plus the header TTL.
+func expiresAt(msg *amqp.Message) (time.Time, bool) {
+	if msg.Properties != nil && msg.Properties.AbsoluteExpiryTime != nil && !msg.Properties.AbsoluteExpiryTime.IsZero() {
+		return *msg.Properties.AbsoluteExpiryTime, true
+	}
+	if msg.Header == nil || msg.Header.TTL <= 0 {
+		return time.Time{}, false
+	}
+	enqueued, ok := msg.Annotations[enqueuedTimeAnnotation].(time.Time)
+	if !ok {
+		return time.Time{}, false
+	}
+	return enqueued.Add(msg.Header.TTL), true
+}
+
+// messageExpired reports whether msg is past its TTL at now.
+func messageExpired(msg *amqp.Message, now time.Time) bool {
+	at, ok := expiresAt(msg)
+	return ok && !now.Before(at)
+}
+
+// expiredDecision settles an expired message with policy instead of handling it.
+func expiredDecision(policy SettlementPolicy) *SettlementDecision {
+	return &SettlementDecision{
+		Policy:      policy,
+		Reason:      expiredDeadLetterReason,
+		Description: "message expired before it was handled",
+	}
+}
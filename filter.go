@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// MessageFilter reports whether a received message should be handled.
+type MessageFilter func(msg *amqp.Message) bool
+
+// FilterMiddleware accepts messages that filter rejects without passing them
+// to the handler.
+func FilterMiddleware(filter MessageFilter) SubscriberMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			if !filter(msg) {
+				return nil
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// FilterChain builds a MessageFilter matching the messages that pass every
+// step added to it.
+type FilterChain struct {
+	filters []MessageFilter
+}
+
+// NewFilterChain returns an empty chain, whose filter matches every message.
+func NewFilterChain() *FilterChain {
+	return &FilterChain{}
+}
+
+// Where adds filter to the chain.
+func (c *FilterChain) Where(filter MessageFilter) *FilterChain {
+	c.filters = append(c.filters, filter)
+	return c
+}
+
+// BySubject matches messages with the given subject.
+func (c *FilterChain) BySubject(subject string) *FilterChain {
+	return c.Where(func(msg *amqp.Message) bool {
+		return msg.Properties != nil && msg.Properties.Subject != nil && *msg.Properties.Subject == subject
+	})
+}
+
+// ByProperty matches messages whose application property name equals value.
+// Non-string property values are compared in their fmt.Sprint form.
+func (c *FilterChain) ByProperty(name, value string) *FilterChain {
+	return c.Where(func(msg *amqp.Message) bool {
+		v, ok := msg.ApplicationProperties[name]
+		return ok && fmt.Sprint(v) == value
+	})
+}
+
+// MaxAge matches messages enqueued at most maxAge ago. Messages without an
+// enqueued time match.
+func (c *FilterChain) MaxAge(maxAge time.Duration) *FilterChain {
+	return c.Where(func(msg *amqp.Message) bool {
+		enqueued, ok := msg.Annotations[enqueuedTimeAnnotation].(time.Time)
+		return !ok || time.Since(enqueued) <= maxAge
+	})
+}
+
+// Build returns the filter of the chain. Later changes to the chain do not
+// affect it.
+func (c *FilterChain) Build() MessageFilter {
+	filters := slices.Clone(c.filters)
+	return func(msg *amqp.Message) bool {
+		for _, filter := range filters {
+			if !filter(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
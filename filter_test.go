@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestFilterChain(t *testing.T) {
+	message := func(subject string, props map[string]any, enqueued time.Time) *amqp.Message {
+		msg := amqp.NewMessage([]byte("hello"))
+		if subject != "" {
+			msg.Properties = &amqp.MessageProperties{Subject: &subject}
+		}
+		msg.ApplicationProperties = props
+		if !enqueued.IsZero() {
+			msg.Annotations = amqp.Annotations{enqueuedTimeAnnotation: enqueued}
+		}
+		return msg
+	}
+	now := time.Now()
+	chain := NewFilterChain().BySubject("orders").ByProperty("region", "us-east").MaxAge(5 * time.Minute).Build()
+	tests := []struct {
+		name   string
+		filter MessageFilter
+		msg    *amqp.Message
+		want   bool
+	}{
+		{name: "empty chain", filter: NewFilterChain().Build(), msg: message("", nil, time.Time{}), want: true},
+		{name: "all steps match", filter: chain, msg: message("orders", map[string]any{"region": "us-east"}, now.Add(-time.Minute)), want: true},
+		{name: "no enqueued time", filter: chain, msg: message("orders", map[string]any{"region": "us-east"}, time.Time{}), want: true},
+		{name: "other subject", filter: chain, msg: message("invoices", map[string]any{"region": "us-east"}, now)},
+		{name: "no subject", filter: chain, msg: message("", map[string]any{"region": "us-east"}, now)},
+		{name: "other region", filter: chain, msg: message("orders", map[string]any{"region": "eu-west"}, now)},
+		{name: "no region", filter: chain, msg: message("orders", nil, now)},
+		{name: "too old", filter: chain, msg: message("orders", map[string]any{"region": "us-east"}, now.Add(-10*time.Minute))},
+		{name: "non-string property", filter: NewFilterChain().ByProperty("priority", "3").Build(), msg: message("", map[string]any{"priority": int32(3)}, time.Time{}), want: true},
+		{
+			name:   "custom step",
+			filter: NewFilterChain().Where(func(msg *amqp.Message) bool { return len(msg.GetData()) > 10 }).Build(),
+			msg:    message("", nil, time.Time{}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter(tt.msg); got != tt.want {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterChainBuildIsolated(t *testing.T) {
+	c := NewFilterChain().BySubject("orders")
+	filter := c.Build()
+	c.BySubject("invoices")
+	subject := "orders"
+	msg := &amqp.Message{Properties: &amqp.MessageProperties{Subject: &subject}}
+	if !filter(msg) {
+		t.Error("filter() = false after a step was added to its chain, want true")
+	}
+	if c.Build()(msg) {
+		t.Error("rebuilt filter() = true, want false")
+	}
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	handled := make(chan string, 2)
+	s := newBrokerSubscriber(t, config,
+		WithMiddleware(FilterMiddleware(NewFilterChain().ByProperty("region", "us-east").Build())),
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			handled <- string(msg.GetData())
+			return nil
+		}),
+	)
+	listenInBackground(t, s)
+
+	for _, region := range []string{"eu-west", "us-east"} {
+		msg := amqp.NewMessage([]byte(region))
+		msg.ApplicationProperties = map[string]any{"region": region}
+		b.send(config.SubscriptionPath(), msg)
+	}
+	for _, outcome := range b.waitSettlements(2) {
+		if outcome.State.Outcome != "accepted" {
+			t.Errorf("%s outcome = %q, want accepted", outcome.Message.GetData(), outcome.State.Outcome)
+		}
+	}
+	close(handled)
+	var got []string
+	for body := range handled {
+		got = append(got, body)
+	}
+	if len(got) != 1 || got[0] != "us-east" {
+		t.Errorf("handled %v, want [us-east]", got)
+	}
+}
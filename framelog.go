@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"net"
+)
+
+// LevelTrace is the log level of AMQP frame dumps, below debug. LOG_LEVEL
+// accepts "trace" for it.
+const LevelTrace = slog.LevelDebug - 4
+
+// frameLogConn logs the bytes read from and written to a broker connection
+// as hex dumps at LevelTrace. go-amqp writes one frame per call, so each
+// sent frame is logged on its own; received bytes are logged as read and
+// may hold several frames or part of one.
+type frameLogConn struct {
+	net.Conn
+	logger *slog.Logger
+}
+
+func (c *frameLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.dump("amqp bytes received", b[:n])
+	return n, err
+}
+
+func (c *frameLogConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.dump("amqp bytes sent", b[:n])
+	return n, err
+}
+
+func (c *frameLogConn) dump(msg string, b []byte) {
+	ctx := context.Background()
+	if len(b) == 0 || !c.logger.Enabled(ctx, LevelTrace) {
+		return
+	}
+	c.logger.Log(ctx, LevelTrace, msg, "bytes", len(b), "dump", hex.Dump(b))
+}
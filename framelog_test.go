@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a handler.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAMQPFrameLog(t *testing.T) {
+	// hex.Dump of the AMQP protocol header the client sends first.
+	const headerDump = "41 4d 51 50 00 01 00 00"
+	tests := []struct {
+		name      string
+		env       string
+		level     slog.Level
+		wantDumps bool
+	}{
+		{name: "enabled", env: "true", level: LevelTrace, wantDumps: true},
+		{name: "disabled", env: "false", level: LevelTrace},
+		{name: "above trace level", env: "true", level: slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(connectionStringVariable, "amqp://localhost")
+			t.Setenv(topicVariable, "topic")
+			t.Setenv(subscriptionNameVariable, "sub")
+			t.Setenv(amqpFrameLogVariable, tt.env)
+			loaded, err := LoadConfig(EnvConfigSource{})
+			if err != nil {
+				t.Fatalf("LoadConfig() = %v", err)
+			}
+
+			b := newTestBroker(t)
+			config := b.config()
+			config.AMQPFrameLog = loaded.AMQPFrameLog
+			var out syncBuffer
+			handler, err := newLogHandler(&out, "text", tt.level)
+			if err != nil {
+				t.Fatalf("newLogHandler() = %v", err)
+			}
+			p, cleanup, err := NewPublisher(context.Background(), slog.New(handler), config)
+			if err != nil {
+				t.Fatalf("NewPublisher() = %v", err)
+			}
+			t.Cleanup(cleanup)
+			if err := p.Publish(context.Background(), "hello", nil); err != nil {
+				t.Fatalf("Publish() = %v", err)
+			}
+
+			logs := out.String()
+			if got := strings.Contains(logs, "amqp bytes sent"); got != tt.wantDumps {
+				t.Errorf("sent bytes logged = %v, want %v\n%s", got, tt.wantDumps, logs)
+			}
+			if got := strings.Contains(logs, "amqp bytes received"); got != tt.wantDumps {
+				t.Errorf("received bytes logged = %v, want %v", got, tt.wantDumps)
+			}
+			if got := strings.Contains(logs, headerDump); got != tt.wantDumps {
+				t.Errorf("protocol header dump %q logged = %v, want %v", headerDump, got, tt.wantDumps)
+			}
+			if tt.wantDumps && !strings.Contains(logs, "level=TRACE") {
+				t.Errorf("dumps not logged at TRACE:\n%s", logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gin-gonic/gin"
+)
+
+// handleHealth reports 200 when both the publisher and subscriber links are
+// up and 503 otherwise, along with the publisher's pending acknowledgements
+// and recent publish latency percentiles in milliseconds.
+// It only reads the last known link state, so it never blocks on the broker.
+func handleHealth(publisher *Publisher, subscriber *Subscriber) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reason string
+		switch {
+		case !publisher.Healthy():
+			reason = "publisher link is down"
+		case !subscriber.Healthy():
+			reason = "subscriber link is down"
+		}
+		stats := publisher.Stats()
+		resp := gin.H{
+			"status":      "ok",
+			"pendingAcks": publisher.PendingAcks(),
+			"publishLatencyMs": gin.H{
+				"p50": stats.LatencyP50().Milliseconds(),
+				"p90": stats.LatencyP90().Milliseconds(),
+				"p99": stats.LatencyP99().Milliseconds(),
+			},
+		}
+		if reason != "" {
+			resp["status"] = "degraded"
+			resp["reason"] = reason
+			c.JSON(http.StatusServiceUnavailable, resp)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// handleLiveness reports that the process is running.
+func handleLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// handleReadiness reports 200 once the publisher and subscriber links are
+// established and neither is reconnecting, and 503 otherwise. Like
+// handleHealth it only reflects the last known link state.
+func handleReadiness(publisher *Publisher, subscriber *Subscriber) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reason string
+		switch {
+		case !publisher.Ready():
+			reason = "publisher link is not ready"
+		case !subscriber.Ready():
+			reason = "subscriber link is not ready"
+		}
+		if reason != "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": reason})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	}
+}
+
+// linkFailure reports whether err means a link, its session or its connection
+// has been closed.
+func linkFailure(err error) bool {
+	var linkErr *amqp.LinkError
+	var sessionErr *amqp.SessionError
+	var connErr *amqp.ConnError
+	return errors.As(err, &linkErr) || errors.As(err, &sessionErr) || errors.As(err, &connErr)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		setup      func(b *testBroker, p *Publisher, s *Subscriber)
+		wantStatus int
+		wantReason string
+	}{
+		{name: "ready", setup: func(*testBroker, *Publisher, *Subscriber) {}, wantStatus: http.StatusOK},
+		{name: "publisher reconnecting", wantStatus: http.StatusServiceUnavailable, wantReason: "publisher link is not ready",
+			setup: func(_ *testBroker, p *Publisher, _ *Subscriber) {
+				p.stateMu.Lock()
+				p.reconnecting = true
+				p.stateMu.Unlock()
+			}},
+		{name: "subscriber reconnecting", wantStatus: http.StatusServiceUnavailable, wantReason: "subscriber link is not ready",
+			setup: func(_ *testBroker, _ *Publisher, s *Subscriber) {
+				s.mu.Lock()
+				s.reconnecting = true
+				s.mu.Unlock()
+			}},
+		{name: "connections lost", wantStatus: http.StatusServiceUnavailable, wantReason: "publisher link is not ready",
+			setup: func(b *testBroker, p *Publisher, _ *Subscriber) {
+				b.dropConnections()
+				b.waitFor("the publisher to see its connection closed", func() bool { return !p.Ready() })
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			p := newBrokerPublisher(t, config)
+			s := newBrokerSubscriber(t, config)
+			tt.setup(b, p, s)
+
+			engine := gin.New()
+			readiness := handleReadiness(p, s)
+			engine.GET("/ready", readiness)
+			engine.GET("/readyz", readiness)
+			engine.GET("/healthz", handleLiveness)
+			for _, path := range []string{"/ready", "/readyz"} {
+				w := httptest.NewRecorder()
+				engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				var body struct{ Status, Reason string }
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("decode %s response %s: %v", path, w.Body, err)
+				}
+				if w.Code != tt.wantStatus || body.Reason != tt.wantReason {
+					t.Errorf("GET %s = %d %q, want %d %q", path, w.Code, body.Reason, tt.wantStatus, tt.wantReason)
+				}
+			}
+			// Liveness does not depend on the links.
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("GET /healthz = %d, want 200", w.Code)
+			}
+		})
+	}
+}
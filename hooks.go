@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Azure/go-amqp"
+)
+
+// PreHandleHook runs before the subscriber's handler. It may return a
+// context and Envelope derived from those it is given; the handler is
+// called with them, and with the Envelope's Message. An error settles the
+// message like a handler error, without calling the handler.
+type PreHandleHook func(ctx context.Context, env Envelope) (context.Context, Envelope, error)
+
+// PostHandleHook runs after the subscriber's handler, or after a failed
+// PreHandleHook, with its result, e.g. for cleanup or auditing. It runs
+// before the message is settled and cannot change the outcome, except by
+// panicking, which is handled according to the subscriber's PanicPolicy.
+type PostHandleHook func(ctx context.Context, env Envelope, handlerErr error)
+
+// callHandler calls handler with msg's Envelope in the context, between the
+// subscriber's pre- and post-handle hooks. A panic in either hook is handled
+// like one in the handler, according to the PanicPolicy; a panicking
+// PostHandleHook replaces the handler's result.
+func (s *Subscriber) callHandler(ctx context.Context, handler MessageHandler, msg *amqp.Message) error {
+	env := WrapEnvelope(msg)
+	var err error
+	if s.preHandle != nil {
+		err = s.recoverPanic("pre-handle hook", func() error {
+			hookCtx, hookEnv, err := s.preHandle(ContextWithEnvelope(ctx, env), env)
+			if err == nil {
+				ctx, env = hookCtx, hookEnv
+				if env.Message != nil {
+					msg = env.Message
+				}
+			}
+			return err
+		})
+	}
+	ctx = ContextWithEnvelope(ctx, env)
+	if err == nil {
+		err = s.recoverPanic("handler", func() error { return handler(ctx, msg) })
+	}
+	if s.postHandle != nil {
+		if hookErr := s.recoverPanic("post-handle hook", func() error {
+			s.postHandle(ctx, env, err)
+			return nil
+		}); hookErr != nil {
+			err = hookErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// firstReceiveWatch reports a subscriber that receives no message within
+// FirstReceiveTimeout of starting to listen.
+type firstReceiveWatch struct {
+	timeout   time.Duration
+	onTimeout func()
+	metrics   MetricsRecorder
+	logger    *slog.Logger
+
+	startOnce sync.Once
+	doneOnce  sync.Once
+	// done is closed once the first message is received.
+	done chan struct{}
+}
+
+// newFirstReceiveWatch returns a watch calling onTimeout, which may be nil,
+// after timeout, or nil when timeout is not positive.
+func newFirstReceiveWatch(timeout time.Duration, onTimeout func(), metrics MetricsRecorder, logger *slog.Logger) *firstReceiveWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	return &firstReceiveWatch{timeout: timeout, onTimeout: onTimeout, metrics: metrics, logger: logger, done: make(chan struct{})}
+}
+
+// start starts the timeout on the first call. It is cancelled when ctx is
+// done. A nil watch does nothing.
+func (w *firstReceiveWatch) start(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	w.startOnce.Do(func() {
+		go func() {
+			timer := time.NewTimer(w.timeout)
+			defer timer.Stop()
+			select {
+			case <-w.done:
+			case <-ctx.Done():
+			case <-timer.C:
+				w.logger.WarnContext(ctx, "no message received within first receive timeout, check the subscription",
+					"timeout_seconds", w.timeout.Seconds())
+				w.metrics.incIdleTimeout()
+				if w.onTimeout != nil {
+					w.onTimeout()
+				}
+			}
+		}()
+	})
+}
+
+// received stops the timeout. A nil watch does nothing.
+func (w *firstReceiveWatch) received() {
+	if w == nil {
+		return
+	}
+	w.doneOnce.Do(func() { close(w.done) })
+}
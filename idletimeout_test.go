@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFirstReceiveTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name        string
+		send        bool
+		wantTimeout bool
+	}{
+		{name: "no message", wantTimeout: true},
+		{name: "message received in time", send: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			metrics := NewMetrics(config)
+			logger, logs := recordingLogger()
+			idle := make(chan struct{}, 2)
+			handled := make(chan struct{}, 1)
+			s := newBrokerSubscriber(t, config,
+				WithSubscriberMetrics(metrics),
+				func(o *SubscriberOptions) {
+					o.Logger = logger
+					o.FirstReceiveTimeout = timeout
+					o.OnIdleTimeout = func() { idle <- struct{}{} }
+				},
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					handled <- struct{}{}
+					return nil
+				}),
+			)
+			if tt.send {
+				b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("hello")))
+			}
+			listenInBackground(t, s)
+			if tt.send {
+				<-handled
+			}
+
+			select {
+			case <-idle:
+				if !tt.wantTimeout {
+					t.Fatal("OnIdleTimeout called after a message was received")
+				}
+			case <-time.After(3 * timeout):
+				if tt.wantTimeout {
+					t.Fatal("OnIdleTimeout not called")
+				}
+			}
+			want := 0.0
+			if tt.wantTimeout {
+				want = 1
+			}
+			if got := testutil.ToFloat64(metrics.IdleTimeouts); got != want {
+				t.Errorf("amqp_subscriber_idle_timeout_total = %v, want %v", got, want)
+			}
+			if got := logs.count(slog.LevelWarn, "no message received within first receive timeout, check the subscription"); got != int(want) {
+				t.Errorf("logged %d idle warnings, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatVariable = "LOG_FORMAT"
+	logLevelVariable  = "LOG_LEVEL"
+)
+
+// newLogHandler returns a slog handler writing to w in the given format,
+// "json" (the default) or "text", dropping records below level.
+func newLogHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{AddSource: true, Level: level, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.LevelKey && a.Value.Any() == LevelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+		return a
+	}}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("environment variable %s must be %q or %q, got %q", logFormatVariable, "json", "text", format)
+	}
+}
+
+// newLogger returns the logger passed to the constructors, configured by
+// LOG_FORMAT and LOG_LEVEL. Without them it writes one JSON object per line
+// at info level.
+func newLogger() (*slog.Logger, error) {
+	var level slog.Level
+	if v := os.Getenv(logLevelVariable); strings.EqualFold(v, "trace") {
+		level = LevelTrace
+	} else if v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("environment variable %s must be trace, debug, info, warn or error, got %q", logLevelVariable, v)
+		}
+	}
+	handler, err := newLogHandler(os.Stdout, os.Getenv(logFormatVariable), level)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(handler), nil
+}
+
+// fatal logs msg at error level, attributed to its caller, and exits.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	logger.Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseTextRecord parses a line written by slog's text handler into its
+// key=value pairs, unquoting quoted values.
+func parseTextRecord(t *testing.T, line string) map[string]string {
+	t.Helper()
+	record := map[string]string{}
+	for line != "" {
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			t.Fatalf("no key=value pair in %q", line)
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				t.Fatalf("bad quoted value in %q: %v", rest, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		record[key] = value
+		line = strings.TrimPrefix(rest, " ")
+	}
+	return record
+}
+
+func TestNewLogHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		parse   func(t *testing.T, line string) map[string]string
+		wantErr bool
+	}{
+		{name: "default", parse: parseJSONRecord},
+		{name: "json", format: "json", parse: parseJSONRecord},
+		{name: "text", format: "TEXT", parse: parseTextRecord},
+		{name: "unknown", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			handler, err := newLogHandler(&out, tt.format, LevelTrace)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLogHandler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			logger := slog.New(handler)
+			logger.Info("message published", "topic", "orders", "message_id", "m 1")
+			logger.Log(t.Context(), LevelTrace, "frame sent")
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("wrote %d lines, want 2:\n%s", len(lines), out.String())
+			}
+			first := tt.parse(t, lines[0])
+			for key, want := range map[string]string{"level": "INFO", "msg": "message published", "topic": "orders", "message_id": "m 1"} {
+				if first[key] != want {
+					t.Errorf("%s = %q, want %q", key, first[key], want)
+				}
+			}
+			if first["source"] == "" {
+				t.Error("record has no source")
+			}
+			if got := tt.parse(t, lines[1])["level"]; got != "TRACE" {
+				t.Errorf("trace record level = %q, want TRACE", got)
+			}
+		})
+	}
+}
+
+// parseJSONRecord parses a line written by slog's JSON handler, keeping the
+// string fields.
+func parseJSONRecord(t *testing.T, line string) map[string]string {
+	t.Helper()
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatalf("parse %q: %v", line, err)
+	}
+	record := map[string]string{}
+	for key, value := range fields {
+		if s, ok := value.(string); ok {
+			record[key] = s
+		} else if value != nil {
+			record[key] = "set"
+		}
+	}
+	return record
+}
@@ -2,35 +2,41 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/Azure/go-amqp"
 	"github.com/gin-gonic/gin"
-)
-
-const (
-	brokerUrlVariable        = "ASB_BROKER_URL"
-	accessKeyNameVariable    = "ASB_ACCESS_KEY_NAME"
-	accessKeyVariable        = "ASB_ACCESS_KEY"
-	topicVariable            = "ASB_TOPIC"
-	subscriptionNameVariable = "ASB_SUBSCRIPTION"
-	connectionStringVariable = "ASB_CONNECTION_STRING"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	logger := log.New(os.Stdout, "[AMQP] ", log.LstdFlags|log.Lshortfile)
-	logger.Println("Starting AMQP Publisher-Subscriber application")
+	configFile := flag.String("config", os.Getenv(configFileVariable), "path to a YAML or JSON config file")
+	flags := NewFlagConfigSource(flag.CommandLine)
+	flag.Parse()
 
-	config, err := loadConfigs()
+	logger, err := newLogger()
 	if err != nil {
-		logger.Fatalf("Failed to load config: %v", err)
+		log.Fatalf("Failed to create logger: %v", err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("starting AMQP publisher-subscriber application")
+
+	sources := []ConfigSource{EnvConfigSource{}, flags}
+	if *configFile != "" {
+		sources = slices.Insert(sources, 0, ConfigSource(FileConfigSource{Path: *configFile}))
+	}
+	config, err := LoadConfig(sources...)
+	if err != nil {
+		fatal(logger, "failed to load config", "error", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -39,200 +45,104 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	publisher, cleanupPub, err := NewPublisher(ctx, logger, config)
+	metrics := NewMetrics(config)
+	if err := metrics.Register(prometheus.DefaultRegisterer); err != nil {
+		fatal(logger, "metrics registration failed", "error", err)
+	}
+	exporter, err := newAzureMonitorExporterFromEnv(config.Credential, logger)
+	if err != nil {
+		fatal(logger, "Azure Monitor exporter init failed", "error", err)
+	}
+	if exporter != nil {
+		if err := metrics.Register(exporter); err != nil {
+			fatal(logger, "Azure Monitor metrics registration failed", "error", err)
+		}
+		go exporter.Run(ctx, time.Minute)
+		logger.Info("exporting metrics to Azure Monitor")
+	}
+
+	var recorder MetricsRecorder = metrics
+	statsd, err := newStatsDExporterFromEnv()
 	if err != nil {
-		logger.Fatalf("Publisher init failed: %v", err)
+		fatal(logger, "StatsD exporter init failed", "error", err)
+	}
+	if statsd != nil {
+		defer statsd.Close()
+		recorder = CombineMetrics(metrics, statsd)
+		logger.Info("exporting metrics to StatsD")
+	}
+
+	publisher, cleanupPub, err := NewPublisher(ctx, logger, config, WithPublisherMetrics(recorder))
+	if err != nil {
+		fatal(logger, "publisher init failed", "error", err)
 	}
 	defer cleanupPub()
+	publishers := NewPublisherRegistry(logger, config, publisher, WithPublisherMetrics(recorder))
+	defer publishers.Close()
 
 	// Init Subscriber
-	subscriber, cleanupSub, err := NewSubscriber(ctx, logger, config)
+	subscriber, cleanupSub, err := NewSubscriber(ctx, logger, config, WithSubscriberMetrics(recorder))
 	if err != nil {
-		logger.Fatalf("Subscriber init failed: %v", err)
+		fatal(logger, "subscriber init failed", "error", err)
 	}
 	defer cleanupSub()
 
 	go func() {
-		if err := subscriber.StartListening(ctx); err != nil {
-			logger.Fatalf("Subscriber error: %v", err)
+		if err := subscriber.listenAndResume(ctx); err != nil {
+			fatal(logger, "subscriber error", "error", err)
 		}
 	}()
-	logger.Println("Subscriber started successfully")
+	logger.Info("subscriber started")
 
 	router := gin.New()
-	router.POST("/publish", publisher.handlePublish)
+	router.POST("/publish", publishers.handlePublish)
+	router.GET("/topics", publishers.handleListTopics)
+	router.POST("/topics", publishers.handleRegisterTopic)
+	router.POST("/topics/:topic/ttl", publishers.handleSetTopicTTL)
+	router.GET("/health", handleHealth(publisher, subscriber))
+	router.GET("/healthz", handleLiveness)
+	readiness := handleReadiness(publisher, subscriber)
+	router.GET("/ready", readiness)
+	router.GET("/readyz", readiness)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	server := &http.Server{
-		Addr:    ":8080",
+		Addr:    config.ListenAddr,
 		Handler: router,
 	}
 
 	go func() {
-		logger.Println("HTTP server started on :8080")
+		logger.Info("HTTP server started", "addr", config.ListenAddr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("Server failed: %v", err)
+			fatal(logger, "server failed", "error", err)
 		}
 	}()
 
 	<-sigChan
-	logger.Println("Shutdown signal received")
-	cancel()
+	logger.Info("shutdown signal received")
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Stop taking new work and let in-flight messages and /publish requests
+	// complete within the same deadline, before the links are closed by the
+	// deferred cleanups.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 	defer shutdownCancel()
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		logger.Fatalf("HTTP server Shutdown failed: %v", err)
-	}
-	logger.Println("Gracefully shut down")
-}
-
-type AmqpConfig struct {
-	ConnectionString string
-	Topic            string
-	Subscription     string
-}
-
-func loadConfigs() (AmqpConfig, error) {
-	brokerUrl := os.Getenv(brokerUrlVariable)
-	accessKeyName := os.Getenv(accessKeyNameVariable)
-	accessKey := os.Getenv(accessKeyVariable)
-	topic := os.Getenv(topicVariable)
-	subscriptionName := os.Getenv(subscriptionNameVariable)
-	connectionString := os.Getenv(connectionStringVariable)
-
-	if topic == "" || subscriptionName == "" {
-		return AmqpConfig{}, fmt.Errorf("environment variables %s (topic) and %s (subscription name) are required",
-			topicVariable, subscriptionNameVariable)
-	}
 
-	if connectionString == "" {
-		if brokerUrl == "" || accessKeyName == "" || accessKey == "" {
-			return AmqpConfig{},
-				fmt.Errorf(
-					`environment variables %s (broker URL), %s (access key name), and %s (access key) are required 
-				when %s (connection string) is not provided`, brokerUrlVariable, accessKeyNameVariable,
-					accessKeyVariable, connectionStringVariable)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := subscriber.GracefulStop(shutdownCtx); err != nil {
+			logger.Error("subscriber graceful stop failed", "error", err)
 		}
-		encodedKey := url.QueryEscape(accessKey)
-		connectionString = fmt.Sprintf("amqps://%s:%s@%s", accessKeyName, encodedKey, brokerUrl)
-	}
-
-	subscription := fmt.Sprintf("%s/subscriptions/%s", topic, subscriptionName)
-
-	return AmqpConfig{
-		ConnectionString: connectionString,
-		Topic:            topic,
-		Subscription:     subscription,
-	}, nil
-}
-
-type Publisher struct {
-	sender *amqp.Sender
-	logger *log.Logger
-}
-
-func NewPublisher(ctx context.Context, logger *log.Logger, config AmqpConfig) (*Publisher, func(), error) {
-	conn, err := amqp.Dial(ctx, config.ConnectionString, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
-	}
-
-	session, err := conn.NewSession(ctx, nil)
-	if err != nil {
-		conn.Close()
-		return nil, nil, fmt.Errorf("failed to create AMQP session: %w", err)
-	}
-
-	sender, err := session.NewSender(ctx, config.Topic, nil)
-	if err != nil {
-		session.Close(ctx)
-		conn.Close()
-		return nil, nil, fmt.Errorf("failed to create AMQP sender: %w", err)
-	}
-
-	cleanup := func() {
-		sender.Close(ctx)
-		session.Close(ctx)
-		conn.Close()
-	}
-
-	return &Publisher{sender: sender, logger: logger}, cleanup, nil
-}
-
-func (p *Publisher) Publish(ctx context.Context, message string) error {
-	msg := amqp.NewMessage([]byte(message))
-	if err := p.sender.Send(ctx, msg, nil); err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
-	}
-	p.logger.Printf("Published message: %s", message)
-	return nil
-}
-
-func (p *Publisher) handlePublish(c *gin.Context) {
-	var req PublishRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
-		return
-	}
-	if err := p.Publish(c, req.Message); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish message"})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"status": "Message published"})
-}
-
-type Subscriber struct {
-	receiver *amqp.Receiver
-	logger   *log.Logger
-}
-
-func NewSubscriber(ctx context.Context, logger *log.Logger, config AmqpConfig) (*Subscriber, func(), error) {
-	conn, err := amqp.Dial(ctx, config.ConnectionString, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
-	}
-
-	session, err := conn.NewSession(ctx, nil)
-	if err != nil {
-		conn.Close()
-		return nil, nil, fmt.Errorf("failed to create AMQP session: %w", err)
-	}
-
-	receiver, err := session.NewReceiver(ctx, config.Subscription, nil)
-	if err != nil {
-		session.Close(ctx)
-		conn.Close()
-		return nil, nil, fmt.Errorf("failed to create AMQP receiver: %w", err)
-	}
-
-	cleanup := func() {
-		receiver.Close(ctx)
-		session.Close(ctx)
-		conn.Close()
-	}
-
-	return &Subscriber{receiver: receiver, logger: logger}, cleanup, nil
-}
-
-func (s *Subscriber) StartListening(ctx context.Context) error {
-	for {
-		select {
-		case <-ctx.Done():
-			s.logger.Println("Subscriber shutting down...")
-			return nil
-		default:
-			msg, err := s.receiver.Receive(ctx, nil)
-			if err != nil {
-				return fmt.Errorf("failed to receive message: %w", err)
-			}
-			s.logger.Printf("Received message: %s", string(msg.GetData()))
-			if err := s.receiver.AcceptMessage(ctx, msg); err != nil {
-				return fmt.Errorf("failed to accept message: %w", err)
-			}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("HTTP server shutdown failed, in-flight requests aborted", "error", err)
 		}
-	}
-}
+	}()
+	wg.Wait()
+	cancel()
 
-type PublishRequest struct {
-	Message string `json:"message"`
+	logger.Info("gracefully shut down")
 }
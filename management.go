@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// managementPingOperation is the operation sent by the management ping.
+const managementPingOperation = "GET-IDENTITY"
+
+// ErrManagementPingFailed is returned by StartListening when the management
+// ping got no response. It is retryable: as the session and connection may
+// be dead too, the subscriber redials them before attaching a new receiver.
+var ErrManagementPingFailed = errors.New("management ping failed")
+
+// managementRequest sends request to the node at address over a temporary
+// sender and reply receiver on session, and returns the response. The
+// request's message ID and reply-to address are set here.
+func managementRequest(ctx context.Context, session *amqp.Session, address string, request *amqp.Message) (*amqp.Message, error) {
+	replyTo, err := randomAddress("mgmt")
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := session.NewSender(ctx, address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create management sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	receiver, err := session.NewReceiver(ctx, address, &amqp.ReceiverOptions{TargetAddress: replyTo})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create management receiver: %w", err)
+	}
+	defer receiver.Close(ctx)
+
+	if request.Properties == nil {
+		request.Properties = &amqp.MessageProperties{}
+	}
+	request.Properties.MessageID = replyTo
+	request.Properties.ReplyTo = &replyTo
+	if err := sender.Send(ctx, request, nil); err != nil {
+		return nil, fmt.Errorf("failed to send management request: %w", err)
+	}
+
+	response, err := receiver.Receive(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive management response: %w", err)
+	}
+	if err := receiver.AcceptMessage(ctx, response); err != nil {
+		return nil, fmt.Errorf("failed to accept management response: %w", err)
+	}
+	return response, nil
+}
+
+// pingManagement sends a management request to the subscription every
+// interval until ctx is done. Any response, even an error status, shows the
+// connection is alive; when none arrives within the interval the receive
+// loop is interrupted with ErrManagementPingFailed so it reconnects. No ping
+// is sent while reconnecting.
+func (s *Subscriber) pingManagement(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		address := s.source + "/$management"
+		session := s.session
+		reconnecting := s.reconnecting
+		s.mu.Unlock()
+		if reconnecting {
+			continue
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		_, err := managementRequest(pingCtx, session, address, &amqp.Message{
+			ApplicationProperties: map[string]any{"operation": managementPingOperation},
+		})
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			s.logger.WarnContext(ctx, "management ping failed, reconnecting", "error", err)
+			s.interrupt(fmt.Errorf("%w: %w", ErrManagementPingFailed, s.recordErr(err)))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// listenAndResumeInBackground runs s.listenAndResume until the test ends,
+// returning the channel its result is sent on.
+func listenAndResumeInBackground(t testing.TB, s *Subscriber) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.listenAndResume(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-result
+	})
+	return result
+}
+
+func TestSubscriberReconnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail breaks the broker side of the subscriber's connection.
+		fail func(b *testBroker, unanswered *atomic.Bool)
+	}{
+		{
+			name: "connection dropped",
+			fail: func(b *testBroker, unanswered *atomic.Bool) {
+				b.dropConnections()
+			},
+		},
+		{
+			name: "management ping unanswered",
+			fail: func(b *testBroker, unanswered *atomic.Bool) {
+				unanswered.Store(true)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			var unanswered atomic.Bool
+			b.mu.Lock()
+			b.management = func(address string, req *amqp.Message) *amqp.Message {
+				// Stop answering on the first connection only.
+				if unanswered.Load() && b.connections() == 1 {
+					return nil
+				}
+				return &amqp.Message{ApplicationProperties: map[string]any{"status-code": int32(200)}}
+			}
+			b.mu.Unlock()
+
+			received := make(chan string, 10)
+			s := newBrokerSubscriber(t, b.config(),
+				func(o *SubscriberOptions) { o.ManagementPingInterval = 100 * time.Millisecond },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					received <- string(msg.GetData())
+					return nil
+				}))
+			result := listenAndResumeInBackground(t, s)
+
+			b.send("topic", amqp.NewMessage([]byte("before")))
+			if got := <-received; got != "before" {
+				t.Fatalf("received %q, want before", got)
+			}
+			b.waitFor("a management ping", func() bool {
+				return len(b.receivedAt("topic/subscriptions/sub/$management")) > 0
+			})
+
+			tt.fail(b, &unanswered)
+			b.waitFor("a second connection", func() bool { return b.connections() == 2 })
+
+			b.send("topic", amqp.NewMessage([]byte("after")))
+			select {
+			case got := <-received:
+				if got != "after" {
+					t.Fatalf("received %q, want after", got)
+				}
+			case err := <-result:
+				t.Fatalf("listenAndResume returned %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message received after reconnecting")
+			}
+			if !s.Healthy() {
+				t.Error("subscriber unhealthy after reconnecting")
+			}
+		})
+	}
+}
+
+func TestSubscriberReconnectBackoff(t *testing.T) {
+	b := newTestBroker(t)
+	s := newBrokerSubscriber(t, b.config())
+	s.reconnectBackoff = RetryPolicy{InitialBackoff: 10 * time.Millisecond}
+	b.listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := s.resume(ctx, &amqp.ConnError{})
+	if err == nil {
+		t.Fatal("resume succeeded without a broker")
+	}
+	if ctx.Err() == nil {
+		t.Errorf("resume returned %v before ctx was done", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"session lock lost", ErrSessionLockLost, true},
+		{"management ping failed", ErrManagementPingFailed, true},
+		{"connection lost", &amqp.ConnError{}, true},
+		{"session lost", &amqp.SessionError{}, true},
+		{"link detached", &amqp.LinkError{}, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	// entityAPIVersion is the version of the Service Bus entity
+	// management API queried by ManagementClient.
+	entityAPIVersion = "2021-05"
+	// sasTokenLifetime is how long the SAS tokens ManagementClient signs
+	// stay valid.
+	sasTokenLifetime = 10 * time.Minute
+	// managementRefreshInterval is how often a Publisher refreshes the
+	// cache of its Management client.
+	managementRefreshInterval = 5 * time.Minute
+)
+
+// ManagementClient reads settings of the configured topic that are not
+// available over AMQP and caches them, and updates them. Service Bus only
+// exposes entity descriptions through its HTTPS management API, so that is
+// used here with the configured SAS key or Azure AD credential.
+type ManagementClient struct {
+	url    string
+	config AmqpConfig
+	client *http.Client
+	logger *slog.Logger
+
+	mu     sync.RWMutex
+	window time.Duration
+}
+
+// NewManagementClient returns a client for the topic of config. Its cache is
+// empty until Refresh or Run is called.
+func NewManagementClient(logger *slog.Logger, config AmqpConfig) *ManagementClient {
+	return &ManagementClient{
+		url:    fmt.Sprintf("https://%s/%s", brokerHost(config), config.Topic),
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger.With("topic", config.Topic),
+	}
+}
+
+// DuplicateDetectionWindow returns the cached duplicate detection window of
+// the topic, which is 0 when duplicate detection is disabled or the window
+// has not been read yet.
+func (m *ManagementClient) DuplicateDetectionWindow() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.window
+}
+
+// Run refreshes the cache immediately and then every interval until ctx is
+// done. Failures are logged and the previous values kept.
+func (m *ManagementClient) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.Refresh(ctx); err != nil && ctx.Err() == nil {
+			m.logger.ErrorContext(ctx, "failed to read topic description", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// topicDescription holds the fields of a Service Bus topic description read
+// by ManagementClient.
+type topicDescription struct {
+	RequiresDuplicateDetection          bool   `xml:"content>TopicDescription>RequiresDuplicateDetection"`
+	DuplicateDetectionHistoryTimeWindow string `xml:"content>TopicDescription>DuplicateDetectionHistoryTimeWindow"`
+}
+
+// Refresh reads the topic description and updates the cache.
+func (m *ManagementClient) Refresh(ctx context.Context) error {
+	entry, err := m.getEntry(ctx)
+	if err != nil {
+		return err
+	}
+
+	var description topicDescription
+	if err := xml.Unmarshal(entry, &description); err != nil {
+		return fmt.Errorf("failed to decode topic description: %w", err)
+	}
+	var window time.Duration
+	if description.RequiresDuplicateDetection {
+		if window, err = parseISO8601Duration(description.DuplicateDetectionHistoryTimeWindow); err != nil {
+			return fmt.Errorf("invalid duplicate detection window: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.window = window
+	m.mu.Unlock()
+	return nil
+}
+
+// SetEntityTTL sets the topic's DefaultMessageTimeToLive, the TTL of
+// messages published without one. The management API only replaces whole
+// descriptions, so the current one is read and written back with the new
+// TTL; settings changed concurrently by others may be overwritten.
+func (m *ManagementClient) SetEntityTTL(ctx context.Context, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("TTL must be positive")
+	}
+	entry, err := m.getEntry(ctx)
+	if err != nil {
+		return err
+	}
+	description, err := withDefaultTTL(entry, ttl)
+	if err != nil {
+		return err
+	}
+
+	body := `<entry xmlns="http://www.w3.org/2005/Atom"><content type="application/xml">` + string(description) + `</content></entry>`
+	req, err := m.newRequest(ctx, http.MethodPut, "", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/atom+xml;type=entry;charset=utf-8")
+	req.Header.Set("If-Match", "*")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to update topic description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("topic update request failed with status %d", resp.StatusCode)
+	}
+	m.logger.InfoContext(ctx, "updated topic default message TTL", "ttl_seconds", ttl.Seconds())
+	return nil
+}
+
+// withDefaultTTL returns the TopicDescription element of entry with its
+// DefaultMessageTimeToLive set to ttl and every other element kept as it is.
+func withDefaultTTL(entry []byte, ttl time.Duration) ([]byte, error) {
+	var description bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(entry))
+	encoder := xml.NewEncoder(&description)
+	// depth is the nesting within the description, 0 outside it.
+	depth, inTTL, replaced := 0, false, false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode topic description: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && t.Name.Local != "TopicDescription" {
+				continue
+			}
+			depth++
+			inTTL = depth == 2 && t.Name.Local == "DefaultMessageTimeToLive"
+			// Namespace declarations are dropped, as the encoder declares
+			// the namespace of each element itself.
+			t.Attr = slices.DeleteFunc(slices.Clone(t.Attr), func(a xml.Attr) bool {
+				return a.Name.Space == "xmlns" || a.Name.Local == "xmlns"
+			})
+			token = t
+			if inTTL {
+				if err := encoder.EncodeToken(token); err != nil {
+					return nil, fmt.Errorf("failed to encode topic description: %w", err)
+				}
+				token, replaced = xml.CharData(formatISO8601Duration(ttl)), true
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				continue
+			}
+			depth--
+			inTTL = false
+		case xml.CharData:
+			if depth == 0 || inTTL {
+				continue
+			}
+		default:
+			if depth == 0 {
+				continue
+			}
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, fmt.Errorf("failed to encode topic description: %w", err)
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to encode topic description: %w", err)
+	}
+	if description.Len() == 0 {
+		return nil, errors.New("topic entry has no topic description")
+	}
+	if !replaced {
+		return nil, errors.New("topic description has no default message TTL")
+	}
+	return description.Bytes(), nil
+}
+
+// getEntry returns the Atom entry holding the topic description.
+func (m *ManagementClient) getEntry(ctx context.Context) ([]byte, error) {
+	req, err := m.newRequest(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get topic description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("topic description request failed with status %d", resp.StatusCode)
+	}
+	entry, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic description: %w", err)
+	}
+	return entry, nil
+}
+
+// AutoCreateSubscriptionOptions are the settings of a subscription created
+// by ManagementClient.CreateSubscription. Zero values leave the Service Bus
+// defaults.
+type AutoCreateSubscriptionOptions struct {
+	MaxDeliveryCount  int
+	LockDuration      time.Duration
+	DefaultMessageTTL time.Duration
+	RequiresSession   bool
+}
+
+// subscriptionDescription is the Service Bus subscription description sent
+// by CreateSubscription. Service Bus requires its elements in this order.
+type subscriptionDescription struct {
+	XMLName                  xml.Name `xml:"http://schemas.microsoft.com/netservices/2010/10/servicebus/connect SubscriptionDescription"`
+	LockDuration             string   `xml:"LockDuration,omitempty"`
+	RequiresSession          bool     `xml:"RequiresSession,omitempty"`
+	DefaultMessageTimeToLive string   `xml:"DefaultMessageTimeToLive,omitempty"`
+	MaxDeliveryCount         int      `xml:"MaxDeliveryCount,omitempty"`
+}
+
+// CreateSubscription creates the subscription name of the topic with opts.
+// It reports whether the subscription was created; an existing subscription
+// is left as it is.
+func (m *ManagementClient) CreateSubscription(ctx context.Context, name string, opts AutoCreateSubscriptionOptions) (bool, error) {
+	description := subscriptionDescription{
+		RequiresSession:  opts.RequiresSession,
+		MaxDeliveryCount: opts.MaxDeliveryCount,
+	}
+	if opts.LockDuration > 0 {
+		description.LockDuration = formatISO8601Duration(opts.LockDuration)
+	}
+	if opts.DefaultMessageTTL > 0 {
+		description.DefaultMessageTimeToLive = formatISO8601Duration(opts.DefaultMessageTTL)
+	}
+	content, err := xml.Marshal(description)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode subscription description: %w", err)
+	}
+
+	body := `<entry xmlns="http://www.w3.org/2005/Atom"><content type="application/xml">` + string(content) + `</content></entry>`
+	req, err := m.newRequest(ctx, http.MethodPut, "/subscriptions/"+url.PathEscape(name), strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/atom+xml;type=entry;charset=utf-8")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to create subscription %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+		m.logger.InfoContext(ctx, "created subscription", "subscription", name)
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("subscription create request failed with status %d", resp.StatusCode)
+	}
+}
+
+// subscriptionFeed holds the fields of the topic's subscription list read by
+// ManagementClient.
+type subscriptionFeed struct {
+	Entries []struct {
+		ActiveMessageCount int64 `xml:"content>SubscriptionDescription>CountDetails>ActiveMessageCount"`
+	} `xml:"entry"`
+}
+
+// PendingMessageCount returns the number of active messages waiting in the
+// topic's subscriptions, which is where Service Bus keeps a topic's backlog.
+// Only the first page of the subscription list, 100 subscriptions, is read.
+func (m *ManagementClient) PendingMessageCount(ctx context.Context) (int64, error) {
+	req, err := m.newRequest(ctx, http.MethodGet, "/subscriptions", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("subscription list request failed with status %d", resp.StatusCode)
+	}
+	var feed subscriptionFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return 0, fmt.Errorf("failed to decode subscription list: %w", err)
+	}
+	var count int64
+	for _, entry := range feed.Entries {
+		count += entry.ActiveMessageCount
+	}
+	return count, nil
+}
+
+// newRequest returns an authorized request to the topic's management URL
+// extended by path.
+func (m *ManagementClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, m.url+path+"?api-version="+entityAPIVersion, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create management request: %w", err)
+	}
+	authorization, err := m.authorization(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	return req, nil
+}
+
+// authorization returns the Authorization header of management requests: an
+// Azure AD bearer token in AAD mode, a SAS token otherwise.
+func (m *ManagementClient) authorization(ctx context.Context) (string, error) {
+	if m.config.AuthMode == AuthModeAAD {
+		token, err := m.config.Credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{serviceBusScope}})
+		if err != nil {
+			return "", fmt.Errorf("failed to get Azure AD token: %w", err)
+		}
+		return "Bearer " + token.Token, nil
+	}
+
+	keyName, key := m.config.AccessKeyName, m.config.AccessKey
+	if keyName == "" || key == "" {
+		u, err := url.Parse(m.config.ConnectionString)
+		if err != nil || u.User == nil {
+			return "", errors.New("no SAS key to authorize management requests")
+		}
+		keyName = u.User.Username()
+		key, _ = u.User.Password()
+	}
+	return sasToken(m.url, keyName, key, time.Now().Add(sasTokenLifetime)), nil
+}
+
+// sasToken signs a shared access signature for resource valid until expiry.
+func sasToken(resource, keyName, key string, expiry time.Time) string {
+	audience := url.QueryEscape(strings.ToLower(resource))
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(audience + "\n" + expires))
+	signature := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s&skn=%s", audience, signature, expires, keyName)
+}
+
+// brokerHost returns the namespace host of config.
+func brokerHost(config AmqpConfig) string {
+	if config.BrokerURL != "" {
+		return config.BrokerURL
+	}
+	if u, err := url.Parse(config.ConnectionString); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+var iso8601Duration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISO8601Duration parses the day-time durations used by Service Bus,
+// such as "PT10M" or "P1DT2H".
+func parseISO8601Duration(s string) (time.Duration, error) {
+	match := iso8601Duration.FindStringSubmatch(s)
+	if match == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("unsupported duration %q", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("unsupported duration %q", s)
+		}
+		d += time.Duration(n * float64(unit))
+	}
+	return d, nil
+}
+
+// formatISO8601Duration formats d as an ISO 8601 duration in seconds, such
+// as "PT3600S".
+func formatISO8601Duration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S"
+}
+
+// maxTrackedMessageIDs bounds the message IDs a Publisher remembers to warn
+// about duplicates.
+const maxTrackedMessageIDs = 100000
+
+// publishedIDs remembers when recent message IDs were published, to warn
+// when one is reused within the duplicate detection window.
+type publishedIDs struct {
+	management *ManagementClient
+
+	mu    sync.Mutex
+	times map[string]time.Time
+	// order lists every publish oldest first, for pruning.
+	order []publishedID
+}
+
+type publishedID struct {
+	id string
+	at time.Time
+}
+
+func newPublishedIDs(management *ManagementClient) *publishedIDs {
+	if management == nil {
+		return nil
+	}
+	return &publishedIDs{management: management, times: make(map[string]time.Time)}
+}
+
+// seen records messageID as published now and reports whether it was
+// already published within the duplicate detection window. A nil tracker
+// reports nothing.
+func (p *publishedIDs) seen(messageID any, now time.Time) bool {
+	window := p.windowOf()
+	if window <= 0 || messageID == nil {
+		return false
+	}
+	id := fmt.Sprint(messageID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.order) > 0 && (now.Sub(p.order[0].at) > window || len(p.order) >= maxTrackedMessageIDs) {
+		// Only forget the ID if it was not published again since.
+		if oldest := p.order[0]; p.times[oldest.id].Equal(oldest.at) {
+			delete(p.times, oldest.id)
+		}
+		p.order = p.order[1:]
+	}
+	last, ok := p.times[id]
+	p.times[id] = now
+	p.order = append(p.order, publishedID{id, now})
+	return ok && now.Sub(last) <= window
+}
+
+func (p *publishedIDs) windowOf() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.management.DuplicateDetectionWindow()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// newTestManagementServer starts a management API served by handler and
+// returns a constructor of clients of it, which request the path of their
+// config's topic.
+func newTestManagementServer(t *testing.T, handler http.HandlerFunc) func(config AmqpConfig) *ManagementClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return func(config AmqpConfig) *ManagementClient {
+		config.AccessKeyName, config.AccessKey = "key", "secret"
+		m := NewManagementClient(discardLogger(), config)
+		m.url = server.URL + "/" + config.Topic
+		m.client = server.Client()
+		return m
+	}
+}
+
+// newTestManagementClient returns a client of topic "topic" whose management
+// API is served by handler.
+func newTestManagementClient(t *testing.T, handler http.HandlerFunc) *ManagementClient {
+	t.Helper()
+	return newTestManagementServer(t, handler)(AmqpConfig{Topic: "topic"})
+}
+
+// topicEntry returns the Atom entry of a topic description with the given
+// duplicate detection window, or without duplicate detection when window is
+// empty.
+func topicEntry(window string) string {
+	duplicateDetection := "<RequiresDuplicateDetection>false</RequiresDuplicateDetection>"
+	if window != "" {
+		duplicateDetection = "<RequiresDuplicateDetection>true</RequiresDuplicateDetection>" +
+			"<DuplicateDetectionHistoryTimeWindow>" + window + "</DuplicateDetectionHistoryTimeWindow>"
+	}
+	return `<entry xmlns="http://www.w3.org/2005/Atom"><content type="application/xml">` +
+		`<TopicDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect">` +
+		`<DefaultMessageTimeToLive>P14D</DefaultMessageTimeToLive>` + duplicateDetection +
+		`</TopicDescription></content></entry>`
+}
+
+func TestManagementClientRefresh(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		entry   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "window", status: http.StatusOK, entry: topicEntry("PT10M"), want: 10 * time.Minute},
+		{name: "days and hours", status: http.StatusOK, entry: topicEntry("P1DT2H"), want: 26 * time.Hour},
+		{name: "duplicate detection disabled", status: http.StatusOK, entry: topicEntry("")},
+		{name: "invalid window", status: http.StatusOK, entry: topicEntry("ten minutes"), wantErr: true},
+		{name: "not found", status: http.StatusNotFound, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/topic" || r.URL.Query().Get("api-version") != entityAPIVersion {
+					t.Errorf("request %s %s, want GET /topic?api-version=%s", r.Method, r.URL, entityAPIVersion)
+				}
+				if r.Header.Get("Authorization") == "" {
+					t.Error("request not authorized")
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.entry)
+			})
+			err := m.Refresh(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := m.DuplicateDetectionWindow(); got != tt.want {
+				t.Errorf("DuplicateDetectionWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishedIDs(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name   string
+		window time.Duration
+		id     any
+		again  time.Duration
+		want   bool
+	}{
+		{name: "within window", window: time.Minute, id: "m1", again: 30 * time.Second, want: true},
+		{name: "after window", window: time.Minute, id: "m1", again: 2 * time.Minute},
+		{name: "no window", id: "m1", again: time.Second},
+		{name: "no message ID", window: time.Minute, again: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManagementClient(discardLogger(), AmqpConfig{Topic: "topic"})
+			m.window = tt.window
+			ids := newPublishedIDs(m)
+			if ids.seen(tt.id, start) {
+				t.Fatal("first publish reported as seen")
+			}
+			if got := ids.seen(tt.id, start.Add(tt.again)); got != tt.want {
+				t.Errorf("seen after %v = %v, want %v", tt.again, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisherWarnsOnDuplicateMessageID(t *testing.T) {
+	m := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, topicEntry("PT10M"))
+	})
+	logger, logs := recordingLogger()
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) {
+		o.Management = m
+		o.Logger = logger
+	})
+
+	// The publisher refreshes the cache when it starts.
+	b.waitFor("duplicate detection window cached", func() bool { return m.DuplicateDetectionWindow() == 10*time.Minute })
+
+	for _, id := range []string{"m1", "m2", "m1"} {
+		msg := amqp.NewMessage([]byte("body"))
+		msg.Properties = &amqp.MessageProperties{MessageID: id}
+		if err := p.PublishMessage(context.Background(), msg); err != nil {
+			t.Fatalf("publish %s: %v", id, err)
+		}
+	}
+	const warning = "message ID reused within the duplicate detection window, the broker will drop the message"
+	if got := logs.count(slog.LevelWarn, warning); got != 1 {
+		t.Errorf("logged %d duplicate warnings, want 1", got)
+	}
+}
+
+func TestManagementClientSetEntityTTL(t *testing.T) {
+	const description = `<TopicDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect" xmlns:i="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<DefaultMessageTimeToLive>P14D</DefaultMessageTimeToLive><MaxSizeInMegabytes>1024</MaxSizeInMegabytes>` +
+		`<AuthorizationRules></AuthorizationRules></TopicDescription>`
+	entry := func(description string) string {
+		return `<entry xmlns="http://www.w3.org/2005/Atom"><title type="text">topic</title><content type="application/xml">` +
+			description + `</content></entry>`
+	}
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		entry     string
+		putStatus int
+		wantPut   bool
+		wantErr   bool
+	}{
+		{name: "updated", ttl: time.Hour, entry: entry(description), putStatus: http.StatusOK, wantPut: true},
+		{name: "empty TTL element", ttl: time.Hour, putStatus: http.StatusOK, wantPut: true,
+			entry: entry(strings.Replace(description, "<DefaultMessageTimeToLive>P14D</DefaultMessageTimeToLive>", "<DefaultMessageTimeToLive/>", 1))},
+		{name: "update rejected", ttl: time.Hour, entry: entry(description), putStatus: http.StatusPreconditionFailed, wantPut: true, wantErr: true},
+		{name: "no TTL element", ttl: time.Hour, wantErr: true,
+			entry: entry(strings.Replace(description, "<DefaultMessageTimeToLive>P14D</DefaultMessageTimeToLive>", "", 1))},
+		{name: "no description", ttl: time.Hour, entry: entry(""), wantErr: true},
+		{name: "non-positive TTL", entry: entry(description), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var put *http.Request
+			var body []byte
+			m := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					fmt.Fprint(w, tt.entry)
+					return
+				}
+				put = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.putStatus)
+			})
+			err := m.SetEntityTTL(context.Background(), tt.ttl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetEntityTTL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (put != nil) != tt.wantPut {
+				t.Fatalf("description written = %v, want %v", put != nil, tt.wantPut)
+			}
+			if put == nil {
+				return
+			}
+			if put.Method != http.MethodPut || put.Header.Get("If-Match") != "*" {
+				t.Errorf("request %s with If-Match %q, want PUT with If-Match *", put.Method, put.Header.Get("If-Match"))
+			}
+			var written struct {
+				Description struct {
+					DefaultMessageTimeToLive string
+					MaxSizeInMegabytes       string
+				} `xml:"content>TopicDescription"`
+			}
+			if err := xml.Unmarshal(body, &written); err != nil {
+				t.Fatalf("decode written entry %s: %v", body, err)
+			}
+			if got := written.Description.DefaultMessageTimeToLive; got != "PT3600S" {
+				t.Errorf("written DefaultMessageTimeToLive = %q, want PT3600S", got)
+			}
+			if got := written.Description.MaxSizeInMegabytes; got != "1024" {
+				t.Errorf("written MaxSizeInMegabytes = %q, want it kept as 1024", got)
+			}
+		})
+	}
+}
+
+func TestManagementClientCreateSubscription(t *testing.T) {
+	type description struct {
+		LockDuration             string
+		RequiresSession          string
+		DefaultMessageTimeToLive string
+		MaxDeliveryCount         string
+	}
+	tests := []struct {
+		name        string
+		opts        AutoCreateSubscriptionOptions
+		status      int
+		want        description
+		wantCreated bool
+		wantErr     bool
+	}{
+		{
+			name: "all options",
+			opts: AutoCreateSubscriptionOptions{
+				MaxDeliveryCount:  5,
+				LockDuration:      30 * time.Second,
+				DefaultMessageTTL: time.Hour,
+				RequiresSession:   true,
+			},
+			status:      http.StatusCreated,
+			want:        description{LockDuration: "PT30S", RequiresSession: "true", DefaultMessageTimeToLive: "PT3600S", MaxDeliveryCount: "5"},
+			wantCreated: true,
+		},
+		{name: "service defaults", status: http.StatusCreated, wantCreated: true},
+		{name: "already exists", opts: AutoCreateSubscriptionOptions{MaxDeliveryCount: 5}, status: http.StatusConflict,
+			want: description{MaxDeliveryCount: "5"}},
+		{name: "create rejected", status: http.StatusUnauthorized, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			var body []byte
+			m := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+				req = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(tt.status)
+			})
+			created, err := m.CreateSubscription(context.Background(), "sub", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateSubscription() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if created != tt.wantCreated {
+				t.Errorf("CreateSubscription() = %v, want %v", created, tt.wantCreated)
+			}
+			if req.Method != http.MethodPut || req.URL.Path != "/topic/subscriptions/sub" {
+				t.Errorf("request %s %s, want PUT /topic/subscriptions/sub", req.Method, req.URL.Path)
+			}
+			var written struct {
+				Description description `xml:"content>SubscriptionDescription"`
+			}
+			if err := xml.Unmarshal(body, &written); err != nil {
+				t.Fatalf("decode written entry %s: %v", body, err)
+			}
+			if written.Description != tt.want {
+				t.Errorf("written description = %+v, want %+v", written.Description, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// MessageTrace records when a received message passed each phase of
+// handling, for finding where a slow pipeline spends its time. Handler
+// timestamps are zero for messages settled without calling the handler,
+// such as oversized or expired ones.
+type MessageTrace struct {
+	MessageID any
+	// ReceivedAt is when the receive loop took the message off the link,
+	// before it waited for a worker.
+	ReceivedAt     time.Time
+	HandlerStartAt time.Time
+	HandlerEndAt   time.Time
+	// AckedAt is when the settlement was confirmed by the broker, or
+	// failed, including for acceptances settled in a batch.
+	AckedAt time.Time
+	Outcome SettlementPolicy
+}
+
+// traceReceived starts the trace of msg when TraceMessages is set.
+func (s *Subscriber) traceReceived(msg *amqp.Message) {
+	if !s.traceMessages {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.traces == nil {
+		s.traces = make(map[*amqp.Message]*MessageTrace)
+	}
+	s.traces[msg] = &MessageTrace{MessageID: messageIDOf(msg), ReceivedAt: now}
+}
+
+// traceHandler records when the handler of msg ran.
+func (s *Subscriber) traceHandler(msg *amqp.Message, start, end time.Time) {
+	if !s.traceMessages {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if trace, ok := s.traces[msg]; ok {
+		trace.HandlerStartAt, trace.HandlerEndAt = start, end
+	}
+}
+
+// traceSettled completes the trace of msg and reports it to OnTrace, or logs
+// it when OnTrace is not set.
+func (s *Subscriber) traceSettled(msg *amqp.Message, decision *SettlementDecision) {
+	if !s.traceMessages {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	trace, ok := s.traces[msg]
+	delete(s.traces, msg)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	trace.AckedAt = now
+	if decision != nil {
+		trace.Outcome = decision.Policy
+	}
+	if s.onTrace != nil {
+		s.onTrace(*trace)
+		return
+	}
+	attrs := []any{"message_id", trace.MessageID, "outcome", trace.Outcome.String(), "received_at", trace.ReceivedAt}
+	if !trace.HandlerStartAt.IsZero() {
+		attrs = append(attrs,
+			"handler_start_at", trace.HandlerStartAt,
+			"handler_end_at", trace.HandlerEndAt,
+			"queued_ms", trace.HandlerStartAt.Sub(trace.ReceivedAt).Milliseconds(),
+			"handler_ms", trace.HandlerEndAt.Sub(trace.HandlerStartAt).Milliseconds())
+	}
+	attrs = append(attrs, "acked_at", trace.AckedAt, "total_ms", trace.AckedAt.Sub(trace.ReceivedAt).Milliseconds())
+	s.logger.Info("message trace", attrs...)
+}
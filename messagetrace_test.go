@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestTraceMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantHandler bool
+		wantOutcome SettlementPolicy
+	}{
+		{name: "handled", body: "hello", wantHandler: true, wantOutcome: PolicyAccept},
+		{name: "settled without the handler", body: "far too large", wantOutcome: PolicyDeadLetter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			traces := make(chan MessageTrace, 1)
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) {
+					o.MaxBodySize = 5
+					o.TraceMessages = true
+					o.OnTrace = func(trace MessageTrace) { traces <- trace }
+				},
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					time.Sleep(10 * time.Millisecond)
+					return nil
+				}),
+			)
+			listenInBackground(t, s)
+			msg := amqp.NewMessage([]byte(tt.body))
+			msg.Properties = &amqp.MessageProperties{MessageID: "id-1"}
+			b.send(config.SubscriptionPath(), msg)
+
+			var trace MessageTrace
+			select {
+			case trace = <-traces:
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnTrace was not called")
+			}
+			if trace.MessageID != "id-1" || trace.Outcome != tt.wantOutcome {
+				t.Errorf("trace of %v settled %s, want id-1 settled %s", trace.MessageID, trace.Outcome, tt.wantOutcome)
+			}
+			if trace.ReceivedAt.IsZero() || trace.AckedAt.IsZero() {
+				t.Fatalf("trace = %+v, want ReceivedAt and AckedAt set", trace)
+			}
+			if !tt.wantHandler {
+				if !trace.HandlerStartAt.IsZero() || !trace.HandlerEndAt.IsZero() {
+					t.Errorf("handler timestamps = %v, %v, want zero", trace.HandlerStartAt, trace.HandlerEndAt)
+				}
+				if !trace.AckedAt.After(trace.ReceivedAt) {
+					t.Errorf("AckedAt %v not after ReceivedAt %v", trace.AckedAt, trace.ReceivedAt)
+				}
+				return
+			}
+			if trace.HandlerStartAt.Before(trace.ReceivedAt) {
+				t.Errorf("HandlerStartAt %v before ReceivedAt %v", trace.HandlerStartAt, trace.ReceivedAt)
+			}
+			if trace.HandlerEndAt.Sub(trace.HandlerStartAt) < 10*time.Millisecond {
+				t.Errorf("handler took %s, want at least the 10ms it slept", trace.HandlerEndAt.Sub(trace.HandlerStartAt))
+			}
+			if !trace.AckedAt.After(trace.HandlerEndAt) {
+				t.Errorf("AckedAt %v not after HandlerEndAt %v", trace.AckedAt, trace.HandlerEndAt)
+			}
+		})
+	}
+}
+
+func TestTraceMessagesLogged(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	logger, logs := recordingLogger()
+	s := newBrokerSubscriber(t, config,
+		func(o *SubscriberOptions) {
+			o.Logger = logger
+			o.TraceMessages = true
+		},
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error { return nil }),
+	)
+	listenInBackground(t, s)
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("hello")))
+	b.waitSettlements(1)
+	b.waitFor("message trace", func() bool { return logs.count(slog.LevelInfo, "message trace") == 1 })
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsRecorder receives the metric updates of Publisher and Subscriber.
+// It is implemented by *Metrics for Prometheus and by *StatsDExporter.
+type MetricsRecorder interface {
+	observePublish(d time.Duration, err error)
+	incReceived()
+	incReceiveErrors()
+	observeDelivery(deliveryCount uint32)
+	incIdleTimeout()
+}
+
+// noMetrics is used when no recorder is configured.
+var noMetrics MetricsRecorder = (*Metrics)(nil)
+
+// CombineMetrics returns a recorder forwarding every update to each of
+// recorders.
+func CombineMetrics(recorders ...MetricsRecorder) MetricsRecorder {
+	return metricsRecorders(recorders)
+}
+
+type metricsRecorders []MetricsRecorder
+
+func (rs metricsRecorders) observePublish(d time.Duration, err error) {
+	for _, r := range rs {
+		r.observePublish(d, err)
+	}
+}
+
+func (rs metricsRecorders) incReceived() {
+	for _, r := range rs {
+		r.incReceived()
+	}
+}
+
+func (rs metricsRecorders) incReceiveErrors() {
+	for _, r := range rs {
+		r.incReceiveErrors()
+	}
+}
+
+func (rs metricsRecorders) observeDelivery(deliveryCount uint32) {
+	for _, r := range rs {
+		r.observeDelivery(deliveryCount)
+	}
+}
+
+func (rs metricsRecorders) incIdleTimeout() {
+	for _, r := range rs {
+		r.incIdleTimeout()
+	}
+}
+
+// deliveryAttemptBucket returns the attempt number of a delivery, from the
+// AMQP delivery count of previous failed attempts, with 5 and over grouped
+// as "5+".
+func deliveryAttemptBucket(deliveryCount uint32) string {
+	if attempt := deliveryCount + 1; attempt < 5 {
+		return strconv.Itoa(int(attempt))
+	}
+	return "5+"
+}
+
+// Metrics holds the Prometheus collectors updated by Publisher and
+// Subscriber. All methods are safe to call on a nil *Metrics.
+type Metrics struct {
+	MessagesPublished prometheus.Counter
+	MessagesReceived  prometheus.Counter
+	PublishErrors     prometheus.Counter
+	ReceiveErrors     prometheus.Counter
+	PublishDuration   prometheus.Histogram
+	// MessageRetries counts received messages by delivery attempt.
+	MessageRetries *prometheus.CounterVec
+	// IdleTimeouts counts subscribers that received no message within
+	// their FirstReceiveTimeout.
+	IdleTimeouts prometheus.Counter
+}
+
+// NewMetrics creates the collectors, labelled with the configured topic and
+// subscription only to keep cardinality low.
+func NewMetrics(config AmqpConfig) *Metrics {
+	labels := prometheus.Labels{"topic": config.Topic, "subscription": config.SubscriptionPath()}
+	return &Metrics{
+		MessagesPublished: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "messages_published_total",
+			Help:        "Number of messages successfully published.",
+			ConstLabels: labels,
+		}),
+		MessagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "messages_received_total",
+			Help:        "Number of messages received by the subscriber.",
+			ConstLabels: labels,
+		}),
+		PublishErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "publish_errors_total",
+			Help:        "Number of messages that failed to publish.",
+			ConstLabels: labels,
+		}),
+		ReceiveErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "receive_errors_total",
+			Help:        "Number of failures receiving or settling messages.",
+			ConstLabels: labels,
+		}),
+		PublishDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "publish_duration_seconds",
+			Help:        "Time taken to publish a message, including failed attempts.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+		MessageRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "amqp_message_retry_total",
+			Help:        "Number of messages received, by delivery attempt (1, 2, 3, 4, 5+).",
+			ConstLabels: labels,
+		}, []string{"delivery_count"}),
+		IdleTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "amqp_subscriber_idle_timeout_total",
+			Help:        "Number of times no message was received within the subscriber's first receive timeout.",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+// Register registers every collector with r.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	return errors.Join(
+		r.Register(m.MessagesPublished),
+		r.Register(m.MessagesReceived),
+		r.Register(m.PublishErrors),
+		r.Register(m.ReceiveErrors),
+		r.Register(m.PublishDuration),
+		r.Register(m.MessageRetries),
+		r.Register(m.IdleTimeouts),
+	)
+}
+
+func (m *Metrics) observePublish(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.PublishDuration.Observe(d.Seconds())
+	if err != nil {
+		m.PublishErrors.Inc()
+		return
+	}
+	m.MessagesPublished.Inc()
+}
+
+func (m *Metrics) incReceived() {
+	if m == nil {
+		return
+	}
+	m.MessagesReceived.Inc()
+}
+
+func (m *Metrics) incReceiveErrors() {
+	if m == nil {
+		return
+	}
+	m.ReceiveErrors.Inc()
+}
+
+func (m *Metrics) observeDelivery(deliveryCount uint32) {
+	if m == nil {
+		return
+	}
+	m.MessageRetries.WithLabelValues(deliveryAttemptBucket(deliveryCount)).Inc()
+}
+
+func (m *Metrics) incIdleTimeout() {
+	if m == nil {
+		return
+	}
+	m.IdleTimeouts.Inc()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMessageRetriesMetric(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	metrics := NewMetrics(config)
+	s := newBrokerSubscriber(t, config, WithSubscriberMetrics(metrics), WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+		return nil
+	}))
+	listenInBackground(t, s)
+
+	// The delivery count is that of previous failed attempts, so a count
+	// of 0 is the first attempt.
+	deliveryCounts := []uint32{0, 0, 1, 2, 3, 4, 9}
+	for _, count := range deliveryCounts {
+		msg := amqp.NewMessage([]byte("body"))
+		msg.Header = &amqp.MessageHeader{DeliveryCount: count}
+		b.send(config.SubscriptionPath(), msg)
+	}
+	b.waitSettlements(len(deliveryCounts))
+
+	for attempt, want := range map[string]float64{"1": 2, "2": 1, "3": 1, "4": 1, "5+": 2} {
+		if got := testutil.ToFloat64(metrics.MessageRetries.WithLabelValues(attempt)); got != want {
+			t.Errorf("amqp_message_retry_total{delivery_count=%q} = %v, want %v", attempt, got, want)
+		}
+	}
+	if got := testutil.CollectAndCount(metrics.MessageRetries); got != 5 {
+		t.Errorf("amqp_message_retry_total has %d series, want 5", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// MetricsFlusher is implemented by metrics recorders that buffer updates,
+// such as a StatsDExporter from NewBufferedStatsDExporter, and by the
+// recorders of CombineMetrics.
+type MetricsFlusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush flushes every recorder that buffers updates.
+func (rs metricsRecorders) Flush(ctx context.Context) error {
+	var errs []error
+	for _, r := range rs {
+		if f, ok := r.(MetricsFlusher); ok {
+			errs = append(errs, f.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// metricsFlush flushes a recorder every MetricsFlushInterval.
+type metricsFlush struct {
+	flusher MetricsFlusher
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// startMetricsFlush flushes recorder every interval until stopped, or
+// returns nil when interval is not positive or recorder does not buffer.
+func startMetricsFlush(recorder MetricsRecorder, interval time.Duration, logger *slog.Logger) *metricsFlush {
+	flusher, ok := recorder.(MetricsFlusher)
+	if interval <= 0 || !ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &metricsFlush{flusher: flusher, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := flusher.Flush(ctx); err != nil && ctx.Err() == nil {
+				logger.WarnContext(ctx, "failed to flush metrics", "error", err)
+			}
+		}
+	}()
+	return f
+}
+
+// stop ends the periodic flush and flushes once more, so no update is
+// lost. A nil metricsFlush does nothing.
+func (f *metricsFlush) stop() error {
+	if f == nil {
+		return nil
+	}
+	f.cancel()
+	<-f.done
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return f.flusher.Flush(ctx)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flushRecorder is a MetricsRecorder counting its flushes.
+type flushRecorder struct {
+	flushes atomic.Int32
+}
+
+func (r *flushRecorder) observePublish(time.Duration, error) {}
+func (r *flushRecorder) incReceived()                        {}
+func (r *flushRecorder) incReceiveErrors()                   {}
+func (r *flushRecorder) observeDelivery(uint32)              {}
+func (r *flushRecorder) incIdleTimeout()                     {}
+
+func (r *flushRecorder) Flush(context.Context) error {
+	r.flushes.Add(1)
+	return nil
+}
+
+func TestMetricsFlushInterval(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	r := &flushRecorder{}
+	f := startMetricsFlush(CombineMetrics(r), interval, discardLogger())
+	if f == nil {
+		t.Fatal("startMetricsFlush() = nil, want a periodic flush")
+	}
+	time.Sleep(10*interval + interval/2)
+	flushed := r.flushes.Load()
+	// Allow for a slow scheduler, but not for flushing on every update or
+	// only at the end.
+	if flushed < 5 || flushed > 11 {
+		t.Errorf("flushed %d times in 10.5 intervals, want about 10", flushed)
+	}
+	if err := f.stop(); err != nil {
+		t.Fatalf("stop() = %v", err)
+	}
+	if got := r.flushes.Load(); got != flushed+1 {
+		t.Errorf("flushed %d times on stop, want once", got-flushed)
+	}
+	time.Sleep(2 * interval)
+	if got := r.flushes.Load(); got != flushed+1 {
+		t.Errorf("flushed %d times after stop, want none", got-flushed-1)
+	}
+}
+
+func TestMetricsFlushDisabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorder MetricsRecorder
+		interval time.Duration
+	}{
+		{name: "no interval", recorder: &flushRecorder{}},
+		{name: "recorder without Flush", recorder: NewMetrics(AmqpConfig{}), interval: time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := startMetricsFlush(tt.recorder, tt.interval, discardLogger())
+			if f != nil {
+				t.Error("startMetricsFlush() started a periodic flush, want nil")
+			}
+			if err := f.stop(); err != nil {
+				t.Errorf("nil stop() = %v", err)
+			}
+		})
+	}
+}
+
+func TestMetricsFlushedOnClose(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	r := &flushRecorder{}
+	_, cleanup, err := NewPublisher(context.Background(), discardLogger(), config, WithPublisherMetrics(r), func(o *PublisherOptions) {
+		o.MetricsFlushInterval = time.Hour
+	})
+	if err != nil {
+		t.Fatalf("NewPublisher: %v", err)
+	}
+	cleanup()
+	if got := r.flushes.Load(); got != 1 {
+		t.Errorf("publisher flushed %d times on close, want 1", got)
+	}
+
+	r = &flushRecorder{}
+	_, cleanup, err = NewSubscriber(context.Background(), discardLogger(), config, WithSubscriberMetrics(r), func(o *SubscriberOptions) {
+		o.MetricsFlushInterval = time.Hour
+	})
+	if err != nil {
+		t.Fatalf("NewSubscriber: %v", err)
+	}
+	cleanup()
+	if got := r.flushes.Load(); got != 1 {
+		t.Errorf("subscriber flushed %d times on close, want 1", got)
+	}
+}
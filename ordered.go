@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// sendTask is a send queued behind earlier sends with the same partition
+// key.
+type sendTask struct {
+	send func() error
+	done chan error
+}
+
+// partitionQueue holds the sends of one partition key waiting to run, oldest
+// first. It is guarded by partitionQueues.mu, under which sends are queued,
+// so they run in the order they called do.
+type partitionQueue struct {
+	tasks []sendTask
+}
+
+// partitionQueues runs sends with the same partition key one at a time, in
+// the order they were queued, each key drained by its own goroutine that
+// exits when the key's queue is empty.
+type partitionQueues struct {
+	mu     sync.Mutex
+	queues map[string]*partitionQueue
+}
+
+func newPartitionQueues(enabled bool) *partitionQueues {
+	if !enabled {
+		return nil
+	}
+	return &partitionQueues{queues: make(map[string]*partitionQueue)}
+}
+
+// do runs send after the sends queued before it for msg's partition key and
+// returns its error. Messages without a partition key, or a nil
+// partitionQueues, are sent directly.
+func (q *partitionQueues) do(msg *amqp.Message, send func() error) error {
+	key, _ := msg.Annotations[partitionKeyAnnotation].(string)
+	if q == nil || key == "" {
+		return send()
+	}
+
+	task := sendTask{send: send, done: make(chan error, 1)}
+	q.mu.Lock()
+	if queue, ok := q.queues[key]; ok {
+		queue.tasks = append(queue.tasks, task)
+	} else {
+		queue = &partitionQueue{tasks: []sendTask{task}}
+		q.queues[key] = queue
+		go q.drain(key, queue)
+	}
+	q.mu.Unlock()
+	return <-task.done
+}
+
+// drain runs the sends of key's queue until it is empty, then removes it.
+func (q *partitionQueues) drain(key string, queue *partitionQueue) {
+	for {
+		q.mu.Lock()
+		if len(queue.tasks) == 0 {
+			delete(q.queues, key)
+			q.mu.Unlock()
+			return
+		}
+		task := queue.tasks[0]
+		queue.tasks[0] = sendTask{}
+		queue.tasks = queue.tasks[1:]
+		q.mu.Unlock()
+
+		task.done <- task.send()
+	}
+}
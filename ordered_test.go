@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// partitionedMessage returns a message with partition key key.
+func partitionedMessage(key string) *amqp.Message {
+	msg := amqp.NewMessage(nil)
+	if key != "" {
+		msg.Annotations = amqp.Annotations{partitionKeyAnnotation: key}
+	}
+	return msg
+}
+
+// queuedSends returns the number of sends waiting in key's queue.
+func queuedSends(q *partitionQueues, key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if queue, ok := q.queues[key]; ok {
+		return len(queue.tasks)
+	}
+	return 0
+}
+
+func TestPartitionQueuesOrder(t *testing.T) {
+	const n = 50
+	q := newPartitionQueues(true)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var order []int
+	record := func(i int) func() error {
+		return func() error {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.do(partitionedMessage("a"), func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	// Each send is submitted once the previous one is queued, so the
+	// submission order is known while they all run concurrently.
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.do(partitionedMessage("a"), record(i))
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for queuedSends(q, "a") != i+1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("send %d not queued", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	want := make([]int, n)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(order, want) {
+		t.Errorf("sends ran in order %v, want %v", order, want)
+	}
+	if queuedSends(q, "a") != 0 || len(q.queues) != 0 {
+		t.Errorf("queue of key a not removed once drained")
+	}
+}
+
+func TestPartitionQueuesKeysIndependent(t *testing.T) {
+	tests := []struct {
+		name string
+		q    *partitionQueues
+		key  string
+	}{
+		{name: "other key", q: newPartitionQueues(true), key: "b"},
+		{name: "no key", q: newPartitionQueues(true)},
+		{name: "disabled", key: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			started := make(chan struct{})
+			blocked := make(chan error, 1)
+			go func() {
+				blocked <- tt.q.do(partitionedMessage("a"), func() error {
+					close(started)
+					<-release
+					return nil
+				})
+			}()
+			<-started
+			defer func() {
+				close(release)
+				<-blocked
+			}()
+
+			done := make(chan error, 1)
+			go func() { done <- tt.q.do(partitionedMessage(tt.key), func() error { return nil }) }()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("do() error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send waited for a send of another partition key")
+			}
+		})
+	}
+}
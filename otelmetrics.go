@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meterName is the instrumentation scope of the OpenTelemetry instruments.
+const meterName = "github.com/chameerar/asb_amqp_pubsub"
+
+// otelMetrics is a MetricsRecorder updating OpenTelemetry instruments named
+// like the Prometheus collectors of Metrics, without the _total suffix.
+type otelMetrics struct {
+	published       metric.Int64Counter
+	received        metric.Int64Counter
+	publishErrors   metric.Int64Counter
+	receiveErrors   metric.Int64Counter
+	publishDuration metric.Float64Histogram
+	retries         metric.Int64Counter
+	idleTimeouts    metric.Int64Counter
+	// attrs identify the topic, and subscription, of every recording.
+	attrs metric.MeasurementOption
+}
+
+// newOTelMetrics creates the instruments with the meter of provider. attrs
+// are added to every recording.
+func newOTelMetrics(provider metric.MeterProvider, attrs ...attribute.KeyValue) (*otelMetrics, error) {
+	meter := provider.Meter(meterName)
+	m := &otelMetrics{attrs: metric.WithAttributes(attrs...)}
+	var errs [7]error
+	m.published, errs[0] = meter.Int64Counter("messages_published", metric.WithDescription("Number of messages successfully published."))
+	m.received, errs[1] = meter.Int64Counter("messages_received", metric.WithDescription("Number of messages received by the subscriber."))
+	m.publishErrors, errs[2] = meter.Int64Counter("publish_errors", metric.WithDescription("Number of messages that failed to publish."))
+	m.receiveErrors, errs[3] = meter.Int64Counter("receive_errors", metric.WithDescription("Number of failures receiving or settling messages."))
+	m.publishDuration, errs[4] = meter.Float64Histogram("publish_duration", metric.WithUnit("s"),
+		metric.WithDescription("Time taken to publish a message, including failed attempts."))
+	m.retries, errs[5] = meter.Int64Counter("amqp_message_retry", metric.WithDescription("Number of messages received, by delivery attempt (1, 2, 3, 4, 5+)."))
+	m.idleTimeouts, errs[6] = meter.Int64Counter("amqp_subscriber_idle_timeout",
+		metric.WithDescription("Number of times no message was received within the subscriber's first receive timeout."))
+	if err := errors.Join(errs[:]...); err != nil {
+		return nil, fmt.Errorf("failed to create OpenTelemetry instruments: %w", err)
+	}
+	return m, nil
+}
+
+// withOTelMetrics returns recorder extended to also record to the meter of
+// provider, or recorder itself when provider is nil.
+func withOTelMetrics(recorder MetricsRecorder, provider metric.MeterProvider, attrs ...attribute.KeyValue) (MetricsRecorder, error) {
+	if provider == nil {
+		return recorder, nil
+	}
+	m, err := newOTelMetrics(provider, attrs...)
+	if err != nil {
+		return nil, err
+	}
+	if recorder == nil {
+		return m, nil
+	}
+	return CombineMetrics(recorder, m), nil
+}
+
+func (m *otelMetrics) observePublish(d time.Duration, err error) {
+	ctx := context.Background()
+	m.publishDuration.Record(ctx, d.Seconds(), m.attrs)
+	if err != nil {
+		m.publishErrors.Add(ctx, 1, m.attrs)
+		return
+	}
+	m.published.Add(ctx, 1, m.attrs)
+}
+
+func (m *otelMetrics) incReceived() {
+	m.received.Add(context.Background(), 1, m.attrs)
+}
+
+func (m *otelMetrics) incReceiveErrors() {
+	m.receiveErrors.Add(context.Background(), 1, m.attrs)
+}
+
+func (m *otelMetrics) observeDelivery(deliveryCount uint32) {
+	m.retries.Add(context.Background(), 1, m.attrs,
+		metric.WithAttributes(attribute.String("delivery_count", deliveryAttemptBucket(deliveryCount))))
+}
+
+func (m *otelMetrics) incIdleTimeout() {
+	m.idleTimeouts.Add(context.Background(), 1, m.attrs)
+}
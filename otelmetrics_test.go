@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectOTel returns the data points recorded by reader, by instrument name.
+// Sums hold the counter values and histograms the number of recordings.
+func collectOTel(t *testing.T, reader sdkmetric.Reader) map[string][]otelPoint {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect() = %v", err)
+	}
+	points := make(map[string][]otelPoint)
+	for _, scope := range rm.ScopeMetrics {
+		if scope.Scope.Name != meterName {
+			t.Errorf("instrumentation scope = %q, want %q", scope.Scope.Name, meterName)
+		}
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, p := range data.DataPoints {
+					points[m.Name] = append(points[m.Name], otelPoint{p.Attributes, uint64(p.Value)})
+				}
+			case metricdata.Histogram[float64]:
+				for _, p := range data.DataPoints {
+					points[m.Name] = append(points[m.Name], otelPoint{p.Attributes, p.Count})
+				}
+			}
+		}
+	}
+	return points
+}
+
+type otelPoint struct {
+	attrs attribute.Set
+	value uint64
+}
+
+// otelValue returns the value of the single point of name, failing the test
+// unless it has attribute key set to value.
+func otelValue(t *testing.T, points map[string][]otelPoint, name string, key attribute.Key, value string) uint64 {
+	t.Helper()
+	if len(points[name]) != 1 {
+		t.Fatalf("%s has %d data points, want 1", name, len(points[name]))
+	}
+	p := points[name][0]
+	if got, _ := p.attrs.Value(key); got.AsString() != value {
+		t.Errorf("%s attribute %s = %q, want %q", name, key, got.AsString(), value)
+	}
+	return p.value
+}
+
+func TestPublisherOTelMetrics(t *testing.T) {
+	b := newTestBroker(t)
+	b.sendOutcome = func(address string, msg *amqp.Message) brokerState {
+		if string(msg.GetData()) == "bad" {
+			return brokerState{Outcome: "rejected", Condition: "amqp:internal-error"}
+		}
+		return brokerState{Outcome: "accepted"}
+	}
+	reader := sdkmetric.NewManualReader()
+	p := newBrokerPublisher(t, b.config(), WithPublisherOTELMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))))
+
+	for _, body := range []string{"one", "two", "bad"} {
+		p.Publish(context.Background(), body, nil)
+	}
+
+	points := collectOTel(t, reader)
+	tests := []struct {
+		name string
+		want uint64
+	}{
+		{name: "messages_published", want: 2},
+		{name: "publish_errors", want: 1},
+		{name: "publish_duration", want: 3},
+	}
+	for _, tt := range tests {
+		if got := otelValue(t, points, tt.name, "topic", "topic"); got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriberOTelMetrics(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	reader := sdkmetric.NewManualReader()
+	handled := make(chan struct{}, 1)
+	s := newBrokerSubscriber(t, config,
+		WithSubscriberOTELMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			handled <- struct{}{}
+			return nil
+		}),
+	)
+	listenInBackground(t, s)
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("hello")))
+	<-handled
+	b.waitSettlements(1)
+
+	points := collectOTel(t, reader)
+	if got := otelValue(t, points, "messages_received", "subscription", config.SubscriptionPath()); got != 1 {
+		t.Errorf("messages_received = %d, want 1", got)
+	}
+	if got := otelValue(t, points, "amqp_message_retry", "delivery_count", "1"); got != 1 {
+		t.Errorf("amqp_message_retry{delivery_count=1} = %d, want 1", got)
+	}
+	if got := points["receive_errors"]; len(got) != 0 {
+		t.Errorf("receive_errors = %v, want no recordings", got)
+	}
+}
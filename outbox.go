@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// outboxBatchSize is the number of entries DrainOutbox claims at a time.
+	outboxBatchSize = 100
+	// outboxClaimTimeout is how long claimed entries are hidden from other
+	// drains. Entries claimed by a drain that stopped without releasing
+	// them become pending again after it.
+	outboxClaimTimeout = 5 * time.Minute
+)
+
+// OutboxMessage is a message waiting in the outbox to be published.
+type OutboxMessage struct {
+	ID        int64
+	MessageID string
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// OutboxStore persists messages so that recording a message and changing
+// application state can commit together, with publishing happening later.
+type OutboxStore interface {
+	// Enqueue adds a message to the outbox.
+	Enqueue(ctx context.Context, msg OutboxMessage) error
+	// Drain passes up to limit pending messages, oldest first, to send and
+	// removes each one only after send returns nil. It returns the number
+	// of messages removed.
+	Drain(ctx context.Context, limit int, send func(OutboxMessage) error) (int, error)
+}
+
+// SQLOutbox is an OutboxStore backed by an "outbox" table in a SQLite
+// database.
+type SQLOutbox struct {
+	db *sql.DB
+}
+
+// TransactionalOutbox returns an OutboxStore using db. The table is created
+// with CreateTable.
+func TransactionalOutbox(db *sql.DB) OutboxStore {
+	return &SQLOutbox{db: db}
+}
+
+// CreateTable creates the outbox table if it does not exist.
+func (o *SQLOutbox) CreateTable(ctx context.Context) error {
+	_, err := o.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id TEXT NOT NULL,
+		body BLOB NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		claimed_until INTEGER
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox table: %w", err)
+	}
+	return nil
+}
+
+// Enqueue adds msg to the outbox in its own transaction.
+func (o *SQLOutbox) Enqueue(ctx context.Context, msg OutboxMessage) error {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin outbox transaction: %w", err)
+	}
+	if err := o.EnqueueTx(ctx, tx, msg); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox transaction: %w", err)
+	}
+	return nil
+}
+
+// EnqueueTx adds msg to the outbox as part of the caller's transaction, so it
+// is only published if the caller's other changes commit.
+func (o *SQLOutbox) EnqueueTx(ctx context.Context, tx *sql.Tx, msg OutboxMessage) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO outbox (message_id, body, created_at) VALUES (?, ?, ?)`,
+		msg.MessageID, msg.Body, msg.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox message: %w", err)
+	}
+	return nil
+}
+
+// Drain claims up to limit pending messages in a short transaction, so that
+// concurrent drains skip them, and sends them without holding it. Each sent
+// message is deleted as soon as send returns nil. If send fails, the claims
+// on the messages not yet sent are released and the error is returned. A
+// message whose delete fails after sending is sent again once its claim
+// expires, so consumers should deduplicate by message ID.
+func (o *SQLOutbox) Drain(ctx context.Context, limit int, send func(OutboxMessage) error) (int, error) {
+	claimed, err := o.claim(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	drained := 0
+	for i, msg := range claimed {
+		if err := send(msg); err != nil {
+			return drained, errors.Join(err, o.release(ctx, claimed[i:]))
+		}
+		if _, err := o.db.ExecContext(ctx, `DELETE FROM outbox WHERE id = ?`, msg.ID); err != nil {
+			return drained, errors.Join(fmt.Errorf("failed to delete outbox message %d: %w", msg.ID, err), o.release(ctx, claimed[i+1:]))
+		}
+		drained++
+	}
+	return drained, nil
+}
+
+// claim marks up to limit unclaimed messages, oldest first, as claimed for
+// outboxClaimTimeout and returns them.
+func (o *SQLOutbox) claim(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin outbox transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	pending, err := pendingOutboxMessages(ctx, tx, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	claimed := pending[:0]
+	for _, msg := range pending {
+		// The claim is conditional so that a message claimed by another
+		// drain since the query is skipped.
+		res, err := tx.ExecContext(ctx,
+			`UPDATE outbox SET claimed_until = ? WHERE id = ? AND (claimed_until IS NULL OR claimed_until < ?)`,
+			now.Add(outboxClaimTimeout).UnixNano(), msg.ID, now.UnixNano())
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim outbox message %d: %w", msg.ID, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("failed to claim outbox message %d: %w", msg.ID, err)
+		}
+		if n == 1 {
+			claimed = append(claimed, msg)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit outbox transaction: %w", err)
+	}
+	return claimed, nil
+}
+
+// release makes msgs pending again.
+func (o *SQLOutbox) release(ctx context.Context, msgs []OutboxMessage) error {
+	var errs []error
+	for _, msg := range msgs {
+		if _, err := o.db.ExecContext(ctx, `UPDATE outbox SET claimed_until = NULL WHERE id = ?`, msg.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release outbox message %d: %w", msg.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func pendingOutboxMessages(ctx context.Context, tx *sql.Tx, now time.Time, limit int) ([]OutboxMessage, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, message_id, body, created_at FROM outbox
+		WHERE claimed_until IS NULL OR claimed_until < ? ORDER BY id LIMIT ?`, now.UnixNano(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		if err := rows.Scan(&msg.ID, &msg.MessageID, &msg.Body, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read outbox message: %w", err)
+		}
+		pending = append(pending, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	return pending, nil
+}
+
+// DrainOutbox publishes the messages in store every interval until ctx is
+// done. Messages are removed only after the broker accepts them.
+func DrainOutbox(ctx context.Context, logger *slog.Logger, store OutboxStore, publisher *Publisher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			drained, err := store.Drain(ctx, outboxBatchSize, func(msg OutboxMessage) error {
+				amqpMsg := amqp.NewMessage(msg.Body)
+				amqpMsg.Properties = &amqp.MessageProperties{MessageID: msg.MessageID}
+				_, err := publisher.PublishWithReceipt(ctx, amqpMsg)
+				return err
+			})
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to drain outbox", "error", err)
+				break
+			}
+			if drained < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
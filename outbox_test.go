@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestOutbox returns an outbox in an in-memory SQLite database. The pool
+// holds a single connection, so a drain that keeps a transaction open while
+// sending blocks any other use of the database.
+func newTestOutbox(t *testing.T) (*SQLOutbox, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	outbox := TransactionalOutbox(db).(*SQLOutbox)
+	if err := outbox.CreateTable(context.Background()); err != nil {
+		t.Fatalf("CreateTable: %v", err)
+	}
+	return outbox, db
+}
+
+// drainIDs drains outbox and returns the message IDs sent.
+func drainIDs(t *testing.T, outbox *SQLOutbox) []string {
+	t.Helper()
+	var sent []string
+	if _, err := outbox.Drain(context.Background(), outboxBatchSize, func(msg OutboxMessage) error {
+		sent = append(sent, msg.MessageID)
+		return nil
+	}); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	return sent
+}
+
+func TestOutboxEnqueueTx(t *testing.T) {
+	tests := []struct {
+		name   string
+		commit bool
+		want   []string
+	}{
+		{name: "committed", commit: true, want: []string{"m1"}},
+		{name: "rolled back"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbox, db := newTestOutbox(t)
+			ctx := context.Background()
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("BeginTx: %v", err)
+			}
+			if err := outbox.EnqueueTx(ctx, tx, OutboxMessage{MessageID: "m1", Body: []byte("body")}); err != nil {
+				t.Fatalf("EnqueueTx: %v", err)
+			}
+			if tt.commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatalf("ending transaction: %v", err)
+			}
+			if got := drainIDs(t, outbox); !slices.Equal(got, tt.want) {
+				t.Errorf("drained %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxDrain(t *testing.T) {
+	tests := []struct {
+		name        string
+		failOn      string
+		wantDrained int
+		wantRest    []string
+	}{
+		{name: "all sent", wantDrained: 3},
+		{name: "send fails", failOn: "m2", wantDrained: 1, wantRest: []string{"m2", "m3"}},
+		{name: "first send fails", failOn: "m1", wantRest: []string{"m1", "m2", "m3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbox, _ := newTestOutbox(t)
+			ctx := context.Background()
+			for i := 1; i <= 3; i++ {
+				if err := outbox.Enqueue(ctx, OutboxMessage{MessageID: fmt.Sprintf("m%d", i), Body: []byte("body")}); err != nil {
+					t.Fatalf("Enqueue: %v", err)
+				}
+			}
+
+			var sent []string
+			drained, err := outbox.Drain(ctx, outboxBatchSize, func(msg OutboxMessage) error {
+				if msg.MessageID == tt.failOn {
+					return errors.New("broker unavailable")
+				}
+				if string(msg.Body) != "body" || msg.CreatedAt.IsZero() {
+					t.Errorf("drained message %+v, want its body and creation time", msg)
+				}
+				sent = append(sent, msg.MessageID)
+				return nil
+			})
+			if (err != nil) != (tt.failOn != "") {
+				t.Fatalf("Drain error = %v, want error %v", err, tt.failOn != "")
+			}
+			if drained != tt.wantDrained || len(sent) != tt.wantDrained {
+				t.Errorf("drained %d and sent %v, want %d", drained, sent, tt.wantDrained)
+			}
+			if got := drainIDs(t, outbox); !slices.Equal(got, tt.wantRest) {
+				t.Errorf("left in outbox %v, want %v", got, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestOutboxDrainSendsOutsideTransaction(t *testing.T) {
+	outbox, _ := newTestOutbox(t)
+	if err := outbox.Enqueue(context.Background(), OutboxMessage{MessageID: "m1", Body: []byte("body")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained, err := outbox.Drain(ctx, outboxBatchSize, func(msg OutboxMessage) error {
+		// The database has a single connection, so this only proceeds if
+		// the first drain released it before sending.
+		nested, err := outbox.Drain(ctx, outboxBatchSize, func(msg OutboxMessage) error {
+			t.Errorf("claimed message %s drained again", msg.MessageID)
+			return nil
+		})
+		if err != nil || nested != 0 {
+			t.Errorf("concurrent Drain = %d, %v, want 0, nil", nested, err)
+		}
+		return nil
+	})
+	if err != nil || drained != 1 {
+		t.Fatalf("Drain = %d, %v, want 1, nil", drained, err)
+	}
+}
+
+func TestOutboxExpiredClaim(t *testing.T) {
+	outbox, db := newTestOutbox(t)
+	ctx := context.Background()
+	if err := outbox.Enqueue(ctx, OutboxMessage{MessageID: "m1", Body: []byte("body")}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	claimed, err := outbox.claim(ctx, outboxBatchSize)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("claim = %v, %v, want one message", claimed, err)
+	}
+	if got := drainIDs(t, outbox); len(got) != 0 {
+		t.Fatalf("drained claimed messages %v", got)
+	}
+
+	// A drain that stopped without releasing its claim.
+	if _, err := db.ExecContext(ctx, `UPDATE outbox SET claimed_until = ?`, time.Now().Add(-time.Second).UnixNano()); err != nil {
+		t.Fatalf("expiring claim: %v", err)
+	}
+	if got := drainIDs(t, outbox); !slices.Equal(got, []string{"m1"}) {
+		t.Errorf("drained %v after the claim expired, want [m1]", got)
+	}
+}
+
+func TestDrainOutbox(t *testing.T) {
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config())
+	outbox, _ := newTestOutbox(t)
+	for _, id := range []string{"m1", "m2"} {
+		if err := outbox.Enqueue(context.Background(), OutboxMessage{MessageID: id, Body: []byte(id)}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		DrainOutbox(ctx, discardLogger(), outbox, p, 10*time.Millisecond)
+	}()
+	b.waitFor("outbox drained to the topic", func() bool { return len(b.receivedAt("topic")) == 2 })
+	cancel()
+	<-done
+
+	for i, msg := range b.receivedAt("topic") {
+		if want := fmt.Sprintf("m%d", i+1); msg.Properties == nil || msg.Properties.MessageID != want {
+			t.Errorf("message %d = %+v, want message ID %s", i, msg.Properties, want)
+		}
+	}
+	if got := drainIDs(t, outbox); len(got) != 0 {
+		t.Errorf("left in outbox %v after publishing", got)
+	}
+}
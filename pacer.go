@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sendPacer spaces sends evenly at a fixed rate. It is a token bucket
+// holding at most one token, refilled every interval, so sends never burst.
+type sendPacer struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// next is when the next token is available.
+	next time.Time
+}
+
+// newSendPacer returns a pacer allowing rate sends per second, or nil when
+// rate is not positive.
+func newSendPacer(rate float64) *sendPacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &sendPacer{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the caller may send. A nil pacer never blocks. If ctx is
+// done first, the reserved token is not returned, so the following sends
+// keep their spacing.
+func (p *sendPacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(p.interval)
+	p.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
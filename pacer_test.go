@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewSendPacer(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want time.Duration
+	}{
+		{rate: 0},
+		{rate: -1},
+		{rate: 1, want: time.Second},
+		{rate: 200, want: 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		p := newSendPacer(tt.rate)
+		if tt.want == 0 {
+			if p != nil {
+				t.Errorf("newSendPacer(%v) = %+v, want nil", tt.rate, p)
+			}
+			continue
+		}
+		if p == nil || p.interval != tt.want {
+			t.Errorf("newSendPacer(%v) = %+v, want interval %s", tt.rate, p, tt.want)
+		}
+	}
+}
+
+func TestSendPacerSpacesSends(t *testing.T) {
+	const sends = 10
+	p := newSendPacer(200)
+	start := time.Now()
+	for range sends {
+		if err := p.wait(context.Background()); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+	}
+	// The first send goes immediately, the others each wait an interval.
+	if elapsed, want := time.Since(start), (sends-1)*p.interval; elapsed < want {
+		t.Errorf("%d sends took %s, want at least %s", sends, elapsed, want)
+	}
+
+	// Idle time does not build up a burst.
+	time.Sleep(10 * p.interval)
+	start = time.Now()
+	for range 3 {
+		p.wait(context.Background())
+	}
+	if elapsed, want := time.Since(start), 2*p.interval; elapsed < want {
+		t.Errorf("sends after idling took %s, want at least %s", elapsed, want)
+	}
+}
+
+func TestSendPacerCancel(t *testing.T) {
+	p := newSendPacer(1)
+	if err := p.wait(context.Background()); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	var nilPacer *sendPacer
+	if err := nilPacer.wait(ctx); err != nil {
+		t.Errorf("nil pacer wait = %v, want nil", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+)
+
+// handlerPanickedReason is the dead-letter reason of messages whose handler
+// panicked under PanicRecoverAndDeadLetter.
+const handlerPanickedReason = "HandlerPanicked"
+
+// PanicPolicy selects what the subscriber does when its handler, or a
+// PreHandleHook or PostHandleHook, panics.
+type PanicPolicy int
+
+const (
+	// PanicRecover recovers and abandons the message, as for a handler
+	// error. It is the default.
+	PanicRecover PanicPolicy = iota
+	// PanicRecoverAndDeadLetter recovers and dead-letters the message with
+	// reason "HandlerPanicked", so it is not redelivered.
+	PanicRecoverAndDeadLetter
+	// PanicPropagate does not recover. A Go panic cannot end just the
+	// worker goroutine, so it terminates the process, leaving the message
+	// to be redelivered once its lock expires and the restarted process to
+	// reconnect.
+	PanicPropagate
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicRecover:
+		return "recover"
+	case PanicRecoverAndDeadLetter:
+		return "recover-and-dead-letter"
+	case PanicPropagate:
+		return "propagate"
+	default:
+		return fmt.Sprintf("PanicPolicy(%d)", int(p))
+	}
+}
+
+// recoverPanic calls fn, converting a panic into a result according to the
+// subscriber's PanicPolicy. what names fn in the error.
+func (s *Subscriber) recoverPanic(what string, fn func() error) (err error) {
+	if s.panicPolicy == PanicPropagate {
+		return fn()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v", what, r)
+			if s.panicPolicy == PanicRecoverAndDeadLetter {
+				err = &SettlementDecision{Policy: PolicyDeadLetter, Reason: handlerPanickedReason, Description: err.Error(), Err: err}
+			}
+		}
+	}()
+	return fn()
+}
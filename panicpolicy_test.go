@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPanicPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     PanicPolicy
+		want       string
+		wantReason any
+	}{
+		{name: "recover", policy: PanicRecover, want: "modified"},
+		{name: "recover and dead-letter", policy: PanicRecoverAndDeadLetter, want: "rejected", wantReason: handlerPanickedReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.PanicPolicy = tt.policy },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					if redelivered(msg) {
+						return nil
+					}
+					panic("boom")
+				}))
+			listenInBackground(t, s)
+
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("panic")))
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.want {
+				t.Errorf("outcome = %q, want %q", got.Outcome, tt.want)
+			}
+			if tt.wantReason != nil && got.Info["DeadLetterReason"] != tt.wantReason {
+				t.Errorf("DeadLetterReason = %v, want %v", got.Info["DeadLetterReason"], tt.wantReason)
+			}
+			if !s.Healthy() {
+				t.Error("subscriber unhealthy after a recovered panic")
+			}
+		})
+	}
+}
+
+func TestHookPanicPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      PanicPolicy
+		preHook     bool
+		want        string
+		wantReason  any
+		wantHandled bool
+	}{
+		{name: "pre-handle recover", policy: PanicRecover, preHook: true, want: "modified"},
+		{name: "pre-handle dead-letter", policy: PanicRecoverAndDeadLetter, preHook: true, want: "rejected", wantReason: handlerPanickedReason},
+		{name: "post-handle recover", policy: PanicRecover, want: "modified", wantHandled: true},
+		{name: "post-handle dead-letter", policy: PanicRecoverAndDeadLetter, want: "rejected", wantReason: handlerPanickedReason, wantHandled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			handled := make(chan struct{}, 1)
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) {
+					o.PanicPolicy = tt.policy
+					if tt.preHook {
+						o.PreHandleHook = func(ctx context.Context, env Envelope) (context.Context, Envelope, error) {
+							if redelivered(env.Message) {
+								return ctx, env, nil
+							}
+							panic("boom")
+						}
+					} else {
+						o.PostHandleHook = func(ctx context.Context, env Envelope, handlerErr error) {
+							if !redelivered(env.Message) {
+								panic("boom")
+							}
+						}
+					}
+				},
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					if !redelivered(msg) {
+						handled <- struct{}{}
+					}
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("panic")))
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.want {
+				t.Errorf("outcome = %q, want %q", got.Outcome, tt.want)
+			}
+			if tt.wantReason != nil && got.Info["DeadLetterReason"] != tt.wantReason {
+				t.Errorf("DeadLetterReason = %v, want %v", got.Info["DeadLetterReason"], tt.wantReason)
+			}
+			if gotHandled := len(handled) == 1; gotHandled != tt.wantHandled {
+				t.Errorf("handler called = %v, want %v", gotHandled, tt.wantHandled)
+			}
+			if !s.Healthy() {
+				t.Error("subscriber unhealthy after a recovered hook panic")
+			}
+		})
+	}
+}
+
+func TestPanicPropagate(t *testing.T) {
+	tests := []struct {
+		name       string
+		subscriber *Subscriber
+		handler    MessageHandler
+	}{
+		{
+			name:       "handler",
+			subscriber: &Subscriber{panicPolicy: PanicPropagate},
+			handler:    func(ctx context.Context, msg *amqp.Message) error { panic("boom") },
+		},
+		{
+			name: "pre-handle hook",
+			subscriber: &Subscriber{panicPolicy: PanicPropagate, preHandle: func(ctx context.Context, env Envelope) (context.Context, Envelope, error) {
+				panic("boom")
+			}},
+			handler: func(ctx context.Context, msg *amqp.Message) error { return nil },
+		},
+		{
+			name: "post-handle hook",
+			subscriber: &Subscriber{panicPolicy: PanicPropagate, postHandle: func(ctx context.Context, env Envelope, handlerErr error) {
+				panic("boom")
+			}},
+			handler: func(ctx context.Context, msg *amqp.Message) error { return nil },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != "boom" {
+					t.Errorf("recovered %v, want boom", r)
+				}
+			}()
+			tt.subscriber.callHandler(context.Background(), tt.handler, amqp.NewMessage(nil))
+			t.Error("panic not propagated")
+		})
+	}
+}
+
+func TestPanicPolicyString(t *testing.T) {
+	tests := []struct {
+		policy PanicPolicy
+		want   string
+	}{
+		{PanicRecover, "recover"},
+		{PanicRecoverAndDeadLetter, "recover-and-dead-letter"},
+		{PanicPropagate, "propagate"},
+		{PanicPolicy(9), "PanicPolicy(9)"},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.String(); got != tt.want {
+			t.Errorf("PanicPolicy(%d).String() = %q, want %q", int(tt.policy), got, tt.want)
+		}
+	}
+}
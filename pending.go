@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pendingLimit pauses receiving while too many received messages are not yet
+// handled: once max are pending it blocks wait until the count drops to half
+// of max.
+type pendingLimit struct {
+	max int
+
+	mu    sync.Mutex
+	count int
+	// resume is closed when receiving may continue; nil while not paused.
+	resume chan struct{}
+}
+
+// newPendingLimit returns a limit of n pending messages, or nil when n is not
+// positive.
+func newPendingLimit(n int) *pendingLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &pendingLimit{max: n}
+}
+
+// received counts a message received. A nil limit does nothing.
+func (l *pendingLimit) received() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	if l.count >= l.max && l.resume == nil {
+		l.resume = make(chan struct{})
+	}
+}
+
+// handled counts a received message as handled.
+func (l *pendingLimit) handled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count--
+	if l.resume != nil && l.count <= l.max/2 {
+		close(l.resume)
+		l.resume = nil
+	}
+}
+
+// wait blocks while receiving is paused or until ctx is done.
+func (l *pendingLimit) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	resume := l.resume
+	l.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
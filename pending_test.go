@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingLimit(t *testing.T) {
+	// steps is a string of r (received) and h (handled).
+	tests := []struct {
+		name       string
+		max        int
+		steps      string
+		wantPaused bool
+	}{
+		{name: "below the limit", max: 4, steps: "rrr", wantPaused: false},
+		{name: "at the limit", max: 4, steps: "rrrr", wantPaused: true},
+		{name: "above half", max: 4, steps: "rrrrh", wantPaused: true},
+		{name: "back to half", max: 4, steps: "rrrrhh", wantPaused: false},
+		{name: "paused again", max: 4, steps: "rrrrhhrr", wantPaused: true},
+		{name: "handled as received", max: 2, steps: "rhrhrh", wantPaused: false},
+		{name: "odd limit", max: 3, steps: "rrrhh", wantPaused: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newPendingLimit(tt.max)
+			for _, step := range strings.Split(tt.steps, "") {
+				if step == "r" {
+					l.received()
+				} else {
+					l.handled()
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if paused := l.wait(ctx) != nil; paused != tt.wantPaused {
+				t.Errorf("paused = %v, want %v", paused, tt.wantPaused)
+			}
+		})
+	}
+}
+
+func TestPendingLimitResumes(t *testing.T) {
+	l := newPendingLimit(2)
+	l.received()
+	l.received()
+	resumed := make(chan error, 1)
+	go func() { resumed <- l.wait(context.Background()) }()
+	select {
+	case err := <-resumed:
+		t.Fatalf("wait returned %v while paused", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.handled()
+	if err := <-resumed; err != nil {
+		t.Errorf("wait = %v, want nil", err)
+	}
+}
+
+func TestNilPendingLimit(t *testing.T) {
+	if l := newPendingLimit(0); l != nil {
+		t.Fatalf("newPendingLimit(0) = %+v, want nil", l)
+	}
+	var l *pendingLimit
+	l.received()
+	l.handled()
+	if err := l.wait(context.Background()); err != nil {
+		t.Errorf("wait = %v, want nil", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// priorityProperty is the application property read by PriorityPublisher.
+const priorityProperty = "amqp_priority"
+
+// ErrPublisherClosed is returned for messages queued on a PriorityPublisher
+// after it was closed, or still queued when it was.
+var ErrPublisherClosed = errors.New("publisher closed")
+
+// prioritySend is a message queued on a PriorityPublisher.
+type prioritySend struct {
+	ctx      context.Context
+	msg      *amqp.Message
+	priority int64
+	// seq keeps messages of equal priority in the order they were queued.
+	seq    uint64
+	result chan error
+}
+
+// priorityQueue is a container/heap of queued sends, highest priority first.
+type priorityQueue []*prioritySend
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *priorityQueue) Push(x any) { *q = append(*q, x.(*prioritySend)) }
+
+func (q *priorityQueue) Pop() any {
+	old := *q
+	send := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return send
+}
+
+// PriorityPublisher sends messages through a Publisher one at a time, taking
+// the queued message with the highest priority first, so urgent messages
+// overtake those queued before them. The priority is the integer
+// "amqp_priority" application property; messages without it have priority 0.
+type PriorityPublisher struct {
+	publisher *Publisher
+
+	mu     sync.Mutex
+	queue  priorityQueue
+	seq    uint64
+	closed bool
+	// queued is signalled when a message is queued.
+	queued chan struct{}
+	done   chan struct{}
+}
+
+// NewPriorityPublisher starts sending the messages queued with Publish
+// through publisher. The returned func stops it, failing the messages still
+// queued with ErrPublisherClosed once the current send completes.
+func NewPriorityPublisher(publisher *Publisher) (*PriorityPublisher, func()) {
+	pp := &PriorityPublisher{
+		publisher: publisher,
+		queued:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		pp.run()
+	}()
+	return pp, func() {
+		pp.mu.Lock()
+		if !pp.closed {
+			pp.closed = true
+			close(pp.done)
+		}
+		pp.mu.Unlock()
+		<-stopped
+	}
+}
+
+// Publish queues msg and waits until it is sent, returning the result of
+// Publisher.PublishMessage. If ctx is done first the message is dropped
+// from the queue if it was not sent yet.
+func (pp *PriorityPublisher) Publish(ctx context.Context, msg *amqp.Message) error {
+	send := &prioritySend{ctx: ctx, msg: msg, priority: priorityOf(msg), result: make(chan error, 1)}
+	pp.mu.Lock()
+	if pp.closed {
+		pp.mu.Unlock()
+		return ErrPublisherClosed
+	}
+	send.seq = pp.seq
+	pp.seq++
+	heap.Push(&pp.queue, send)
+	pp.mu.Unlock()
+	select {
+	case pp.queued <- struct{}{}:
+	default:
+	}
+
+	select {
+	case err := <-send.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (pp *PriorityPublisher) run() {
+	for {
+		send := pp.next()
+		if send == nil {
+			select {
+			case <-pp.queued:
+				continue
+			case <-pp.done:
+				pp.failQueued()
+				return
+			}
+		}
+		if err := send.ctx.Err(); err != nil {
+			send.result <- err
+			continue
+		}
+		send.result <- pp.publisher.PublishMessage(send.ctx, send.msg)
+	}
+}
+
+// next pops the queued send with the highest priority, or returns nil when
+// none is queued.
+func (pp *PriorityPublisher) next() *prioritySend {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.queue.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&pp.queue).(*prioritySend)
+}
+
+func (pp *PriorityPublisher) failQueued() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, send := range pp.queue {
+		send.result <- ErrPublisherClosed
+	}
+	pp.queue = nil
+}
+
+// priorityOf returns the priority of msg.
+func priorityOf(msg *amqp.Message) int64 {
+	priority, _ := integerProperty(msg.ApplicationProperties[priorityProperty], 64)
+	return priority
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPriorityPublisherOrder(t *testing.T) {
+	b := newTestBroker(t)
+	// The broker holds the first message until release is closed, so the
+	// others queue up behind it.
+	var mu sync.Mutex
+	var sent []string
+	sending := make(chan struct{}, 1)
+	release := make(chan struct{})
+	b.sendOutcome = func(address string, msg *amqp.Message) brokerState {
+		mu.Lock()
+		sent = append(sent, string(msg.GetData()))
+		first := len(sent) == 1
+		mu.Unlock()
+		if first {
+			sending <- struct{}{}
+			<-release
+		}
+		return brokerState{Outcome: "accepted"}
+	}
+	pp, stop := NewPriorityPublisher(newBrokerPublisher(t, b.config()))
+	t.Cleanup(stop)
+	unblock := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(unblock)
+
+	var wg sync.WaitGroup
+	publish := func(body string, priority any) {
+		msg := amqp.NewMessage([]byte(body))
+		if priority != nil {
+			msg.ApplicationProperties = map[string]any{priorityProperty: priority}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pp.Publish(context.Background(), msg); err != nil {
+				t.Errorf("Publish(%s) = %v", body, err)
+			}
+		}()
+	}
+	queued := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pp.mu.Lock()
+			got := pp.queue.Len()
+			pp.mu.Unlock()
+			if got == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("queued %d messages, want %d", got, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	publish("blocker", nil)
+	<-sending
+	for i, m := range []struct {
+		body     string
+		priority any
+	}{
+		{"low-1", int64(1)},
+		{"none", nil},
+		{"high", int32(9)},
+		{"low-2", int64(1)},
+		{"mid", "5"},
+	} {
+		publish(m.body, m.priority)
+		queued(i + 1)
+	}
+	unblock()
+	wg.Wait()
+
+	want := []string{"blocker", "high", "mid", "low-1", "low-2", "none"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+}
+
+func TestPriorityPublisherClosed(t *testing.T) {
+	b := newTestBroker(t)
+	pp, stop := NewPriorityPublisher(newBrokerPublisher(t, b.config()))
+	stop()
+	if err := pp.Publish(context.Background(), amqp.NewMessage([]byte("late"))); !errors.Is(err, ErrPublisherClosed) {
+		t.Errorf("Publish() after stop = %v, want ErrPublisherClosed", err)
+	}
+	if got := len(b.receivedAt("topic")); got != 0 {
+		t.Errorf("broker received %d messages, want 0", got)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+// AMQPType is the AMQP type an application property is encoded as.
+type AMQPType int
+
+const (
+	// AMQPTypeString encodes the value's fmt.Sprint form as a string.
+	AMQPTypeString AMQPType = iota
+	// AMQPTypeBinary encodes a []byte or string as binary.
+	AMQPTypeBinary
+	// AMQPTypeInt32 encodes an integer or decimal string as an int.
+	AMQPTypeInt32
+	// AMQPTypeInt64 encodes an integer or decimal string as a long.
+	AMQPTypeInt64
+	// AMQPTypeBool encodes a bool or boolean string as a boolean.
+	AMQPTypeBool
+	// AMQPTypeUUID encodes a UUID, [16]byte or UUID string as a uuid.
+	AMQPTypeUUID
+)
+
+func (t AMQPType) String() string {
+	switch t {
+	case AMQPTypeString:
+		return "string"
+	case AMQPTypeBinary:
+		return "binary"
+	case AMQPTypeInt32:
+		return "int32"
+	case AMQPTypeInt64:
+		return "int64"
+	case AMQPTypeBool:
+		return "bool"
+	case AMQPTypeUUID:
+		return "uuid"
+	default:
+		return fmt.Sprintf("AMQPType(%d)", int(t))
+	}
+}
+
+// applicationProperties returns properties with the values named in types
+// converted to the Go types go-amqp encodes as those AMQP types. Properties
+// without a type are passed as is.
+func applicationProperties(properties map[string]any, types map[string]AMQPType) (map[string]any, error) {
+	if len(properties) == 0 {
+		return nil, nil
+	}
+	converted := make(map[string]any, len(properties))
+	for name, value := range properties {
+		t, ok := types[name]
+		if !ok {
+			converted[name] = value
+			continue
+		}
+		v, err := convertProperty(value, t)
+		if err != nil {
+			return nil, fmt.Errorf("application property %s: %w", name, err)
+		}
+		converted[name] = v
+	}
+	return converted, nil
+}
+
+func convertProperty(value any, t AMQPType) (any, error) {
+	switch t {
+	case AMQPTypeString:
+		return fmt.Sprint(value), nil
+	case AMQPTypeBinary:
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+	case AMQPTypeInt32:
+		if n, ok := integerProperty(value, 32); ok {
+			return int32(n), nil
+		}
+	case AMQPTypeInt64:
+		if n, ok := integerProperty(value, 64); ok {
+			return n, nil
+		}
+	case AMQPTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+	case AMQPTypeUUID:
+		switch v := value.(type) {
+		case amqp.UUID:
+			return v, nil
+		case uuid.UUID:
+			return amqp.UUID(v), nil
+		case [16]byte:
+			return amqp.UUID(v), nil
+		case string:
+			if id, err := uuid.Parse(v); err == nil {
+				return amqp.UUID(id), nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown AMQP type %v", t)
+	}
+	return nil, fmt.Errorf("cannot encode %T as %v", value, t)
+}
+
+// integerProperty returns value as an integer that fits in bits.
+func integerProperty(value any, bits int) (int64, bool) {
+	var n int64
+	switch v := value.(type) {
+	case int:
+		n = int64(v)
+	case int8:
+		n = int64(v)
+	case int16:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint8:
+		n = int64(v)
+	case uint16:
+		n = int64(v)
+	case uint32:
+		n = int64(v)
+	case string:
+		parsed, err := strconv.ParseInt(v, 10, bits)
+		if err != nil {
+			return 0, false
+		}
+		return parsed, true
+	default:
+		return 0, false
+	}
+	if bits < 64 && (n < -1<<(bits-1) || n >= 1<<(bits-1)) {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+func TestApplicationPropertyTypes(t *testing.T) {
+	id := uuid.MustParse("6f1c1d9e-2d3b-4a5c-8e7f-9a0b1c2d3e4f")
+	tests := []struct {
+		name    string
+		value   any
+		typ     AMQPType
+		want    any
+		wantErr bool
+	}{
+		{name: "string", value: 42, typ: AMQPTypeString, want: "42"},
+		{name: "binary from string", value: "raw", typ: AMQPTypeBinary, want: []byte("raw")},
+		{name: "binary from bytes", value: []byte{1, 2}, typ: AMQPTypeBinary, want: []byte{1, 2}},
+		{name: "binary from int", value: 1, typ: AMQPTypeBinary, wantErr: true},
+		{name: "int32", value: int64(7), typ: AMQPTypeInt32, want: int32(7)},
+		{name: "int32 from string", value: "-7", typ: AMQPTypeInt32, want: int32(-7)},
+		{name: "int32 overflow", value: int64(1) << 31, typ: AMQPTypeInt32, wantErr: true},
+		{name: "int64", value: "9000000000", typ: AMQPTypeInt64, want: int64(9000000000)},
+		{name: "bool from string", value: "true", typ: AMQPTypeBool, want: true},
+		{name: "bool from int", value: 1, typ: AMQPTypeBool, wantErr: true},
+		{name: "UUID from string", value: id.String(), typ: AMQPTypeUUID, want: amqp.UUID(id)},
+		{name: "UUID", value: id, typ: AMQPTypeUUID, want: amqp.UUID(id)},
+		{name: "invalid UUID", value: "not-a-uuid", typ: AMQPTypeUUID, wantErr: true},
+		{name: "unknown type", value: "v", typ: AMQPType(99), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applicationProperties(map[string]any{"p": tt.value, "untyped": 1}, map[string]AMQPType{"p": tt.typ})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applicationProperties() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got["p"], tt.want) {
+				t.Errorf("p = %#v, want %#v", got["p"], tt.want)
+			}
+			if got["untyped"] != 1 {
+				t.Errorf("untyped property = %#v, want it passed as is", got["untyped"])
+			}
+		})
+	}
+}
+
+func TestPublishPropertyTypes(t *testing.T) {
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config())
+	opts := &SendOptions{
+		ApplicationProperties: map[string]any{"signature": "c2lnbmVk", "count": "3", "plain": "text"},
+		PropertyTypes:         map[string]AMQPType{"signature": AMQPTypeBinary, "count": AMQPTypeInt32},
+	}
+	if err := p.Publish(context.Background(), "body", opts); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	received := b.receivedAt("topic")
+	if len(received) != 1 {
+		t.Fatalf("broker received %d messages, want 1", len(received))
+	}
+	want := map[string]any{"signature": []byte("c2lnbmVk"), "count": int32(3), "plain": "text"}
+	if got := received[0].ApplicationProperties; !reflect.DeepEqual(got, want) {
+		t.Errorf("received application properties %#v, want %#v", got, want)
+	}
+
+	// On the wire the binary property's value follows its str8 key with
+	// the vbin8 type code 0xa0, where a string would have str8's 0xa1.
+	encoded, err := received[0].MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode received message: %v", err)
+	}
+	key := append([]byte{0xa1, byte(len("signature"))}, "signature"...)
+	i := bytes.Index(encoded, key)
+	if i < 0 || i+len(key) >= len(encoded) {
+		t.Fatal("signature property not found in the encoded message")
+	}
+	if code := encoded[i+len(key)]; code != 0xa0 {
+		t.Errorf("signature encoded with type code %#x, want vbin8 0xa0", code)
+	}
+}
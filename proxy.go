@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// dialAMQP opens the AMQP connection to config.ConnectionString over
+// config.Transport, through config.ProxyURL when set. With AMQPFrameLog the
+// connection's traffic is logged to logger at LevelTrace.
+func dialAMQP(ctx context.Context, logger *slog.Logger, config AmqpConfig, opts *amqp.ConnOptions) (*amqp.Conn, error) {
+	if config.Transport != TransportWebSocket && config.ProxyURL == nil && !config.AMQPFrameLog {
+		return amqp.Dial(ctx, config.ConnectionString, opts)
+	}
+
+	u, err := url.Parse(config.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	// amqp.NewConn does not parse the connection string, so TLS and the
+	// SASL credentials Dial takes from it are set up here.
+	var connOpts amqp.ConnOptions
+	if opts != nil {
+		connOpts = *opts
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if connOpts.TLSConfig != nil {
+		tlsConfig = connOpts.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	var conn net.Conn
+	switch {
+	case config.Transport == TransportWebSocket:
+		conn, err = dialWebSocket(ctx, u.Hostname(), config.ProxyURL, tlsConfig)
+	case config.ProxyURL != nil:
+		conn, err = dialTunneled(ctx, u, config.ProxyURL, tlsConfig)
+	default:
+		conn, err = dialDirect(ctx, u, tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.AMQPFrameLog {
+		conn = &frameLogConn{Conn: conn, logger: logger.With("broker", u.Host)}
+	}
+	connOpts.TLSConfig = nil
+	if u.User != nil {
+		password, _ := u.User.Password()
+		connOpts.SASLType = amqp.SASLTypePlain(u.User.Username(), password)
+	}
+	if connOpts.HostName == "" {
+		connOpts.HostName = u.Hostname()
+	}
+	return amqp.NewConn(ctx, conn, &connOpts)
+}
+
+// dialDirect connects to the broker at u, with TLS for amqps URLs, as
+// amqp.Dial would.
+func dialDirect(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	secure, addr := brokerAddr(u)
+	var conn net.Conn
+	var err error
+	if secure {
+		dialer := tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// brokerAddr returns the address of the broker at u and whether the URL asks
+// for TLS.
+func brokerAddr(u *url.URL) (bool, string) {
+	secure := u.Scheme == "amqps" || u.Scheme == "amqp+ssl"
+	port := u.Port()
+	if port == "" {
+		port = "5672"
+		if secure {
+			port = "5671"
+		}
+	}
+	return secure, net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialTunneled connects to the broker at u through the proxy at proxyURL,
+// with TLS for amqps URLs.
+func dialTunneled(ctx context.Context, u *url.URL, proxyURL *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	secure, addr := brokerAddr(u)
+	conn, err := dialProxyTunnel(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s through proxy failed: %w", u.Host, err)
+	}
+	return tlsConn, nil
+}
+
+// dialProxyTunnel connects to the HTTP proxy at proxyURL and asks it to open
+// a tunnel to target with CONNECT, returning the tunneled connection.
+func dialProxyTunnel(ctx context.Context, proxyURL *url.URL, target string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddr, target, resp.Status)
+	}
+	// The broker does not speak before the client, so nothing may follow
+	// the response yet.
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s sent unexpected data after CONNECT response", proxyAddr)
+	}
+	return conn, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// testProxy is an HTTP proxy that answers CONNECT requests with status and,
+// on 200, tunnels the connection to the requested address.
+type testProxy struct {
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// newTestProxy starts a proxy answering with status, stopped when the test
+// ends, and returns it with its URL.
+func newTestProxy(t *testing.T, status int) (*testProxy, *url.URL) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &testProxy{status: status}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p, &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+	if p.status != http.StatusOK {
+		(&http.Response{StatusCode: p.status, ProtoMajor: 1, ProtoMinor: 1}).Write(conn)
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		(&http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1}).Write(conn)
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// connects returns the CONNECT requests received so far.
+func (p *testProxy) connects() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*http.Request(nil), p.requests...)
+}
+
+func TestPublishThroughProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		user     *url.Userinfo
+		wantAuth string
+		wantErr  bool
+	}{
+		{name: "tunneled", status: http.StatusOK},
+		{name: "with credentials", status: http.StatusOK, user: url.UserPassword("proxy-user", "p@ss"),
+			wantAuth: "Basic " + base64.StdEncoding.EncodeToString([]byte("proxy-user:p@ss"))},
+		{name: "refused", status: http.StatusProxyAuthRequired, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			proxy, proxyURL := newTestProxy(t, tt.status)
+			proxyURL.User = tt.user
+			config := b.config()
+			config.ProxyURL = proxyURL
+
+			p, cleanup, err := NewPublisher(context.Background(), discardLogger(), config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPublisher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			connects := proxy.connects()
+			if len(connects) != 1 {
+				t.Fatalf("proxy received %d requests, want 1", len(connects))
+			}
+			brokerAddr := b.listener.Addr().String()
+			if req := connects[0]; req.Method != http.MethodConnect || req.Host != brokerAddr || req.Header.Get("Proxy-Authorization") != tt.wantAuth {
+				t.Errorf("proxy request %s %s with Proxy-Authorization %q, want CONNECT %s with %q",
+					req.Method, req.Host, req.Header.Get("Proxy-Authorization"), brokerAddr, tt.wantAuth)
+			}
+			if err != nil {
+				return
+			}
+			defer cleanup()
+
+			if err := p.Publish(context.Background(), "tunneled", nil); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+			if got := len(b.receivedAt("topic")); got != 1 {
+				t.Errorf("broker received %d messages, want 1", got)
+			}
+		})
+	}
+}
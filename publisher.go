@@ -0,0 +1,1122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// SendOptions holds optional per-message settings for Publish.
+type SendOptions struct {
+	// MessageID identifies the message for Service Bus duplicate detection.
+	// A random UUID is generated when empty.
+	MessageID string
+	// ScheduledEnqueueTime delays delivery of the message until the given time.
+	ScheduledEnqueueTime *time.Time
+	// TimeToLive, when positive, is set as the header TTL. Service Bus drops
+	// or dead-letters the message if it is not consumed in time.
+	TimeToLive time.Duration
+	// PartitionKey selects the partition of a partitioned topic.
+	PartitionKey string
+	// ViaPartitionKey selects the partition of the transfer queue used for
+	// transactional sends.
+	ViaPartitionKey string
+	// ApplicationProperties are the message's custom properties.
+	ApplicationProperties map[string]any
+	// PropertyTypes names the AMQP type of application properties that must
+	// not be sent with the type go-amqp infers from their Go value, e.g. a
+	// string sent as binary.
+	PropertyTypes map[string]AMQPType
+}
+
+// PublisherOptions holds the optional settings of a Publisher.
+type PublisherOptions struct {
+	// Metrics records publish counts and latency when set.
+	Metrics MetricsRecorder
+	// MeterProvider, when set, also records the metrics with OpenTelemetry
+	// instruments of its meter.
+	MeterProvider metric.MeterProvider
+	// MetricsFlushInterval, when positive, flushes Metrics at this interval
+	// and on close if it buffers updates, as a StatsDExporter from
+	// NewBufferedStatsDExporter does.
+	MetricsFlushInterval time.Duration
+	// CircuitBreaker, when set, rejects sends with ErrCircuitOpen after
+	// repeated failures until probe sends succeed again.
+	CircuitBreaker *CircuitBreakerOptions
+	// Logger replaces the logger passed to NewPublisher when set.
+	Logger *slog.Logger
+	// DispositionTimeout, when positive, bounds how long each send waits for
+	// the broker's disposition once the message is transferred. The send then
+	// fails with ErrDispositionTimeout, leaving the link open.
+	DispositionTimeout time.Duration
+	// Encoder serializes the values passed to PublishTyped. Defaults to
+	// JSONEncoder.
+	Encoder Encoder
+	// ErrorSinkTopic, when set, receives every message whose send failed or
+	// was rejected by the broker once retries are exhausted, with the
+	// "x-original-topic" application property naming the topic it was
+	// meant for. Messages held back before being sent, such as with
+	// ErrCircuitOpen or ErrRetryBudgetExhausted, are not. The publish error
+	// is still returned.
+	ErrorSinkTopic string
+	// SmoothSendRate, when positive, spaces sends evenly at this many
+	// messages per second, delaying callers as needed instead of letting
+	// them burst.
+	SmoothSendRate float64
+	// Management, when set, supplies the topic's duplicate detection window.
+	// The publisher refreshes it every 5 minutes until it is closed.
+	// Publishing a message ID again within the window logs a warning, as
+	// Service Bus will silently drop the message.
+	Management *ManagementClient
+	// ThrottleOnQueueDepth, when positive, blocks sends while more than this
+	// many active messages wait in the topic's subscriptions, as polled
+	// through Management every ThrottleCheckInterval (default 10s).
+	// NewPublisher creates a ManagementClient for the topic when Management
+	// is not set, and PublisherRegistry.Register one for every registered
+	// topic. Blocked sends fail when their context is done.
+	ThrottleOnQueueDepth  int64
+	ThrottleCheckInterval time.Duration
+	// DualWriteEventGrid also posts every published message to the Event
+	// Grid topic at EventGridEndpoint as a CloudEvent, authenticated with
+	// EventGridKey when set. Event Grid failures are logged as warnings and
+	// never fail the AMQP send.
+	DualWriteEventGrid bool
+	EventGridEndpoint  string
+	EventGridKey       string
+	// EventGridRetryPolicy retries Event Grid posts that fail with a
+	// retryable status, 429 and 503 unless configured otherwise. Without
+	// MaxRetries they are not retried.
+	EventGridRetryPolicy RetryPolicy
+	// GlobalRetryBudget, when set, limits the retries of sends that failed
+	// because the session or connection was lost. A send with no retry left
+	// fails at once with ErrRetryBudgetExhausted; the session is still
+	// reopened for later sends. Share one budget between publishers to
+	// bound their retries together.
+	GlobalRetryBudget *RetryBudget
+	// LinkAttachTimeout, when positive, bounds each attempt to attach a
+	// sender, which otherwise waits as long as the caller's context when the
+	// broker does not answer. Timed out attempts are retried up to
+	// LinkAttachMaxRetries times.
+	LinkAttachTimeout    time.Duration
+	LinkAttachMaxRetries int
+	// BodyEncoding selects how the bodies of the messages the publisher
+	// builds are written, raw (the default) or base64. Messages passed to
+	// PublishMessage and PublishWithReceipt are sent as they are.
+	BodyEncoding BodyEncoding
+	// OrderedPartitions sends messages with the same partition key one at
+	// a time, in the order they are published, so concurrent publishers
+	// cannot reorder a key's messages. Sends for different keys, and of
+	// messages without a key, still run concurrently.
+	OrderedPartitions bool
+	// Validators run in order on every message before it is sent; the
+	// first error fails the publish with ErrInvalidMessage.
+	Validators []MessageValidator
+	// MaxMessageBodyBytes, when positive, fails publishes of messages
+	// whose data sections hold more than this many bytes with
+	// ErrMessageTooLarge, before they are validated or sent.
+	MaxMessageBodyBytes int
+	// SubjectPrefix, when set, is prepended to the subject of every
+	// message, for subscription rules that route on subject prefixes.
+	// Messages without a subject get the prefix as subject, and subjects
+	// already starting with it are left as they are, so that republishing
+	// a message does not prefix it twice.
+	SubjectPrefix string
+	// DrainBeforeClose makes the publisher's cleanup wait, for up to 5s,
+	// until sends in progress have their disposition before detaching the
+	// sender, as Drain does. The sender's credit is granted by the broker,
+	// and AMQP only lets the receiving side drain it, so this is the
+	// sender-side equivalent. Without it cleanup detaches immediately and
+	// sends in progress fail.
+	DrainBeforeClose bool
+	// Middleware wraps every PublishMessage and PublishWithReceipt call, the
+	// first outermost, e.g. to add application properties from the context.
+	Middleware []PublisherMiddleware
+}
+
+// ErrDispositionTimeout is returned when the broker does not settle a sent
+// message within PublisherOptions.DispositionTimeout. The message may still
+// have been accepted.
+var ErrDispositionTimeout = errors.New("timed out waiting for message disposition")
+
+// PublisherOption configures a Publisher in NewPublisher.
+type PublisherOption func(*PublisherOptions)
+
+// WithCircuitBreaker enables the publisher's circuit breaker.
+func WithCircuitBreaker(opts CircuitBreakerOptions) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.CircuitBreaker = &opts
+	}
+}
+
+// WithEncoder serializes the values passed to PublishTyped with e.
+func WithEncoder(e Encoder) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Encoder = e
+	}
+}
+
+// WithPublisherLogger logs to l instead of the logger passed to NewPublisher.
+func WithPublisherLogger(l *slog.Logger) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Logger = l
+	}
+}
+
+// WithPublisherMetrics records publish metrics to m.
+func WithPublisherMetrics(m MetricsRecorder) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithPublisherOTELMeterProvider also records publish metrics with the
+// OpenTelemetry meter of mp.
+func WithPublisherOTELMeterProvider(mp metric.MeterProvider) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.MeterProvider = mp
+	}
+}
+
+// WithValidators runs v, in order, on every message before it is sent.
+func WithValidators(v ...MessageValidator) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Validators = append(o.Validators, v...)
+	}
+}
+
+// WithContextExtractor adds the properties extractor returns for the
+// publish context, such as a tenant ID, to the application properties of
+// every message. Properties the message already has are kept. It is added
+// as middleware, after any added before.
+func WithContextExtractor(extractor func(ctx context.Context) map[string]string) PublisherOption {
+	return WithPublisherMiddleware(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			for key, value := range extractor(ctx) {
+				if _, ok := msg.ApplicationProperties[key]; ok {
+					continue
+				}
+				if msg.ApplicationProperties == nil {
+					msg.ApplicationProperties = make(map[string]any)
+				}
+				msg.ApplicationProperties[key] = value
+			}
+			return next(ctx, msg)
+		}
+	})
+}
+
+// WithPublisherMiddleware wraps every publish in m, in addition to any
+// middleware added before.
+func WithPublisherMiddleware(m ...PublisherMiddleware) PublisherOption {
+	return func(o *PublisherOptions) {
+		o.Middleware = append(o.Middleware, m...)
+	}
+}
+
+type Publisher struct {
+	// conn is replaced when the warm standby connection is promoted.
+	conn    atomic.Pointer[amqp.Conn]
+	topic   string
+	logger  *slog.Logger
+	metrics MetricsRecorder
+	breaker *circuitBreaker
+	pacer   *sendPacer
+	// throttle blocks sends while the topic's backlog is too deep.
+	throttle *depthThrottle
+	// retryBudget limits retries after session or connection failures.
+	retryBudget *RetryBudget
+	// partitions serializes sends per partition key when set.
+	partitions *partitionQueues
+	// eventGrid receives a copy of every published message when set.
+	eventGrid *eventGridForwarder
+	// publishedIDs warns about message IDs reused within the duplicate
+	// detection window.
+	publishedIDs *publishedIDs
+	encoder      Encoder
+	bodyEncoding BodyEncoding
+	validators   []MessageValidator
+	maxBodyBytes int
+	// subjectPrefix is copied from PublisherOptions.
+	subjectPrefix string
+	middleware    []PublisherMiddleware
+	// drainBeforeClose is copied from PublisherOptions.
+	drainBeforeClose bool
+	// errorSinkTopic receives the messages that failed to publish.
+	errorSinkTopic string
+	// dispositionTimeout bounds the wait for each send's disposition.
+	dispositionTimeout time.Duration
+	// linkAttachTimeout and linkAttachRetries bound sender attaches.
+	linkAttachTimeout time.Duration
+	linkAttachRetries int
+	// inFlight counts sends in progress, including those waiting for
+	// SmoothSendRate or a retry; pendingAcks only those waiting for the
+	// broker's disposition.
+	inFlight    atomic.Int64
+	pendingAcks atomic.Int64
+	// latencies feeds Stats.
+	latencies latencyWindow
+	// metricsFlush flushes metrics with MetricsFlushInterval.
+	metricsFlush *metricsFlush
+	// stopManagement ends the refresh of PublisherOptions.Management.
+	stopManagement context.CancelFunc
+
+	mu      sync.RWMutex
+	session *amqp.Session
+	sender  *amqp.Sender
+	// standby is the idle connection to the secondary broker kept with
+	// AmqpConfig.WarmStandby, until it is promoted.
+	standby *amqp.Conn
+
+	// stateMu guards the link state read by health probes. It is separate
+	// from mu so probes never wait for a reconnect to finish.
+	stateMu sync.Mutex
+	// linkErr is the last link, session or connection failure seen by Publish,
+	// cleared by the next successful send.
+	linkErr error
+	// reconnecting is set while the session and sender are being reopened.
+	reconnecting bool
+
+	// replyListeners caches the listener of each reply address used by
+	// Request.
+	replyMu        sync.Mutex
+	replyListeners map[string]*ReplyListener
+
+	// sinkSession and sinkSender are attached to the error-sink topic on
+	// the first failed publish.
+	sinkMu      sync.Mutex
+	sinkSession *amqp.Session
+	sinkSender  *amqp.Sender
+}
+
+func NewPublisher(ctx context.Context, logger *slog.Logger, config AmqpConfig, opts ...PublisherOption) (*Publisher, func(), error) {
+	var options PublisherOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Logger != nil {
+		logger = options.Logger
+	}
+
+	conn, err := dial(ctx, logger, config, config.Topic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
+	}
+
+	if options.ThrottleOnQueueDepth > 0 && options.Management == nil {
+		options.Management = NewManagementClient(logger, config)
+	}
+	if options.ErrorSinkTopic != "" {
+		// Publishers of a PublisherRegistry share the connection and so its
+		// authorization for the error sink.
+		if err := authorize(ctx, logger, conn, config, options.ErrorSinkTopic); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to authorize error sink topic %s: %w", options.ErrorSinkTopic, err)
+		}
+	}
+
+	publisher, err := newPublisher(ctx, conn, config.Topic, logger, options)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var standby *amqp.Conn
+	if config.WarmStandby {
+		if standby, err = dialStandby(ctx, logger, config); err != nil {
+			publisher.close(ctx)
+			conn.Close()
+			return nil, nil, err
+		}
+		publisher.standby = standby
+	}
+
+	cleanup := func() {
+		publisher.close(ctx)
+		conn.Close()
+		if standby != nil {
+			standby.Close()
+		}
+	}
+
+	return publisher, cleanup, nil
+}
+
+// newPublisher attaches a publisher for topic to an open connection, which
+// stays owned by the caller.
+func newPublisher(ctx context.Context, conn *amqp.Conn, topic string, logger *slog.Logger, options PublisherOptions) (*Publisher, error) {
+	metrics, err := withOTelMetrics(options.Metrics, options.MeterProvider, attribute.String("topic", topic))
+	if err != nil {
+		return nil, err
+	}
+	publisher := &Publisher{
+		topic:              topic,
+		logger:             logger.With("topic", topic),
+		metrics:            metrics,
+		dispositionTimeout: options.DispositionTimeout,
+		linkAttachTimeout:  options.LinkAttachTimeout,
+		linkAttachRetries:  max(options.LinkAttachMaxRetries, 0),
+		encoder:            options.Encoder,
+		bodyEncoding:       options.BodyEncoding,
+		validators:         options.Validators,
+		maxBodyBytes:       options.MaxMessageBodyBytes,
+		subjectPrefix:      options.SubjectPrefix,
+		middleware:         options.Middleware,
+		drainBeforeClose:   options.DrainBeforeClose,
+		errorSinkTopic:     options.ErrorSinkTopic,
+		pacer:              newSendPacer(options.SmoothSendRate),
+		retryBudget:        options.GlobalRetryBudget,
+		partitions:         newPartitionQueues(options.OrderedPartitions),
+		publishedIDs:       newPublishedIDs(options.Management),
+	}
+	if publisher.encoder == nil {
+		publisher.encoder = JSONEncoder{}
+	}
+	if publisher.metrics == nil {
+		publisher.metrics = noMetrics
+	}
+	publisher.conn.Store(conn)
+	if options.DualWriteEventGrid {
+		if options.EventGridEndpoint == "" {
+			return nil, errors.New("DualWriteEventGrid requires an EventGridEndpoint")
+		}
+		publisher.eventGrid = &eventGridForwarder{
+			endpoint: options.EventGridEndpoint,
+			key:      options.EventGridKey,
+			client:   &http.Client{Timeout: eventGridTimeout},
+			retry:    options.EventGridRetryPolicy,
+			logger:   publisher.logger,
+		}
+	}
+	if options.CircuitBreaker != nil {
+		publisher.breaker = newCircuitBreaker(*options.CircuitBreaker)
+	}
+	if options.ThrottleOnQueueDepth > 0 && options.Management == nil {
+		return nil, errors.New("ThrottleOnQueueDepth requires a Management client")
+	}
+	if err := publisher.openSession(ctx); err != nil {
+		return nil, err
+	}
+	publisher.metricsFlush = startMetricsFlush(publisher.metrics, options.MetricsFlushInterval, publisher.logger)
+	publisher.throttle = newDepthThrottle(options.Management, options.ThrottleOnQueueDepth, options.ThrottleCheckInterval, publisher.logger)
+	if options.Management != nil {
+		managementCtx, cancel := context.WithCancel(context.Background())
+		publisher.stopManagement = cancel
+		go options.Management.Run(managementCtx, managementRefreshInterval)
+	}
+	return publisher, nil
+}
+
+// close closes the reply listeners, sender and session, leaving the
+// connection open. With DrainBeforeClose it first waits for sends in
+// progress.
+func (p *Publisher) close(ctx context.Context) {
+	p.throttle.stop()
+	if p.stopManagement != nil {
+		p.stopManagement()
+	}
+	if p.drainBeforeClose {
+		drainCtx, cancel := context.WithTimeout(ctx, closeTimeout)
+		if err := p.Drain(drainCtx); err != nil {
+			p.logger.WarnContext(ctx, "closing sender with sends in progress", "error", err)
+		}
+		cancel()
+	}
+	p.closeReplyListeners(ctx)
+	if err := p.metricsFlush.stop(); err != nil {
+		p.logger.WarnContext(ctx, "failed to flush metrics", "error", err)
+	}
+	p.closeErrorSink(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sender.Close(ctx)
+	p.session.Close(ctx)
+}
+
+// openSession begins a new session on the existing connection and attaches
+// the sender to it. The caller must hold p.mu or own p exclusively.
+func (p *Publisher) openSession(ctx context.Context) error {
+	session, err := p.conn.Load().NewSession(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create AMQP session: %w", err)
+	}
+
+	sender, err := p.attachSender(ctx, session, p.topic)
+	if err != nil {
+		session.Close(ctx)
+		return fmt.Errorf("failed to create AMQP sender: %w", err)
+	}
+
+	p.session = session
+	p.sender = sender
+	return nil
+}
+
+// attachSender attaches a sender to address on session, retrying attempts
+// that take longer than p.linkAttachTimeout.
+func (p *Publisher) attachSender(ctx context.Context, session *amqp.Session, address string) (*amqp.Sender, error) {
+	if p.linkAttachTimeout <= 0 {
+		return session.NewSender(ctx, address, nil)
+	}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.linkAttachTimeout)
+		sender, err := session.NewSender(attemptCtx, address, nil)
+		timedOut := err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if !timedOut {
+			return sender, err
+		}
+		if attempt > p.linkAttachRetries {
+			return nil, fmt.Errorf("sender attach to %s timed out after %d attempts of %s: %w", address, attempt, p.linkAttachTimeout, err)
+		}
+		p.logger.WarnContext(ctx, "sender attach timed out, retrying", "address", address, "attempt", attempt, "timeout", p.linkAttachTimeout)
+	}
+}
+
+// reopenSession replaces the session and sender after the broker closed the
+// session, leaving the connection untouched. failed is the sender that
+// observed the error; if another caller already replaced it nothing is done.
+func (p *Publisher) reopenSession(ctx context.Context, failed *amqp.Sender) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sender != failed {
+		return nil
+	}
+
+	p.setReconnecting(true)
+	defer p.setReconnecting(false)
+
+	old := p.session
+	if err := p.openSession(ctx); err != nil {
+		return err
+	}
+	old.Close(ctx)
+	p.logger.WarnContext(ctx, "AMQP session closed by broker, reopened session and sender")
+	return nil
+}
+
+// dialStandby connects to the secondary broker of config.
+func dialStandby(ctx context.Context, logger *slog.Logger, config AmqpConfig) (*amqp.Conn, error) {
+	secondary, err := config.secondary()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, logger, secondary, config.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to standby AMQP broker: %w", err)
+	}
+	return conn, nil
+}
+
+func (p *Publisher) hasStandby() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.standby != nil
+}
+
+// promoteStandby switches to the standby connection after the connection
+// behind failed was lost, opening a new session and sender on it.
+func (p *Publisher) promoteStandby(ctx context.Context, failed *amqp.Sender) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sender != failed {
+		return nil
+	}
+	if p.standby == nil {
+		return errors.New("no standby connection")
+	}
+
+	p.setReconnecting(true)
+	defer p.setReconnecting(false)
+
+	old := p.session
+	p.conn.Store(p.standby)
+	p.standby = nil
+	if err := p.openSession(ctx); err != nil {
+		return err
+	}
+	old.Close(ctx)
+	p.logger.WarnContext(ctx, "AMQP connection lost, promoted warm standby connection")
+	return nil
+}
+
+// Session returns the current AMQP session, for configuring links that
+// PublisherOptions does not cover. The session is replaced if the broker
+// closes it. It is owned by the publisher: callers must not close it.
+func (p *Publisher) Session() *amqp.Session {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.session
+}
+
+// Connection returns the underlying AMQP connection. It is owned by the
+// publisher and may be shared with other publishers: callers must not
+// close it.
+func (p *Publisher) Connection() *amqp.Conn {
+	return p.conn.Load()
+}
+
+// InFlight returns the number of sends in progress.
+func (p *Publisher) InFlight() int64 {
+	return p.inFlight.Load()
+}
+
+// drainPollInterval is how often Drain checks for sends in progress.
+const drainPollInterval = 10 * time.Millisecond
+
+// Drain waits until no send is in progress or ctx is done. Sends started
+// meanwhile extend the wait, so callers should stop publishing first.
+func (p *Publisher) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for p.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to drain %d sends in progress: %w", p.InFlight(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// PendingAcks returns the number of messages sent but not yet acknowledged
+// by the broker.
+func (p *Publisher) PendingAcks() int {
+	return int(p.pendingAcks.Load())
+}
+
+// connOpen reports whether the underlying connection is still open.
+func (p *Publisher) connOpen() bool {
+	select {
+	case <-p.conn.Load().Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// Healthy reports whether the connection is open and the sender link has not
+// failed. It does not contact the broker.
+func (p *Publisher) Healthy() bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.linkErr == nil && p.connOpen()
+}
+
+// Ready reports whether the publisher is healthy and not reopening its
+// session.
+func (p *Publisher) Ready() bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.linkErr == nil && !p.reconnecting && p.connOpen()
+}
+
+func (p *Publisher) setLinkErr(err error) {
+	if err != nil && !linkFailure(err) {
+		return
+	}
+	p.stateMu.Lock()
+	p.linkErr = err
+	p.stateMu.Unlock()
+}
+
+func (p *Publisher) setReconnecting(reconnecting bool) {
+	p.stateMu.Lock()
+	p.reconnecting = reconnecting
+	p.stateMu.Unlock()
+}
+
+// sessionClosed reports whether err was caused by the session ending.
+func sessionClosed(err error) bool {
+	var sessionErr *amqp.SessionError
+	return errors.As(err, &sessionErr)
+}
+
+// Publish sends message to the topic. opts may be nil.
+func (p *Publisher) Publish(ctx context.Context, message string, opts *SendOptions) error {
+	msg, err := p.newMessage([]byte(message), opts)
+	if err != nil {
+		return err
+	}
+	return p.PublishMessage(ctx, msg)
+}
+
+// PublishTyped encodes v with the publisher's Encoder and sends it with the
+// encoder's content type. opts may be nil.
+func (p *Publisher) PublishTyped(ctx context.Context, v any, opts *SendOptions) error {
+	msg, err := p.encodeMessage(v, opts)
+	if err != nil {
+		return err
+	}
+	return p.PublishMessage(ctx, msg)
+}
+
+// BatchError reports the messages of a batch that could not be published.
+// Errors holds one entry per value, nil for those that were sent.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Unwrap()
+	return fmt.Sprintf("failed to publish %d of %d messages: %v", len(failed), len(e.Errors), failed[0])
+}
+
+// Unwrap returns the errors of the failed messages.
+func (e *BatchError) Unwrap() []error {
+	var failed []error
+	for _, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+// PublishTypedBatch encodes each of values with the publisher's Encoder and
+// sends them in order, continuing past failures. If any fails it returns a
+// *BatchError holding the error of each value.
+func (p *Publisher) PublishTypedBatch(ctx context.Context, values []any) error {
+	errs := make([]error, len(values))
+	failed := false
+	for i, v := range values {
+		msg, err := p.encodeMessage(v, nil)
+		if err == nil {
+			err = p.PublishMessage(ctx, msg)
+		}
+		if err != nil {
+			errs[i], failed = err, true
+		}
+	}
+	if failed {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+// encodeMessage builds the AMQP message of v encoded with p.encoder.
+func (p *Publisher) encodeMessage(v any, opts *SendOptions) (*amqp.Message, error) {
+	body, contentType, err := p.encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := p.newMessage(body, opts)
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties.ContentType = &contentType
+	return msg, nil
+}
+
+// newMessage builds a message of body in the publisher's BodyEncoding.
+func (p *Publisher) newMessage(body []byte, opts *SendOptions) (*amqp.Message, error) {
+	return newMessage(p.bodyEncoding.encode(body), opts)
+}
+
+// newMessage builds the AMQP message for body according to opts, which may
+// be nil.
+func newMessage(body []byte, opts *SendOptions) (*amqp.Message, error) {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	properties, err := applicationProperties(opts.ApplicationProperties, opts.PropertyTypes)
+	if err != nil {
+		return nil, err
+	}
+	msg := amqp.NewMessage(body)
+	msg.ApplicationProperties = properties
+
+	messageID := opts.MessageID
+	if messageID == "" {
+		messageID = uuid.NewString()
+	}
+	msg.Properties = &amqp.MessageProperties{MessageID: messageID}
+	if opts.TimeToLive > 0 {
+		msg.Header = &amqp.MessageHeader{TTL: opts.TimeToLive}
+	}
+
+	if opts.ScheduledEnqueueTime != nil {
+		AnnotateScheduleAt(msg, *opts.ScheduledEnqueueTime)
+	}
+	if opts.PartitionKey != "" {
+		AnnotatePartitionKey(msg, opts.PartitionKey)
+	}
+	if opts.ViaPartitionKey != "" {
+		AnnotateViaPartitionKey(msg, opts.ViaPartitionKey)
+	}
+	return msg, nil
+}
+
+// PublishMessage sends a fully built AMQP message to the topic.
+func (p *Publisher) PublishMessage(ctx context.Context, msg *amqp.Message) error {
+	return chainPublisherMiddleware(p.publishMessage, p.middleware)(ctx, msg)
+}
+
+func (p *Publisher) publishMessage(ctx context.Context, msg *amqp.Message) error {
+	p.prefixSubject(msg)
+	if err := p.checkBodySize(ctx, msg); err != nil {
+		return err
+	}
+	if err := p.validate(msg); err != nil {
+		return err
+	}
+	p.warnDuplicate(ctx, msg)
+	start := time.Now()
+	err := p.partitions.do(msg, func() error {
+		return p.withSender(ctx, msg, func(sender *amqp.Sender) error {
+			state, err := p.sendAndWait(ctx, sender, msg)
+			if err != nil {
+				return err
+			}
+			// Like Sender.Send, only a rejection is a failure here.
+			if _, rejected := state.(*amqp.StateRejected); rejected {
+				return dispositionErr(state)
+			}
+			return nil
+		})
+	})
+	latency := time.Since(start)
+	p.metrics.observePublish(latency, err)
+	p.latencies.observe(latency)
+	p.logPublished(ctx, msg, latency, err)
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	p.eventGrid.forward(ctx, p.topic, msg)
+	return nil
+}
+
+// prefixSubject prepends the publisher's SubjectPrefix to the subject of
+// msg.
+func (p *Publisher) prefixSubject(msg *amqp.Message) {
+	if p.subjectPrefix == "" {
+		return
+	}
+	if msg.Properties == nil {
+		msg.Properties = &amqp.MessageProperties{}
+	}
+	subject := p.subjectPrefix
+	if msg.Properties.Subject != nil {
+		if strings.HasPrefix(*msg.Properties.Subject, p.subjectPrefix) {
+			return
+		}
+		subject += *msg.Properties.Subject
+	}
+	msg.Properties.Subject = &subject
+}
+
+// warnDuplicate logs a warning when the ID of msg was already published
+// within the topic's duplicate detection window.
+func (p *Publisher) warnDuplicate(ctx context.Context, msg *amqp.Message) {
+	if p.publishedIDs.seen(messageIDOf(msg), time.Now()) {
+		p.logger.WarnContext(ctx, "message ID reused within the duplicate detection window, the broker will drop the message",
+			"message_id", messageIDOf(msg), "window", p.publishedIDs.windowOf())
+	}
+}
+
+// logPublished logs the outcome of publishing msg.
+func (p *Publisher) logPublished(ctx context.Context, msg *amqp.Message, latency time.Duration, err error) {
+	attrs := []any{"message_id", messageIDOf(msg), "latency_ms", latency.Milliseconds()}
+	if err != nil {
+		p.logger.ErrorContext(ctx, "publish failed", append(attrs, "outcome", "failed", "error", err)...)
+		return
+	}
+	if at, ok := msg.Annotations[scheduledEnqueueTimeAnnotation].(time.Time); ok {
+		attrs = append(attrs, "scheduled_enqueue_time", at)
+	}
+	p.logger.InfoContext(ctx, "message published", append(attrs, "outcome", "accepted")...)
+}
+
+// messageIDOf returns the message ID of msg, or nil if it has none.
+func messageIDOf(msg *amqp.Message) any {
+	if msg.Properties == nil {
+		return nil
+	}
+	return msg.Properties.MessageID
+}
+
+// PublishReceipt describes a message the broker has accepted.
+type PublishReceipt struct {
+	MessageID any
+	// SequenceNumber is read from the x-opt-sequence-number annotation. Service
+	// Bus does not include it in the accepted outcome, so it is 0 unless the
+	// message already carries one.
+	SequenceNumber int64
+	// EnqueuedTime is when the broker's acceptance was received.
+	EnqueuedTime time.Time
+}
+
+// PublishWithReceipt sends msg and waits for the broker's disposition,
+// returning a receipt once the message is accepted.
+func (p *Publisher) PublishWithReceipt(ctx context.Context, msg *amqp.Message) (*PublishReceipt, error) {
+	var receipt *PublishReceipt
+	err := chainPublisherMiddleware(func(ctx context.Context, msg *amqp.Message) error {
+		var err error
+		receipt, err = p.publishWithReceipt(ctx, msg)
+		return err
+	}, p.middleware)(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (p *Publisher) publishWithReceipt(ctx context.Context, msg *amqp.Message) (*PublishReceipt, error) {
+	p.prefixSubject(msg)
+	if err := p.checkBodySize(ctx, msg); err != nil {
+		return nil, err
+	}
+	if err := p.validate(msg); err != nil {
+		return nil, err
+	}
+	p.warnDuplicate(ctx, msg)
+	start := time.Now()
+	var state amqp.DeliveryState
+	err := p.partitions.do(msg, func() error {
+		return p.withSender(ctx, msg, func(sender *amqp.Sender) error {
+			var err error
+			state, err = p.sendAndWait(ctx, sender, msg)
+			if err != nil {
+				return err
+			}
+			if _, rejected := state.(*amqp.StateRejected); rejected {
+				return dispositionErr(state)
+			}
+			return nil
+		})
+	})
+	if err == nil {
+		err = dispositionErr(state)
+	}
+	latency := time.Since(start)
+	p.metrics.observePublish(latency, err)
+	p.latencies.observe(latency)
+	p.logPublished(ctx, msg, latency, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send message: %w", err)
+	}
+	p.eventGrid.forward(ctx, p.topic, msg)
+
+	receipt := &PublishReceipt{MessageID: messageIDOf(msg), EnqueuedTime: time.Now().UTC()}
+	if seq, ok := msg.Annotations[sequenceNumberAnnotation].(int64); ok {
+		receipt.SequenceNumber = seq
+	}
+	return receipt, nil
+}
+
+// sequenceNumberAnnotation is the message annotation carrying the sequence
+// number Service Bus assigned to a message.
+const sequenceNumberAnnotation = "x-opt-sequence-number"
+
+// sendAndWait sends msg and waits for its disposition, for at most
+// p.dispositionTimeout when set.
+func (p *Publisher) sendAndWait(ctx context.Context, sender *amqp.Sender, msg *amqp.Message) (amqp.DeliveryState, error) {
+	p.pendingAcks.Add(1)
+	defer p.pendingAcks.Add(-1)
+
+	receipt, err := sender.SendWithReceipt(ctx, msg, nil)
+	if err != nil {
+		return nil, err
+	}
+	waitCtx := ctx
+	if p.dispositionTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.dispositionTimeout)
+		defer cancel()
+	}
+	state, err := receipt.Wait(waitCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w after %s", ErrDispositionTimeout, p.dispositionTimeout)
+	}
+	return state, err
+}
+
+// dispositionErr converts a non-accepted outcome into an error.
+func dispositionErr(state amqp.DeliveryState) error {
+	switch state := state.(type) {
+	case *amqp.StateAccepted:
+		return nil
+	case *amqp.StateRejected:
+		if state.Error != nil {
+			return fmt.Errorf("message rejected: %w", state.Error)
+		}
+		return errors.New("message rejected")
+	case *amqp.StateReleased:
+		return errors.New("message released by broker")
+	case *amqp.StateModified:
+		return errors.New("message modified by broker")
+	default:
+		return fmt.Errorf("unexpected delivery state %T", state)
+	}
+}
+
+// withSender runs fn with the current sender, retrying once after reopening
+// the session if the broker closed it, or after promoting the warm standby if
+// the connection was lost. It waits while sends are throttled on the topic's
+// backlog and for its turn when SmoothSendRate is set, and fails fast with
+// ErrCircuitOpen while the circuit breaker is open. When sending msg still
+// fails after the retry, msg is sent to the error sink; it is not when msg
+// was held back before being sent or the retry budget ran out.
+func (p *Publisher) withSender(ctx context.Context, msg *amqp.Message, fn func(*amqp.Sender) error) error {
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	if err := p.throttle.wait(ctx); err != nil {
+		return err
+	}
+	if err := p.pacer.wait(ctx); err != nil {
+		return err
+	}
+	if err := p.breaker.allow(); err != nil {
+		return err
+	}
+	err := p.send(ctx, fn)
+	p.breaker.record(err)
+	if err != nil && !errors.Is(err, ErrRetryBudgetExhausted) {
+		p.sendToErrorSink(ctx, msg, err)
+	}
+	return err
+}
+
+func (p *Publisher) send(ctx context.Context, fn func(*amqp.Sender) error) error {
+	p.mu.RLock()
+	sender := p.sender
+	p.mu.RUnlock()
+
+	err := fn(sender)
+	var recovery func(context.Context, *amqp.Sender) error
+	switch {
+	case err == nil:
+	case sessionClosed(err) && p.connOpen():
+		recovery = p.reopenSession
+	case linkFailure(err) && !p.connOpen() && p.hasStandby():
+		recovery = p.promoteStandby
+	}
+	if recovery != nil {
+		if recoveryErr := recovery(ctx, sender); recoveryErr != nil {
+			err = errors.Join(err, recoveryErr)
+		} else if !p.retryBudget.allow() {
+			err = errors.Join(err, ErrRetryBudgetExhausted)
+		} else {
+			p.mu.RLock()
+			sender = p.sender
+			p.mu.RUnlock()
+			err = fn(sender)
+		}
+	}
+	p.setLinkErr(err)
+	return err
+}
+
+// servePublish publishes the message of a decoded PublishRequest and writes
+// the response.
+func (p *Publisher) servePublish(c *gin.Context, req PublishRequest) {
+	scheduledAt, err := req.scheduledEnqueueTime(time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl, err := req.timeToLive()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts := &SendOptions{
+		MessageID:            req.MessageID,
+		ScheduledEnqueueTime: scheduledAt,
+		TimeToLive:           ttl,
+	}
+	msg, err := p.newMessage([]byte(req.Message), opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	receipt, err := p.PublishWithReceipt(c, msg)
+	if errors.Is(err, ErrMessageTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrInvalidMessage) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Publisher temporarily unavailable"})
+		return
+	}
+	if errors.Is(err, ErrDispositionTimeout) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Timed out waiting for the broker to accept the message"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish message"})
+		return
+	}
+	resp := gin.H{"status": "Message published", "messageId": receipt.MessageID}
+	if receipt.SequenceNumber != 0 {
+		resp["sequenceNumber"] = receipt.SequenceNumber
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type PublishRequest struct {
+	Message string `json:"message"`
+	// Topic selects a topic registered with POST /topics. The default topic
+	// is used when it is omitted.
+	Topic string `json:"topic,omitempty"`
+	// MessageID is an optional caller-chosen ID used by Service Bus duplicate
+	// detection. A UUID is generated when it is omitted.
+	MessageID string `json:"messageId,omitempty"`
+	// ScheduledEnqueueTimeUTC is an optional RFC3339 time at which the broker
+	// makes the message visible to subscribers.
+	ScheduledEnqueueTimeUTC *time.Time `json:"scheduledEnqueueTimeUtc,omitempty"`
+	// DelaySeconds is an alternative to ScheduledEnqueueTimeUTC that delays
+	// the message relative to when the request is received.
+	DelaySeconds *int `json:"delaySeconds,omitempty"`
+	// TimeToLiveSeconds optionally limits how long the message may wait to
+	// be consumed.
+	TimeToLiveSeconds *int `json:"timeToLiveSeconds,omitempty"`
+}
+
+// timeToLive returns the requested TTL, or 0 when none was given.
+func (r PublishRequest) timeToLive() (time.Duration, error) {
+	if r.TimeToLiveSeconds == nil {
+		return 0, nil
+	}
+	if *r.TimeToLiveSeconds <= 0 {
+		return 0, errors.New("timeToLiveSeconds must be positive")
+	}
+	return time.Duration(*r.TimeToLiveSeconds) * time.Second, nil
+}
+
+// scheduledEnqueueTime resolves the requested schedule, returning nil when
+// the message should be visible immediately.
+func (r PublishRequest) scheduledEnqueueTime(now time.Time) (*time.Time, error) {
+	switch {
+	case r.ScheduledEnqueueTimeUTC != nil && r.DelaySeconds != nil:
+		return nil, errors.New("only one of scheduledEnqueueTimeUtc and delaySeconds may be set")
+	case r.ScheduledEnqueueTimeUTC != nil:
+		if r.ScheduledEnqueueTimeUTC.Before(now) {
+			return nil, errors.New("scheduledEnqueueTimeUtc must not be in the past")
+		}
+		return r.ScheduledEnqueueTimeUTC, nil
+	case r.DelaySeconds != nil:
+		if *r.DelaySeconds < 0 {
+			return nil, errors.New("delaySeconds must not be negative")
+		}
+		at := now.Add(time.Duration(*r.DelaySeconds) * time.Second)
+		return &at, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPublisherSessionReuse(t *testing.T) {
+	tests := []struct {
+		name string
+		// between runs before each publish after the first.
+		between      func(b *testBroker)
+		wantSessions int
+	}{
+		{name: "kept across publishes", between: func(b *testBroker) {}, wantSessions: 0},
+		{name: "reopened after the broker ends it", between: func(b *testBroker) { b.endSessions("topic") }, wantSessions: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config())
+			begun := b.sessionsBegun()
+
+			const publishes = 3
+			for i := range publishes {
+				if i > 0 {
+					tt.between(b)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err := p.Publish(ctx, "hello", nil)
+				cancel()
+				if err != nil {
+					t.Fatalf("publish %d: %v", i+1, err)
+				}
+			}
+			if got := len(b.receivedAt("topic")); got != publishes {
+				t.Errorf("broker received %d messages, want %d", got, publishes)
+			}
+			if got := b.sessionsBegun() - begun; got != tt.wantSessions {
+				t.Errorf("%d sessions begun after NewPublisher, want %d", got, tt.wantSessions)
+			}
+			if got := b.connections(); got != 1 {
+				t.Errorf("%d connections, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPublishRequestScheduledEnqueueTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+	tests := []struct {
+		name    string
+		req     PublishRequest
+		want    *time.Time
+		wantErr bool
+	}{
+		{name: "immediate", req: PublishRequest{}},
+		{name: "at a time", req: PublishRequest{ScheduledEnqueueTimeUTC: &later}, want: &later},
+		{name: "in the past", req: PublishRequest{ScheduledEnqueueTimeUTC: &earlier}, wantErr: true},
+		{name: "delayed", req: PublishRequest{DelaySeconds: ptr(3600)}, want: &later},
+		{name: "negative delay", req: PublishRequest{DelaySeconds: ptr(-1)}, wantErr: true},
+		{name: "both", req: PublishRequest{ScheduledEnqueueTimeUTC: &later, DelaySeconds: ptr(1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.scheduledEnqueueTime(now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scheduledEnqueueTime error = %v, want error %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want) {
+				t.Errorf("scheduledEnqueueTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishScheduled(t *testing.T) {
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config())
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	if err := p.Publish(context.Background(), "later", &SendOptions{ScheduledEnqueueTime: &at}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := p.Publish(context.Background(), "now", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	received := b.receivedAt("topic")
+	if len(received) != 2 {
+		t.Fatalf("broker received %d messages, want 2", len(received))
+	}
+	got, ok := received[0].Annotations[scheduledEnqueueTimeAnnotation].(time.Time)
+	if !ok || !got.Equal(at) {
+		t.Errorf("%s = %v, want %v", scheduledEnqueueTimeAnnotation, received[0].Annotations[scheduledEnqueueTimeAnnotation], at)
+	}
+	if v, ok := received[1].Annotations[scheduledEnqueueTimeAnnotation]; ok {
+		t.Errorf("unscheduled message annotated with %v", v)
+	}
+}
+
+func TestPublishWithReceipt(t *testing.T) {
+	tests := []struct {
+		name    string
+		outcome string
+		seq     any
+		wantSeq int64
+		wantErr bool
+	}{
+		{name: "accepted", outcome: "accepted"},
+		{name: "with sequence number", outcome: "accepted", seq: int64(42), wantSeq: 42},
+		{name: "rejected", outcome: "rejected", wantErr: true},
+		{name: "released", outcome: "released", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			b.sendOutcome = func(address string, msg *amqp.Message) brokerState {
+				return brokerState{Outcome: tt.outcome}
+			}
+			p := newBrokerPublisher(t, b.config())
+			msg := amqp.NewMessage([]byte("hello"))
+			msg.Properties = &amqp.MessageProperties{MessageID: "id-1"}
+			if tt.seq != nil {
+				msg.Annotations = amqp.Annotations{sequenceNumberAnnotation: tt.seq}
+			}
+
+			before := time.Now().UTC()
+			receipt, err := p.PublishWithReceipt(context.Background(), msg)
+			if tt.wantErr {
+				if err == nil || receipt != nil {
+					t.Fatalf("PublishWithReceipt = %+v, %v, want an error", receipt, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PublishWithReceipt: %v", err)
+			}
+			if receipt.MessageID != "id-1" {
+				t.Errorf("MessageID = %v, want id-1", receipt.MessageID)
+			}
+			if receipt.SequenceNumber != tt.wantSeq {
+				t.Errorf("SequenceNumber = %d, want %d", receipt.SequenceNumber, tt.wantSeq)
+			}
+			if receipt.EnqueuedTime.Before(before) || receipt.EnqueuedTime.After(time.Now().UTC()) {
+				t.Errorf("EnqueuedTime = %v, want the time of acceptance", receipt.EnqueuedTime)
+			}
+		})
+	}
+}
+
+func TestPublisherInFlightAndDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		wantErr      bool
+	}{
+		{name: "drained", drainTimeout: 5 * time.Second},
+		{name: "timed out", drainTimeout: 10 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			// Sends pace at one per 100ms, so they stay in flight while
+			// waiting their turn.
+			p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) { o.SmoothSendRate = 10 })
+
+			const sends = 3
+			errs := make(chan error, sends)
+			for range sends {
+				go func() { errs <- p.Publish(context.Background(), "hello", nil) }()
+			}
+			b.waitFor("sends in flight", func() bool { return p.InFlight() == sends || len(b.receivedAt("topic")) > 0 })
+			if got := p.InFlight(); got < sends-1 {
+				t.Errorf("InFlight = %d, want at least %d", got, sends-1)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.drainTimeout)
+			defer cancel()
+			err := p.Drain(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Drain = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && p.InFlight() != 0 {
+				t.Errorf("InFlight = %d after Drain, want 0", p.InFlight())
+			}
+			for range sends {
+				if err := <-errs; err != nil {
+					t.Errorf("publish: %v", err)
+				}
+			}
+			if got := p.InFlight(); got != 0 {
+				t.Errorf("InFlight = %d after the sends, want 0", got)
+			}
+		})
+	}
+}
+
+func TestSubjectPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		subject string
+		want    string
+	}{
+		{name: "no prefix", subject: "orders", want: "orders"},
+		{name: "no subject", prefix: "eu.", want: "eu."},
+		{name: "explicit subject", prefix: "eu.", subject: "orders", want: "eu.orders"},
+		{name: "already prefixed", prefix: "eu.", subject: "eu.orders", want: "eu.orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) { o.SubjectPrefix = tt.prefix })
+			msg := amqp.NewMessage([]byte("body"))
+			if tt.subject != "" {
+				msg.Properties = &amqp.MessageProperties{Subject: ptr(tt.subject)}
+			}
+			if err := p.PublishMessage(context.Background(), msg); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+
+			received := b.receivedAt("topic")
+			if len(received) != 1 {
+				t.Fatalf("broker received %d messages, want 1", len(received))
+			}
+			var got string
+			if props := received[0].Properties; props != nil && props.Subject != nil {
+				got = *props.Subject
+			}
+			if got != tt.want {
+				t.Errorf("subject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublisherSessionAndConnection(t *testing.T) {
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config())
+
+	session, conn := p.Session(), p.Connection()
+	if session == nil || conn == nil {
+		t.Fatalf("Session() = %v, Connection() = %v, want both set", session, conn)
+	}
+	p.mu.RLock()
+	internal := p.session
+	p.mu.RUnlock()
+	if session != internal || conn != p.conn.Load() {
+		t.Error("Session() or Connection() does not return the publisher's own")
+	}
+
+	// A link opened by the caller on the session works next to the
+	// publisher's sender.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sender, err := session.NewSender(ctx, "audit", nil)
+	if err != nil {
+		t.Fatalf("NewSender on Session(): %v", err)
+	}
+	defer sender.Close(ctx)
+	if err := sender.Send(ctx, amqp.NewMessage([]byte("audit")), nil); err != nil {
+		t.Fatalf("send on the caller's link: %v", err)
+	}
+	if err := p.Publish(ctx, "hello", nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if len(b.receivedAt("audit")) != 1 || len(b.receivedAt("topic")) != 1 {
+		t.Errorf("broker received %d audit and %d topic messages, want 1 each", len(b.receivedAt("audit")), len(b.receivedAt("topic")))
+	}
+}
+
+func TestPublisherPendingAcks(t *testing.T) {
+	b := newTestBroker(t)
+	// The broker holds the dispositions of published messages until
+	// release is called.
+	held := make(chan struct{})
+	release := sync.OnceFunc(func() { close(held) })
+	defer release()
+	b.sendOutcome = func(string, *amqp.Message) brokerState {
+		<-held
+		return brokerState{Outcome: "accepted"}
+	}
+	p := newBrokerPublisher(t, b.config())
+	if got := p.PendingAcks(); got != 0 {
+		t.Fatalf("PendingAcks() before publishing = %d, want 0", got)
+	}
+
+	const publishes = 3
+	errs := make(chan error, publishes)
+	for range publishes {
+		go func() { errs <- p.Publish(context.Background(), "hello", nil) }()
+	}
+	b.waitFor("sends awaiting acknowledgement", func() bool { return p.PendingAcks() == publishes })
+
+	release()
+	for range publishes {
+		if err := <-errs; err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	if got := p.PendingAcks(); got != 0 {
+		t.Errorf("PendingAcks() after acknowledgement = %d, want 0", got)
+	}
+}
+
+func TestDispositionTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	// The broker holds the disposition of the first message until release
+	// is called.
+	held := make(chan struct{})
+	release := sync.OnceFunc(func() { close(held) })
+	defer release()
+	b.sendOutcome = func(_ string, msg *amqp.Message) brokerState {
+		if string(msg.GetData()) == "held" {
+			<-held
+		}
+		return brokerState{Outcome: "accepted"}
+	}
+	p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) { o.DispositionTimeout = 50 * time.Millisecond })
+
+	start := time.Now()
+	err := p.PublishMessage(context.Background(), amqp.NewMessage([]byte("held")))
+	if !errors.Is(err, ErrDispositionTimeout) {
+		t.Fatalf("publish error = %v, want ErrDispositionTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("publish returned after %v, want about the 50ms timeout", elapsed)
+	}
+	release()
+
+	// The timeout ends the wait, not the link or the connection.
+	if err := p.PublishMessage(context.Background(), amqp.NewMessage([]byte("next"))); err != nil {
+		t.Fatalf("publish after a disposition timeout: %v", err)
+	}
+	if !p.Healthy() {
+		t.Error("publisher unhealthy after a disposition timeout")
+	}
+	if got := b.connections(); got != 1 {
+		t.Errorf("%d connections, want 1", got)
+	}
+}
+
+func TestWarmStandbyFailover(t *testing.T) {
+	tests := []struct {
+		name        string
+		warmStandby bool
+		wantErr     bool
+	}{
+		{name: "promotes the standby", warmStandby: true},
+		{name: "no standby", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, secondary := newTestBroker(t), newTestBroker(t)
+			config := primary.config()
+			if tt.warmStandby {
+				config.WarmStandby = true
+				config.SecondaryConnectionString = secondary.config().ConnectionString
+			}
+			p := newBrokerPublisher(t, config)
+			wantStandby := 0
+			if tt.warmStandby {
+				wantStandby = 1
+			}
+			if got := secondary.connections(); got != wantStandby {
+				t.Fatalf("%d connections to the secondary after NewPublisher, want %d", got, wantStandby)
+			}
+			if err := p.Publish(context.Background(), "before", nil); err != nil {
+				t.Fatalf("publish to the primary: %v", err)
+			}
+
+			primary.dropConnections()
+			primary.waitFor("the publisher to see its connection closed", func() bool { return !p.connOpen() })
+			start := time.Now()
+			err := p.Publish(context.Background(), "after", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publish after losing the primary: error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("failover took %v", elapsed)
+			}
+			if len(primary.receivedAt("topic")) != 1 || len(secondary.receivedAt("topic")) != 1 {
+				t.Errorf("primary received %d and secondary %d messages, want 1 each", len(primary.receivedAt("topic")), len(secondary.receivedAt("topic")))
+			}
+			// The standby connection was promoted, not dialled again.
+			if got := secondary.connections(); got != 1 {
+				t.Errorf("%d connections to the secondary, want 1", got)
+			}
+			if !p.Healthy() {
+				t.Error("publisher unhealthy after promoting the standby")
+			}
+		})
+	}
+}
+
+func TestPublishTypedBatch(t *testing.T) {
+	type order struct {
+		ID string `json:"id"`
+	}
+	tests := []struct {
+		name       string
+		values     []any
+		want       []string
+		wantFailed []int
+	}{
+		{name: "heterogeneous", values: []any{order{ID: "o1"}, map[string]int{"n": 2}, "text", 42, []bool{true}},
+			want: []string{`{"id":"o1"}`, `{"n":2}`, `"text"`, `42`, `[true]`}},
+		{name: "continues past a failure", values: []any{order{ID: "o1"}, make(chan int), 7},
+			want: []string{`{"id":"o1"}`, `7`}, wantFailed: []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config())
+			err := p.PublishTypedBatch(context.Background(), tt.values)
+
+			var batchErr *BatchError
+			if tt.wantFailed == nil {
+				if err != nil {
+					t.Fatalf("PublishTypedBatch: %v", err)
+				}
+			} else if !errors.As(err, &batchErr) || len(batchErr.Errors) != len(tt.values) {
+				t.Fatalf("PublishTypedBatch error = %v, want a *BatchError with one entry per value", err)
+			} else {
+				for i, err := range batchErr.Errors {
+					if wantErr := slices.Contains(tt.wantFailed, i); (err != nil) != wantErr {
+						t.Errorf("error of value %d = %v, want error %v", i, err, wantErr)
+					}
+				}
+			}
+
+			received := b.receivedAt("topic")
+			if len(received) != len(tt.want) {
+				t.Fatalf("broker received %d messages, want %d", len(received), len(tt.want))
+			}
+			for i, msg := range received {
+				if string(msg.GetData()) != tt.want[i] || *msg.Properties.ContentType != jsonContentType {
+					t.Errorf("message %d = %s with content type %q, want %s, %s", i, msg.GetData(), *msg.Properties.ContentType, tt.want[i], jsonContentType)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkAttachTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		hung         int32
+		retries      int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "retried after a hung attach", hung: 1, retries: 2, wantAttempts: 2},
+		{name: "retries exhausted", hung: 10, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "no retries", hung: 10, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			// The first tt.hung attaches to the topic are never answered.
+			var attempts atomic.Int32
+			b.ignoreAttach = func(address string) bool {
+				return address == "topic" && attempts.Add(1) <= tt.hung
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			start := time.Now()
+			p, cleanup, err := NewPublisher(ctx, discardLogger(), b.config(), func(o *PublisherOptions) {
+				o.LinkAttachTimeout = 100 * time.Millisecond
+				o.LinkAttachMaxRetries = tt.retries
+			})
+			if err == nil {
+				t.Cleanup(cleanup)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPublisher() = %v, want error %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("NewPublisher() took %s, want the attach timeout to fire", elapsed)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("attach attempts = %d, want %d", got, tt.wantAttempts)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("NewPublisher() = %v, want context.DeadlineExceeded", err)
+				}
+				return
+			}
+			if err := p.Publish(context.Background(), "hello", nil); err != nil {
+				t.Errorf("Publish() = %v", err)
+			}
+		})
+	}
+}
+
+func TestDrainBeforeClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		drain       bool
+		wantSuccess bool
+	}{
+		{name: "drained", drain: true, wantSuccess: true},
+		{name: "closed at once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			// Sends pace at one per 100ms, so they are still in progress
+			// when the publisher is closed.
+			p, cleanup, err := NewPublisher(context.Background(), discardLogger(), b.config(), func(o *PublisherOptions) {
+				o.SmoothSendRate = 10
+				o.DrainBeforeClose = tt.drain
+			})
+			if err != nil {
+				t.Fatalf("NewPublisher: %v", err)
+			}
+
+			const sends = 3
+			errs := make(chan error, sends)
+			for range sends {
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					errs <- p.Publish(ctx, "hello", nil)
+				}()
+			}
+			b.waitFor("sends in flight", func() bool { return p.InFlight() == sends || len(b.receivedAt("topic")) > 0 })
+			cleanup()
+
+			failed := 0
+			for range sends {
+				if err := <-errs; err != nil {
+					failed++
+				}
+			}
+			if tt.wantSuccess && failed > 0 {
+				t.Errorf("%d sends failed, want all to complete before the sender closed", failed)
+			}
+			if !tt.wantSuccess && failed == 0 {
+				t.Error("all sends completed, want the close to fail those in progress")
+			}
+			if got := len(b.receivedAt("topic")); got != sends-failed {
+				t.Errorf("broker received %d messages, want %d", got, sends-failed)
+			}
+		})
+	}
+}
+
+type tenantKey struct{}
+
+func TestWithContextExtractor(t *testing.T) {
+	extractor := func(ctx context.Context) map[string]string {
+		tenant, ok := ctx.Value(tenantKey{}).(string)
+		if !ok {
+			return nil
+		}
+		return map[string]string{"tenantId": tenant, "source": "api"}
+	}
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		props map[string]any
+		want  map[string]any
+	}{
+		{name: "tenant in context", ctx: context.WithValue(context.Background(), tenantKey{}, "acme"),
+			want: map[string]any{"tenantId": "acme", "source": "api"}},
+		{name: "existing properties kept", ctx: context.WithValue(context.Background(), tenantKey{}, "acme"),
+			props: map[string]any{"source": "batch", "kind": "order"},
+			want:  map[string]any{"tenantId": "acme", "source": "batch", "kind": "order"}},
+		{name: "nothing extracted", ctx: context.Background()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), WithContextExtractor(extractor))
+			msg := amqp.NewMessage([]byte("hello"))
+			msg.ApplicationProperties = tt.props
+			if err := p.PublishMessage(tt.ctx, msg); err != nil {
+				t.Fatalf("PublishMessage() = %v", err)
+			}
+			sent := b.receivedAt("topic")
+			if len(sent) != 1 {
+				t.Fatalf("broker received %d messages, want 1", len(sent))
+			}
+			if got := sent[0].ApplicationProperties; !maps.Equal(got, tt.want) {
+				t.Errorf("application properties = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
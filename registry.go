@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PublisherRegistry holds a Publisher per topic. Topics registered at runtime
+// get their own session and sender on the connection of the default
+// publisher, so no new connection is dialled.
+type PublisherRegistry struct {
+	logger       *slog.Logger
+	config       AmqpConfig
+	options      PublisherOptions
+	defaultTopic string
+	// newManagement returns the management client of a topic's config.
+	newManagement func(config AmqpConfig) *ManagementClient
+
+	mu         sync.RWMutex
+	publishers map[string]*Publisher
+}
+
+// NewPublisherRegistry returns a registry holding defaultPublisher under its
+// topic. opts apply to the publishers created by Register. The default
+// publisher is not closed by Close; it stays owned by the caller.
+func NewPublisherRegistry(logger *slog.Logger, config AmqpConfig, defaultPublisher *Publisher, opts ...PublisherOption) *PublisherRegistry {
+	var options PublisherOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Logger != nil {
+		logger = options.Logger
+	}
+	return &PublisherRegistry{
+		logger:       logger,
+		config:       config,
+		options:      options,
+		defaultTopic: defaultPublisher.topic,
+		newManagement: func(config AmqpConfig) *ManagementClient {
+			return NewManagementClient(logger, config)
+		},
+		publishers: map[string]*Publisher{defaultPublisher.topic: defaultPublisher},
+	}
+}
+
+// management returns a management client of topic.
+func (r *PublisherRegistry) management(topic string) *ManagementClient {
+	config := r.config
+	config.Topic = topic
+	return r.newManagement(config)
+}
+
+// Get returns the publisher for topic, or the default publisher when topic
+// is empty.
+func (r *PublisherRegistry) Get(topic string) (*Publisher, bool) {
+	if topic == "" {
+		topic = r.defaultTopic
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	publisher, ok := r.publishers[topic]
+	return publisher, ok
+}
+
+// Register returns the publisher for topic, creating it on the shared
+// connection if it does not exist yet. A ManagementClient is bound to one
+// topic, so when the registry's options use one the publisher gets its own,
+// for topic.
+func (r *PublisherRegistry) Register(ctx context.Context, topic string) (*Publisher, error) {
+	if publisher, ok := r.Get(topic); ok {
+		return publisher, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if publisher, ok := r.publishers[topic]; ok {
+		return publisher, nil
+	}
+
+	conn := r.publishers[r.defaultTopic].Connection()
+	if err := authorize(ctx, r.logger, conn, r.config, topic); err != nil {
+		return nil, fmt.Errorf("failed to authorize topic %s: %w", topic, err)
+	}
+	options := r.options
+	if options.Management != nil || options.ThrottleOnQueueDepth > 0 {
+		options.Management = r.management(topic)
+	}
+	publisher, err := newPublisher(ctx, conn, topic, r.logger, options)
+	if err != nil {
+		return nil, err
+	}
+	r.publishers[topic] = publisher
+	r.logger.InfoContext(ctx, "registered publisher", "topic", topic)
+	return publisher, nil
+}
+
+// Topics returns the registered topics in sorted order.
+func (r *PublisherRegistry) Topics() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	topics := make([]string, 0, len(r.publishers))
+	for topic := range r.publishers {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// Close closes the senders of the publishers created by Register. It should
+// be called once in-flight publishes have completed.
+func (r *PublisherRegistry) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for topic, publisher := range r.publishers {
+		if topic == r.defaultTopic {
+			continue
+		}
+		publisher.close(ctx)
+		delete(r.publishers, topic)
+	}
+}
+
+func (r *PublisherRegistry) handlePublish(c *gin.Context) {
+	var req PublishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	publisher, ok := r.Get(req.Topic)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Topic %q is not registered", req.Topic)})
+		return
+	}
+	publisher.servePublish(c, req)
+}
+
+func (r *PublisherRegistry) handleListTopics(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"topics": r.Topics()})
+}
+
+type RegisterTopicRequest struct {
+	Topic string `json:"topic" binding:"required"`
+}
+
+func (r *PublisherRegistry) handleRegisterTopic(c *gin.Context) {
+	var req RegisterTopicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, err := r.Register(c, req.Topic); err != nil {
+		r.logger.ErrorContext(c, "failed to register topic", "topic", req.Topic, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register topic"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"status": "Topic registered", "topic": req.Topic})
+}
+
+type SetTopicTTLRequest struct {
+	TTLSeconds int64 `json:"ttl_seconds" binding:"required"`
+}
+
+func (r *PublisherRegistry) handleSetTopicTTL(c *gin.Context) {
+	var req SetTopicTTLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.TTLSeconds <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must be positive"})
+		return
+	}
+	topic := c.Param("topic")
+	if _, ok := r.Get(topic); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Topic %q is not registered", topic)})
+		return
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if err := r.management(topic).SetEntityTTL(c, ttl); err != nil {
+		r.logger.ErrorContext(c, "failed to set topic TTL", "topic", topic, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to set topic TTL"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Topic TTL updated", "topic": topic, "ttl_seconds": req.TTLSeconds})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHandleSetTopicTTL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := newTestBroker(t)
+	config := b.config()
+	defaultPublisher := newBrokerPublisher(t, config)
+
+	tests := []struct {
+		name       string
+		topic      string
+		body       string
+		putStatus  int
+		wantStatus int
+		wantPut    bool
+	}{
+		{name: "updated", topic: "topic", body: `{"ttl_seconds": 3600}`, putStatus: http.StatusOK, wantStatus: http.StatusOK, wantPut: true},
+		{name: "negative TTL", topic: "topic", body: `{"ttl_seconds": -5}`, wantStatus: http.StatusBadRequest},
+		{name: "zero TTL", topic: "topic", body: `{"ttl_seconds": 0}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", topic: "topic", body: `{`, wantStatus: http.StatusBadRequest},
+		{name: "unknown topic", topic: "other", body: `{"ttl_seconds": 3600}`, wantStatus: http.StatusNotFound},
+		{name: "update failed", topic: "topic", body: `{"ttl_seconds": 3600}`, putStatus: http.StatusInternalServerError, wantStatus: http.StatusBadGateway, wantPut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var puts []string
+			registry := NewPublisherRegistry(discardLogger(), config, defaultPublisher)
+			registry.newManagement = newTestManagementServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					fmt.Fprint(w, topicEntry(""))
+					return
+				}
+				puts = append(puts, r.URL.Path)
+				w.WriteHeader(tt.putStatus)
+			})
+			engine := gin.New()
+			engine.POST("/topics/:topic/ttl", registry.handleSetTopicTTL)
+
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/topics/"+tt.topic+"/ttl", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := len(puts) > 0; got != tt.wantPut {
+				t.Fatalf("description written = %v, want %v", got, tt.wantPut)
+			}
+			if tt.wantPut && puts[0] != "/"+tt.topic {
+				t.Errorf("wrote description of %s, want /%s", puts[0], tt.topic)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+// RequestHandler processes a request and returns the reply to publish. An
+// error settles the request like that of a MessageHandler and no reply is
+// sent.
+type RequestHandler func(ctx context.Context, req Envelope) (Envelope, error)
+
+// ReplyingSubscriber is a Subscriber that answers each request it receives
+// by publishing the RequestHandler's reply to a reply topic.
+type ReplyingSubscriber struct {
+	*Subscriber
+	handler   RequestHandler
+	publisher *Publisher
+}
+
+// NewReplyingSubscriber subscribes to config's subscription and publishes
+// the reply to each request to replyTopic over the same connection. The
+// reply carries the request's correlation ID, or its message ID when it has
+// none, so it can be matched by Publisher.Request. A request is only settled
+// once its reply has been accepted; if publishing fails it is abandoned and
+// redelivered.
+func NewReplyingSubscriber(ctx context.Context, logger *slog.Logger, config AmqpConfig, replyTopic string, handler RequestHandler, opts ...SubscriberOption) (*ReplyingSubscriber, func(), error) {
+	rs := &ReplyingSubscriber{handler: handler}
+	subscriber, cleanup, err := NewSubscriber(ctx, logger, config, append(opts, WithHandler(rs.handle))...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := authorize(ctx, logger, subscriber.conn, config, replyTopic); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to authorize reply topic %s: %w", replyTopic, err)
+	}
+	publisher, err := newPublisher(ctx, subscriber.conn, replyTopic, logger, PublisherOptions{})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	rs.Subscriber = subscriber
+	rs.publisher = publisher
+
+	return rs, func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		publisher.close(closeCtx)
+		cleanup()
+	}, nil
+}
+
+func (rs *ReplyingSubscriber) handle(ctx context.Context, msg *amqp.Message) error {
+	req := WrapEnvelope(msg)
+	reply, err := rs.handler(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := rs.publisher.PublishMessage(ctx, replyMessage(req, reply)); err != nil {
+		return fmt.Errorf("failed to publish reply to %v: %w", req.MessageID, err)
+	}
+	return nil
+}
+
+// replyMessage builds the AMQP message of reply to req.
+func replyMessage(req, reply Envelope) *amqp.Message {
+	msg := amqp.NewMessage(reply.Body)
+	msg.ApplicationProperties = reply.ApplicationProperties
+
+	messageID := reply.MessageID
+	if messageID == nil {
+		messageID = uuid.NewString()
+	}
+	correlationID := req.CorrelationID
+	if correlationID == nil {
+		correlationID = req.MessageID
+	}
+	msg.Properties = &amqp.MessageProperties{MessageID: messageID, CorrelationID: correlationID}
+	if reply.ContentType != "" {
+		msg.Properties.ContentType = &reply.ContentType
+	}
+	if reply.Subject != "" {
+		msg.Properties.Subject = &reply.Subject
+	}
+	return msg
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestReplyingSubscriber(t *testing.T) {
+	tests := []struct {
+		name string
+		// correlationID is that of the request, whose message ID is "req-1".
+		correlationID   any
+		handlerErr      error
+		rejectReplies   bool
+		wantCorrelation any
+		wantReplies     int
+		wantOutcome     string
+	}{
+		{name: "request correlation ID", correlationID: "conv-1", wantCorrelation: "conv-1", wantReplies: 1, wantOutcome: "accepted"},
+		{name: "request message ID", wantCorrelation: "req-1", wantReplies: 1, wantOutcome: "accepted"},
+		{name: "handler fails", handlerErr: errors.New("boom"), wantOutcome: "modified"},
+		{name: "reply rejected", rejectReplies: true, wantOutcome: "modified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			if tt.rejectReplies {
+				b.sendOutcome = func(address string, msg *amqp.Message) brokerState {
+					if address == "replies" {
+						return brokerState{Outcome: "rejected", Condition: "amqp:internal-error"}
+					}
+					return brokerState{Outcome: "accepted"}
+				}
+			}
+			rs, cleanup, err := NewReplyingSubscriber(context.Background(), discardLogger(), config, "replies",
+				func(ctx context.Context, req Envelope) (Envelope, error) {
+					if redelivered(req.Message) {
+						return Envelope{}, DeadLetter("Done", "")
+					}
+					return Envelope{Body: append([]byte("re: "), req.Body...), ContentType: "text/plain"}, tt.handlerErr
+				})
+			if err != nil {
+				t.Fatalf("NewReplyingSubscriber: %v", err)
+			}
+			t.Cleanup(cleanup)
+			listenInBackground(t, rs.Subscriber)
+
+			req := amqp.NewMessage([]byte("ping"))
+			req.Properties = &amqp.MessageProperties{MessageID: "req-1", CorrelationID: tt.correlationID}
+			b.send(config.SubscriptionPath(), req)
+			if got := b.waitSettlements(1)[0].State.Outcome; got != tt.wantOutcome {
+				t.Errorf("request outcome = %q, want %q", got, tt.wantOutcome)
+			}
+
+			replies := b.receivedAt("replies")
+			if len(replies) != tt.wantReplies {
+				t.Fatalf("reply topic received %d messages, want %d", len(replies), tt.wantReplies)
+			}
+			if len(b.receivedAt("topic")) != 0 {
+				t.Error("reply published to the request topic")
+			}
+			if tt.wantCorrelation == nil {
+				return
+			}
+			reply := replies[0]
+			if reply.Properties == nil || reply.Properties.CorrelationID != tt.wantCorrelation {
+				t.Errorf("reply properties = %+v, want correlation ID %v", reply.Properties, tt.wantCorrelation)
+			}
+			if string(reply.GetData()) != "re: ping" || *reply.Properties.ContentType != "text/plain" || reply.Properties.MessageID == nil {
+				t.Errorf("reply = %q with properties %+v", reply.GetData(), reply.Properties)
+			}
+		})
+	}
+}
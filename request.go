@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/google/uuid"
+)
+
+// errReplyListenerClosed is returned to requests waiting on a listener whose
+// receiver stopped.
+var errReplyListenerClosed = errors.New("reply listener closed")
+
+// Request publishes message with a new message ID as its correlation ID and
+// replyTo as its reply address, then waits up to timeout for the reply
+// carrying that correlation ID. A zero timeout waits until ctx is done.
+func (p *Publisher) Request(ctx context.Context, message string, replyTo string, timeout time.Duration) (*amqp.Message, error) {
+	listener, err := p.replyListener(ctx, replyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	messageID := uuid.NewString()
+	replies, stop := listener.wait(messageID)
+	defer stop()
+
+	msg, err := p.newMessage([]byte(message), &SendOptions{MessageID: messageID})
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties.ReplyTo = &replyTo
+	msg.Properties.CorrelationID = messageID
+	if err := p.PublishMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return nil, fmt.Errorf("failed to receive reply to %s: %w", messageID, listener.Err())
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no reply to %s: %w", messageID, ctx.Err())
+	}
+}
+
+// replyListener returns the running listener for address, starting one if
+// there is none or the previous one stopped.
+func (p *Publisher) replyListener(ctx context.Context, address string) (*ReplyListener, error) {
+	p.replyMu.Lock()
+	defer p.replyMu.Unlock()
+	if listener, ok := p.replyListeners[address]; ok {
+		if listener.Err() == nil {
+			return listener, nil
+		}
+		listener.Close(ctx)
+		delete(p.replyListeners, address)
+	}
+
+	listener, err := NewReplyListener(ctx, p.logger, p.Connection(), address)
+	if err != nil {
+		return nil, err
+	}
+	if p.replyListeners == nil {
+		p.replyListeners = make(map[string]*ReplyListener)
+	}
+	p.replyListeners[address] = listener
+	return listener, nil
+}
+
+// closeReplyListeners stops every listener started by Request.
+func (p *Publisher) closeReplyListeners(ctx context.Context) {
+	p.replyMu.Lock()
+	defer p.replyMu.Unlock()
+	for address, listener := range p.replyListeners {
+		listener.Close(ctx)
+		delete(p.replyListeners, address)
+	}
+}
+
+// ReplyListener receives the replies sent to one address and hands each to
+// the request waiting for its correlation ID, so concurrent requests can
+// share a single receiver.
+type ReplyListener struct {
+	session  *amqp.Session
+	receiver *amqp.Receiver
+	logger   *slog.Logger
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu      sync.Mutex
+	waiters map[string]chan *amqp.Message
+	err     error
+}
+
+// NewReplyListener attaches a receiver to address on its own session of conn
+// and starts dispatching replies in the background.
+func NewReplyListener(ctx context.Context, logger *slog.Logger, conn *amqp.Conn, address string) (*ReplyListener, error) {
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reply session: %w", err)
+	}
+	receiver, err := session.NewReceiver(ctx, address, nil)
+	if err != nil {
+		session.Close(ctx)
+		return nil, fmt.Errorf("failed to create reply receiver: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	l := &ReplyListener{
+		session:  session,
+		receiver: receiver,
+		logger:   logger,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		waiters:  make(map[string]chan *amqp.Message),
+	}
+	go l.run(runCtx)
+	return l, nil
+}
+
+// wait registers interest in the reply with correlationID. The returned
+// channel receives the reply, or is closed if the listener stops first; stop
+// must be called once the caller no longer waits.
+func (l *ReplyListener) wait(correlationID string) (<-chan *amqp.Message, func()) {
+	ch := make(chan *amqp.Message, 1)
+	l.mu.Lock()
+	if l.err != nil {
+		close(ch)
+	} else {
+		l.waiters[correlationID] = ch
+	}
+	l.mu.Unlock()
+
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.waiters, correlationID)
+		l.mu.Unlock()
+	}
+}
+
+func (l *ReplyListener) run(ctx context.Context) {
+	defer close(l.done)
+	for {
+		msg, err := l.receiver.Receive(ctx, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = errReplyListenerClosed
+			}
+			l.stop(err)
+			return
+		}
+		if err := l.receiver.AcceptMessage(ctx, msg); err != nil {
+			l.logger.ErrorContext(ctx, "failed to accept reply", "message_id", messageIDOf(msg), "error", err)
+		}
+		l.dispatch(msg)
+	}
+}
+
+func (l *ReplyListener) dispatch(msg *amqp.Message) {
+	var correlationID string
+	if msg.Properties != nil && msg.Properties.CorrelationID != nil {
+		correlationID = fmt.Sprint(msg.Properties.CorrelationID)
+	}
+
+	l.mu.Lock()
+	ch, ok := l.waiters[correlationID]
+	delete(l.waiters, correlationID)
+	l.mu.Unlock()
+
+	if !ok {
+		l.logger.Warn("discarding reply with unknown correlation ID", "correlation_id", correlationID)
+		return
+	}
+	ch <- msg
+}
+
+// stop records why the listener stopped and releases every waiting request.
+func (l *ReplyListener) stop(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+	for id, ch := range l.waiters {
+		close(ch)
+		delete(l.waiters, id)
+	}
+}
+
+// Err returns why the listener stopped, or nil while it is running.
+func (l *ReplyListener) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Close stops the listener and closes its receiver and session.
+func (l *ReplyListener) Close(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+	return errors.Join(l.receiver.Close(ctx), l.session.Close(ctx))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned, joined with the send error, when a
+// failed send is not retried because the publisher's RetryBudget is used
+// up.
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudget is a token bucket limiting the retries of all the sends that
+// share it, so a slow or failing broker is not flooded with retries from
+// many concurrent callers. It may be shared by several publishers.
+type RetryBudget struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRetryBudget returns a budget allowing rate retries per second on
+// average and up to burst at once. It starts full.
+func NewRetryBudget(rate float64, burst int) *RetryBudget {
+	return &RetryBudget{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a retry from the budget, reporting false when none is left. A
+// nil budget allows every retry.
+func (b *RetryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
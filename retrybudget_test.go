@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetAllow(t *testing.T) {
+	b := NewRetryBudget(2, 3)
+	for i := range 3 {
+		if !b.allow() {
+			t.Fatalf("allow() %d of the burst = false, want true", i+1)
+		}
+	}
+	if b.allow() {
+		t.Fatal("allow() after the burst = true, want false")
+	}
+	// Half a second at 2 per second refills one retry.
+	b.mu.Lock()
+	b.last = b.last.Add(-500 * time.Millisecond)
+	b.mu.Unlock()
+	if !b.allow() {
+		t.Error("allow() after refilling = false, want true")
+	}
+	if b.allow() {
+		t.Error("allow() after the refill was used = true, want false")
+	}
+	// The bucket never holds more than the burst.
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Hour)
+	b.mu.Unlock()
+	allowed := 0
+	for b.allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("allow() after an hour idle allowed %d, want the burst of 3", allowed)
+	}
+
+	var unlimited *RetryBudget
+	if !unlimited.allow() {
+		t.Error("nil budget allow() = false, want true")
+	}
+}
+
+func TestGlobalRetryBudget(t *testing.T) {
+	const publishers, burst = 8, 3
+	b := newTestBroker(t)
+	// The budget does not refill during the test.
+	budget := NewRetryBudget(1e-9, burst)
+	ps := make([]*Publisher, publishers)
+	for i := range ps {
+		ps[i] = newBrokerPublisher(t, b.config(), func(o *PublisherOptions) { o.GlobalRetryBudget = budget })
+	}
+
+	// Every publisher's next send fails and needs a retry.
+	b.endSessions("topic")
+	errs := make([]error, publishers)
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			errs[i] = p.Publish(ctx, "hello", nil)
+		}()
+	}
+	wg.Wait()
+
+	var retried, exhausted int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			retried++
+		case errors.Is(err, ErrRetryBudgetExhausted):
+			exhausted++
+		default:
+			t.Errorf("Publish() = %v, want nil or ErrRetryBudgetExhausted", err)
+		}
+	}
+	if retried != burst || exhausted != publishers-burst {
+		t.Errorf("%d sends retried and %d failed, want %d and %d", retried, exhausted, burst, publishers-burst)
+	}
+	if got := len(b.receivedAt("topic")); got != burst {
+		t.Errorf("broker received %d messages, want %d", got, burst)
+	}
+
+	// Sessions were reopened even for the sends that were not retried.
+	for i, p := range ps {
+		if err := p.Publish(context.Background(), "after", nil); err != nil {
+			t.Errorf("publisher %d: Publish() after the failure = %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+)
+
+// unroutableReason is the dead-letter reason of messages PropertyGroupRouter
+// has no handler for.
+const unroutableReason = "UnroutableMessage"
+
+// PropertyGroupRouter dispatches messages to handlers by the value of an
+// application property. Routes must be added before the router handles
+// messages.
+type PropertyGroupRouter struct {
+	fallback MessageHandler
+	// properties lists the routed property names in the order they were
+	// first added; routes maps each to its handlers by value.
+	properties []string
+	routes     map[string]map[string]MessageHandler
+}
+
+// NewPropertyGroupRouter returns a router passing messages that match no
+// route to fallback. When fallback is nil they are dead-lettered with reason
+// "UnroutableMessage".
+func NewPropertyGroupRouter(fallback MessageHandler) *PropertyGroupRouter {
+	return &PropertyGroupRouter{fallback: fallback, routes: make(map[string]map[string]MessageHandler)}
+}
+
+// Route passes messages whose application property propertyName equals value
+// to handler. Non-string property values are compared in their fmt.Sprint
+// form. When a message matches routes on several properties, the property
+// routed first wins.
+func (r *PropertyGroupRouter) Route(propertyName, value string, handler MessageHandler) *PropertyGroupRouter {
+	byValue, ok := r.routes[propertyName]
+	if !ok {
+		byValue = make(map[string]MessageHandler)
+		r.routes[propertyName] = byValue
+		r.properties = append(r.properties, propertyName)
+	}
+	byValue[value] = handler
+	return r
+}
+
+// Handle is the router's MessageHandler.
+func (r *PropertyGroupRouter) Handle(ctx context.Context, msg *amqp.Message) error {
+	for _, property := range r.properties {
+		v, ok := msg.ApplicationProperties[property]
+		if !ok {
+			continue
+		}
+		if handler, ok := r.routes[property][fmt.Sprint(v)]; ok {
+			return handler(ctx, msg)
+		}
+	}
+	if r.fallback == nil {
+		return DeadLetter(unroutableReason, "no handler matches the message's application properties")
+	}
+	return r.fallback(ctx, msg)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPropertyGroupRouter(t *testing.T) {
+	// handledBy returns a handler reporting name to got.
+	var got string
+	handledBy := func(name string) MessageHandler {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			got = name
+			return nil
+		}
+	}
+	router := NewPropertyGroupRouter(handledBy("default")).
+		Route("region", "eu", handledBy("eu")).
+		Route("region", "us", handledBy("us")).
+		Route("priority", "1", handledBy("urgent"))
+
+	tests := []struct {
+		name       string
+		properties map[string]any
+		want       string
+	}{
+		{name: "known value", properties: map[string]any{"region": "eu"}, want: "eu"},
+		{name: "other known value", properties: map[string]any{"region": "us"}, want: "us"},
+		{name: "unknown value", properties: map[string]any{"region": "apac"}, want: "default"},
+		{name: "missing property", properties: map[string]any{"tenant": "acme"}, want: "default"},
+		{name: "no properties", want: "default"},
+		{name: "non-string value", properties: map[string]any{"priority": int64(1)}, want: "urgent"},
+		{name: "first routed property wins", properties: map[string]any{"priority": "1", "region": "us"}, want: "us"},
+		{name: "falls through to a later property", properties: map[string]any{"region": "apac", "priority": "1"}, want: "urgent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			msg := amqp.NewMessage([]byte("body"))
+			msg.ApplicationProperties = tt.properties
+			if err := router.Handle(context.Background(), msg); err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("handled by %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPropertyGroupRouterWithoutFallback(t *testing.T) {
+	router := NewPropertyGroupRouter(nil).Route("region", "eu", func(context.Context, *amqp.Message) error { return nil })
+	msg := amqp.NewMessage([]byte("body"))
+	msg.ApplicationProperties = map[string]any{"region": "us"}
+
+	var decision *SettlementDecision
+	if err := router.Handle(context.Background(), msg); !errors.As(err, &decision) || decision.Policy != PolicyDeadLetter || decision.Reason != unroutableReason {
+		t.Errorf("Handle = %v, want a dead-letter with reason %s", err, unroutableReason)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	sessionFilterName = "com.microsoft:session-filter"
+	sessionFilterCode = 0x00000137_0000000C
+
+	sessionLockLostCondition amqp.ErrCond = "com.microsoft:session-lock-lost"
+)
+
+// ErrSessionLockLost is returned by StartListening when the broker released
+// the subscriber's session lock. It is retryable: reattaching the receiver
+// acquires the session again and unsettled messages are redelivered.
+var ErrSessionLockLost = errors.New("service bus session lock lost")
+
+// IsRetryable reports whether the subscriber can resume after err by
+// reattaching its receiver or reconnecting.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrSessionLockLost) || errors.Is(err, ErrManagementPingFailed) || connectionLost(err)
+}
+
+// sessionFilter selects the session the receiver locks. An empty sessionID
+// accepts the next available session.
+func sessionFilter(sessionID string) amqp.LinkFilter {
+	var value any
+	if sessionID != "" {
+		value = sessionID
+	}
+	return amqp.NewLinkFilter(sessionFilterName, sessionFilterCode, value)
+}
+
+// startOffsetFilter positions the receiver at the earliest retained message
+// on brokers that track offsets, such as Event Hubs.
+func startOffsetFilter() amqp.LinkFilter {
+	return amqp.NewSelectorFilter("amqp.annotation.x-opt-offset > '-1'")
+}
+
+// describeSession returns the session ID the broker assigned to receiver.
+func describeSession(receiver *amqp.Receiver) string {
+	if id, ok := receiver.LinkSourceFilterValue(sessionFilterName).(string); ok {
+		return id
+	}
+	return "(unknown)"
+}
+
+func sessionLockLost(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Condition == sessionLockLostCondition
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+)
+
+// deadLetterCondition is the rejection condition Service Bus interprets as a
+// request to move the message to the dead-letter sub-queue.
+const deadLetterCondition amqp.ErrCond = "com.microsoft:dead-letter"
+
+// SettlementPolicy selects how a received message is settled.
+type SettlementPolicy int
+
+const (
+	// PolicyAccept completes the message.
+	PolicyAccept SettlementPolicy = iota
+	// PolicyAbandon releases the lock so the message is redelivered, counting
+	// the attempt against the subscription's max delivery count.
+	PolicyAbandon
+	// PolicyDeadLetter moves the message to the dead-letter sub-queue.
+	PolicyDeadLetter
+	// PolicyDefer sets the message aside; it is not redelivered to this link.
+	PolicyDefer
+)
+
+func (p SettlementPolicy) String() string {
+	switch p {
+	case PolicyAccept:
+		return "accept"
+	case PolicyAbandon:
+		return "abandon"
+	case PolicyDeadLetter:
+		return "dead-letter"
+	case PolicyDefer:
+		return "defer"
+	default:
+		return fmt.Sprintf("SettlementPolicy(%d)", int(p))
+	}
+}
+
+// SettlementDecision is returned by a MessageHandler, directly or wrapped, to
+// choose how the message is settled. Any other error abandons the message.
+type SettlementDecision struct {
+	Policy SettlementPolicy
+	// Reason and Description are recorded on dead-lettered messages.
+	Reason      string
+	Description string
+	// Annotations are merged into the message when it is abandoned or
+	// deferred. Those with string keys are also recorded as application
+	// properties when it is dead-lettered.
+	Annotations amqp.Annotations
+	// Err is the processing error behind the decision, if any.
+	Err error
+}
+
+func (d *SettlementDecision) Error() string {
+	if d.Err != nil {
+		return fmt.Sprintf("%s: %v", d.Policy, d.Err)
+	}
+	if d.Reason != "" {
+		return fmt.Sprintf("%s: %s", d.Policy, d.Reason)
+	}
+	return d.Policy.String()
+}
+
+func (d *SettlementDecision) Unwrap() error {
+	return d.Err
+}
+
+// Abandon returns a decision to abandon the message because of err.
+func Abandon(err error) error {
+	return &SettlementDecision{Policy: PolicyAbandon, Err: err}
+}
+
+// DeadLetter returns a decision to dead-letter the message with reason.
+func DeadLetter(reason, description string) error {
+	return &SettlementDecision{Policy: PolicyDeadLetter, Reason: reason, Description: description}
+}
+
+// Defer returns a decision to defer the message.
+func Defer() error {
+	return &SettlementDecision{Policy: PolicyDefer}
+}
+
+// decisionFor maps a handler result to a settlement decision.
+func decisionFor(err error) *SettlementDecision {
+	if err == nil {
+		return &SettlementDecision{Policy: PolicyAccept}
+	}
+	var decision *SettlementDecision
+	if errors.As(err, &decision) {
+		return decision
+	}
+	return &SettlementDecision{Policy: PolicyAbandon, Err: err}
+}
+
+// settle applies decision to msg.
+func settle(ctx context.Context, receiver *amqp.Receiver, msg *amqp.Message, decision *SettlementDecision) error {
+	var err error
+	switch decision.Policy {
+	case PolicyAccept:
+		err = receiver.AcceptMessage(ctx, msg)
+	case PolicyAbandon:
+		err = receiver.ModifyMessage(ctx, msg, &amqp.ModifyMessageOptions{
+			DeliveryFailed: true,
+			Annotations:    decision.Annotations,
+		})
+	case PolicyDeadLetter:
+		// Service Bus sets the other entries of the error info as
+		// application properties of the dead-lettered message.
+		info := make(map[string]any, len(decision.Annotations)+2)
+		for key, value := range decision.Annotations {
+			if name, ok := key.(string); ok {
+				info[name] = value
+			}
+		}
+		info["DeadLetterReason"] = decision.Reason
+		info["DeadLetterErrorDescription"] = decision.Description
+		err = receiver.RejectMessage(ctx, msg, &amqp.Error{
+			Condition:   deadLetterCondition,
+			Description: decision.Description,
+			Info:        info,
+		})
+	case PolicyDefer:
+		err = receiver.ModifyMessage(ctx, msg, &amqp.ModifyMessageOptions{
+			UndeliverableHere: true,
+			Annotations:       decision.Annotations,
+		})
+	default:
+		return fmt.Errorf("unknown settlement policy %v", decision.Policy)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %s message: %w", decision.Policy, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is the number of most recent publishes the latency
+// percentiles are computed over.
+const latencyWindowSize = 4096
+
+// latencyWindow keeps the latencies of the most recent publishes. The
+// percentiles are exact over the window rather than estimated over every
+// publish with an HDR histogram or CKMS sketch: memory stays bounded, and
+// old latencies age out instead of masking a recent slowdown.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	// next is the index the next sample overwrites once samples is full.
+	next int
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// sorted returns a sorted copy of the samples.
+func (w *latencyWindow) sorted() []time.Duration {
+	w.mu.Lock()
+	samples := slices.Clone(w.samples)
+	w.mu.Unlock()
+	slices.Sort(samples)
+	return samples
+}
+
+// PublishStats is a snapshot of the publish latencies of a Publisher over
+// its most recent 4096 publishes, failed ones included.
+type PublishStats struct {
+	// latencies are sorted.
+	latencies []time.Duration
+}
+
+// Stats returns a snapshot of the publish latencies.
+func (p *Publisher) Stats() PublishStats {
+	return PublishStats{latencies: p.latencies.sorted()}
+}
+
+// Count returns the number of publishes in the snapshot.
+func (s PublishStats) Count() int {
+	return len(s.latencies)
+}
+
+// LatencyP50 returns the median publish latency, or 0 without publishes.
+func (s PublishStats) LatencyP50() time.Duration {
+	return s.percentile(50)
+}
+
+// LatencyP90 returns the 90th percentile publish latency.
+func (s PublishStats) LatencyP90() time.Duration {
+	return s.percentile(90)
+}
+
+// LatencyP99 returns the 99th percentile publish latency.
+func (s PublishStats) LatencyP99() time.Duration {
+	return s.percentile(99)
+}
+
+// percentile returns the nearest-rank percentile p of the latencies.
+func (s PublishStats) percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(s.latencies))))
+	return s.latencies[max(rank, 1)-1]
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestPublishStatsPercentiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		samples       []time.Duration
+		wantCount     int
+		p50, p90, p99 time.Duration
+	}{
+		{name: "no publishes"},
+		{name: "one publish", samples: []time.Duration{7 * time.Millisecond}, wantCount: 1,
+			p50: 7 * time.Millisecond, p90: 7 * time.Millisecond, p99: 7 * time.Millisecond},
+		{name: "1000 publishes", samples: shuffled(millisecondsUpTo(1000)), wantCount: 1000,
+			p50: 500 * time.Millisecond, p90: 900 * time.Millisecond, p99: 990 * time.Millisecond},
+		// Once the window is full the oldest latencies, 1ms to 1000ms,
+		// are overwritten.
+		{name: "window full", samples: millisecondsUpTo(1000 + latencyWindowSize), wantCount: latencyWindowSize,
+			p50: 3048 * time.Millisecond, p90: 4687 * time.Millisecond, p99: 5056 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Publisher{}
+			for _, d := range tt.samples {
+				p.latencies.observe(d)
+			}
+			stats := p.Stats()
+			if got := stats.Count(); got != tt.wantCount {
+				t.Errorf("Count() = %d, want %d", got, tt.wantCount)
+			}
+			for _, c := range []struct {
+				name      string
+				got, want time.Duration
+			}{
+				{"LatencyP50", stats.LatencyP50(), tt.p50},
+				{"LatencyP90", stats.LatencyP90(), tt.p90},
+				{"LatencyP99", stats.LatencyP99(), tt.p99},
+			} {
+				if c.got != c.want {
+					t.Errorf("%s() = %v, want %v", c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// millisecondsUpTo returns the latencies from 1 to n milliseconds in order.
+func millisecondsUpTo(n int) []time.Duration {
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+	return samples
+}
+
+func shuffled(samples []time.Duration) []time.Duration {
+	rand.Shuffle(len(samples), func(i, j int) { samples[i], samples[j] = samples[j], samples[i] })
+	return samples
+}
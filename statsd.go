@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+const (
+	statsdAddrVariable   = "STATSD_ADDR"
+	statsdPrefixVariable = "STATSD_PREFIX"
+)
+
+// statsdMaxPacketSize is the largest packet a buffered StatsDExporter
+// sends, small enough not to be fragmented on common networks.
+const statsdMaxPacketSize = 1432
+
+// StatsDExporter is a MetricsRecorder sending each update to a StatsD server
+// over UDP: counters as "|c" and the publish duration as a "|ms" timing.
+// Send errors are ignored, as is usual for StatsD.
+type StatsDExporter struct {
+	client *statsd.Client
+	// buffered leaves updates in the client's buffer until Flush or a full
+	// packet.
+	buffered bool
+}
+
+// NewStatsDExporter returns an exporter sending to addr (host:port). When
+// prefix is not empty it is prepended to every bucket name, separated by a
+// dot. It may fail when nothing listens at addr, which the client probes.
+func NewStatsDExporter(addr, prefix string) (*StatsDExporter, error) {
+	opts := []statsd.Option{
+		statsd.Address(addr),
+		// Packets are only sent by Flush or when full, never by the
+		// client's own timer.
+		statsd.FlushPeriod(0),
+		statsd.MaxPacketSize(statsdMaxPacketSize),
+	}
+	if prefix != "" {
+		opts = append(opts, statsd.Prefix(prefix))
+	}
+	client, err := statsd.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD at %s: %w", addr, err)
+	}
+	return &StatsDExporter{client: client}, nil
+}
+
+// NewBufferedStatsDExporter is like NewStatsDExporter, but collects updates
+// into packets of up to 1432 bytes, one per line, sent when full or when
+// Flush is called. Set MetricsFlushInterval on the publisher and subscriber
+// using it so that updates are not held back indefinitely.
+func NewBufferedStatsDExporter(addr, prefix string) (*StatsDExporter, error) {
+	e, err := NewStatsDExporter(addr, prefix)
+	if err != nil {
+		return nil, err
+	}
+	e.buffered = true
+	return e, nil
+}
+
+// newStatsDExporterFromEnv builds an exporter from STATSD_ADDR and
+// STATSD_PREFIX. It returns nil when STATSD_ADDR is unset.
+func newStatsDExporterFromEnv() (*StatsDExporter, error) {
+	addr := os.Getenv(statsdAddrVariable)
+	if addr == "" {
+		return nil, nil
+	}
+	return NewStatsDExporter(addr, os.Getenv(statsdPrefixVariable))
+}
+
+// Close sends any buffered updates and closes the UDP socket.
+func (e *StatsDExporter) Close() error {
+	e.client.Close()
+	return nil
+}
+
+// Flush sends the buffered updates. It does nothing for an exporter from
+// NewStatsDExporter, which sends each update at once.
+func (e *StatsDExporter) Flush(context.Context) error {
+	e.client.Flush()
+	return nil
+}
+
+// sent sends an update at once unless the exporter buffers them.
+func (e *StatsDExporter) sent() {
+	if !e.buffered {
+		e.client.Flush()
+	}
+}
+
+func (e *StatsDExporter) observePublish(d time.Duration, err error) {
+	e.client.Timing("publish_duration", d.Milliseconds())
+	if err != nil {
+		e.client.Increment("publish_errors")
+	} else {
+		e.client.Increment("messages_published")
+	}
+	e.sent()
+}
+
+func (e *StatsDExporter) incReceived() {
+	e.client.Increment("messages_received")
+	e.sent()
+}
+
+func (e *StatsDExporter) incReceiveErrors() {
+	e.client.Increment("receive_errors")
+	e.sent()
+}
+
+func (e *StatsDExporter) observeDelivery(deliveryCount uint32) {
+	e.client.Increment("message_retries." + deliveryAttemptBucket(deliveryCount))
+	e.sent()
+}
+
+func (e *StatsDExporter) incIdleTimeout() {
+	e.client.Increment("subscriber_idle_timeouts")
+	e.sent()
+}
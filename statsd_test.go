@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStatsDListener returns a UDP socket standing in for a StatsD server.
+func newStatsDListener(t *testing.T) net.PacketConn {
+	t.Helper()
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// readPacket returns the next packet received by ln, or "" when none
+// arrives within timeout. The empty packets the client sends to check that
+// the server is listening are skipped.
+func readPacket(t *testing.T, ln net.PacketConn, timeout time.Duration) string {
+	t.Helper()
+	buf := make([]byte, 64*1024)
+	ln.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := ln.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return ""
+			}
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		if n > 0 {
+			return string(buf[:n])
+		}
+	}
+}
+
+func TestStatsDExporter(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		update func(e *StatsDExporter)
+		want   string
+	}{
+		{name: "published", prefix: "asb", update: func(e *StatsDExporter) { e.observePublish(12*time.Millisecond, nil) },
+			want: "asb.publish_duration:12|ms\nasb.messages_published:1|c"},
+		{name: "publish error", prefix: "asb.", update: func(e *StatsDExporter) { e.observePublish(3*time.Millisecond, errors.New("failed")) },
+			want: "asb.publish_duration:3|ms\nasb.publish_errors:1|c"},
+		{name: "received", update: func(e *StatsDExporter) { e.incReceived() }, want: "messages_received:1|c"},
+		{name: "receive error", prefix: "asb", update: func(e *StatsDExporter) { e.incReceiveErrors() }, want: "asb.receive_errors:1|c"},
+		{name: "first delivery", prefix: "asb", update: func(e *StatsDExporter) { e.observeDelivery(0) }, want: "asb.message_retries.1:1|c"},
+		{name: "many deliveries", prefix: "asb", update: func(e *StatsDExporter) { e.observeDelivery(9) }, want: "asb.message_retries.5+:1|c"},
+		{name: "idle timeout", prefix: "asb", update: func(e *StatsDExporter) { e.incIdleTimeout() }, want: "asb.subscriber_idle_timeouts:1|c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln := newStatsDListener(t)
+			e, err := NewStatsDExporter(ln.LocalAddr().String(), tt.prefix)
+			if err != nil {
+				t.Fatalf("NewStatsDExporter: %v", err)
+			}
+			defer e.Close()
+
+			tt.update(e)
+			if got := readPacket(t, ln, 5*time.Second); got != tt.want {
+				t.Errorf("packet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferedStatsDExporter(t *testing.T) {
+	ln := newStatsDListener(t)
+	e, err := NewBufferedStatsDExporter(ln.LocalAddr().String(), "asb")
+	if err != nil {
+		t.Fatalf("NewBufferedStatsDExporter: %v", err)
+	}
+	defer e.Close()
+
+	e.incReceived()
+	e.incReceived()
+	if got := readPacket(t, ln, 100*time.Millisecond); got != "" {
+		t.Fatalf("buffered exporter sent %q before Flush", got)
+	}
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got, want := readPacket(t, ln, 5*time.Second), "asb.messages_received:1|c\nasb.messages_received:1|c"; got != want {
+		t.Errorf("flushed packet = %q, want %q", got, want)
+	}
+
+	// Updates that overflow a packet are sent without waiting for Flush,
+	// in packets that are not fragmented.
+	for range 100 {
+		e.incReceived()
+	}
+	got := readPacket(t, ln, 5*time.Second)
+	if got == "" || len(got) > statsdMaxPacketSize {
+		t.Fatalf("full packet of %d bytes, want up to %d", len(got), statsdMaxPacketSize)
+	}
+	for _, line := range strings.Split(got, "\n") {
+		if line != "asb.messages_received:1|c" {
+			t.Errorf("line %q in full packet, want asb.messages_received:1|c", line)
+		}
+	}
+}
+
+func TestStatsDExporterFromEnv(t *testing.T) {
+	t.Setenv(statsdAddrVariable, "")
+	if e, err := newStatsDExporterFromEnv(); e != nil || err != nil {
+		t.Errorf("newStatsDExporterFromEnv() without %s = %v, %v, want nil", statsdAddrVariable, e, err)
+	}
+
+	ln := newStatsDListener(t)
+	t.Setenv(statsdAddrVariable, ln.LocalAddr().String())
+	t.Setenv(statsdPrefixVariable, "env")
+	e, err := newStatsDExporterFromEnv()
+	if err != nil {
+		t.Fatalf("newStatsDExporterFromEnv: %v", err)
+	}
+	defer e.Close()
+	e.incReceived()
+	if got, want := readPacket(t, ln, 5*time.Second), "env.messages_received:1|c"; got != want {
+		t.Errorf("packet = %q, want %q", got, want)
+	}
+}
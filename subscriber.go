@@ -0,0 +1,1195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const closeTimeout = 5 * time.Second
+
+// messageTooLargeReason is the dead-letter reason of messages over
+// SubscriberOptions.MaxBodySize.
+const messageTooLargeReason = "MessageTooLarge"
+
+// MessageHandler processes a received message. A nil return accepts the
+// message. Returning a *SettlementDecision (see Abandon, DeadLetter and
+// Defer) selects another outcome; any other error, or a panic, abandons it
+// so the broker can redeliver it.
+type MessageHandler func(ctx context.Context, msg *amqp.Message) error
+
+// HandlerFactory returns the handler of one message, e.g. to give it
+// request-scoped services. ctx is the context the returned handler is
+// called with.
+type HandlerFactory func(ctx context.Context) MessageHandler
+
+// factoryHandler calls factory for each message and handles it with the
+// handler it returns.
+func factoryHandler(factory HandlerFactory) MessageHandler {
+	return func(ctx context.Context, msg *amqp.Message) error {
+		handler := factory(ctx)
+		if handler == nil {
+			return errors.New("handler factory returned no handler")
+		}
+		return handler(ctx, msg)
+	}
+}
+
+// DispatchMode selects how received messages reach the handler when
+// ASB_CONCURRENCY is above 1.
+type DispatchMode int
+
+const (
+	// DispatchModeInline runs the handler on a fixed pool of workers, each
+	// blocked until its handler returns. It is the default.
+	DispatchModeInline DispatchMode = iota
+	// DispatchModeGoroutine starts a goroutine per message, with at most
+	// ASB_CONCURRENCY running at once. DispatchBufferSize is ignored.
+	DispatchModeGoroutine
+)
+
+// SubscriberOptions holds the optional settings of a Subscriber.
+type SubscriberOptions struct {
+	// Handler processes each received message. Defaults to logging the body.
+	Handler MessageHandler
+	// HandlerFactory, when set, is called for each received message to get
+	// a fresh handler, instead of using Handler.
+	HandlerFactory HandlerFactory
+	// Middleware wraps Handler and any handler set later with SetHandler,
+	// the first outermost.
+	Middleware []SubscriberMiddleware
+	// Metrics records receive counts and errors when set.
+	Metrics MetricsRecorder
+	// MeterProvider, when set, also records the metrics with OpenTelemetry
+	// instruments of its meter.
+	MeterProvider metric.MeterProvider
+	// MetricsFlushInterval, when positive, flushes Metrics at this interval
+	// and on close if it buffers updates, as a StatsDExporter from
+	// NewBufferedStatsDExporter does.
+	MetricsFlushInterval time.Duration
+	// Logger replaces the logger passed to NewSubscriber when set.
+	Logger *slog.Logger
+	// DispatchBufferSize is the number of received messages that may wait
+	// for a free worker. Link credit is raised to match, so the broker only
+	// pushes more messages once the buffer drains. Ignored in session mode.
+	DispatchBufferSize int
+	// DispatchMode selects worker or goroutine-per-message dispatch. Ignored
+	// in session mode.
+	DispatchMode DispatchMode
+	// SessionAffinity gives each worker its own queue and sends every
+	// message with the same session ID to the same worker, so messages of a
+	// session are handled in order while other sessions proceed in parallel.
+	// Use it for subscriptions received without session mode whose messages
+	// carry session IDs. DispatchBufferSize is split across the queues.
+	// Ignored in DispatchModeGoroutine.
+	SessionAffinity bool
+	// AutoCreateSubscription creates the configured subscription with
+	// AutoCreateSubscriptionOptions through the Service Bus management API
+	// when it does not exist yet. An existing subscription is not changed.
+	AutoCreateSubscription        bool
+	AutoCreateSubscriptionOptions AutoCreateSubscriptionOptions
+	// MaxPendingMessages, when positive, stops taking messages from the
+	// link once this many are received but not yet handled, until half of
+	// them are. Link credit is only replenished as messages are settled, so
+	// the broker sends at most the credit beyond them meanwhile.
+	MaxPendingMessages int
+	// ManagementPingInterval, when positive, sends a management request to
+	// the subscription at this interval so a dead connection is noticed even
+	// when no messages arrive.
+	ManagementPingInterval time.Duration
+	// SkipExpired settles messages already past their TTL with ExpiredPolicy
+	// instead of passing them to the handler. PolicyAccept, the zero value,
+	// drops them; PolicyAbandon and PolicyDeadLetter leave the broker to
+	// expire or dead-letter them.
+	SkipExpired   bool
+	ExpiredPolicy SettlementPolicy
+	// MaxBodySize, when positive, dead-letters messages whose body is larger
+	// than this many bytes with reason "MessageTooLarge" instead of handling
+	// them.
+	MaxBodySize int64
+	// ReceiveFromStart adds a source filter asking the broker to deliver
+	// from the earliest retained message rather than the current position.
+	// It applies to brokers that keep an offset, such as Event Hubs; Service
+	// Bus subscriptions always deliver from the oldest unsettled message.
+	ReceiveFromStart bool
+	// ErrorHandlingStrategy selects whether a failure to settle a message
+	// stops StartListening (the default), is logged and skipped, or pauses
+	// receiving with exponential backoff.
+	ErrorHandlingStrategy ErrorHandlingStrategy
+	// HandlerTimeout, when positive, bounds the context of each handler
+	// call. HandlerTimeouts overrides it for messages with the given
+	// Subject. Handlers must return once the context is done; their error
+	// then abandons the message.
+	HandlerTimeout  time.Duration
+	HandlerTimeouts map[string]time.Duration
+	// AckBatchSize, when above 1, buffers accepted messages and settles
+	// them once this many are buffered or AckBatchInterval (default 1s) has
+	// passed, instead of waiting for each acceptance in the handler. Link
+	// credit is raised to cover the buffer. Other outcomes are settled
+	// immediately. Ignored in session mode.
+	AckBatchSize     int
+	AckBatchInterval time.Duration
+	// AsyncAcks settles handled messages on a dedicated goroutine, so
+	// workers take the next message without waiting for the broker's
+	// disposition. Messages are still settled before StartListening
+	// returns. Acceptances buffered by AckBatchSize are settled by the batch.
+	// Ignored in session mode.
+	AsyncAcks bool
+	// FirstReceiveTimeout, when positive, reports a subscriber that has
+	// received no message this long after StartListening was first called,
+	// which usually means a misconfigured subscription: a warning is
+	// logged, the amqp_subscriber_idle_timeout_total counter incremented
+	// and OnIdleTimeout called when set. Receiving continues regardless.
+	FirstReceiveTimeout time.Duration
+	OnIdleTimeout       func()
+	// PanicPolicy selects whether the message of a panicking handler or hook is
+	// abandoned, the default, or dead-lettered, or whether the panic is
+	// left to terminate the process.
+	PanicPolicy PanicPolicy
+	// TraceMessages records a MessageTrace of the phases of each message,
+	// from receipt to settlement, and passes it to OnTrace, or logs it at
+	// info level when OnTrace is not set.
+	TraceMessages bool
+	OnTrace       func(MessageTrace)
+	// PreHandleHook and PostHandleHook run before and after the handler,
+	// inside any middleware, for each message the handler is called for.
+	PreHandleHook  PreHandleHook
+	PostHandleHook PostHandleHook
+	// Enricher adds application properties to each message before it is
+	// settled.
+	Enricher MessageEnricher
+	// DLQReasonMap dead-letters messages whose handler returns an error
+	// matching a key, with the key's reason and the error as description,
+	// instead of abandoning them. Keys match like errors.Is, and a nil
+	// pointer key such as (*ValidationError)(nil) matches any error of its
+	// type. Abandon, Defer and DeadLetter results are not mapped; a
+	// DeadLetter without a reason gets "GenericHandlerError".
+	DLQReasonMap map[error]string
+	// Decoder deserializes bodies for handlers built with TypedHandler.
+	// Defaults to ContentTypeDecoder. DeserializationErrorPolicy selects
+	// how messages it fails to decode are settled.
+	Decoder                    Decoder
+	DeserializationErrorPolicy DeserializationErrorPolicy
+	// DecoderFallbacks are tried in order when Decoder fails, whether it
+	// cannot decode the body or returns ErrUnknownContentType. Decoding
+	// fails only if all of them fail too.
+	DecoderFallbacks []Decoder
+	// WorkerStackSize, when positive, is the deepest stack in bytes a worker
+	// must be able to reach. Go cannot start a goroutine with a larger stack;
+	// stacks grow on demand up to a process-wide maximum, 1 GB by default on
+	// 64-bit platforms, so the maximum is only raised when WorkerStackSize
+	// exceeds it. It is never lowered. A maximum set elsewhere with
+	// debug.SetMaxStack is not taken into account.
+	WorkerStackSize int
+}
+
+// SubscriberOption configures a Subscriber in NewSubscriber.
+type SubscriberOption func(*SubscriberOptions)
+
+// WithHandler sets the handler that processes received messages.
+func WithHandler(h MessageHandler) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Handler = h
+	}
+}
+
+// WithHandlerFactory gets a fresh handler from f for each received message.
+func WithHandlerFactory(f HandlerFactory) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.HandlerFactory = f
+	}
+}
+
+// WithMiddleware wraps the subscriber's handler in m, in addition to any
+// middleware added before.
+func WithMiddleware(m ...SubscriberMiddleware) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Middleware = append(o.Middleware, m...)
+	}
+}
+
+// WithEnricher runs e on each message before it is settled.
+func WithEnricher(e MessageEnricher) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Enricher = e
+	}
+}
+
+// WithDecoder deserializes message bodies for TypedHandler with d.
+func WithDecoder(d Decoder) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Decoder = d
+	}
+}
+
+// WithDecoderFallbacks tries decoders, in order, when the subscriber's
+// Decoder fails, in addition to any fallbacks added before.
+func WithDecoderFallbacks(decoders ...Decoder) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.DecoderFallbacks = append(o.DecoderFallbacks, decoders...)
+	}
+}
+
+// WithSubscriberLogger logs to l instead of the logger passed to NewSubscriber.
+func WithSubscriberLogger(l *slog.Logger) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Logger = l
+	}
+}
+
+// WithSubscriberMetrics records receive metrics to m.
+func WithSubscriberMetrics(m MetricsRecorder) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.Metrics = m
+	}
+}
+
+// WithSubscriberOTELMeterProvider also records receive metrics with the
+// OpenTelemetry meter of mp.
+func WithSubscriberOTELMeterProvider(mp metric.MeterProvider) SubscriberOption {
+	return func(o *SubscriberOptions) {
+		o.MeterProvider = mp
+	}
+}
+
+type Subscriber struct {
+	conn     *amqp.Conn
+	session  *amqp.Session
+	receiver *amqp.Receiver
+	// source and receiverOpts are kept to reattach the receiver, and
+	// config to reconnect. source is guarded by mu as UpdateSubscription
+	// may change it, and so are conn, session and receiver as reconnect
+	// replaces them.
+	config       AmqpConfig
+	topic        string
+	source       string
+	receiverOpts *amqp.ReceiverOptions
+	// sessionEnabled is set when the receiver locks a session.
+	sessionEnabled bool
+	logger         *slog.Logger
+	metrics        MetricsRecorder
+	// concurrency is the number of messages handled in parallel.
+	concurrency int
+	// bufferSize is the capacity of the channel between the receive loop
+	// and the workers.
+	bufferSize      int
+	dispatchMode    DispatchMode
+	sessionAffinity bool
+	// skipExpired and expiredPolicy are copied from SubscriberOptions.
+	skipExpired   bool
+	expiredPolicy SettlementPolicy
+	maxBodySize   int64
+	decoding      decoding
+	enricher      MessageEnricher
+	dlqReasons    map[error]string
+	panicPolicy   PanicPolicy
+	preHandle     PreHandleHook
+	postHandle    PostHandleHook
+	// handlerTimeout and handlerTimeouts are copied from SubscriberOptions.
+	handlerTimeout  time.Duration
+	handlerTimeouts map[string]time.Duration
+	errorStrategy   ErrorHandlingStrategy
+	// pause holds back receiving under ErrorHandlingExponentialPause.
+	pause errorPause
+	// pending holds back receiving over MaxPendingMessages.
+	pending *pendingLimit
+	// acks buffers accepted messages when AckBatchSize is set.
+	acks *ackBatcher
+	// firstReceive reports no message within FirstReceiveTimeout.
+	firstReceive *firstReceiveWatch
+	// asyncAcks starts an ackQueue for each receive loop, which is set in
+	// ackQueue while it runs.
+	asyncAcks bool
+	ackQueue  *ackQueue
+
+	mu             sync.Mutex
+	handler        MessageHandler
+	middleware     []SubscriberMiddleware
+	cancelReceive  context.CancelFunc // stops fetching new messages
+	cancelHandling context.CancelFunc // aborts the message currently being handled
+	done           chan struct{}      // closed when StartListening returns
+	stopPing       context.CancelFunc
+	// metricsFlush flushes metrics with MetricsFlushInterval.
+	metricsFlush *metricsFlush
+	// interruptErr is returned by StartListening after interrupt stopped it.
+	interruptErr error
+	// unsettled holds the messages received but not yet settled, reported
+	// when a graceful stop times out.
+	unsettled map[*amqp.Message]struct{}
+	stopping  bool
+	closeOnce sync.Once
+	// linkErr is the last link, session or connection failure seen while
+	// receiving or settling.
+	linkErr error
+	// reconnecting is set while the receiver is being reattached or the
+	// connection redialed.
+	reconnecting bool
+	// reconnectBackoff spaces the attempts of reconnect.
+	reconnectBackoff RetryPolicy
+	// traceMessages and onTrace are copied from SubscriberOptions; traces
+	// holds the traces of the unsettled messages.
+	traceMessages bool
+	onTrace       func(MessageTrace)
+	traces        map[*amqp.Message]*MessageTrace
+}
+
+func NewSubscriber(ctx context.Context, logger *slog.Logger, config AmqpConfig, opts ...SubscriberOption) (*Subscriber, func(), error) {
+	var options SubscriberOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Logger != nil {
+		logger = options.Logger
+	}
+
+	metrics, err := withOTelMetrics(options.Metrics, options.MeterProvider,
+		attribute.String("topic", config.Topic), attribute.String("subscription", config.SubscriptionPath()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if options.AutoCreateSubscription {
+		management := NewManagementClient(logger, config)
+		if _, err := management.CreateSubscription(ctx, config.Subscription, options.AutoCreateSubscriptionOptions); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if options.WorkerStackSize > 0 {
+		raiseMaxStack(options.WorkerStackSize)
+	}
+
+	concurrency := max(config.Concurrency, 1)
+	bufferSize := max(options.DispatchBufferSize, 0)
+	if options.DispatchMode == DispatchModeGoroutine {
+		bufferSize = 0
+	}
+	// Keep enough messages in flight for every worker to be busy and the
+	// dispatch buffer to be full.
+	ackBatchSize := 0
+	if options.AckBatchSize > 1 {
+		ackBatchSize = options.AckBatchSize
+	}
+	credit := max(int32(config.PrefetchCount), int32(concurrency+bufferSize+ackBatchSize))
+	if config.SessionEnabled {
+		// Messages of a session must be handled and settled one at a time.
+		concurrency, bufferSize, ackBatchSize, credit = 1, 0, 0, 1
+	}
+	receiverOpts := &amqp.ReceiverOptions{Credit: credit}
+	if config.SessionEnabled {
+		receiverOpts.Filters = append(receiverOpts.Filters, sessionFilter(config.SessionID))
+	}
+	if options.ReceiveFromStart {
+		receiverOpts.Filters = append(receiverOpts.Filters, startOffsetFilter())
+	}
+	conn, session, receiver, err := connectReceiver(ctx, logger, config, config.SubscriptionPath(), receiverOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subscriber := &Subscriber{
+		conn:            conn,
+		session:         session,
+		receiver:        receiver,
+		config:          config,
+		topic:           config.Topic,
+		source:          config.SubscriptionPath(),
+		receiverOpts:    receiverOpts,
+		sessionEnabled:  config.SessionEnabled,
+		logger:          logger.With("topic", config.Topic, "subscription", config.Subscription),
+		metrics:         metrics,
+		concurrency:     concurrency,
+		dispatchMode:    options.DispatchMode,
+		sessionAffinity: options.SessionAffinity,
+		bufferSize:      bufferSize,
+		skipExpired:     options.SkipExpired,
+		expiredPolicy:   options.ExpiredPolicy,
+		maxBodySize:     options.MaxBodySize,
+		enricher:        options.Enricher,
+		dlqReasons:      maps.Clone(options.DLQReasonMap),
+		panicPolicy:     options.PanicPolicy,
+		preHandle:       options.PreHandleHook,
+		postHandle:      options.PostHandleHook,
+		traceMessages:   options.TraceMessages,
+		onTrace:         options.OnTrace,
+		pending:         newPendingLimit(options.MaxPendingMessages),
+		asyncAcks:       options.AsyncAcks && !config.SessionEnabled,
+		errorStrategy:   options.ErrorHandlingStrategy,
+		handlerTimeout:  options.HandlerTimeout,
+		handlerTimeouts: maps.Clone(options.HandlerTimeouts),
+	}
+	if config.SessionEnabled {
+		subscriber.logger.InfoContext(ctx, "receiving from Service Bus session", "session_id", describeSession(receiver))
+	}
+	if subscriber.metrics == nil {
+		subscriber.metrics = noMetrics
+	}
+	subscriber.decoding = decoding{
+		decoder: options.Decoder,
+		policy:  options.DeserializationErrorPolicy,
+		logger:  subscriber.logger,
+	}
+	if subscriber.decoding.decoder == nil {
+		subscriber.decoding.decoder = ContentTypeDecoder{}
+	}
+	if len(options.DecoderFallbacks) > 0 {
+		subscriber.decoding.decoder = append(fallbackDecoder{subscriber.decoding.decoder}, options.DecoderFallbacks...)
+	}
+	subscriber.firstReceive = newFirstReceiveWatch(options.FirstReceiveTimeout, options.OnIdleTimeout, subscriber.metrics, subscriber.logger)
+	if ackBatchSize > 0 {
+		subscriber.acks = newAckBatcher(ackBatchSize, options.AckBatchInterval, subscriber.acceptedBatched)
+	}
+	subscriber.middleware = slices.Clone(options.Middleware)
+	if options.HandlerFactory != nil {
+		options.Handler = factoryHandler(options.HandlerFactory)
+	}
+	subscriber.SetHandler(options.Handler)
+	if options.ManagementPingInterval > 0 {
+		pingCtx, stopPing := context.WithCancel(context.Background())
+		subscriber.stopPing = stopPing
+		go subscriber.pingManagement(pingCtx, options.ManagementPingInterval)
+	}
+	subscriber.metricsFlush = startMetricsFlush(subscriber.metrics, options.MetricsFlushInterval, subscriber.logger)
+	cleanup := func() {
+		subscriber.Close()
+	}
+
+	return subscriber, cleanup, nil
+}
+
+// connectReceiver dials the broker of config and attaches a receiver to
+// source on a new session.
+func connectReceiver(ctx context.Context, logger *slog.Logger, config AmqpConfig, source string, opts *amqp.ReceiverOptions) (*amqp.Conn, *amqp.Session, *amqp.Receiver, error) {
+	conn, err := dial(ctx, logger, config, source)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
+	}
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create AMQP session: %w", err)
+	}
+
+	receiver, err := session.NewReceiver(ctx, source, opts)
+	if err != nil {
+		session.Close(ctx)
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to create AMQP receiver: %w", err)
+	}
+	return conn, session, receiver, nil
+}
+
+// maxStack is the maximum goroutine stack size as set by raiseMaxStack,
+// starting from the runtime's default. debug.SetMaxStack can only read the
+// maximum by setting it, which would lower it for every goroutine meanwhile.
+var (
+	maxStackMu sync.Mutex
+	maxStack   = defaultMaxStack()
+)
+
+// defaultMaxStack returns the runtime's default maximum stack size.
+func defaultMaxStack() int {
+	if strconv.IntSize == 64 {
+		return 1_000_000_000
+	}
+	return 250_000_000
+}
+
+// raiseMaxStack raises the maximum goroutine stack size to size bytes when
+// it is larger.
+func raiseMaxStack(size int) {
+	maxStackMu.Lock()
+	defer maxStackMu.Unlock()
+	if size > maxStack {
+		debug.SetMaxStack(size)
+		maxStack = size
+	}
+}
+
+// errSubscriptionChanged stops the receive loop when UpdateSubscription
+// replaces the receiver; StartListening then resumes on the new one.
+var errSubscriptionChanged = errors.New("subscription changed")
+
+// StartListening receives and handles messages until ctx is done, the
+// subscriber is stopped or receiving fails. When the broker detaches the
+// receiver link while the session and connection stay up, a new link is
+// attached on the same session and receiving resumes.
+func (s *Subscriber) StartListening(ctx context.Context) error {
+	s.firstReceive.start(ctx)
+	for {
+		err := s.listen(ctx)
+		switch {
+		case errors.Is(err, errSubscriptionChanged):
+		case s.linkDetached(err):
+			s.logger.WarnContext(ctx, "receiver link detached, reattaching", "error", err)
+			if err := s.reattachReceiver(ctx); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// linkDetached reports whether err means only the receiver link was
+// detached. Lost session locks are left to the caller, as documented for
+// ErrSessionLockLost.
+func (s *Subscriber) linkDetached(err error) bool {
+	var linkErr *amqp.LinkError
+	if !errors.As(err, &linkErr) || errors.Is(err, ErrSessionLockLost) || connectionLost(err) {
+		return false
+	}
+	return !s.connClosed()
+}
+
+// connClosed reports whether the connection has been closed.
+func (s *Subscriber) connClosed() bool {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	select {
+	case <-conn.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// listenAndResume runs StartListening until it returns nil, resuming after
+// each retryable error. It returns the first error that is not retryable or
+// that resuming failed with, unless ctx is done.
+func (s *Subscriber) listenAndResume(ctx context.Context) error {
+	for {
+		err := s.StartListening(ctx)
+		if err == nil || !IsRetryable(err) {
+			return err
+		}
+		s.logger.WarnContext(ctx, "subscriber error, resuming", "error", err)
+		if err := s.resume(ctx, err); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// resume prepares the subscriber to listen again after StartListening
+// returned the retryable err. When the connection or session was lost or the
+// management ping failed, the connection is redialed; otherwise only the
+// receiver is reattached.
+func (s *Subscriber) resume(ctx context.Context, err error) error {
+	if errors.Is(err, ErrManagementPingFailed) || connectionLost(err) || s.connClosed() {
+		return s.reconnect(ctx)
+	}
+	return s.reattachReceiver(ctx)
+}
+
+// connectionLost reports whether err means the session or connection failed.
+func connectionLost(err error) bool {
+	var sessionErr *amqp.SessionError
+	var connErr *amqp.ConnError
+	return errors.As(err, &sessionErr) || errors.As(err, &connErr)
+}
+
+func (s *Subscriber) listen(ctx context.Context) error {
+	handleCtx, cancelHandling := context.WithCancel(ctx)
+	defer cancelHandling()
+	receiveCtx, cancelReceive := context.WithCancel(handleCtx)
+	defer cancelReceive()
+
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return nil
+	}
+	s.cancelReceive = cancelReceive
+	s.cancelHandling = cancelHandling
+	s.interruptErr = nil
+	s.done = make(chan struct{})
+	done := s.done
+	receiver := s.receiver
+	s.mu.Unlock()
+	defer close(done)
+	// Settle buffered acceptances before StartListening returns.
+	defer s.acks.flush()
+	if s.asyncAcks {
+		queue := newAckQueue(s.concurrency+s.bufferSize, s.settledAsync)
+		s.mu.Lock()
+		s.ackQueue = queue
+		s.mu.Unlock()
+		defer func() {
+			// Workers have returned, so nothing is added any more.
+			queue.close()
+			s.mu.Lock()
+			s.ackQueue = nil
+			s.mu.Unlock()
+		}()
+	}
+
+	if s.concurrency > 1 || s.bufferSize > 0 {
+		return s.listenConcurrently(receiveCtx, cancelReceive, handleCtx, receiver)
+	}
+
+	for {
+		if err := s.waitToReceive(receiveCtx); err != nil {
+			s.logger.InfoContext(ctx, "subscriber shutting down")
+			return nil
+		}
+		msg, err := receiver.Receive(receiveCtx, nil)
+		if err != nil {
+			if receiveCtx.Err() != nil {
+				if err := s.takeInterrupt(); err != nil {
+					return err
+				}
+				s.logger.InfoContext(ctx, "subscriber shutting down")
+				return nil
+			}
+			return s.recordErr(fmt.Errorf("failed to receive message: %w", err))
+		}
+		s.track(msg)
+		if err := s.handled(handleCtx, s.handleMessage(handleCtx, msg)); err != nil {
+			if handleCtx.Err() != nil {
+				if err := s.takeInterrupt(); err != nil {
+					return err
+				}
+				s.logger.InfoContext(ctx, "subscriber shutting down")
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// listenConcurrently feeds received messages to a pool of s.concurrency
+// workers through a channel buffering up to s.bufferSize messages. The
+// receive loop blocks while the buffer is full. With more than one worker,
+// messages are no longer handled in the order they were received. Once
+// receiving stops, every message already received is still handled and
+// settled before it returns. In DispatchModeGoroutine each message is
+// handled on its own goroutine instead, with at most s.concurrency running.
+// With SessionAffinity each worker has its own queue, and the receive loop
+// blocks while the queue of the next message's worker is full.
+func (s *Subscriber) listenConcurrently(receiveCtx context.Context, cancelReceive context.CancelFunc, handleCtx context.Context, receiver *amqp.Receiver) error {
+	workerErrs := make(chan error, 1)
+	handle := func(msg *amqp.Message) {
+		if err := s.handled(handleCtx, s.handleMessage(handleCtx, msg)); err != nil {
+			select {
+			case workerErrs <- err:
+			default:
+			}
+			cancelReceive()
+		}
+	}
+
+	var wg sync.WaitGroup
+	// In DispatchModeGoroutine, slots bounds the running handlers;
+	// otherwise queues feed the workers: one shared queue, or one per
+	// worker with SessionAffinity.
+	var queues []chan *amqp.Message
+	var affinity *sessionAffinity
+	var slots chan struct{}
+	switch {
+	case s.dispatchMode == DispatchModeGoroutine:
+		slots = make(chan struct{}, s.concurrency)
+	case s.sessionAffinity:
+		affinity = newSessionAffinity(s.concurrency)
+		for range s.concurrency {
+			queue := make(chan *amqp.Message, s.bufferSize/s.concurrency)
+			queues = append(queues, queue)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for msg := range queue {
+					handle(msg)
+					affinity.release(msg)
+				}
+			}()
+		}
+	default:
+		queue := make(chan *amqp.Message, s.bufferSize)
+		queues = append(queues, queue)
+		for range s.concurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for msg := range queue {
+					handle(msg)
+				}
+			}()
+		}
+	}
+
+	var receiveErr error
+	for {
+		if err := s.waitToReceive(receiveCtx); err != nil {
+			break
+		}
+		msg, err := receiver.Receive(receiveCtx, nil)
+		if err != nil {
+			if receiveCtx.Err() == nil {
+				receiveErr = s.recordErr(fmt.Errorf("failed to receive message: %w", err))
+			}
+			break
+		}
+		s.track(msg)
+		switch {
+		case affinity != nil:
+			queues[affinity.assign(msg)] <- msg
+			continue
+		case slots == nil:
+			queues[0] <- msg
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			handle(msg)
+		}()
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	if receiveErr != nil {
+		return receiveErr
+	}
+	if err := s.takeInterrupt(); err != nil {
+		return err
+	}
+	select {
+	case err := <-workerErrs:
+		if handleCtx.Err() == nil {
+			return err
+		}
+	default:
+	}
+	s.logger.InfoContext(handleCtx, "subscriber shutting down")
+	return nil
+}
+
+// interrupt stops the running receive loop, making StartListening return err
+// once the messages already received are settled.
+func (s *Subscriber) interrupt(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping || s.cancelReceive == nil {
+		return
+	}
+	s.interruptErr = err
+	s.cancelReceive()
+}
+
+func (s *Subscriber) takeInterrupt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.interruptErr
+	s.interruptErr = nil
+	return err
+}
+
+// Healthy reports whether the connection is open and the receiver link has
+// not failed. It does not contact the broker.
+func (s *Subscriber) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.linkUp()
+}
+
+// Ready reports whether the subscriber is healthy and not reattaching its
+// receiver.
+func (s *Subscriber) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.reconnecting && s.linkUp()
+}
+
+// linkUp must be called with s.mu held.
+func (s *Subscriber) linkUp() bool {
+	if s.linkErr != nil {
+		return false
+	}
+	select {
+	case <-s.conn.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// recordErr counts a receive or settlement failure and remembers err if it
+// means the receiver link is no longer usable. A lost session lock is
+// wrapped with ErrSessionLockLost.
+func (s *Subscriber) recordErr(err error) error {
+	s.metrics.incReceiveErrors()
+	if sessionLockLost(err) {
+		err = fmt.Errorf("%w: %w", ErrSessionLockLost, err)
+	}
+	if linkFailure(err) {
+		s.mu.Lock()
+		s.linkErr = err
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// reattachReceiver replaces a failed receiver with a new link on the same
+// session, using the options of the original link. It must not be called
+// while StartListening is running.
+func (s *Subscriber) reattachReceiver(ctx context.Context) error {
+	s.mu.Lock()
+	old := s.receiver
+	s.reconnecting = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.reconnecting = false
+		s.mu.Unlock()
+	}()
+
+	closeCtx, cancel := context.WithTimeout(ctx, closeTimeout)
+	old.Close(closeCtx)
+	cancel()
+
+	s.mu.Lock()
+	source := s.source
+	session := s.session
+	s.mu.Unlock()
+	receiver, err := session.NewReceiver(ctx, source, s.receiverOpts)
+	if err != nil {
+		return s.recordErr(fmt.Errorf("failed to reattach AMQP receiver: %w", err))
+	}
+
+	s.mu.Lock()
+	s.receiver = receiver
+	s.linkErr = nil
+	s.mu.Unlock()
+	if s.sessionEnabled {
+		s.logger.InfoContext(ctx, "receiving from Service Bus session", "session_id", describeSession(receiver))
+	}
+	return nil
+}
+
+// reconnect replaces the connection, session and receiver with new ones,
+// dialed like those of NewSubscriber, once the old ones can no longer be
+// trusted. Failed attempts are retried with backoff until ctx is done. It
+// must not be called while StartListening is running.
+func (s *Subscriber) reconnect(ctx context.Context) error {
+	s.mu.Lock()
+	conn, session, receiver := s.conn, s.session, s.receiver
+	source := s.source
+	s.reconnecting = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.reconnecting = false
+		s.mu.Unlock()
+	}()
+
+	closeCtx, cancel := context.WithTimeout(ctx, closeTimeout)
+	receiver.Close(closeCtx)
+	session.Close(closeCtx)
+	cancel()
+	conn.Close()
+
+	for attempt := 0; ; attempt++ {
+		conn, session, receiver, err := connectReceiver(ctx, s.logger, s.config, source, s.receiverOpts)
+		if err == nil {
+			s.mu.Lock()
+			stopping := s.stopping
+			if !stopping {
+				s.conn, s.session, s.receiver = conn, session, receiver
+				s.linkErr = nil
+			}
+			s.mu.Unlock()
+			if stopping {
+				// Close has already closed the old connection.
+				conn.Close()
+				return nil
+			}
+			s.logger.InfoContext(ctx, "reconnected to AMQP broker", "attempt", attempt+1)
+			if s.sessionEnabled {
+				s.logger.InfoContext(ctx, "receiving from Service Bus session", "session_id", describeSession(receiver))
+			}
+			return nil
+		}
+
+		delay := s.reconnectBackoff.backoff(attempt, 0)
+		s.logger.WarnContext(ctx, "reconnect failed, retrying", "attempt", attempt+1, "error", s.recordErr(err), "backoff", delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to reconnect: %w", err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// UpdateSubscription moves the subscriber to subscription, another
+// subscription of the same topic, on the same session. A running
+// StartListening resumes on the new subscription; messages it was handling
+// on the old one are aborted and, once the old receiver detaches, abandoned
+// to the broker for redelivery.
+func (s *Subscriber) UpdateSubscription(ctx context.Context, subscription string) error {
+	source := fmt.Sprintf("%s/subscriptions/%s", s.topic, subscription)
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+	receiver, err := session.NewReceiver(ctx, source, s.receiverOpts)
+	if err != nil {
+		return fmt.Errorf("failed to attach receiver to %s: %w", source, err)
+	}
+
+	s.mu.Lock()
+	old := s.receiver
+	s.receiver = receiver
+	s.source = source
+	s.linkErr = nil
+	var done chan struct{}
+	if s.cancelHandling != nil && !s.stopping {
+		s.interruptErr = errSubscriptionChanged
+		s.cancelHandling()
+		done = s.done
+	}
+	s.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	old.Close(closeCtx)
+	s.logger.InfoContext(ctx, "switched subscription", "new_subscription", subscription)
+	return nil
+}
+
+// SetHandler replaces the handler used for subsequently received messages.
+func (s *Subscriber) SetHandler(h MessageHandler) {
+	if h == nil {
+		h = s.logMessage
+	}
+	h = chainMiddleware(h, s.middleware)
+	s.mu.Lock()
+	s.handler = h
+	s.mu.Unlock()
+}
+
+// waitToReceive blocks while receiving is paused after errors or over
+// MaxPendingMessages, or until ctx is done.
+func (s *Subscriber) waitToReceive(ctx context.Context) error {
+	if err := s.pause.wait(ctx); err != nil {
+		return err
+	}
+	return s.pending.wait(ctx)
+}
+
+// handleMessage runs the handler and settles msg according to its result.
+// Only settlement failures are returned.
+func (s *Subscriber) handleMessage(ctx context.Context, msg *amqp.Message) error {
+	batched := false
+	var decision *SettlementDecision
+	defer func() {
+		if !batched {
+			s.untrack(msg)
+			s.traceSettled(msg, decision)
+		}
+		s.pending.handled()
+	}()
+	s.metrics.incReceived()
+	s.firstReceive.received()
+	var deliveryCount uint32
+	if msg.Header != nil {
+		deliveryCount = msg.Header.DeliveryCount
+	}
+	s.metrics.observeDelivery(deliveryCount)
+	s.mu.Lock()
+	handler := s.handler
+	receiver := s.receiver
+	queue := s.ackQueue
+	s.mu.Unlock()
+
+	start := time.Now()
+	switch size := int64(len(msg.GetData())); {
+	case s.maxBodySize > 0 && size > s.maxBodySize:
+		s.logger.WarnContext(ctx, "rejecting oversized message", "message_id", messageIDOf(msg), "size", size, "max_size", s.maxBodySize)
+		decision = &SettlementDecision{
+			Policy:      PolicyDeadLetter,
+			Reason:      messageTooLargeReason,
+			Description: fmt.Sprintf("body of %d bytes exceeds the limit of %d", size, s.maxBodySize),
+		}
+	case s.skipExpired && messageExpired(msg, start):
+		s.logger.WarnContext(ctx, "skipping expired message", "message_id", messageIDOf(msg), "outcome", s.expiredPolicy.String())
+		decision = expiredDecision(s.expiredPolicy)
+	default:
+		handlerCtx := context.WithValue(ctx, decodingContextKey{}, s.decoding)
+		if timeout := s.handlerTimeoutFor(msg); timeout > 0 {
+			var cancel context.CancelFunc
+			handlerCtx, cancel = context.WithTimeout(handlerCtx, timeout)
+			defer cancel()
+		}
+		handlerStart := time.Now()
+		decision = s.handlerDecision(s.callHandler(handlerCtx, handler, msg))
+		s.traceHandler(msg, handlerStart, time.Now())
+	}
+	decision = s.enrich(msg, decision)
+	var err error
+	if decision.Policy == PolicyAccept && s.acks != nil {
+		// Untracked by acceptedBatched once the batch is settled.
+		batched = true
+		s.acks.add(receiver, msg)
+	} else if queue != nil {
+		// Untracked by settledAsync.
+		batched = true
+		queue.add(receiver, msg, decision)
+	} else {
+		err = settle(ctx, receiver, msg, decision)
+	}
+
+	attrs := []any{"message_id", messageIDOf(msg), "outcome", decision.Policy.String(),
+		"latency_ms", time.Since(start).Milliseconds()}
+	switch {
+	case err != nil:
+		s.logger.ErrorContext(ctx, "failed to settle message", append(attrs, "error", err)...)
+		return s.recordErr(err)
+	case decision.Policy != PolicyAccept:
+		s.logger.WarnContext(ctx, "handler did not complete message", append(attrs, "error", decision)...)
+	default:
+		s.logger.InfoContext(ctx, "message handled", attrs...)
+	}
+	return nil
+}
+
+// acceptedBatched is called by s.acks once msg has been accepted, or failed
+// to be.
+func (s *Subscriber) acceptedBatched(msg *amqp.Message, err error) {
+	s.settledAsync(msg, &SettlementDecision{Policy: PolicyAccept}, err)
+}
+
+// settledAsync untracks msg once it was settled outside handleMessage and
+// records a settlement failure. It cannot stop the receive loop, so
+// ErrorHandlingStrategy does not apply.
+func (s *Subscriber) settledAsync(msg *amqp.Message, decision *SettlementDecision, err error) {
+	s.untrack(msg)
+	s.traceSettled(msg, decision)
+	if err != nil {
+		s.logger.Error("failed to settle message", "message_id", messageIDOf(msg), "outcome", decision.Policy.String(), "error", err)
+		s.recordErr(err)
+	}
+}
+
+// track records msg as received and not yet settled.
+func (s *Subscriber) track(msg *amqp.Message) {
+	s.pending.received()
+	s.traceReceived(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unsettled == nil {
+		s.unsettled = make(map[*amqp.Message]struct{})
+	}
+	s.unsettled[msg] = struct{}{}
+}
+
+func (s *Subscriber) untrack(msg *amqp.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.unsettled, msg)
+}
+
+// unsettledIDs returns the message IDs of the messages not yet settled.
+func (s *Subscriber) unsettledIDs() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]any, 0, len(s.unsettled))
+	for msg := range s.unsettled {
+		ids = append(ids, messageIDOf(msg))
+	}
+	return ids
+}
+
+// handlerTimeoutFor returns the handler timeout of msg: the one configured
+// for its subject, or the default.
+func (s *Subscriber) handlerTimeoutFor(msg *amqp.Message) time.Duration {
+	if msg.Properties != nil && msg.Properties.Subject != nil {
+		if timeout, ok := s.handlerTimeouts[*msg.Properties.Subject]; ok {
+			return timeout
+		}
+	}
+	return s.handlerTimeout
+}
+
+// logMessage is the default handler.
+func (s *Subscriber) logMessage(ctx context.Context, msg *amqp.Message) error {
+	s.logger.InfoContext(ctx, "received message", "message_id", messageIDOf(msg), "body", string(msg.GetData()))
+	return nil
+}
+
+// GracefulStop stops fetching new messages, waits for the message currently
+// being handled to be settled and then closes the subscriber. If ctx expires
+// first, the in-flight message is aborted as with Close and ctx.Err() is returned.
+func (s *Subscriber) GracefulStop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopping = true
+	if s.cancelReceive != nil {
+		s.cancelReceive()
+	}
+	done := s.done
+	s.mu.Unlock()
+
+	var err error
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			ids := s.unsettledIDs()
+			s.logger.WarnContext(ctx, "graceful stop timed out, aborting unsettled messages", "count", len(ids), "message_ids", ids)
+		}
+	}
+	if closeErr := s.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	return err
+}
+
+// Close stops the subscriber immediately, aborting any message that is
+// currently being handled, and closes the receiver, session and connection.
+func (s *Subscriber) Close() error {
+	s.mu.Lock()
+	s.stopping = true
+	if s.cancelHandling != nil {
+		s.cancelHandling()
+	}
+	if s.stopPing != nil {
+		s.stopPing()
+	}
+	s.mu.Unlock()
+
+	var err error
+	s.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		s.mu.Lock()
+		receiver, session, conn := s.receiver, s.session, s.conn
+		s.mu.Unlock()
+		err = errors.Join(receiver.Close(ctx), session.Close(ctx), conn.Close(), s.metricsFlush.stop())
+	})
+	return err
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestRaiseMaxStack(t *testing.T) {
+	defer func(saved int) {
+		debug.SetMaxStack(saved)
+		maxStack = saved
+	}(maxStack)
+
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"below the default", 64 << 20, defaultMaxStack()},
+		{"at the default", defaultMaxStack(), defaultMaxStack()},
+		{"above the default", defaultMaxStack() + 1<<20, defaultMaxStack() + 1<<20},
+		{"below a raised maximum", 1 << 20, defaultMaxStack() + 1<<20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raiseMaxStack(tt.size)
+			if maxStack != tt.want {
+				t.Errorf("maximum after raiseMaxStack(%d) = %d, want %d", tt.size, maxStack, tt.want)
+			}
+		})
+	}
+	// Setting the recorded maximum again returns the runtime's current one.
+	if got := debug.SetMaxStack(maxStack); got != maxStack {
+		t.Errorf("runtime maximum = %d, want %d", got, maxStack)
+	}
+}
+
+// recurse uses about 1 KB of stack per level.
+func recurse(depth int) int {
+	var frame [1024]byte
+	frame[depth%len(frame)] = byte(depth)
+	if depth == 0 {
+		return int(frame[0])
+	}
+	return recurse(depth-1) + int(frame[depth%len(frame)])
+}
+
+func TestWorkerStackSizeDeepRecursion(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	config.Concurrency = 4
+	s := newBrokerSubscriber(t, config,
+		func(o *SubscriberOptions) { o.WorkerStackSize = 64 << 20 },
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			// About 32 MB of stack.
+			recurse(32 << 10)
+			return nil
+		}))
+	listenInBackground(t, s)
+
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("deep")))
+	if got := b.waitSettlements(1)[0].State.Outcome; got != "accepted" {
+		t.Errorf("outcome = %q, want accepted", got)
+	}
+}
+
+func TestWorkerPoolHeavyLoad(t *testing.T) {
+	const messages = 500
+	tests := []struct {
+		name string
+		opts func(*SubscriberOptions)
+	}{
+		{"inline", func(o *SubscriberOptions) { o.DispatchBufferSize = 16 }},
+		{"goroutine per message", func(o *SubscriberOptions) { o.DispatchMode = DispatchModeGoroutine }},
+		{"session affinity", func(o *SubscriberOptions) { o.SessionAffinity, o.DispatchBufferSize = true, 16 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			config.Concurrency = 8
+			var handled atomic.Int64
+			s := newBrokerSubscriber(t, config, tt.opts,
+				func(o *SubscriberOptions) { o.WorkerStackSize = 1 << 20 },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					recurse(64)
+					handled.Add(1)
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			for i := range messages {
+				msg := amqp.NewMessage([]byte(fmt.Sprint(i)))
+				msg.Properties = &amqp.MessageProperties{GroupID: ptr(fmt.Sprint(i % 5))}
+				b.send(config.SubscriptionPath(), msg)
+			}
+			b.waitSettlements(messages)
+			if got := handled.Load(); got != messages {
+				t.Errorf("handled %d messages, want %d", got, messages)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGracefulStop(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		release     bool
+		wantErr     error
+		wantOutcome string
+		wantAborted bool
+	}{
+		{name: "handler finishes", timeout: 5 * time.Second, release: true, wantOutcome: "accepted"},
+		{name: "timeout aborts handler", timeout: 50 * time.Millisecond, wantErr: context.DeadlineExceeded, wantAborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var aborted atomic.Bool
+			s := newBrokerSubscriber(t, config, WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+				close(started)
+				select {
+				case <-release:
+					return nil
+				case <-ctx.Done():
+					aborted.Store(true)
+					return ctx.Err()
+				}
+			}))
+			listenInBackground(t, s)
+
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("slow")))
+			<-started
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			stopped := make(chan error, 1)
+			go func() { stopped <- s.GracefulStop(ctx) }()
+			if tt.release {
+				// The handler keeps running while the stop waits.
+				time.Sleep(50 * time.Millisecond)
+				if aborted.Load() {
+					t.Fatal("handler aborted by a graceful stop")
+				}
+				close(release)
+			}
+
+			if err := <-stopped; !errors.Is(err, tt.wantErr) {
+				t.Errorf("GracefulStop = %v, want %v", err, tt.wantErr)
+			}
+			if aborted.Load() != tt.wantAborted {
+				t.Errorf("handler aborted = %v, want %v", aborted.Load(), tt.wantAborted)
+			}
+			if tt.wantOutcome != "" {
+				if got := b.waitSettlements(1)[0].State.Outcome; got != tt.wantOutcome {
+					t.Errorf("outcome = %q, want %q", got, tt.wantOutcome)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatchBuffer(t *testing.T) {
+	tests := []struct {
+		name           string
+		concurrency    int
+		sessionEnabled bool
+		opts           func(*SubscriberOptions)
+		wantBuffer     int
+		wantCredit     uint32
+	}{
+		{name: "none", concurrency: 1, opts: func(o *SubscriberOptions) {}, wantBuffer: 0, wantCredit: 1},
+		{name: "buffered", concurrency: 2, opts: func(o *SubscriberOptions) { o.DispatchBufferSize = 8 }, wantBuffer: 8, wantCredit: 10},
+		{name: "negative", concurrency: 2, opts: func(o *SubscriberOptions) { o.DispatchBufferSize = -1 }, wantBuffer: 0, wantCredit: 2},
+		{
+			name:        "goroutine per message",
+			concurrency: 2,
+			opts:        func(o *SubscriberOptions) { o.DispatchBufferSize, o.DispatchMode = 8, DispatchModeGoroutine },
+			wantBuffer:  0,
+			wantCredit:  2,
+		},
+		{
+			name:           "session mode",
+			concurrency:    4,
+			sessionEnabled: true,
+			opts:           func(o *SubscriberOptions) { o.DispatchBufferSize = 8 },
+			wantBuffer:     0,
+			wantCredit:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			config.Concurrency = tt.concurrency
+			config.PrefetchCount = 1
+			config.SessionEnabled = tt.sessionEnabled
+			s := newBrokerSubscriber(t, config, tt.opts)
+			if s.bufferSize != tt.wantBuffer {
+				t.Errorf("buffer size = %d, want %d", s.bufferSize, tt.wantBuffer)
+			}
+			if got := s.receiverOpts.Credit; uint32(got) != tt.wantCredit {
+				t.Errorf("credit = %d, want %d", got, tt.wantCredit)
+			}
+		})
+	}
+}
+
+func TestDispatchBufferHoldsMessages(t *testing.T) {
+	const buffer = 4
+	b := newTestBroker(t)
+	config := b.config()
+	release := make(chan struct{})
+	var handled atomic.Int64
+	s := newBrokerSubscriber(t, config,
+		func(o *SubscriberOptions) { o.DispatchBufferSize = buffer },
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			<-release
+			handled.Add(1)
+			return nil
+		}))
+	listenInBackground(t, s)
+
+	const messages = 10
+	for i := range messages {
+		b.send(config.SubscriptionPath(), amqp.NewMessage([]byte(fmt.Sprint(i))))
+	}
+	// The worker holds one message and the buffer the next ones, so the
+	// broker keeps the rest until they are settled.
+	b.waitFor("the buffer to fill", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.queues[config.SubscriptionPath()]) == messages-1-buffer
+	})
+	close(release)
+	b.waitSettlements(messages)
+	if got := handled.Load(); got != messages {
+		t.Errorf("handled %d messages, want %d", got, messages)
+	}
+}
+
+func TestPrefetchCredit(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefetch    uint32
+		concurrency int
+		want        uint32
+	}{
+		{"prefetch above concurrency", 50, 2, 50},
+		{"concurrency above prefetch", 1, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			config.PrefetchCount = tt.prefetch
+			config.Concurrency = tt.concurrency
+			s := newBrokerSubscriber(t, config)
+			if got := uint32(s.receiverOpts.Credit); got != tt.want {
+				t.Errorf("credit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateSubscription(t *testing.T) {
+	tests := []struct {
+		name string
+		// listening runs StartListening during the switch.
+		listening bool
+	}{
+		{"while listening", true},
+		{"before listening", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			received := make(chan string, 10)
+			s := newBrokerSubscriber(t, config, WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+				received <- string(msg.GetData())
+				return nil
+			}))
+			if tt.listening {
+				listenInBackground(t, s)
+				b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("old")))
+				if got := <-received; got != "old" {
+					t.Fatalf("received %q, want old", got)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.UpdateSubscription(ctx, "other"); err != nil {
+				t.Fatalf("UpdateSubscription: %v", err)
+			}
+			if !tt.listening {
+				listenInBackground(t, s)
+			}
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("left behind")))
+			b.send("topic/subscriptions/other", amqp.NewMessage([]byte("new")))
+			select {
+			case got := <-received:
+				if got != "new" {
+					t.Fatalf("received %q, want new", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("nothing received from the new subscription")
+			}
+			b.waitFor("the settlement on the new subscription", func() bool {
+				outcomes := b.settlements()
+				return len(outcomes) > 0 && outcomes[len(outcomes)-1].Address == "topic/subscriptions/other"
+			})
+			b.mu.Lock()
+			left := len(b.queues[config.SubscriptionPath()])
+			b.mu.Unlock()
+			if left != 1 {
+				t.Errorf("%d messages left on the old subscription, want 1", left)
+			}
+		})
+	}
+}
+
+func TestAckBatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		interval time.Duration
+		send     int
+		// wantHeld leaves the batch unsettled, checked after a pause.
+		wantHeld bool
+	}{
+		{name: "flushed when full", size: 3, interval: time.Hour, send: 3},
+		{name: "flushed after the interval", size: 100, interval: 20 * time.Millisecond, send: 2},
+		{name: "held until full", size: 3, interval: time.Hour, send: 2, wantHeld: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			var handled atomic.Int64
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.AckBatchSize, o.AckBatchInterval = tt.size, tt.interval },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					handled.Add(1)
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			for i := range tt.send {
+				b.send(config.SubscriptionPath(), amqp.NewMessage([]byte(fmt.Sprint(i))))
+			}
+			if !tt.wantHeld {
+				for _, outcome := range b.waitSettlements(tt.send) {
+					if outcome.State.Outcome != "accepted" {
+						t.Errorf("outcome = %q, want accepted", outcome.State.Outcome)
+					}
+				}
+				return
+			}
+			b.waitFor("the messages to be handled", func() bool { return handled.Load() == int64(tt.send) })
+			time.Sleep(100 * time.Millisecond)
+			if got := len(b.settlements()); got != 0 {
+				t.Errorf("%d messages settled before the batch filled, want 0", got)
+			}
+		})
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		body        string
+		want        string
+		wantHandled bool
+	}{
+		{name: "no limit", body: "0123456789", want: "accepted", wantHandled: true},
+		{name: "within the limit", maxBodySize: 10, body: "0123456789", want: "accepted", wantHandled: true},
+		{name: "over the limit", maxBodySize: 10, body: "0123456789a", want: "rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			var handled atomic.Int64
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.MaxBodySize = tt.maxBodySize },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					handled.Add(1)
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			b.send(config.SubscriptionPath(), amqp.NewMessage([]byte(tt.body)))
+			got := b.waitSettlements(1)[0].State
+			if got.Outcome != tt.want {
+				t.Errorf("outcome = %q, want %q", got.Outcome, tt.want)
+			}
+			if tt.want == "rejected" && got.Info["DeadLetterReason"] != messageTooLargeReason {
+				t.Errorf("DeadLetterReason = %v, want %v", got.Info["DeadLetterReason"], messageTooLargeReason)
+			}
+			if gotHandled := handled.Load() == 1; gotHandled != tt.wantHandled {
+				t.Errorf("handler called = %v, want %v", gotHandled, tt.wantHandled)
+			}
+		})
+	}
+}
+
+func TestHandlerTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject *string
+		want    time.Duration
+	}{
+		{name: "subject timeout", subject: ptr("fast"), want: 50 * time.Millisecond},
+		{name: "other subject", subject: ptr("slow"), want: time.Hour},
+		{name: "no subject", want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			// remaining receives the time left on the handler's deadline
+			// when it is called.
+			remaining := make(chan time.Duration, 1)
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) {
+					o.HandlerTimeout = time.Hour
+					o.HandlerTimeouts = map[string]time.Duration{"fast": 50 * time.Millisecond}
+				},
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					if redelivered(msg) {
+						return nil
+					}
+					deadline, _ := ctx.Deadline()
+					remaining <- time.Until(deadline)
+					if tt.want < time.Hour {
+						<-ctx.Done()
+						return ctx.Err()
+					}
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			msg := amqp.NewMessage([]byte("body"))
+			msg.Properties = &amqp.MessageProperties{Subject: tt.subject}
+			start := time.Now()
+			b.send(config.SubscriptionPath(), msg)
+			got := b.waitSettlements(1)[0].State.Outcome
+			elapsed := time.Since(start)
+
+			if left := <-remaining; left > tt.want || left < tt.want-time.Second/2 {
+				t.Errorf("handler deadline in %v, want %v", left, tt.want)
+			}
+			if tt.want < time.Hour {
+				if got != "modified" || elapsed < tt.want {
+					t.Errorf("timed out handler settled %q after %v, want modified after %v", got, elapsed, tt.want)
+				}
+			} else if got != "accepted" {
+				t.Errorf("outcome = %q, want accepted", got)
+			}
+		})
+	}
+}
+
+func TestReceiveFromStart(t *testing.T) {
+	const selector = "apache.org:selector-filter:string"
+	tests := []struct {
+		name             string
+		receiveFromStart bool
+		wantFilter       bool
+	}{
+		{name: "from start", receiveFromStart: true, wantFilter: true},
+		{name: "from the current position"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			newBrokerSubscriber(t, config, func(o *SubscriberOptions) { o.ReceiveFromStart = tt.receiveFromStart })
+
+			filter, ok := b.sourceFilters(config.SubscriptionPath())[selector].(wireDescribed)
+			if ok != tt.wantFilter {
+				t.Fatalf("source has %s filter = %v, want %v", selector, ok, tt.wantFilter)
+			}
+			if ok && (filter.descriptor != uint64(0x0000468c00000004) || filter.value != "amqp.annotation.x-opt-offset > '-1'") {
+				t.Errorf("%s = %#x %v, want the selector descriptor and the earliest offset", selector, filter.descriptor, filter.value)
+			}
+		})
+	}
+}
+
+func TestDispatchModeGoroutine(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		send        int
+		wantOverlap int64
+	}{
+		{name: "overlapping handlers", concurrency: 3, send: 3, wantOverlap: 3},
+		{name: "bounded by concurrency", concurrency: 2, send: 5, wantOverlap: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			config := b.config()
+			config.Concurrency = tt.concurrency
+			// Handlers block until release is closed.
+			release := make(chan struct{})
+			var active, maxActive atomic.Int64
+			s := newBrokerSubscriber(t, config,
+				func(o *SubscriberOptions) { o.DispatchMode = DispatchModeGoroutine },
+				WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+					n := active.Add(1)
+					defer active.Add(-1)
+					for m := maxActive.Load(); n > m && !maxActive.CompareAndSwap(m, n); m = maxActive.Load() {
+					}
+					<-release
+					return nil
+				}))
+			listenInBackground(t, s)
+
+			for i := range tt.send {
+				b.send(config.SubscriptionPath(), amqp.NewMessage([]byte(fmt.Sprint(i))))
+			}
+			b.waitFor("handlers to overlap", func() bool { return active.Load() == tt.wantOverlap })
+			// Give any handler over the limit time to start.
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			b.waitSettlements(tt.send)
+			if got := maxActive.Load(); got != tt.wantOverlap {
+				t.Errorf("%d handlers ran at once, want %d", got, tt.wantOverlap)
+			}
+		})
+	}
+}
+
+func TestReattachDetachedReceiver(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	received := make(chan string, 2)
+	s := newBrokerSubscriber(t, config, WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+		received <- string(msg.GetData())
+		return nil
+	}))
+	result := listenInBackground(t, s)
+	wait := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("handled %q, want %q", got, want)
+			}
+		case err := <-result:
+			t.Fatalf("StartListening() = %v, want it to keep running", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not handled", want)
+		}
+	}
+
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("before")))
+	wait("before")
+	b.waitSettlements(1)
+	s.mu.Lock()
+	first := s.receiver
+	s.mu.Unlock()
+	sessions, connections := b.sessionsBegun(), b.connections()
+
+	b.detachReceivers(config.SubscriptionPath())
+	b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("after")))
+	wait("after")
+
+	s.mu.Lock()
+	reattached := s.receiver != first
+	s.mu.Unlock()
+	if !reattached {
+		t.Error("receiver was not replaced after the detach")
+	}
+	if got := b.sessionsBegun(); got != sessions {
+		t.Errorf("sessions begun = %d, want %d", got, sessions)
+	}
+	if got := b.connections(); got != connections {
+		t.Errorf("connections = %d, want %d", got, connections)
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	type call struct {
+		instance               int
+		factoryCtx, handlerCtx context.Context
+	}
+	var mu sync.Mutex
+	var calls []call
+	var instances int
+	s := newBrokerSubscriber(t, config, WithHandlerFactory(func(factoryCtx context.Context) MessageHandler {
+		mu.Lock()
+		instances++
+		instance := instances
+		mu.Unlock()
+		if instance == 3 {
+			return nil
+		}
+		return func(ctx context.Context, msg *amqp.Message) error {
+			mu.Lock()
+			calls = append(calls, call{instance, factoryCtx, ctx})
+			mu.Unlock()
+			return nil
+		}
+	}))
+	listenInBackground(t, s)
+	for range 3 {
+		b.send(config.SubscriptionPath(), amqp.NewMessage([]byte("hello")))
+	}
+	outcomes := b.waitSettlements(3)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if instances != 3 {
+		t.Errorf("factory called %d times, want once per message", instances)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("handlers called %d times, want 2", len(calls))
+	}
+	for i, c := range calls {
+		if c.instance != i+1 {
+			t.Errorf("message %d handled by instance %d, want a fresh one", i+1, c.instance)
+		}
+		if c.factoryCtx != c.handlerCtx {
+			t.Errorf("message %d: handler context differs from the factory's", i+1)
+		}
+	}
+	// The factory returned no handler for the third message.
+	if got := outcomes[2].State.Outcome; got != "modified" {
+		t.Errorf("outcome without a handler = %q, want modified", got)
+	}
+}
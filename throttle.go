@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// defaultThrottleCheckInterval is how often the topic's backlog is polled
+// when ThrottleCheckInterval is not set.
+const defaultThrottleCheckInterval = 10 * time.Second
+
+// depthThrottle blocks sends while the topic's backlog, polled through the
+// management API, is above a threshold.
+type depthThrottle struct {
+	management *ManagementClient
+	threshold  int64
+	interval   time.Duration
+	logger     *slog.Logger
+	cancel     context.CancelFunc
+
+	mu        sync.Mutex
+	throttled bool
+	// released is closed when the throttle is lifted.
+	released chan struct{}
+}
+
+// newDepthThrottle starts polling the backlog of management's topic every
+// interval, or returns nil when threshold is not positive.
+func newDepthThrottle(management *ManagementClient, threshold int64, interval time.Duration, logger *slog.Logger) *depthThrottle {
+	if threshold <= 0 {
+		return nil
+	}
+	if interval <= 0 {
+		interval = defaultThrottleCheckInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &depthThrottle{
+		management: management,
+		threshold:  threshold,
+		interval:   interval,
+		logger:     logger,
+		cancel:     cancel,
+	}
+	go t.run(ctx)
+	return t
+}
+
+// run polls the backlog until ctx is done. A failed poll keeps the previous
+// state.
+func (t *depthThrottle) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		count, err := t.management.PendingMessageCount(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			t.logger.ErrorContext(ctx, "failed to read topic backlog", "error", err)
+		case err == nil:
+			t.set(count > t.threshold, count)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *depthThrottle) set(throttled bool, count int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if throttled == t.throttled {
+		return
+	}
+	t.throttled = throttled
+	if throttled {
+		t.released = make(chan struct{})
+		t.logger.Warn("throttling sends on topic backlog", "pending_messages", count, "threshold", t.threshold)
+		return
+	}
+	close(t.released)
+	t.logger.Info("lifted send throttle", "pending_messages", count, "threshold", t.threshold)
+}
+
+// wait blocks while sends are throttled. A nil throttle never blocks.
+func (t *depthThrottle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	throttled, released := t.throttled, t.released
+	t.mu.Unlock()
+	if !throttled {
+		return nil
+	}
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("throttled on topic backlog: %w", ctx.Err())
+	}
+}
+
+// stop ends polling and releases throttled sends.
+func (t *depthThrottle) stop() {
+	if t == nil {
+		return
+	}
+	t.cancel()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.throttled {
+		t.throttled = false
+		close(t.released)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// subscriptionFeedOf returns the Atom feed of a topic's subscriptions with
+// the given active message counts.
+func subscriptionFeedOf(counts ...int64) string {
+	var feed strings.Builder
+	feed.WriteString(`<feed xmlns="http://www.w3.org/2005/Atom">`)
+	for _, count := range counts {
+		fmt.Fprintf(&feed, `<entry><content type="application/xml"><SubscriptionDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect">`+
+			`<CountDetails><ActiveMessageCount>%d</ActiveMessageCount></CountDetails></SubscriptionDescription></content></entry>`, count)
+	}
+	feed.WriteString(`</feed>`)
+	return feed.String()
+}
+
+// depthServer serves the subscription list of every topic with a single
+// subscription holding *depth active messages, and other requests with an
+// empty topic description.
+func depthServer(depth *atomic.Int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/subscriptions") {
+			fmt.Fprint(w, subscriptionFeedOf(depth.Load()))
+			return
+		}
+		fmt.Fprint(w, topicEntry(""))
+	}
+}
+
+// throttled reports whether p's sends are throttled.
+func throttled(p *Publisher) bool {
+	p.throttle.mu.Lock()
+	defer p.throttle.mu.Unlock()
+	return p.throttle.throttled
+}
+
+func TestPendingMessageCount(t *testing.T) {
+	m := newTestManagementClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topic/subscriptions" {
+			t.Errorf("request path %s, want /topic/subscriptions", r.URL.Path)
+		}
+		fmt.Fprint(w, subscriptionFeedOf(3, 4))
+	})
+	got, err := m.PendingMessageCount(context.Background())
+	if err != nil || got != 7 {
+		t.Errorf("PendingMessageCount() = %d, %v, want 7", got, err)
+	}
+}
+
+func TestThrottleOnQueueDepth(t *testing.T) {
+	tests := []struct {
+		name      string
+		depth     int64
+		wantDelay bool
+	}{
+		{name: "below threshold", depth: 10},
+		{name: "above threshold", depth: 11, wantDelay: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var depth atomic.Int64
+			depth.Store(tt.depth)
+			m := newTestManagementClient(t, depthServer(&depth))
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) {
+				o.Management = m
+				o.ThrottleOnQueueDepth = 10
+				o.ThrottleCheckInterval = 10 * time.Millisecond
+			})
+			if tt.wantDelay {
+				b.waitFor("sends throttled", func() bool { return throttled(p) })
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := p.Publish(ctx, "first", nil)
+			if (err != nil) != tt.wantDelay {
+				t.Fatalf("Publish() error = %v, want delayed %v", err, tt.wantDelay)
+			}
+			if !tt.wantDelay {
+				return
+			}
+			if got := len(b.receivedAt("topic")); got != 0 {
+				t.Fatalf("broker received %d messages while throttled", got)
+			}
+
+			// A send waiting on the throttle goes out once the backlog drops.
+			done := make(chan error, 1)
+			go func() { done <- p.Publish(context.Background(), "second", nil) }()
+			select {
+			case err := <-done:
+				t.Fatalf("Publish() returned %v while throttled", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			depth.Store(0)
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Publish() after the backlog dropped: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send still throttled after the backlog dropped")
+			}
+		})
+	}
+}
+
+func TestRegistryThrottleOnRegisteredTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		options func(o *PublisherOptions)
+	}{
+		{name: "throttle only", options: func(o *PublisherOptions) {}},
+		{name: "management of the default topic", options: func(o *PublisherOptions) {
+			o.Management = NewManagementClient(discardLogger(), AmqpConfig{Topic: "topic"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var depth atomic.Int64
+			depth.Store(100)
+			paths := make(chan string, 100)
+			newManagement := newTestManagementServer(t, func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case paths <- r.URL.Path:
+				default:
+				}
+				depthServer(&depth)(w, r)
+			})
+
+			b := newTestBroker(t)
+			config := b.config()
+			registry := NewPublisherRegistry(discardLogger(), config, newBrokerPublisher(t, config), func(o *PublisherOptions) {
+				o.ThrottleOnQueueDepth = 10
+				o.ThrottleCheckInterval = 10 * time.Millisecond
+				tt.options(o)
+			})
+			registry.newManagement = newManagement
+			t.Cleanup(registry.Close)
+
+			p, err := registry.Register(context.Background(), "orders")
+			if err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			b.waitFor("registered topic throttled", func() bool { return throttled(p) })
+			if path := <-paths; !strings.HasPrefix(path, "/orders") {
+				t.Errorf("management request for %s, want the registered topic orders", path)
+			}
+		})
+	}
+}
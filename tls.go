@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// buildTLSConfig loads the CA bundle and client key pair named or given in
+// cfg. It returns nil when none are configured so the system roots are used.
+func buildTLSConfig(cfg AmqpConfig) (*tls.Config, error) {
+	if cfg.TLSCACertFile == "" && cfg.TLSClientCertFile == "" && cfg.TLSClientKeyFile == "" &&
+		cfg.TLSClientCert == "" && cfg.TLSClientKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.TLSCACertFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", cfg.TLSCACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case cfg.TLSClientCert != "" || cfg.TLSClientKey != "":
+		if cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "" {
+			return nil, errors.New("a TLS client certificate is given both inline and as files")
+		}
+		if cfg.TLSClientCert == "" || cfg.TLSClientKey == "" {
+			return nil, errors.New("both a TLS client certificate and key are required")
+		}
+		cert, err := tls.X509KeyPair([]byte(cfg.TLSClientCert), []byte(cfg.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "":
+		if cfg.TLSClientCertFile == "" || cfg.TLSClientKeyFile == "" {
+			return nil, errors.New("both a TLS client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a key pair in PEM form signed by a test CA.
+type testCertificate struct {
+	cert, key []byte
+	parsed    *x509.Certificate
+	signer    *ecdsa.PrivateKey
+}
+
+// newTestCertificate returns a certificate from template signed by parent,
+// or self-signed when parent is nil.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.parsed, parent.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+	return &testCertificate{
+		cert:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		parsed: parsed,
+		signer: key,
+	}
+}
+
+// writeTestFile writes data to name in a temporary directory and returns its
+// path.
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate, and a client certificate the CA did not sign.
+type testPKI struct {
+	ca, client, untrusted *testCertificate
+	// caFile is the CA certificate written to a file.
+	caFile string
+	// serverConfig serves the server certificate and requires client
+	// certificates signed by the CA.
+	serverConfig *tls.Config
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	ca := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientTemplate := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+
+	serverCert, err := tls.X509KeyPair(server.cert, server.key)
+	if err != nil {
+		t.Fatalf("failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.parsed)
+	return &testPKI{
+		ca:        ca,
+		client:    newTestCertificate(t, clientTemplate("client"), ca),
+		untrusted: newTestCertificate(t, clientTemplate("untrusted"), nil),
+		caFile:    writeTestFile(t, "ca.pem", ca.cert),
+		serverConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+	}
+}
+
+// tlsClientCase is a client key pair tried against a server requiring
+// certificates signed by a testPKI's CA.
+type tlsClientCase struct {
+	name    string
+	config  func(c *AmqpConfig)
+	wantErr bool
+}
+
+func (pki *testPKI) clientCases(t *testing.T) []tlsClientCase {
+	return []tlsClientCase{
+		{name: "inline key pair", config: func(c *AmqpConfig) {
+			c.TLSClientCert, c.TLSClientKey = string(pki.client.cert), string(pki.client.key)
+		}},
+		{name: "key pair files", config: func(c *AmqpConfig) {
+			c.TLSClientCertFile = writeTestFile(t, "client.pem", pki.client.cert)
+			c.TLSClientKeyFile = writeTestFile(t, "client-key.pem", pki.client.key)
+		}},
+		{name: "no client certificate", config: func(c *AmqpConfig) {}, wantErr: true},
+		{name: "untrusted client certificate", config: func(c *AmqpConfig) {
+			c.TLSClientCert, c.TLSClientKey = string(pki.untrusted.cert), string(pki.untrusted.key)
+		}, wantErr: true},
+	}
+}
+
+func TestClientCertificateHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", pki.serverConfig)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	for _, tt := range pki.clientCases(t) {
+		t.Run(tt.name, func(t *testing.T) {
+			config := AmqpConfig{TLSCACertFile: pki.caFile}
+			tt.config(&config)
+			clientConfig, err := buildTLSConfig(config)
+			if err != nil {
+				t.Fatalf("buildTLSConfig: %v", err)
+			}
+
+			// The server verifies the client certificate after the client
+			// considers the handshake done, so its result is the one checked.
+			serverErr := make(chan error, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					serverErr <- err
+					return
+				}
+				defer conn.Close()
+				serverErr <- conn.(*tls.Conn).Handshake()
+			}()
+			conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+			if err == nil {
+				defer conn.Close()
+			} else if !tt.wantErr {
+				t.Fatalf("client handshake: %v", err)
+			}
+			if err := <-serverErr; (err != nil) != tt.wantErr {
+				t.Errorf("server handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	ca := newTestPKI(t).ca
+
+	tests := []struct {
+		name      string
+		config    AmqpConfig
+		wantNil   bool
+		wantCerts int
+		wantErr   bool
+	}{
+		{name: "nothing configured", wantNil: true},
+		{name: "inline key pair", config: AmqpConfig{TLSClientCert: string(ca.cert), TLSClientKey: string(ca.key)}, wantCerts: 1},
+		{name: "inline certificate only", config: AmqpConfig{TLSClientCert: string(ca.cert)}, wantErr: true},
+		{name: "inline key only", config: AmqpConfig{TLSClientKey: string(ca.key)}, wantErr: true},
+		{name: "invalid inline key pair", config: AmqpConfig{TLSClientCert: "not a certificate", TLSClientKey: "not a key"}, wantErr: true},
+		{name: "inline and files", config: AmqpConfig{
+			TLSClientCert: string(ca.cert), TLSClientKey: string(ca.key),
+			TLSClientCertFile: "client.pem", TLSClientKeyFile: "client-key.pem",
+		}, wantErr: true},
+		{name: "certificate file only", config: AmqpConfig{TLSClientCertFile: "client.pem"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildTLSConfig(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("buildTLSConfig() = %v, want nil %v", got, tt.wantNil)
+			}
+			if got != nil && len(got.Certificates) != tt.wantCerts {
+				t.Errorf("client certificates = %d, want %d", len(got.Certificates), tt.wantCerts)
+			}
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	b := newTLSTestBroker(t, pki.serverConfig)
+
+	for _, tt := range pki.clientCases(t) {
+		t.Run(tt.name, func(t *testing.T) {
+			config := b.config()
+			config.ConnectionString = strings.Replace(config.ConnectionString, "amqp://", "amqps://", 1)
+			config.TLSCACertFile = pki.caFile
+			tt.config(&config)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			p, cleanup, err := NewPublisher(ctx, discardLogger(), config)
+			if err == nil {
+				defer cleanup()
+				err = p.Publish(ctx, "hello", nil)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publish over mutual TLS error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// SubscriberMiddleware wraps the subscriber's handler, e.g. to add values to
+// the context of every handler call.
+type SubscriberMiddleware func(next MessageHandler) MessageHandler
+
+// chainMiddleware wraps handler in middleware, the first outermost.
+func chainMiddleware(handler MessageHandler, middleware []SubscriberMiddleware) MessageHandler {
+	for _, m := range slices.Backward(middleware) {
+		handler = m(handler)
+	}
+	return handler
+}
+
+// PublishFunc publishes a message, as Publisher.PublishMessage does.
+type PublishFunc func(ctx context.Context, msg *amqp.Message) error
+
+// PublisherMiddleware wraps the publisher's sends, e.g. to add application
+// properties from the context to every message.
+type PublisherMiddleware func(next PublishFunc) PublishFunc
+
+// chainPublisherMiddleware wraps publish in middleware, the first outermost.
+func chainPublisherMiddleware(publish PublishFunc, middleware []PublisherMiddleware) PublishFunc {
+	for _, m := range slices.Backward(middleware) {
+		publish = m(publish)
+	}
+	return publish
+}
+
+// TraceExtractionMiddleware extracts the trace context propagated in the
+// message's application properties, such as a W3C traceparent and
+// tracestate when propagator is propagation.TraceContext, into the handler's
+// context. Spans the handler starts then join the publisher's trace.
+func TraceExtractionMiddleware(propagator propagation.TextMapPropagator) SubscriberMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, msg *amqp.Message) error {
+			return next(propagator.Extract(ctx, applicationPropertiesCarrier(msg.ApplicationProperties)), msg)
+		}
+	}
+}
+
+// applicationPropertiesCarrier adapts the application properties of a
+// message to a propagation.TextMapCarrier. Non-string values are read in
+// their fmt.Sprint form.
+type applicationPropertiesCarrier map[string]any
+
+func (c applicationPropertiesCarrier) Get(key string) string {
+	switch v := c[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (c applicationPropertiesCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c applicationPropertiesCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceExtractionMiddleware(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name       string
+		properties map[string]any
+		wantValid  bool
+		wantState  string
+	}{
+		{
+			name:       "traceparent",
+			properties: map[string]any{"traceparent": "00-" + traceID + "-" + spanID + "-01"},
+			wantValid:  true,
+		},
+		{
+			name: "traceparent and tracestate",
+			properties: map[string]any{
+				"traceparent": "00-" + traceID + "-" + spanID + "-01",
+				"tracestate":  "vendor=value",
+			},
+			wantValid: true,
+			wantState: "vendor=value",
+		},
+		{name: "no properties"},
+		{name: "malformed traceparent", properties: map[string]any{"traceparent": "not-a-trace"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got trace.SpanContext
+			handler := TraceExtractionMiddleware(propagation.TraceContext{})(func(ctx context.Context, msg *amqp.Message) error {
+				got = trace.SpanContextFromContext(ctx)
+				return nil
+			})
+			msg := amqp.NewMessage([]byte("hello"))
+			msg.ApplicationProperties = tt.properties
+			if err := handler(context.Background(), msg); err != nil {
+				t.Fatalf("handler() = %v", err)
+			}
+
+			if got.IsValid() != tt.wantValid {
+				t.Fatalf("span context valid = %v, want %v", got.IsValid(), tt.wantValid)
+			}
+			if !tt.wantValid {
+				return
+			}
+			if got.TraceID().String() != traceID || got.SpanID().String() != spanID {
+				t.Errorf("span context = %s/%s, want %s/%s", got.TraceID(), got.SpanID(), traceID, spanID)
+			}
+			if !got.IsSampled() || !got.IsRemote() {
+				t.Errorf("span context sampled = %v, remote = %v, want both", got.IsSampled(), got.IsRemote())
+			}
+			if got.TraceState().String() != tt.wantState {
+				t.Errorf("trace state = %q, want %q", got.TraceState(), tt.wantState)
+			}
+		})
+	}
+}
+
+func TestSubscriberMiddleware(t *testing.T) {
+	b := newTestBroker(t)
+	config := b.config()
+	var order []string
+	record := func(name string) SubscriberMiddleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(ctx context.Context, msg *amqp.Message) error {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	spans := make(chan trace.SpanContext, 1)
+	s := newBrokerSubscriber(t, config,
+		WithMiddleware(record("first"), TraceExtractionMiddleware(propagation.TraceContext{})),
+		WithMiddleware(record("second")),
+		WithHandler(func(ctx context.Context, msg *amqp.Message) error {
+			spans <- trace.SpanContextFromContext(ctx)
+			return nil
+		}),
+	)
+	listenInBackground(t, s)
+
+	msg := amqp.NewMessage([]byte("hello"))
+	msg.ApplicationProperties = map[string]any{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	b.send(config.SubscriptionPath(), msg)
+
+	select {
+	case span := <-spans:
+		if span.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("handler trace ID = %s, want the message's traceparent", span.TraceID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("middleware order = %v, want [first second]", order)
+	}
+}
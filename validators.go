@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/go-amqp"
+)
+
+// MessageValidator checks a message before it is sent. A non-nil error
+// rejects the message with ErrInvalidMessage.
+type MessageValidator func(msg *amqp.Message) error
+
+// ErrInvalidMessage is returned when a validator rejects a message. The
+// message is not sent.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ErrMessageTooLarge is returned when a message's body exceeds
+// PublisherOptions.MaxMessageBodyBytes. The message is not sent.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// checkBodySize rejects msg with ErrMessageTooLarge when its body exceeds
+// the publisher's MaxMessageBodyBytes.
+func (p *Publisher) checkBodySize(ctx context.Context, msg *amqp.Message) error {
+	if p.maxBodyBytes <= 0 {
+		return nil
+	}
+	if size := bodySize(msg); size > p.maxBodyBytes {
+		p.logger.WarnContext(ctx, "rejecting oversized message", "message_id", messageIDOf(msg), "size", size, "max_size", p.maxBodyBytes)
+		return fmt.Errorf("%w: body of %d bytes exceeds the limit of %d", ErrMessageTooLarge, size, p.maxBodyBytes)
+	}
+	return nil
+}
+
+// bodySize returns the number of bytes in the data sections of msg.
+func bodySize(msg *amqp.Message) int {
+	size := 0
+	for _, data := range msg.Data {
+		size += len(data)
+	}
+	return size
+}
+
+// validate runs the publisher's validators on msg, stopping at the first
+// error.
+func (p *Publisher) validate(msg *amqp.Message) error {
+	for _, validator := range p.validators {
+		if err := validator(msg); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+		}
+	}
+	return nil
+}
+
+// MaxBodySizeValidator rejects messages whose data sections hold more than n
+// bytes in total.
+func MaxBodySizeValidator(n int) MessageValidator {
+	return func(msg *amqp.Message) error {
+		if size := bodySize(msg); size > n {
+			return fmt.Errorf("body of %d bytes exceeds the limit of %d", size, n)
+		}
+		return nil
+	}
+}
+
+// RequiredPropertiesValidator rejects messages that lack any of the
+// application properties keys.
+func RequiredPropertiesValidator(keys []string) MessageValidator {
+	return func(msg *amqp.Message) error {
+		for _, key := range keys {
+			if _, ok := msg.ApplicationProperties[key]; !ok {
+				return fmt.Errorf("missing required application property %q", key)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator MessageValidator
+		msg       *amqp.Message
+		wantErr   string
+	}{
+		{
+			name:      "body within limit",
+			validator: MaxBodySizeValidator(5),
+			msg:       amqp.NewMessage([]byte("hello")),
+		},
+		{
+			name:      "body over limit",
+			validator: MaxBodySizeValidator(4),
+			msg:       amqp.NewMessage([]byte("hello")),
+			wantErr:   "body of 5 bytes exceeds the limit of 4",
+		},
+		{
+			name:      "required properties present",
+			validator: RequiredPropertiesValidator([]string{"tenant", "kind"}),
+			msg: &amqp.Message{
+				Data:                  [][]byte{[]byte("hello")},
+				ApplicationProperties: map[string]any{"tenant": "a", "kind": "b"},
+			},
+		},
+		{
+			name:      "required property missing",
+			validator: RequiredPropertiesValidator([]string{"tenant", "kind"}),
+			msg: &amqp.Message{
+				Data:                  [][]byte{[]byte("hello")},
+				ApplicationProperties: map[string]any{"tenant": "a"},
+			},
+			wantErr: `missing required application property "kind"`,
+		},
+		{
+			name:      "no application properties",
+			validator: RequiredPropertiesValidator([]string{"tenant"}),
+			msg:       amqp.NewMessage([]byte("hello")),
+			wantErr:   `missing required application property "tenant"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validator(tt.msg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validator() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validator() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublishValidation(t *testing.T) {
+	var calls []string
+	record := func(name string, err error) MessageValidator {
+		return func(*amqp.Message) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+
+	tests := []struct {
+		name       string
+		validators []MessageValidator
+		wantCalls  []string
+		wantErr    bool
+	}{
+		{
+			name:       "all pass",
+			validators: []MessageValidator{record("first", nil), record("second", nil)},
+			wantCalls:  []string{"first", "second"},
+		},
+		{
+			name:       "first failure stops the chain",
+			validators: []MessageValidator{record("first", errors.New("bad")), record("second", nil)},
+			wantCalls:  []string{"first"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			b := newTestBroker(t)
+			p := newBrokerPublisher(t, b.config(), WithValidators(tt.validators...))
+
+			err := p.PublishMessage(context.Background(), amqp.NewMessage([]byte("hello")))
+			if got := errors.Is(err, ErrInvalidMessage); got != tt.wantErr {
+				t.Fatalf("PublishMessage() = %v, want ErrInvalidMessage %v", err, tt.wantErr)
+			}
+			if strings.Join(calls, ",") != strings.Join(tt.wantCalls, ",") {
+				t.Errorf("validators called = %v, want %v", calls, tt.wantCalls)
+			}
+			wantSent := 1
+			if tt.wantErr {
+				wantSent = 0
+			}
+			if got := len(b.receivedAt("topic")); got != wantSent {
+				t.Errorf("broker received %d messages, want %d", got, wantSent)
+			}
+		})
+	}
+}
+
+func TestServePublishInvalidMessage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := newTestBroker(t)
+	p := newBrokerPublisher(t, b.config(), WithValidators(RequiredPropertiesValidator([]string{"tenant"})))
+
+	engine := gin.New()
+	engine.POST("/publish", func(c *gin.Context) {
+		p.servePublish(c, PublishRequest{Message: "hello"})
+	})
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/publish", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /publish = %d %s, want 422", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "tenant") {
+		t.Errorf("POST /publish body = %s, want the validator error", w.Body)
+	}
+	if got := len(b.receivedAt("topic")); got != 0 {
+		t.Errorf("broker received %d messages, want 0", got)
+	}
+}
+
+func TestMaxMessageBodyBytes(t *testing.T) {
+	const limit = 8
+	tests := []struct {
+		name       string
+		size       int
+		wantErr    bool
+		wantStatus int
+	}{
+		{name: "exactly the limit", size: limit, wantStatus: http.StatusOK},
+		{name: "one byte over", size: limit + 1, wantErr: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			logger, logs := recordingLogger()
+			p := newBrokerPublisher(t, b.config(), func(o *PublisherOptions) {
+				o.MaxMessageBodyBytes = limit
+				o.Logger = logger
+			})
+			body := strings.Repeat("x", tt.size)
+
+			err := p.PublishMessage(context.Background(), amqp.NewMessage([]byte(body)))
+			if got := errors.Is(err, ErrMessageTooLarge); got != tt.wantErr {
+				t.Fatalf("PublishMessage() = %v, want ErrMessageTooLarge %v", err, tt.wantErr)
+			}
+			wantWarnings := 0
+			if tt.wantErr {
+				wantWarnings = 1
+			}
+			if got := logs.count(slog.LevelWarn, "rejecting oversized message"); got != wantWarnings {
+				t.Errorf("logged %d oversized warnings, want %d", got, wantWarnings)
+			}
+
+			gin.SetMode(gin.TestMode)
+			engine := gin.New()
+			engine.POST("/publish", func(c *gin.Context) {
+				p.servePublish(c, PublishRequest{Message: body})
+			})
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/publish", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("POST /publish = %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+
+			wantSent := 2
+			if tt.wantErr {
+				wantSent = 0
+			}
+			if got := len(b.receivedAt("topic")); got != wantSent {
+				t.Errorf("broker received %d messages, want %d", got, wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+const (
+	// webhookPropertyHeaderPrefix prefixes the headers carrying forwarded
+	// application properties.
+	webhookPropertyHeaderPrefix = "X-AMQP-"
+	// webhookRejectedReason is the dead-letter reason of messages the
+	// webhook rejects with a client error.
+	webhookRejectedReason = "WebhookRejected"
+)
+
+// WebhookHandler delivers each received message to an HTTP endpoint as a
+// POST of its body. A 2xx response accepts the message. A 4xx response other
+// than 408 or 429 dead-letters it with reason "WebhookRejected"; any other
+// failure abandons it for redelivery.
+type WebhookHandler struct {
+	// URL is the endpoint messages are posted to.
+	URL string
+	// Client sends the requests. Defaults to a client with a 10s timeout.
+	Client *http.Client
+	// ForwardProperties sends each application property as an X-AMQP-<name>
+	// header. Properties whose names are not valid header names are skipped.
+	ForwardProperties bool
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Handle is the webhook's MessageHandler.
+func (h *WebhookHandler) Handle(ctx context.Context, msg *amqp.Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(msg.GetData()))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	if msg.Properties != nil && msg.Properties.ContentType != nil {
+		req.Header.Set("Content-Type", *msg.Properties.ContentType)
+	}
+	if h.ForwardProperties {
+		for name, value := range msg.ApplicationProperties {
+			if validHeaderName(name) {
+				req.Header.Set(webhookPropertyHeaderPrefix+name, headerValue(value))
+			}
+		}
+	}
+
+	client := h.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post message to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		return DeadLetter(webhookRejectedReason, fmt.Sprintf("webhook responded with status %d", code))
+	default:
+		return fmt.Errorf("webhook responded with status %d", code)
+	}
+}
+
+// validHeaderName reports whether name can be used in a header name as is.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// headerValue formats an application property value as a header value,
+// replacing line breaks.
+func headerValue(v any) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(fmt.Sprint(v))
+}
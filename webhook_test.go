@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestWebhookForwardProperties(t *testing.T) {
+	properties := map[string]any{"tenant": "acme", "attempt": int64(2), "bad name": "skipped", "note": "line\nbreak"}
+	tests := []struct {
+		name              string
+		forwardProperties bool
+		wantHeaders       map[string]string
+	}{
+		{name: "forwarded", forwardProperties: true,
+			wantHeaders: map[string]string{"X-Amqp-Tenant": "acme", "X-Amqp-Attempt": "2", "X-Amqp-Note": "line break"}},
+		{name: "not forwarded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer server.Close()
+
+			h := &WebhookHandler{URL: server.URL, Client: server.Client(), ForwardProperties: tt.forwardProperties}
+			msg := amqp.NewMessage([]byte(`{"order":1}`))
+			contentType := "application/json"
+			msg.Properties = &amqp.MessageProperties{ContentType: &contentType}
+			msg.ApplicationProperties = properties
+			if err := h.Handle(context.Background(), msg); err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+
+			if got.Method != http.MethodPost || string(body) != `{"order":1}` || got.Header.Get("Content-Type") != contentType {
+				t.Errorf("webhook received %s %s with content type %q", got.Method, body, got.Header.Get("Content-Type"))
+			}
+			// Header names are canonicalized, as X-Amqp-<Name>.
+			forwarded := 0
+			for name := range got.Header {
+				if strings.HasPrefix(name, "X-Amqp-") {
+					forwarded++
+				}
+			}
+			if forwarded != len(tt.wantHeaders) {
+				t.Errorf("%d property headers forwarded, want %d: %v", forwarded, len(tt.wantHeaders), got.Header)
+			}
+			for name, want := range tt.wantHeaders {
+				if v := got.Header.Get(name); v != want {
+					t.Errorf("%s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	tests := []struct {
+		status         int
+		wantErr        bool
+		wantDeadLetter bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, wantErr: true, wantDeadLetter: true},
+		{status: http.StatusTooManyRequests, wantErr: true},
+		{status: http.StatusRequestTimeout, wantErr: true},
+		{status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			h := &WebhookHandler{URL: server.URL, Client: server.Client()}
+			err := h.Handle(context.Background(), amqp.NewMessage([]byte("body")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Handle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var decision *SettlementDecision
+			if isDeadLetter := errors.As(err, &decision) && decision.Reason == webhookRejectedReason; isDeadLetter != tt.wantDeadLetter {
+				t.Errorf("Handle() = %v, want dead-letter %v", err, tt.wantDeadLetter)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/coder/websocket"
+)
+
+// Transport selects how the AMQP connection reaches the broker.
+type Transport string
+
+const (
+	// TransportTCP connects to the AMQP port, 5671 with TLS.
+	TransportTCP Transport = "tcp"
+	// TransportWebSocket tunnels AMQP through a secure WebSocket on port
+	// 443, for networks that only allow HTTPS out.
+	TransportWebSocket Transport = "websocket"
+)
+
+// webSocketPath is where Service Bus accepts AMQP over WebSockets.
+const webSocketPath = "/$servicebus/websocket"
+
+// dialWebSocket opens a WebSocket with the "amqp" subprotocol to host,
+// through proxyURL when set, and returns it as a net.Conn carrying the AMQP
+// frames in binary messages.
+func dialWebSocket(ctx context.Context, host string, proxyURL *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	target := url.URL{Scheme: "wss", Host: host, Path: webSocketPath}
+	ws, _, err := websocket.Dial(ctx, target.String(), &websocket.DialOptions{
+		HTTPClient:   &http.Client{Transport: transport},
+		Subprotocols: []string{"amqp"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WebSocket to %s: %w", host, err)
+	}
+	// Frames are larger than the default limit of 32KiB.
+	ws.SetReadLimit(-1)
+	// The connection outlives ctx, which only bounds the dial.
+	return websocket.NetConn(context.Background(), ws, websocket.MessageBinary), nil
+}
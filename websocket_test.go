@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestDialWebSocket(t *testing.T) {
+	tests := []struct {
+		name      string
+		reject    bool
+		viaProxy  bool
+		wantError string
+	}{
+		{name: "direct"},
+		{name: "through a proxy", viaProxy: true},
+		{name: "upgrade refused", reject: true, wantError: "failed to open WebSocket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var upgrades []*http.Request
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				upgrades = append(upgrades, r)
+				mu.Unlock()
+				if tt.reject {
+					http.Error(w, "no WebSockets here", http.StatusForbidden)
+					return
+				}
+				ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"amqp"}})
+				if err != nil {
+					return
+				}
+				defer ws.CloseNow()
+				// Echo one binary message back.
+				typ, data, err := ws.Read(r.Context())
+				if err != nil || typ != websocket.MessageBinary {
+					return
+				}
+				ws.Write(r.Context(), websocket.MessageBinary, data)
+			}))
+			t.Cleanup(server.Close)
+
+			var proxy *testProxy
+			var proxyURL *url.URL
+			if tt.viaProxy {
+				proxy, proxyURL = newTestProxy(t, http.StatusOK)
+			}
+			tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			host := strings.TrimPrefix(server.URL, "https://")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialWebSocket(ctx, host, proxyURL, tlsConfig)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("dialWebSocket() = %v, want an error containing %q", err, tt.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("dialWebSocket() = %v", err)
+				}
+				defer conn.Close()
+				frame := []byte("AMQP\x00\x01\x00\x00")
+				if _, err := conn.Write(frame); err != nil {
+					t.Fatalf("Write() = %v", err)
+				}
+				got := make([]byte, len(frame))
+				if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(frame) {
+					t.Errorf("read %q, %v, want the echoed %q", got, err, frame)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(upgrades) != 1 {
+				t.Fatalf("server got %d requests, want 1", len(upgrades))
+			}
+			r := upgrades[0]
+			if r.URL.Path != webSocketPath {
+				t.Errorf("request path = %q, want %q", r.URL.Path, webSocketPath)
+			}
+			if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				t.Errorf("Upgrade header = %q, want websocket", r.Header.Get("Upgrade"))
+			}
+			if got := r.Header.Get("Sec-WebSocket-Protocol"); got != "amqp" {
+				t.Errorf("Sec-WebSocket-Protocol = %q, want amqp", got)
+			}
+			if tt.viaProxy {
+				if connects := proxy.connects(); len(connects) != 1 || connects[0].Method != http.MethodConnect || connects[0].Host != host {
+					t.Errorf("proxy requests = %v, want one CONNECT to %s", connects, host)
+				}
+			}
+		})
+	}
+}